@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/buildinfo"
+)
+
+var startTime = time.Now()
+
+func init() {
+	expvar.Publish("runtime", expvar.Func(runtimeStats))
+	expvar.Publish("build", expvar.Func(func() interface{} { return buildinfo.Get() }))
+}
+
+// NewRouter returns the router of the admin listener. It exposes pprof,
+// expvar runtime stats, the effective configuration and runtime log level
+// control. When token is not empty every request must carry it as a bearer
+// token.
+func NewRouter(token string) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	if token != "" {
+		r.Use(requireToken(token))
+	}
+
+	debug := r.Group("/debug")
+	debug.GET("/pprof/", gin.WrapF(pprof.Index))
+	debug.GET("/pprof/cmdline", gin.WrapF(pprof.Cmdline))
+	debug.GET("/pprof/profile", gin.WrapF(pprof.Profile))
+	debug.GET("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/pprof/trace", gin.WrapF(pprof.Trace))
+	debug.GET("/pprof/:profile", func(c *gin.Context) {
+		pprof.Handler(c.Param("profile")).ServeHTTP(c.Writer, c.Request)
+	})
+	debug.GET("/vars", gin.WrapH(expvar.Handler()))
+
+	r.GET("/config", GetConfigHandler)
+	r.GET("/loglevel", GetLogLevelHandler)
+	r.PUT("/loglevel", SetLogLevelHandler)
+
+	return r
+}
+
+// CheckListener refuses to serve the admin endpoints without a token on an
+// address other processes than those of the host can reach.
+func CheckListener(addr, token string) error {
+	if token != "" || IsLoopback(addr) {
+		return nil
+	}
+	return errors.New("ADMIN_TOKEN is required when ADMIN_ADDR is not a loopback address")
+}
+
+// IsLoopback tells whether the listen address addr only accepts local
+// connections. An empty host listens on every interface.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func requireToken(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	return func(c *gin.Context) {
+		got := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func runtimeStats() interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return map[string]interface{}{
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"goroutines":     runtime.NumGoroutine(),
+		"num_cpu":        runtime.NumCPU(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"heap_alloc":     m.HeapAlloc,
+		"heap_inuse":     m.HeapInuse,
+		"heap_objects":   m.HeapObjects,
+		"sys":            m.Sys,
+		"num_gc":         m.NumGC,
+		"pause_total_ns": m.PauseTotalNs,
+	}
+}
@@ -0,0 +1,80 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRouterRequiresToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := NewRouter("s3cret")
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "Bearer nope", http.StatusUnauthorized},
+		{"not bearer", "s3cret", http.StatusUnauthorized},
+		{"valid", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/loglevel", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckListener(t *testing.T) {
+	tests := []struct {
+		addr    string
+		token   string
+		wantErr bool
+	}{
+		{"127.0.0.1:8092", "", false},
+		{"localhost:8092", "", false},
+		{"[::1]:8092", "", false},
+		{":8092", "", true},
+		{"0.0.0.0:8092", "", true},
+		{"10.0.0.5:8092", "", true},
+		{"admin.internal:8092", "", true},
+		{"8092", "", true},
+		{":8092", "token", false},
+		{"0.0.0.0:8092", "token", false},
+	}
+	for _, tt := range tests {
+		err := CheckListener(tt.addr, tt.token)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CheckListener(%q, %q) = %v, want error %t", tt.addr, tt.token, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		key, value, want string
+	}{
+		{"MONGO_PASSWORD", "pw", redacted},
+		{"ADMIN_TOKEN", "t", redacted},
+		{"MONGO_URL", "mongodb://user:pw@host:27017/db", "mongodb://" + redacted + "@host:27017/db"},
+		{"SERVICE_PORT", "8082", "8082"},
+		{"MONGO_PASSWORD", "", ""},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.key, tt.value); got != tt.want {
+			t.Errorf("redact(%q, %q) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
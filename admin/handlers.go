@@ -0,0 +1,63 @@
+package admin
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// secretParam matches parameter names whose values must never be shown.
+	secretParam = regexp.MustCompile(`(?i)(PASSWORD|SECRET|TOKEN|HEADERS|CREDENTIAL|PASSPHRASE)`)
+	// userInfo matches the credentials part of a connection string.
+	userInfo = regexp.MustCompile(`://[^/@\s]+@`)
+)
+
+type logLevelRequest struct {
+	Level string `json:"level" binding:"required"`
+}
+
+// GetConfigHandler returns every configuration parameter the service has
+// read with its effective value. Secrets are redacted and credentials are
+// stripped from URLs.
+func GetConfigHandler(c *gin.Context) {
+	cfg := utils.EffectiveConfig()
+	for k, v := range cfg {
+		cfg[k] = redact(k, v)
+	}
+	c.JSON(http.StatusOK, cfg)
+}
+
+func GetLogLevelHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logs.Level()})
+}
+
+func SetLogLevelHandler(c *gin.Context) {
+	var req logLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	previous := logs.Level()
+	if err := logs.SetLevel(req.Level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logs.FromContext(c.Request.Context()).Warnf("log level changed from %s to %s", previous, logs.Level())
+	c.JSON(http.StatusOK, gin.H{"level": logs.Level()})
+}
+
+func redact(key, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretParam.MatchString(key) {
+		return redacted
+	}
+	return userInfo.ReplaceAllString(value, "://"+redacted+"@")
+}
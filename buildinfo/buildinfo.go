@@ -0,0 +1,81 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Values injected at build time, e.g.
+//
+//	go build -ldflags "-X github.com/subhamproject/user-service/buildinfo.Version=v1.2.3"
+//
+// Empty values are filled in from the module and VCS information embedded by
+// the Go toolchain.
+var (
+	Version   string
+	GitCommit string
+	BuildTime string
+)
+
+// Info describes the running binary.
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+var (
+	info Info
+	once sync.Once
+)
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	once.Do(func() {
+		bi, ok := debug.ReadBuildInfo()
+		if !ok {
+			bi = nil
+		}
+		info = resolve(Version, GitCommit, BuildTime, bi)
+	})
+	return info
+}
+
+// resolve combines the injected values with the build information bi of
+// the toolchain, which may be nil.
+func resolve(version, gitCommit, buildTime string, bi *debug.BuildInfo) Info {
+	info := Info{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi != nil {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.GitCommit == "" {
+					info.GitCommit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = s.Value
+				}
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+}
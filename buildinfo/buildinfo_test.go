@@ -0,0 +1,53 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func vcsBuildInfo(version string) *debug.BuildInfo {
+	return &debug.BuildInfo{
+		Main: debug.Module{Version: version},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123abcd"},
+			{Key: "vcs.time", Value: "2023-05-01T10:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+}
+
+func TestResolveInjectedValuesWin(t *testing.T) {
+	got := resolve("v1.2.3", "feedbeef", "2023-06-01T00:00:00Z", vcsBuildInfo("v0.0.1"))
+	want := Info{Version: "v1.2.3", GitCommit: "feedbeef", BuildTime: "2023-06-01T00:00:00Z", GoVersion: runtime.Version(), Modified: true}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestResolveFallsBackToToolchain(t *testing.T) {
+	got := resolve("", "", "", vcsBuildInfo("v0.0.1"))
+	want := Info{Version: "v0.0.1", GitCommit: "0123abcd", BuildTime: "2023-05-01T10:00:00Z", GoVersion: runtime.Version(), Modified: true}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestResolveDevBuild(t *testing.T) {
+	if got := resolve("", "", "", vcsBuildInfo("(devel)")); got.Version != "dev" {
+		t.Errorf("devel build version %q, want dev", got.Version)
+	}
+	got := resolve("", "", "", nil)
+	if got.Version != "dev" || got.GitCommit != "" || got.Modified {
+		t.Errorf("without build info got %+v", got)
+	}
+}
+
+func TestGetIsStable(t *testing.T) {
+	if Get() != Get() {
+		t.Error("Get changed between calls")
+	}
+	if Get().GoVersion != runtime.Version() {
+		t.Errorf("go version %q", Get().GoVersion)
+	}
+}
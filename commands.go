@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/usrmgr"
+)
+
+// commands can be run as `user-service <command> [args]`, they share the
+// environment based configuration of the server.
+var commands = map[string]func(args []string) error{
+	"deadletters": deadLettersCommand,
+	"encryption":  encryptionCommand,
+	"gdpr":        gdprCommand,
+	"migrate":     migrateCommand,
+}
+
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, available commands: %s\n", args[0], strings.Join(commandNames(), ", "))
+		return 2
+	}
+	if err := cmd(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deadLettersCommand inspects and replays events that could not be
+// delivered to Kafka.
+//
+//	user-service deadletters list   [-status pending] [-since 2023-01-02T15:04:05Z] [-until ...] [-contains text] [-ids a,b] [-limit n]
+//	user-service deadletters replay [same filters]
+func deadLettersCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "replay") {
+		return errors.New("usage: deadletters list|replay [flags]")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("deadletters "+action, flag.ContinueOnError)
+	status := fs.String("status", usrmgr.DeadLetterPending, "only dead letters in this status, empty for all")
+	since := fs.String("since", "", "only dead letters failed at or after this RFC 3339 time")
+	until := fs.String("until", "", "only dead letters failed before this RFC 3339 time")
+	contains := fs.String("contains", "", "only dead letters whose event contains this text")
+	ids := fs.String("ids", "", "comma separated dead letter ids")
+	limit := fs.Int64("limit", 0, "maximum number of dead letters, 0 for all")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	filter := usrmgr.DeadLetterFilter{Status: *status, Contains: *contains, Limit: *limit}
+	if *ids != "" {
+		filter.IDs = strings.Split(*ids, ",")
+	}
+	var err error
+	if *since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+	}
+
+	client, mongoCtx, cancel, _ := usrmgr.InitMongoDB()
+	defer usrmgr.CloseMongoDB(client, mongoCtx, cancel)
+	ctx := context.Background()
+
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+
+	if action == "list" {
+		deadLetters, err := usrmgr.ListDeadLetters(ctx, filter)
+		if err != nil {
+			return err
+		}
+		return out.Encode(deadLetters)
+	}
+
+	usrmgr.InitKafka()
+	defer usrmgr.CloseKafka()
+	result, err := usrmgr.ReplayDeadLetters(ctx, filter)
+	// report what was replayed before the failure too
+	if encErr := out.Encode(result); err == nil {
+		err = encErr
+	}
+	return err
+}
+
+// migrateCommand manages the MongoDB schema migrations.
+//
+//	user-service migrate up
+//	user-service migrate down [-steps n]
+//	user-service migrate status
+func migrateCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		return errors.New("usage: migrate up|down|status [flags]")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	steps := fs.Int("steps", 1, "number of migrations to revert")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	client, mongoCtx, cancel, _ := usrmgr.InitMongoDB()
+	defer usrmgr.CloseMongoDB(client, mongoCtx, cancel)
+	ctx := context.Background()
+	migrator := usrmgr.NewMigrator()
+
+	switch action {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		return migrator.Down(ctx, *steps)
+	}
+
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(statuses)
+}
+
+// encryptionCommand rotates the data keys of field encryption and moves
+// users to the newest one.
+//
+//	user-service encryption rotate
+//	user-service encryption reencrypt
+func encryptionCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "rotate" && args[0] != "reencrypt") {
+		return errors.New("usage: encryption rotate|reencrypt")
+	}
+
+	client, mongoCtx, cancel, _ := usrmgr.InitMongoDB()
+	defer usrmgr.CloseMongoDB(client, mongoCtx, cancel)
+	ctx := usrmgr.WithActor(context.Background(), usrmgr.SystemActor)
+	if err := usrmgr.InitFieldEncryption(ctx); err != nil {
+		return err
+	}
+
+	if args[0] == "rotate" {
+		rotated, err := usrmgr.RotateDataKeys(ctx, true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rotated: %t\n", rotated)
+		return nil
+	}
+	n, err := usrmgr.ReencryptUsers(ctx)
+	fmt.Printf("reencrypted: %d\n", n)
+	return err
+}
+
+// gdprCommand answers data subject requests: export writes the data held
+// about a user, erase deletes it.
+//
+//	user-service gdpr export -id 100 [-format json|zip] [-out file]
+//	user-service gdpr erase  -id 100 [-reason text]
+func gdprCommand(args []string) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "erase") {
+		return errors.New("usage: gdpr export|erase -id user-id [flags]")
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("gdpr "+action, flag.ContinueOnError)
+	id := fs.String("id", "", "id of the user")
+	format := fs.String("format", "json", "export format, json or zip")
+	out := fs.String("out", "", "file to write the export to, standard output when empty")
+	reason := fs.String("reason", "", "reason recorded with the erasure")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *id == "" {
+		return errors.New("-id is required")
+	}
+	if *format != "json" && *format != "zip" {
+		return errors.New("-format must be json or zip")
+	}
+
+	client, mongoCtx, cancel, _ := usrmgr.InitMongoDB()
+	defer usrmgr.CloseMongoDB(client, mongoCtx, cancel)
+	ctx := usrmgr.WithActor(context.Background(), usrmgr.SystemActor)
+	if err := usrmgr.InitFieldEncryption(ctx); err != nil {
+		return err
+	}
+
+	if action == "erase" {
+		usrmgr.InitKafka()
+		defer usrmgr.CloseKafka()
+		erasure, err := usrmgr.EraseUser(ctx, *id, *reason)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(erasure)
+	}
+
+	export, err := usrmgr.ExportUserData(ctx, *id)
+	if err != nil {
+		return err
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+	if *format == "zip" {
+		err = export.WriteZip(w)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(export)
+	}
+	if *out != "" {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -3,5 +3,4 @@ package consts
 const (
 	ServiceName = "user-service"
 	Environment = "development"
-	VersionId   = 1
 )
@@ -0,0 +1,181 @@
+// Package fieldcrypt encrypts individual document fields with envelope
+// encryption: values are encrypted with data keys, and the data keys are
+// stored wrapped by a master key held by a KeyProvider.
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/subhamproject/user-service/utils"
+)
+
+// Supported values for FIELD_ENCRYPTION_KEY_PROVIDER.
+const (
+	TypeLocal = "local"
+)
+
+// KeySize is the size of data and master keys, AES-256.
+const KeySize = 32
+
+// Ciphertext prefixes, followed by the data key id and the encrypted value.
+const (
+	prefixRandom        = "enc:v1:"
+	prefixDeterministic = "det:v1:"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+	ErrDecrypt    = errors.New("unable to decrypt value")
+)
+
+// KeyProvider holds the master keys data keys are wrapped with. Master
+// keys never leave it, so a KMS can stand in for the local keyfile.
+type KeyProvider interface {
+	// CurrentKeyID returns the master key new data keys are wrapped with.
+	CurrentKeyID() string
+	WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// FromEnv returns the key provider selected by FIELD_ENCRYPTION_KEY_PROVIDER.
+func FromEnv() (KeyProvider, error) {
+	switch kind := utils.GetEnvParam("FIELD_ENCRYPTION_KEY_PROVIDER", TypeLocal); kind {
+	case TypeLocal:
+		path := utils.GetEnvParam("FIELD_ENCRYPTION_KEYFILE", "")
+		if path == "" {
+			return nil, errors.New("FIELD_ENCRYPTION_KEYFILE is required by the local key provider")
+		}
+		return NewLocalKeyProvider(path)
+	default:
+		return nil, fmt.Errorf("unknown FIELD_ENCRYPTION_KEY_PROVIDER %q", kind)
+	}
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DataKey encrypts field values. Separate keys derived from it are used for
+// encryption and for the synthetic nonces of deterministic encryption.
+type DataKey struct {
+	ID string
+
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// NewDataKey returns the data key id with the plaintext key.
+func NewDataKey(id string, key []byte) (DataKey, error) {
+	if len(key) != KeySize {
+		return DataKey{}, fmt.Errorf("data key %s has %d bytes, want %d", id, len(key), KeySize)
+	}
+	if strings.Contains(id, ":") {
+		return DataKey{}, fmt.Errorf("invalid data key id %q", id)
+	}
+	block, err := aes.NewCipher(derive(key, "fieldcrypt encryption"))
+	if err != nil {
+		return DataKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{ID: id, aead: aead, macKey: derive(key, "fieldcrypt nonce")}, nil
+}
+
+func derive(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Encrypt returns plaintext encrypted with a random nonce. field binds the
+// ciphertext to the field it is stored in, it has to be given again to
+// decrypt it.
+func (k DataKey) Encrypt(field, plaintext string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return k.seal(prefixRandom, field, plaintext, nonce), nil
+}
+
+// EncryptDeterministic returns the same ciphertext for the same key, field
+// and plaintext, so encrypted values can be looked up and indexed. It
+// reveals which values are equal, and should only be used where needed.
+func (k DataKey) EncryptDeterministic(field, plaintext string) string {
+	mac := hmac.New(sha256.New, k.macKey)
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(plaintext))
+	return k.seal(prefixDeterministic, field, plaintext, mac.Sum(nil)[:k.aead.NonceSize()])
+}
+
+func (k DataKey) seal(prefix, field, plaintext string, nonce []byte) string {
+	sealed := k.aead.Seal(nonce, nonce, []byte(plaintext), []byte(prefix+field))
+	return prefix + k.ID + ":" + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// Decrypt returns the plaintext of a value of field encrypted by k.
+func (k DataKey) Decrypt(field, ciphertext string) (string, error) {
+	prefix, id, payload, ok := split(ciphertext)
+	if !ok || id != k.ID {
+		return "", ErrDecrypt
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	n := k.aead.NonceSize()
+	plaintext, err := k.aead.Open(nil, sealed[:n], sealed[n:], []byte(prefix+field))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted tells whether value is a ciphertext, values stored before
+// encryption was enabled are not.
+func IsEncrypted(value string) bool {
+	_, _, _, ok := split(value)
+	return ok
+}
+
+// KeyID returns the id of the data key value was encrypted with.
+func KeyID(value string) (string, bool) {
+	_, id, _, ok := split(value)
+	return id, ok
+}
+
+// KeyPattern returns a regular expression matching the values encrypted
+// with data key id.
+func KeyPattern(id string) string {
+	return `^(enc|det):v1:` + id + `:`
+}
+
+func split(value string) (prefix, id, payload string, ok bool) {
+	switch {
+	case strings.HasPrefix(value, prefixRandom):
+		prefix = prefixRandom
+	case strings.HasPrefix(value, prefixDeterministic):
+		prefix = prefixDeterministic
+	default:
+		return "", "", "", false
+	}
+	id, payload, ok = strings.Cut(value[len(prefix):], ":")
+	return prefix, id, payload, ok && id != "" && payload != ""
+}
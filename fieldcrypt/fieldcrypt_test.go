@@ -0,0 +1,182 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T, id string, b byte) DataKey {
+	t.Helper()
+	k, err := NewDataKey(id, bytes.Repeat([]byte{b}, KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestEncrypt(t *testing.T) {
+	k := testKey(t, "k1", 1)
+	a, err := k.Encrypt("name", "jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := k.Encrypt("name", "jane")
+	if a == b {
+		t.Error("random encryption repeats the ciphertext")
+	}
+	if !strings.HasPrefix(a, "enc:v1:k1:") || strings.Contains(a, "jane") {
+		t.Errorf("ciphertext %q", a)
+	}
+	for _, c := range []string{a, b} {
+		if got, err := k.Decrypt("name", c); err != nil || got != "jane" {
+			t.Errorf("Decrypt = %q, %v", got, err)
+		}
+	}
+	if empty, _ := k.Encrypt("name", ""); !IsEncrypted(empty) {
+		t.Error("empty value not encrypted")
+	}
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	k := testKey(t, "k1", 1)
+	a := k.EncryptDeterministic("email", "jane@example.com")
+	if !strings.HasPrefix(a, "det:v1:k1:") {
+		t.Errorf("ciphertext %q", a)
+	}
+	if b := k.EncryptDeterministic("email", "jane@example.com"); a != b {
+		t.Error("deterministic encryption differs for the same value")
+	}
+	if b := k.EncryptDeterministic("email", "john@example.com"); a == b {
+		t.Error("different values encrypt the same")
+	}
+	if b := k.EncryptDeterministic("phone", "jane@example.com"); a[len("det:v1:k1:"):] == b[len("det:v1:k1:"):] {
+		t.Error("the same value encrypts the same in different fields")
+	}
+	other := testKey(t, "k2", 2)
+	if b := other.EncryptDeterministic("email", "jane@example.com"); a[len("det:v1:k1:"):] == b[len("det:v1:k2:"):] {
+		t.Error("different keys encrypt the same")
+	}
+	if got, err := k.Decrypt("email", a); err != nil || got != "jane@example.com" {
+		t.Errorf("Decrypt = %q, %v", got, err)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	k := testKey(t, "k1", 1)
+	c, _ := k.Encrypt("name", "jane")
+	det := k.EncryptDeterministic("name", "jane")
+	payload := c[len("enc:v1:k1:"):]
+	flipped := []byte(payload)
+	if i := len(flipped) / 2; flipped[i] == 'A' {
+		flipped[i] = 'B'
+	} else {
+		flipped[i] = 'A'
+	}
+
+	tests := []struct {
+		name       string
+		field      string
+		ciphertext string
+	}{
+		{"other field", "email", c},
+		{"other key", "name", "enc:v1:k2:" + payload},
+		{"same key id, other key", "name", func() string { c, _ := testKey(t, "k1", 2).Encrypt("name", "jane"); return c }()},
+		{"tampered", "name", "enc:v1:k1:" + string(flipped)},
+		{"truncated", "name", "enc:v1:k1:" + payload[:8]},
+		{"not base64", "name", "enc:v1:k1:!!"},
+		{"mode swapped", "name", "enc:v1:k1:" + det[len("det:v1:k1:"):]},
+		{"plaintext", "name", "jane"},
+		{"no payload", "name", "enc:v1:k1:"},
+	}
+	for _, tt := range tests {
+		if got, err := k.Decrypt(tt.field, tt.ciphertext); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: Decrypt = %q, %v; want ErrDecrypt", tt.name, got, err)
+		}
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	k := testKey(t, "k1", 1)
+	c, _ := k.Encrypt("name", "jane")
+	tests := []struct {
+		value string
+		id    string
+		ok    bool
+	}{
+		{c, "k1", true},
+		{k.EncryptDeterministic("email", "jane@example.com"), "k1", true},
+		{"jane", "", false},
+		{"enc:v1:", "", false},
+		{"enc:v1::x", "", false},
+		{"enc:v2:k1:x", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := KeyID(tt.value)
+		if id != tt.id || ok != tt.ok || IsEncrypted(tt.value) != tt.ok {
+			t.Errorf("KeyID(%q) = %q, %v; want %q, %v", tt.value, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestKeyPattern(t *testing.T) {
+	k1, k10 := testKey(t, "k1", 1), testKey(t, "k10", 1)
+	re := regexp.MustCompile(KeyPattern("k1"))
+	c1, _ := k1.Encrypt("name", "jane")
+	c10, _ := k10.Encrypt("name", "jane")
+	if !re.MatchString(c1) || !re.MatchString(k1.EncryptDeterministic("email", "j")) {
+		t.Error("values of the key not matched")
+	}
+	if re.MatchString(c10) || re.MatchString("jane enc:v1:k1:x") {
+		t.Error("other values matched")
+	}
+}
+
+func TestNewDataKey(t *testing.T) {
+	if _, err := NewDataKey("k1", make([]byte, 16)); err == nil {
+		t.Error("short key accepted")
+	}
+	if _, err := NewDataKey("k:1", make([]byte, KeySize)); err == nil {
+		t.Error("id with a colon accepted")
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	a, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateKey()
+	if len(a) != KeySize || bytes.Equal(a, b) {
+		t.Errorf("keys %x, %x", a, b)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	path := writeKeyfile(t, "k1:"+testMasterKey(1)+"\n")
+	t.Setenv("FIELD_ENCRYPTION_KEY_PROVIDER", "local")
+	t.Setenv("FIELD_ENCRYPTION_KEYFILE", path)
+	p, err := FromEnv()
+	if err != nil || p.CurrentKeyID() != "k1" {
+		t.Errorf("FromEnv = %v, %v", p, err)
+	}
+
+	unsetenv(t, "FIELD_ENCRYPTION_KEYFILE")
+	if _, err := FromEnv(); err == nil {
+		t.Error("local provider without keyfile accepted")
+	}
+	t.Setenv("FIELD_ENCRYPTION_KEY_PROVIDER", "vault")
+	if _, err := FromEnv(); err == nil {
+		t.Error("unknown provider accepted")
+	}
+}
@@ -0,0 +1,102 @@
+package fieldcrypt
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LocalKeyProvider keeps master keys in a file, for development and tests.
+// Each line holds a key as `id:base64`, the last one is current; lines
+// starting with # are ignored. Rotating means appending a key, e.g.
+//
+//	echo "k2:$(openssl rand -base64 32)" >> keys
+//
+// while older keys stay in the file until no data key uses them.
+type LocalKeyProvider struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewLocalKeyProvider reads the keyfile at path.
+func NewLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &LocalKeyProvider{keys: map[string]cipher.AEAD{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%s:%d: want id:base64-key", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("%s:%d: key %s is not %d base64 encoded bytes", path, line, id, KeySize)
+		}
+		if _, ok := p.keys[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key %s", path, line, id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if p.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		p.current = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return p, nil
+}
+
+func (p *LocalKeyProvider) CurrentKeyID() string {
+	return p.current
+}
+
+func (p *LocalKeyProvider) WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s: %w", keyID, ErrUnknownKey)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %s: %w", keyID, ErrUnknownKey)
+	}
+	n := aead.NonceSize()
+	if len(wrapped) < n {
+		return nil, ErrDecrypt
+	}
+	key, err := aead.Open(nil, wrapped[:n], wrapped[n:], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("data key wrapped with %s: %w", keyID, ErrDecrypt)
+	}
+	return key, nil
+}
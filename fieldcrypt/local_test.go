@@ -0,0 +1,91 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMasterKey returns a base64 master key of bytes b.
+func testMasterKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, KeySize))
+}
+
+func writeKeyfile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocalKeyProvider(t *testing.T) {
+	path := writeKeyfile(t, "# retired next quarter\nk1:"+testMasterKey(1)+"\n\n  k2 : "+testMasterKey(2)+"\n")
+	p, err := NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CurrentKeyID() != "k2" {
+		t.Errorf("current key %s, want the last one", p.CurrentKeyID())
+	}
+
+	ctx := context.Background()
+	dataKey, _ := GenerateKey()
+	for _, id := range []string{"k1", "k2"} {
+		wrapped, err := p.WrapKey(ctx, id, dataKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(wrapped, dataKey) {
+			t.Errorf("%s: data key wrapped in plaintext", id)
+		}
+		if got, err := p.UnwrapKey(ctx, id, wrapped); err != nil || !bytes.Equal(got, dataKey) {
+			t.Errorf("%s: UnwrapKey = %x, %v", id, got, err)
+		}
+	}
+
+	wrapped, _ := p.WrapKey(ctx, "k1", dataKey)
+	if _, err := p.UnwrapKey(ctx, "k2", wrapped); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("unwrapped with another master key: %v", err)
+	}
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := p.UnwrapKey(ctx, "k1", wrapped); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("tampered key unwrapped: %v", err)
+	}
+	if _, err := p.UnwrapKey(ctx, "k1", wrapped[:4]); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("truncated key unwrapped: %v", err)
+	}
+	if _, err := p.WrapKey(ctx, "k3", dataKey); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("WrapKey with an unknown key = %v", err)
+	}
+	if _, err := p.UnwrapKey(ctx, "k3", wrapped); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("UnwrapKey with an unknown key = %v", err)
+	}
+}
+
+func TestLocalKeyProviderInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", "# no keys yet\n"},
+		{"no id", ":" + testMasterKey(1)},
+		{"no separator", testMasterKey(1)},
+		{"not base64", "k1:not base64"},
+		{"short key", "k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16))},
+		{"duplicate", "k1:" + testMasterKey(1) + "\nk1:" + testMasterKey(2)},
+	}
+	for _, tt := range tests {
+		if _, err := NewLocalKeyProvider(writeKeyfile(t, tt.content)); err == nil {
+			t.Errorf("%s: keyfile accepted", tt.name)
+		}
+	}
+	if _, err := NewLocalKeyProvider(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing keyfile accepted")
+	}
+}
@@ -2,80 +2,128 @@ package logs
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/subhamproject/user-service/buildinfo"
 	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/utils"
 	"go.opentelemetry.io/otel/trace"
 )
 
-var Log *logrus.Logger
+// Supported values for LOG_TRACE_FIELDS.
+const (
+	FieldStyleOtel    = "otel"
+	FieldStyleDatadog = "datadog"
+)
+
+var (
+	Log        *logrus.Logger
+	fieldStyle string
+)
 
 func init() {
 	// Create a new instance of the logger. You can have any number of instances.
 	Log = logrus.New()
-
-	Log.Formatter = new(logrus.JSONFormatter)
 	// Output to stdout instead of the default stderr
-	Log.Level = logrus.TraceLevel
 	Log.Out = os.Stdout
+
+	Configure(
+		utils.GetEnvParam("LOG_LEVEL", "info"),
+		utils.GetEnvParam("LOG_FORMAT", "json"),
+		utils.GetEnvParam("LOG_TRACE_FIELDS", FieldStyleOtel),
+	)
 }
 
-func AddFieldsToLogger(span trace.Span) logrus.Fields {
-	if span == nil {
-		return logrus.Fields{}
+// Configure sets the level, output format (json or console) and the naming
+// style of the trace correlation fields (otel or datadog) of the logger.
+// Unknown values fall back to info, json and otel respectively.
+func Configure(level, format, style string) {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		lvl = logrus.InfoLevel
 	}
+	Log.SetLevel(lvl)
 
-	return logrus.Fields{
-		"dd.trace_id": convertTraceID(span.SpanContext().TraceID().String()),
-		"dd.span_id":  convertTraceID(span.SpanContext().SpanID().String()),
-		"dd.service":  consts.ServiceName,
+	switch strings.ToLower(format) {
+	case "console", "text":
+		Log.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		Log.SetFormatter(&logrus.JSONFormatter{})
 	}
-}
-
-// var standardFields = logrus.Fields{
-// 	"dd.trace_id": convertTraceID(span.SpanContext().TraceID().String()),
-// 	"dd.span_id":  convertTraceID(span.SpanContext().SpanID().String()),
-// 	"dd.service":  "serviceName",
-// 	"dd.env":      "serviceEnv",
-// 	"dd.version":  "serviceVersion",
-// }
-
-func Info(msg string) {
-	Log.Info(msg)
-}
-
-func Debug(msg string) {
-	Log.Debug(msg)
-}
 
-func Error(msg string) {
-	Log.Error(msg)
+	switch strings.ToLower(style) {
+	case FieldStyleDatadog:
+		fieldStyle = FieldStyleDatadog
+	default:
+		fieldStyle = FieldStyleOtel
+	}
 }
 
-func Warn(msg string) {
-	Log.Warn(msg)
+// SetLevel changes the level of the logger at runtime.
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Log.SetLevel(lvl)
+	return nil
 }
 
-func InfoTrace(ctx context.Context, span trace.Span, msg string) {
-	Log.WithFields(AddFieldsToLogger(span)).WithContext(ctx).Info(msg)
+// Level returns the current level of the logger.
+func Level() string {
+	return Log.GetLevel().String()
 }
 
-func DebugTrace(ctx context.Context, span trace.Span, msg string) {
-	Log.WithFields(AddFieldsToLogger(span)).WithContext(ctx).Debug(msg)
+// FromContext returns a log entry bound to ctx. When ctx carries a valid
+// span the trace and span ids are added so log lines can be correlated with
+// traces in the backend.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return Log.WithContext(ctx).WithFields(traceFields(trace.SpanContextFromContext(ctx)))
 }
 
-func ErrorTrace(ctx context.Context, span trace.Span, msg string) {
-	Log.WithFields(AddFieldsToLogger(span)).WithContext(ctx).Error(msg)
-}
+func traceFields(sc trace.SpanContext) logrus.Fields {
+	if fieldStyle == FieldStyleDatadog {
+		fields := logrus.Fields{
+			"dd.service": consts.ServiceName,
+			"dd.env":     consts.Environment,
+			"dd.version": buildinfo.Get().Version,
+		}
+		if sc.IsValid() {
+			fields["dd.trace_id"] = convertTraceID(sc.TraceID().String())
+			fields["dd.span_id"] = convertTraceID(sc.SpanID().String())
+		}
+		return fields
+	}
 
-func WarnTrace(ctx context.Context, span trace.Span, msg string) {
-	Log.WithFields(AddFieldsToLogger(span)).WithContext(ctx).Warn(msg)
+	fields := logrus.Fields{
+		"service.name":    consts.ServiceName,
+		"service.version": buildinfo.Get().Version,
+	}
+	if sc.IsValid() {
+		fields["trace_id"] = sc.TraceID().String()
+		fields["span_id"] = sc.SpanID().String()
+		fields["trace_flags"] = sc.TraceFlags().String()
+	}
+	return fields
 }
 
+// convertTraceID converts an OpenTelemetry hex id into the decimal
+// representation of its lower 64 bits, which is what Datadog expects.
 func convertTraceID(id string) string {
 	if len(id) < 16 {
 		return ""
 	}
-	return id
+	b, err := hex.DecodeString(id[len(id)-16:])
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatUint(binary.BigEndian.Uint64(b), 10)
 }
@@ -0,0 +1,134 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// capture configures the logger for the test and returns its output.
+func capture(t *testing.T, style string) *bytes.Buffer {
+	t.Helper()
+	out, prevLevel, prevFormatter, prevStyle := Log.Out, Log.GetLevel(), Log.Formatter, fieldStyle
+	t.Cleanup(func() {
+		Log.Out, fieldStyle = out, prevStyle
+		Log.SetLevel(prevLevel)
+		Log.SetFormatter(prevFormatter)
+	})
+	var buf bytes.Buffer
+	Log.Out = &buf
+	Configure("debug", "json", style)
+	return &buf
+}
+
+func spanContext(t *testing.T) context.Context {
+	t.Helper()
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+	return trace.ContextWithSpanContext(context.Background(), sc)
+}
+
+func lastLine(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log line %q is not json: %v", buf.String(), err)
+	}
+	return line
+}
+
+func TestFromContextAddsOtelTraceFields(t *testing.T) {
+	buf := capture(t, FieldStyleOtel)
+	FromContext(spanContext(t)).Info("hello")
+
+	line := lastLine(t, buf)
+	if line["trace_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || line["span_id"] != "00f067aa0ba902b7" {
+		t.Errorf("trace fields missing: %v", line)
+	}
+	if line["trace_flags"] != "01" {
+		t.Errorf("trace_flags = %v, want 01", line["trace_flags"])
+	}
+	if _, ok := line["service.name"]; !ok {
+		t.Error("service.name missing")
+	}
+}
+
+func TestFromContextAddsDatadogTraceFields(t *testing.T) {
+	buf := capture(t, FieldStyleDatadog)
+	FromContext(spanContext(t)).Info("hello")
+
+	line := lastLine(t, buf)
+	// the lower 64 bits of the ids in decimal
+	if line["dd.trace_id"] != "11803532876627986230" || line["dd.span_id"] != "67667974448284343" {
+		t.Errorf("datadog fields: %v", line)
+	}
+	if _, ok := line["trace_id"]; ok {
+		t.Error("otel fields written in datadog style")
+	}
+}
+
+func TestFromContextWithoutSpan(t *testing.T) {
+	buf := capture(t, FieldStyleOtel)
+	var ctx context.Context
+	FromContext(ctx).Info("hello")
+
+	line := lastLine(t, buf)
+	if _, ok := line["trace_id"]; ok {
+		t.Error("trace_id written without a span")
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	capture(t, FieldStyleOtel)
+
+	Configure("warn", "console", "datadog")
+	if Level() != "warning" || fieldStyle != FieldStyleDatadog {
+		t.Errorf("level %s style %s", Level(), fieldStyle)
+	}
+	if _, ok := Log.Formatter.(*logrus.TextFormatter); !ok {
+		t.Errorf("console format uses %T", Log.Formatter)
+	}
+
+	Configure("loud", "xml", "other")
+	if Level() != "info" || fieldStyle != FieldStyleOtel {
+		t.Errorf("unknown values: level %s style %s", Level(), fieldStyle)
+	}
+	if _, ok := Log.Formatter.(*logrus.JSONFormatter); !ok {
+		t.Errorf("unknown format uses %T", Log.Formatter)
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	capture(t, FieldStyleOtel)
+	if err := SetLevel("error"); err != nil || Level() != "error" {
+		t.Errorf("SetLevel(error) = %v, level %s", err, Level())
+	}
+	if err := SetLevel("nope"); err == nil || Level() != "error" {
+		t.Errorf("SetLevel(nope) = %v, level %s", err, Level())
+	}
+}
+
+func TestConvertTraceID(t *testing.T) {
+	tests := map[string]string{
+		"4bf92f3577b34da6a3ce929d0e0e4736": "11803532876627986230",
+		"00f067aa0ba902b7":                 "67667974448284343",
+		"abc":                              "",
+		"zzzzzzzzzzzzzzzz":                 "",
+	}
+	for in, want := range tests {
+		if got := convertTraceID(in); got != want {
+			t.Errorf("convertTraceID(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
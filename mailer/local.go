@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+)
+
+// LogMailer writes emails to the log instead of sending them.
+type LogMailer struct {
+	From string
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	logs.FromContext(ctx).WithField("to", msg.To).WithField("subject", msg.Subject).
+		Infof("email not sent, MAILER is log:\n%s", msg.Body)
+	return nil
+}
+
+// FileMailer stores each email as an .eml file in Dir, where it can be
+// opened with a mail client or picked up by a local stand-in server.
+type FileMailer struct {
+	From string
+	Dir  string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := validHeader(msg.To); err != nil {
+		return err
+	}
+	if err := validHeader(msg.Subject); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o750); err != nil {
+		return err
+	}
+	name := filepath.Join(m.Dir, fmt.Sprintf("%d.eml", time.Now().UnixNano()))
+	if err := os.WriteFile(name, format(m.From, msg), 0o640); err != nil {
+		return err
+	}
+	logs.FromContext(ctx).WithField("to", msg.To).Debugf("email written to %s", name)
+	return nil
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/utils"
+)
+
+// Supported values for MAILER.
+const (
+	TypeLog  = "log"
+	TypeFile = "file"
+	TypeSMTP = "smtp"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv returns the mailer selected by MAILER. The log mailer is the
+// default so development setups work without a mail server.
+func FromEnv() (Mailer, error) {
+	from := utils.GetEnvParam("MAIL_FROM", "user-service@localhost")
+
+	switch strings.ToLower(utils.GetEnvParam("MAILER", TypeLog)) {
+	case TypeLog:
+		return &LogMailer{From: from}, nil
+	case TypeFile:
+		return &FileMailer{From: from, Dir: utils.GetEnvParam("MAIL_DIR", "mail")}, nil
+	case TypeSMTP:
+		pass, err := utils.GetEnvSecretParam("SMTP_PASSWORD", "")
+		if err != nil {
+			return nil, err
+		}
+		return &SMTPMailer{
+			From:     from,
+			Host:     utils.GetEnvParam("SMTP_HOST", "localhost"),
+			Port:     utils.GetEnvIntParam("SMTP_PORT", 587),
+			Username: utils.GetEnvParam("SMTP_USERNAME", ""),
+			Password: pass,
+			TLSMode:  strings.ToLower(utils.GetEnvParam("SMTP_TLS", TLSStartTLS)),
+			Timeout:  utils.GetEnvDurationParam("SMTP_TIMEOUT", 10*time.Second),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown MAILER, expected %s, %s or %s", TypeLog, TypeFile, TypeSMTP)
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader rejects values that would inject headers.
+func validHeader(v string) error {
+	if strings.ContainsAny(v, "\r\n") {
+		return fmt.Errorf("invalid mail header value %q", v)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestFromEnv(t *testing.T) {
+	unsetenv(t, "MAILER")
+	m, err := FromEnv()
+	if _, ok := m.(*LogMailer); !ok || err != nil {
+		t.Errorf("default mailer = %T, %v, want *LogMailer", m, err)
+	}
+
+	t.Setenv("MAILER", "SMTP")
+	t.Setenv("SMTP_HOST", "mail.example.com")
+	t.Setenv("SMTP_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+	m, err = FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpMailer, ok := m.(*SMTPMailer)
+	if !ok || smtpMailer.Host != "mail.example.com" || smtpMailer.Port != 587 ||
+		smtpMailer.Password != "s3cret" || smtpMailer.TLSMode != TLSStartTLS {
+		t.Errorf("smtp mailer = %+v", m)
+	}
+
+	t.Setenv("MAILER", "pigeon")
+	if _, err := FromEnv(); err == nil {
+		t.Error("unknown mailer accepted")
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFormat(t *testing.T) {
+	raw := string(format("svc@example.com", Message{To: "jane@example.com", Subject: "Hi", Body: "line 1\nline 2\n"}))
+	header, body, ok := strings.Cut(raw, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header separator in %q", raw)
+	}
+	for _, h := range []string{"From: svc@example.com", "To: jane@example.com", "Subject: Hi", "Content-Type: text/plain; charset=utf-8"} {
+		if !strings.Contains(header+"\r\n", h+"\r\n") {
+			t.Errorf("header %q missing", h)
+		}
+	}
+	if body != "line 1\r\nline 2\r\n" {
+		t.Errorf("body = %q, want CRLF line endings", body)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	m := &FileMailer{From: "svc@example.com", Dir: dir}
+	if err := m.Send(context.Background(), Message{To: "jane@example.com", Subject: "Hi", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("%d files written", len(files))
+	}
+
+	err := m.Send(context.Background(), Message{To: "jane@example.com\r\nBcc: all@example.com", Subject: "Hi"})
+	if err == nil {
+		t.Error("header injection accepted")
+	}
+}
+
+// fakeSMTP accepts one message over plain SMTP and returns the commands
+// and data it received.
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var lines []string
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					data, err := r.ReadString('\n')
+					if err != nil || data == ".\r\n" {
+						break
+					}
+					lines = append(lines, strings.TrimRight(data, "\r\n"))
+				}
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				received <- lines
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+		received <- lines
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	m := &SMTPMailer{From: "svc@example.com", Host: host, Port: p, TLSMode: TLSNone, Timeout: 5 * time.Second}
+	if err := m.Send(context.Background(), Message{To: "jane@example.com", Subject: "Verify", Body: "open the link"}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Join(<-received, "\n")
+	for _, want := range []string{"MAIL FROM:<svc@example.com>", "RCPT TO:<jane@example.com>", "Subject: Verify", "open the link"} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("server did not receive %q in\n%s", want, lines)
+		}
+	}
+}
+
+func TestSMTPMailerErrors(t *testing.T) {
+	m := &SMTPMailer{From: "svc@example.com", Host: "127.0.0.1", Port: 1, TLSMode: TLSNone, Timeout: time.Second}
+	if err := m.Send(context.Background(), Message{To: "jane@example.com"}); err == nil {
+		t.Error("unreachable server reported no error")
+	}
+	if err := m.Send(context.Background(), Message{To: "a@example.com\nRCPT TO:<b@example.com>"}); err == nil {
+		t.Error("header injection accepted")
+	}
+
+	addr, _ := fakeSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	m = &SMTPMailer{Host: host, Port: p, TLSMode: "ssl3", Timeout: time.Second}
+	if err := m.Send(context.Background(), Message{To: "jane@example.com"}); err == nil {
+		t.Error("unknown tls mode accepted")
+	}
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,6 +10,8 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/admin"
+	"github.com/subhamproject/user-service/logs"
 	"github.com/subhamproject/user-service/otelsvc"
 	"github.com/subhamproject/user-service/usrmgr"
 	"github.com/subhamproject/user-service/utils"
@@ -20,64 +20,186 @@ import (
 )
 
 var (
-	client       *mongo.Client
-	ctx          context.Context
-	cFund        context.CancelFunc
-	server       *http.Server
-	otelShutdown func()
+	client         *mongo.Client
+	ctx            context.Context
+	cFund          context.CancelFunc
+	server         *http.Server
+	adminServer    *http.Server
+	otelShutdown   func()
+	logShutdown    func()
+	metricShutdown func()
+	purgeStop      func()
+	keyRotateStop  func()
+	encryptionStop func()
 )
 
 func main() {
 
+	// run a one-off command such as `user-service deadletters list` instead
+	// of the server when one is given
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 
 	go func() {
 		defer wg.Done()
-		fmt.Println("initializing connection mongo...")
+		logs.FromContext(context.Background()).Info("initializing connection mongo...")
 		//init mogno db
 		client, ctx, cFund, _ = usrmgr.InitMongoDB()
 
+		if utils.GetEnvBoolParam("MONGO_MIGRATE_ON_START", true) {
+			if err := usrmgr.MigrateMongoDB(context.Background()); err != nil {
+				logs.FromContext(context.Background()).Fatalf("mongodb migration failed: %v", err)
+			}
+		}
+
+		if err := usrmgr.InitFieldEncryption(context.Background()); err != nil {
+			logs.FromContext(context.Background()).Fatalf("unable to initialize field encryption: %v", err)
+		}
+
 		//init kafka connection
 		usrmgr.InitKafka()
+
+		if err := usrmgr.InitAccounts(); err != nil {
+			logs.FromContext(context.Background()).Fatalf("unable to initialize accounts: %v", err)
+		}
+		if err := usrmgr.InitOIDC(context.Background()); err != nil {
+			logs.FromContext(context.Background()).Fatalf("unable to initialize token signing: %v", err)
+		}
 	}()
 
 	wg.Wait()
 
-	log.Printf("initializing otel connection...")
-	otelUrl := utils.GetEnvParam("OTEL_COLLECTOR_URL", "localhost:4317")
+	// hard delete users once their soft delete retention has passed
+	if utils.GetEnvBoolParam("USER_PURGE_ENABLE", true) {
+		purgeStop = usrmgr.StartPurgeJob(
+			utils.GetEnvDurationParam("USER_PURGE_INTERVAL", time.Hour),
+			utils.GetEnvDurationParam("USER_DELETE_RETENTION", 30*24*time.Hour))
+	}
+
+	// rotate the token signing keys when they are due
+	if utils.GetEnvBoolParam("OIDC_KEY_ROTATION_ENABLE", true) {
+		keyRotateStop = usrmgr.StartKeyRotationJob(
+			utils.GetEnvDurationParam("OIDC_KEY_ROTATION_CHECK_INTERVAL", time.Hour))
+	}
+
+	// rotate data keys when due and move encrypted fields to the newest
+	if utils.GetEnvBoolParam("FIELD_ENCRYPTION_ENABLE", false) {
+		encryptionStop = usrmgr.StartEncryptionJob(
+			utils.GetEnvDurationParam("FIELD_ENCRYPTION_JOB_INTERVAL", time.Hour))
+	}
+
+	logs.FromContext(context.Background()).Info("initializing otel connection...")
+	tracerCfg := otelsvc.LoadTracerConfig()
+	otelShutdown = otelsvc.InitTracerProvider(tracerCfg)
 	otelEnable := utils.GetEnvBoolParam("OTEL_ENABLE", false)
-	otelShutdown = otelsvc.InitTracerProvider(otelUrl, otelEnable)
+	logShutdown = otelsvc.InitLogProvider(tracerCfg.Collector, tracerCfg.Resource,
+		utils.GetEnvBoolParam("OTEL_LOGS_ENABLE", otelEnable))
+	metricShutdown = otelsvc.InitMeterProvider(tracerCfg.Collector, tracerCfg.Resource,
+		utils.GetEnvBoolParam("OTEL_METRICS_ENABLE", otelEnable))
 
 	r := gin.Default()
+	if err := r.SetTrustedProxies(usrmgr.TrustedProxies()); err != nil {
+		logs.FromContext(context.Background()).Fatalf("TRUSTED_PROXIES configuration error: %v", err)
+	}
 
-	f := func(req *http.Request) bool { return req.URL.Path != "/health" }
-	r.Use(otelgin.Middleware("user-service", otelgin.WithFilter(f)))
+	f := func(req *http.Request) bool {
+		return req.URL.Path != "/health" && req.URL.Path != "/ready" && req.URL.Path != "/version"
+	}
+	r.Use(otelgin.Middleware("user-service", otelgin.WithFilter(f)), usrmgr.RequestContext())
+	certAuth, err := usrmgr.ClientCertAuth()
+	if err != nil {
+		logs.FromContext(context.Background()).Fatalf("client certificate configuration error: %v", err)
+	}
+	r.Use(certAuth, usrmgr.APIKeyAuth())
 
 	r.GET("/health", usrmgr.GetServiceHealthHandler)
-	r.POST("/user", usrmgr.CreateUserHandler)
-	r.GET("/users", usrmgr.GetAllUsersHandler)
-	r.GET("/user", usrmgr.GetUserHandler)
-	r.GET("/user/order", usrmgr.GetUserOrderHandler)
+	r.GET("/ready", usrmgr.GetServiceReadinessHandler)
+	r.GET("/version", usrmgr.GetVersionHandler)
+	r.POST("/user", usrmgr.RequireScope(usrmgr.ScopeUsersWrite), usrmgr.CreateUserHandler)
+	r.GET("/users", usrmgr.RequireScope(usrmgr.ScopeUsersRead), usrmgr.GetAllUsersHandler)
+	r.GET("/user", usrmgr.RequireScope(usrmgr.ScopeUsersRead), usrmgr.GetUserHandler)
+	r.PUT("/user", usrmgr.RequireScope(usrmgr.ScopeUsersWrite), usrmgr.UpdateUserHandler)
+	r.DELETE("/user", usrmgr.RequireScope(usrmgr.ScopeUsersWrite), usrmgr.DeleteUserHandler)
+	r.GET("/verify", usrmgr.VerifyEmailHandler)
+	r.POST("/verify", usrmgr.VerifyEmailHandler)
+	r.POST("/verify/resend", usrmgr.ResendVerificationHandler)
+	r.POST("/login", usrmgr.LoginHandler)
+	r.POST("/login/mfa", usrmgr.LoginMFAHandler)
+	r.POST("/logout", usrmgr.EnrollmentSessionAuth(), usrmgr.LogoutHandler)
+	r.POST("/mfa/enroll", usrmgr.EnrollmentSessionAuth(), usrmgr.StartMFAEnrollmentHandler)
+	r.POST("/mfa/activate", usrmgr.EnrollmentSessionAuth(), usrmgr.ActivateMFAHandler)
+	r.POST("/password/forgot", usrmgr.ForgotPasswordHandler)
+	r.GET("/password/reset", usrmgr.ResetPasswordFormHandler)
+	r.POST("/password/reset", usrmgr.ResetPasswordHandler)
+	r.GET("/.well-known/openid-configuration", usrmgr.DiscoveryHandler)
+	r.GET("/.well-known/jwks.json", usrmgr.JWKSHandler)
+	r.GET("/userinfo", usrmgr.UserInfoHandler)
+	r.POST("/userinfo", usrmgr.UserInfoHandler)
+	r.GET("/user/order", usrmgr.RequireScope(usrmgr.ScopeUsersRead), usrmgr.GetUserOrderHandler)
 
 	serverPort := utils.GetEnvParam("SERVICE_PORT", "8082")
 
+	tlsConfig, err := usrmgr.HTTPServerTLSConfig()
+	if err != nil {
+		logs.FromContext(context.Background()).Fatalf("http tls configuration error: %v", err)
+	}
+
 	server = &http.Server{
-		Addr:    ":" + serverPort,
-		Handler: r,
+		Addr:      ":" + serverPort,
+		Handler:   r,
+		TLSConfig: tlsConfig,
 	}
 
 	// Initializing the server in a goroutine so that
 	// it won't block the graceful shutdown handling below
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		var err error
+		if tlsConfig != nil {
+			// the certificate comes from TLSConfig.GetCertificate
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logs.FromContext(context.Background()).Fatalf("listen: %s", err)
 		}
 	}()
 
+	// The admin listener is kept off SERVICE_PORT and bound to localhost by
+	// default as it exposes pprof and runtime controls.
+	if utils.GetEnvBoolParam("ADMIN_ENABLE", true) {
+		adminAddr := utils.GetEnvParam("ADMIN_ADDR", "127.0.0.1:8092")
+		adminToken := utils.GetEnvParam("ADMIN_TOKEN", "")
+		if err := admin.CheckListener(adminAddr, adminToken); err != nil {
+			logs.FromContext(context.Background()).Fatalf("admin listener configuration error: %v", err)
+		}
+		adminRouter := admin.NewRouter(adminToken)
+		// any local process can reach a listener without a token, it only
+		// gets the diagnostics and never the user administration
+		if adminToken != "" {
+			usrmgr.RegisterAdminRoutes(adminRouter)
+		} else {
+			logs.FromContext(context.Background()).Warn("ADMIN_TOKEN not set, user administration endpoints are disabled")
+		}
+		adminServer = &http.Server{
+			Addr:    adminAddr,
+			Handler: adminRouter,
+		}
+		go func() {
+			logs.FromContext(context.Background()).Infof("admin listener on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logs.FromContext(context.Background()).Errorf("admin listen: %s", err)
+			}
+		}()
+	}
+
 	shutdownServer()
 
-	log.Println("Server exiting")
+	logs.FromContext(context.Background()).Info("Server exiting")
 
 }
 
@@ -90,21 +212,38 @@ func shutdownServer() {
 	// kill -9 is syscall.SIGKILL but can't be catch, so don't need add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	logs.FromContext(context.Background()).Info("Shutting down server...")
 
-	//close mongo driver
-	usrmgr.CloseMongoDB(client, ctx, cFund)
-	//close kafka connection
-	usrmgr.CloseKafka()
-
-	otelShutdown()
-
-	// The context is used to inform the server it has 5 seconds to finish
-	// the request it is currently handling
+	// The context is used to inform the server it has 10 seconds to finish
+	// the request it is currently handling. The servers stop first so no new
+	// events are produced while the kafka queue is flushed.
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			logs.FromContext(ctx).Error("admin server forced to shutdown: ", err)
+		}
+	}
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown: ", err)
+		logs.FromContext(ctx).Error("Server forced to shutdown: ", err)
+	}
+
+	if purgeStop != nil {
+		purgeStop()
+	}
+	if keyRotateStop != nil {
+		keyRotateStop()
+	}
+	if encryptionStop != nil {
+		encryptionStop()
 	}
 
+	//flush queued events and close kafka connection
+	usrmgr.CloseKafka()
+	//close mongo driver
+	usrmgr.CloseMongoDB(client, ctx, cFund)
+
+	otelShutdown()
+	metricShutdown()
+	logShutdown()
 }
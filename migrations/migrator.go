@@ -0,0 +1,294 @@
+package migrations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	appliedCollection = "schema_migrations"
+	lockCollection    = "schema_lock"
+	lockID            = "migrations"
+)
+
+var errLockLost = errors.New("migration lock taken over by another instance")
+
+// Migration is one versioned schema change. Versions are applied in
+// ascending order and must never be reused once released.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// Status reports whether a migration has been applied.
+type Status struct {
+	Version     int        `json:"version"`
+	Description string     `json:"description"`
+	Applied     bool       `json:"applied"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty"`
+}
+
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Migrator applies migrations to a database. A lock document makes sure
+// only one replica migrates at a time; the others wait for it.
+type Migrator struct {
+	db         *mongo.Database
+	migrations []Migration
+	owner      string
+	lockTTL    time.Duration
+}
+
+// New returns a migrator for db. lockTTL bounds how long a crashed replica
+// can hold the lock; a running replica renews it.
+func New(db *mongo.Database, migrations []Migration, lockTTL time.Duration) *Migrator {
+	if lockTTL <= 0 {
+		lockTTL = 5 * time.Minute
+	}
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	return &Migrator{
+		db:         db,
+		migrations: sorted,
+		owner:      lockOwner(),
+		lockTTL:    lockTTL,
+	}
+}
+
+// Up applies every pending migration in version order.
+func (m *Migrator) Up(ctx context.Context) error {
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		if err := m.renewLock(ctx); err != nil {
+			return fmt.Errorf("migration %d not applied: %w", mig.Version, err)
+		}
+		logs.FromContext(ctx).Infof("applying migration %d: %s", mig.Version, mig.Description)
+		if err := mig.Up(ctx, m.db); err != nil {
+			return fmt.Errorf("migration %d failed: %w", mig.Version, err)
+		}
+		_, err := m.db.Collection(appliedCollection).InsertOne(ctx, appliedMigration{
+			Version:     mig.Version,
+			Description: mig.Description,
+			AppliedAt:   time.Now().UTC(),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to record migration %d: %w", mig.Version, err)
+		}
+	}
+	return nil
+}
+
+// Down reverts the last steps applied migrations, newest first.
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	ctx, unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		if err := m.renewLock(ctx); err != nil {
+			return fmt.Errorf("migration %d not reverted: %w", mig.Version, err)
+		}
+		logs.FromContext(ctx).Infof("reverting migration %d: %s", mig.Version, mig.Description)
+		if mig.Down == nil {
+			return fmt.Errorf("migration %d can not be reverted", mig.Version)
+		}
+		if err := mig.Down(ctx, m.db); err != nil {
+			return fmt.Errorf("revert of migration %d failed: %w", mig.Version, err)
+		}
+		if _, err := m.db.Collection(appliedCollection).DeleteOne(ctx, bson.M{"_id": mig.Version}); err != nil {
+			return fmt.Errorf("unable to record revert of migration %d: %w", mig.Version, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// Status lists every known migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		s := Status{Version: mig.Version, Description: mig.Description}
+		if a, ok := applied[mig.Version]; ok {
+			appliedAt := a.AppliedAt
+			s.Applied = true
+			s.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	cursor, err := m.db.Collection(appliedCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var list []appliedMigration
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]appliedMigration, len(list))
+	for _, a := range list {
+		applied[a.Version] = a
+	}
+	return applied, nil
+}
+
+// lock takes the migration lock, waiting while another replica holds it.
+// An expired lock is taken over, so a replica that died while migrating
+// does not block the others forever. The lock is renewed in the background
+// until released; the returned context is canceled when that fails, so a
+// replica whose lock was taken over stops migrating.
+func (m *Migrator) lock(ctx context.Context) (context.Context, func(), error) {
+	locks := m.db.Collection(lockCollection)
+
+	for {
+		now := time.Now().UTC()
+		filter := bson.M{
+			"_id": lockID,
+			"$or": bson.A{
+				bson.M{"expiresAt": bson.M{"$lt": now}},
+				bson.M{"owner": m.owner},
+			},
+		}
+		update := bson.M{"$set": bson.M{"owner": m.owner, "lockedAt": now, "expiresAt": now.Add(m.lockTTL)}}
+
+		_, err := locks.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			break
+		}
+		// the upsert collides with the lock document of another owner
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, nil, fmt.Errorf("unable to take migration lock: %w", err)
+		}
+
+		logs.FromContext(ctx).Info("waiting for migration lock held by another instance")
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("unable to take migration lock: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := keepLock(lockCtx, m.lockTTL/3, m.lockTTL, m.renewLock); err != nil {
+			logs.FromContext(ctx).Errorf("stopping migrations: %v", err)
+			cancel()
+		}
+	}()
+
+	return lockCtx, func() {
+		cancel()
+		<-stopped
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := locks.DeleteOne(ctx, bson.M{"_id": lockID, "owner": m.owner}); err != nil {
+			logs.FromContext(ctx).Errorf("unable to release migration lock: %v", err)
+		}
+	}, nil
+}
+
+// renewLock extends the lock held by this migrator. It fails with
+// errLockLost once another replica has taken the lock over.
+func (m *Migrator) renewLock(ctx context.Context) error {
+	res, err := m.db.Collection(lockCollection).UpdateOne(ctx,
+		bson.M{"_id": lockID, "owner": m.owner},
+		bson.M{"$set": bson.M{"expiresAt": time.Now().UTC().Add(m.lockTTL)}})
+	if err != nil {
+		return fmt.Errorf("unable to renew migration lock: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return errLockLost
+	}
+	return nil
+}
+
+// keepLock calls renew every interval until ctx is done. Failed renewals
+// are retried until the lock, valid for ttl after the last renewal, has
+// expired; a lost lock is reported right away.
+func keepLock(ctx context.Context, interval, ttl time.Duration, renew func(context.Context) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		err := renew(ctx)
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case ctx.Err() != nil:
+			return nil
+		case errors.Is(err, errLockLost):
+			return err
+		case time.Since(renewed) >= ttl:
+			return fmt.Errorf("migration lock expired: %w", err)
+		default:
+			logs.FromContext(ctx).Warn(err)
+		}
+	}
+}
+
+func lockOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
@@ -0,0 +1,104 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestKeepLockRenews(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var renewals int32
+	done := make(chan error)
+	go func() {
+		done <- keepLock(ctx, time.Millisecond, time.Minute, func(context.Context) error {
+			if atomic.AddInt32(&renewals, 1) == 5 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("keepLock = %v, want nil once released", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepLock did not stop")
+	}
+	if atomic.LoadInt32(&renewals) < 5 {
+		t.Errorf("%d renewals", renewals)
+	}
+}
+
+func TestKeepLockLost(t *testing.T) {
+	err := keepLock(context.Background(), time.Millisecond, time.Minute, func(context.Context) error {
+		return errLockLost
+	})
+	if !errors.Is(err, errLockLost) {
+		t.Errorf("keepLock = %v, want %v", err, errLockLost)
+	}
+}
+
+func TestKeepLockRetriesUntilExpired(t *testing.T) {
+	unavailable := errors.New("server unavailable")
+	var calls int32
+	start := time.Now()
+	err := keepLock(context.Background(), time.Millisecond, 30*time.Millisecond, func(context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return unavailable
+	})
+	if !errors.Is(err, unavailable) {
+		t.Errorf("keepLock = %v, want %v", err, unavailable)
+	}
+	if time.Since(start) < 30*time.Millisecond || calls < 2 {
+		t.Errorf("gave up after %v and %d attempts, want retries until the lock expired", time.Since(start), calls)
+	}
+}
+
+func TestAll(t *testing.T) {
+	c := Collections{
+		Users: "users", DeadLetters: "dead_letters", Tokens: "tokens", Sessions: "sessions",
+		Attempts: "attempts", APIKeys: "api_keys", SigningKeys: "signing_keys", Audit: "audit",
+		DataKeys: "data_keys", Erasures: "erasures",
+	}
+	all := All(c)
+	for i, mig := range all {
+		if mig.Version != i+1 {
+			t.Errorf("migration %d has version %d, versions must be consecutive", i, mig.Version)
+		}
+		if mig.Description == "" || mig.Up == nil || mig.Down == nil {
+			t.Errorf("migration %d is incomplete", mig.Version)
+		}
+	}
+
+	sorted := New(nil, []Migration{{Version: 2}, {Version: 1}}, 0)
+	if sorted.migrations[0].Version != 1 || sorted.lockTTL <= 0 {
+		t.Errorf("New did not sort migrations or default the lock ttl: %+v", sorted)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	profile := usersProfileSchema()["properties"].(bson.M)
+	encrypted := usersEncryptedSchema()["properties"].(bson.M)
+	if _, ok := profile["phone"].(bson.M)["pattern"]; !ok {
+		t.Error("profile schema lost the phone pattern")
+	}
+	if _, ok := encrypted["phone"].(bson.M)["pattern"]; ok {
+		t.Error("encrypted schema keeps the phone pattern")
+	}
+
+	for name, schema := range map[string]bson.M{"data keys": dataKeysSchema(), "erasures": erasuresSchema()} {
+		properties := schema["properties"].(bson.M)
+		for _, field := range schema["required"].(bson.A) {
+			if _, ok := properties[field.(string)]; !ok {
+				t.Errorf("%s schema requires undescribed field %s", name, field)
+			}
+		}
+	}
+}
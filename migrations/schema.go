@@ -0,0 +1,366 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections names the collections the migrations operate on.
+type Collections struct {
+	Users       string
+	DeadLetters string
+	Tokens      string
+	Sessions    string
+	Attempts    string
+	APIKeys     string
+	SigningKeys string
+	Audit       string
+	DataKeys    string
+	Erasures    string
+}
+
+// All returns the migrations of the service. New migrations are appended
+// with the next free version; released ones must not be edited.
+func All(c Collections) []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "create users indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Users).Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetName("id_unique").SetUnique(true)},
+					{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetName("name")},
+					{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetName("created_at")},
+				})
+				return err
+			},
+			Down: dropIndexes(c.Users, "id_unique", "name", "created_at"),
+		},
+		{
+			Version:     2,
+			Description: "validate users documents",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return setValidator(ctx, db, c.Users, usersSchema())
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				return setValidator(ctx, db, c.Users, nil)
+			},
+		},
+		{
+			Version:     3,
+			Description: "create dead letters indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.DeadLetters).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "status", Value: 1}, {Key: "failedAt", Value: 1}},
+					Options: options.Index().SetName("status_failed_at"),
+				})
+				return err
+			},
+			Down: dropIndexes(c.DeadLetters, "status_failed_at"),
+		},
+		{
+			Version:     4,
+			Description: "backfill users version",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Users).UpdateMany(ctx,
+					bson.M{"version": bson.M{"$exists": false}},
+					bson.M{"$set": bson.M{"version": 1}})
+				return err
+			},
+			// versions set since then can not be told apart, leave them
+			Down: func(ctx context.Context, db *mongo.Database) error { return nil },
+		},
+		{
+			Version:     5,
+			Description: "index deleted users",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Users).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "deletedAt", Value: 1}},
+					Options: options.Index().SetName("deleted_at").SetSparse(true),
+				})
+				return err
+			},
+			Down: dropIndexes(c.Users, "deleted_at"),
+		},
+		{
+			Version:     6,
+			Description: "index users profile",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				users := db.Collection(c.Users)
+				_, err := users.UpdateMany(ctx,
+					bson.M{"status": bson.M{"$exists": false}},
+					bson.M{"$set": bson.M{"status": "active"}})
+				if err != nil {
+					return err
+				}
+				_, err = users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{
+						Keys: bson.D{{Key: "email", Value: 1}},
+						Options: options.Index().SetName("email_unique").SetUnique(true).
+							SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+					},
+					{Keys: bson.D{{Key: "status", Value: 1}}, Options: options.Index().SetName("status")},
+					{Keys: bson.D{{Key: "labels", Value: 1}}, Options: options.Index().SetName("labels")},
+				})
+				return err
+			},
+			Down: dropIndexes(c.Users, "email_unique", "status", "labels"),
+		},
+		{
+			Version:     7,
+			Description: "validate users profile",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return setValidator(ctx, db, c.Users, usersProfileSchema())
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				return setValidator(ctx, db, c.Users, usersSchema())
+			},
+		},
+		{
+			Version:     8,
+			Description: "create user tokens indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Tokens).Indexes().CreateMany(ctx, []mongo.IndexModel{
+					// expired tokens are removed by the server
+					{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0)},
+					{
+						Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "purpose", Value: 1}, {Key: "createdAt", Value: 1}},
+						Options: options.Index().SetName("user_purpose_created_at"),
+					},
+				})
+				return err
+			},
+			Down: dropIndexes(c.Tokens, "expires_at_ttl", "user_purpose_created_at"),
+		},
+		{
+			Version:     9,
+			Description: "create sessions indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Sessions).Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0)},
+					{Keys: bson.D{{Key: "userId", Value: 1}}, Options: options.Index().SetName("user_id")},
+				})
+				return err
+			},
+			Down: dropIndexes(c.Sessions, "expires_at_ttl", "user_id"),
+		},
+		{
+			Version:     10,
+			Description: "expire login attempts",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Attempts).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+					Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+				})
+				return err
+			},
+			Down: dropIndexes(c.Attempts, "expires_at_ttl"),
+		},
+		{
+			Version:     11,
+			Description: "create api keys indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.APIKeys).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "principal", Value: 1}, {Key: "createdAt", Value: 1}},
+					Options: options.Index().SetName("principal_created_at"),
+				})
+				return err
+			},
+			Down: dropIndexes(c.APIKeys, "principal_created_at"),
+		},
+		{
+			Version:     12,
+			Description: "expire retired signing keys",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.SigningKeys).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+					Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+				})
+				return err
+			},
+			Down: dropIndexes(c.SigningKeys, "expires_at_ttl"),
+		},
+		{
+			Version:     13,
+			Description: "create audit log indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				_, err := db.Collection(c.Audit).Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{Keys: bson.D{{Key: "time", Value: 1}}, Options: options.Index().SetName("time")},
+					{Keys: bson.D{{Key: "targetType", Value: 1}, {Key: "targetId", Value: 1}, {Key: "_id", Value: -1}}, Options: options.Index().SetName("target")},
+					{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: -1}}, Options: options.Index().SetName("actor")},
+				})
+				return err
+			},
+			Down: dropIndexes(c.Audit, "time", "target", "actor"),
+		},
+		{
+			Version:     14,
+			Description: "allow encrypted users profile fields",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return setValidator(ctx, db, c.Users, usersEncryptedSchema())
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				return setValidator(ctx, db, c.Users, usersProfileSchema())
+			},
+		},
+		{
+			Version:     15,
+			Description: "create data keys indexes and validator",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				if err := setValidator(ctx, db, c.DataKeys, dataKeysSchema()); err != nil {
+					return err
+				}
+				_, err := db.Collection(c.DataKeys).Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{Keys: bson.D{{Key: "createdAt", Value: 1}}, Options: options.Index().SetName("created_at")},
+					{Keys: bson.D{{Key: "masterKeyId", Value: 1}}, Options: options.Index().SetName("master_key_id")},
+				})
+				return err
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				if err := dropIndexes(c.DataKeys, "created_at", "master_key_id")(ctx, db); err != nil {
+					return err
+				}
+				return setValidator(ctx, db, c.DataKeys, nil)
+			},
+		},
+		{
+			Version:     16,
+			Description: "create erasures indexes and validator",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				if err := setValidator(ctx, db, c.Erasures, erasuresSchema()); err != nil {
+					return err
+				}
+				_, err := db.Collection(c.Erasures).Indexes().CreateMany(ctx, []mongo.IndexModel{
+					{Keys: bson.D{{Key: "startedAt", Value: 1}}, Options: options.Index().SetName("started_at")},
+					// erasures that were interrupted before completing
+					{
+						Keys:    bson.D{{Key: "completedAt", Value: 1}},
+						Options: options.Index().SetName("completed_at").SetSparse(true),
+					},
+				})
+				return err
+			},
+			Down: func(ctx context.Context, db *mongo.Database) error {
+				if err := dropIndexes(c.Erasures, "started_at", "completed_at")(ctx, db); err != nil {
+					return err
+				}
+				return setValidator(ctx, db, c.Erasures, nil)
+			},
+		},
+	}
+}
+
+func usersSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": bson.A{"id", "name"},
+		"properties": bson.M{
+			"id":   bson.M{"bsonType": "string"},
+			"name": bson.M{"bsonType": "string"},
+		},
+	}
+}
+
+func usersProfileSchema() bson.M {
+	schema := usersSchema()
+	properties := schema["properties"].(bson.M)
+	properties["email"] = bson.M{"bsonType": "string"}
+	properties["phone"] = bson.M{"bsonType": "string", "pattern": `^\+[1-9][0-9]{1,14}$`}
+	properties["displayName"] = bson.M{"bsonType": "string", "maxLength": 100}
+	properties["locale"] = bson.M{"bsonType": "string"}
+	properties["timezone"] = bson.M{"bsonType": "string"}
+	properties["status"] = bson.M{"enum": bson.A{"active", "suspended", "pending"}}
+	properties["labels"] = bson.M{"bsonType": "array", "items": bson.M{"bsonType": "string"}, "maxItems": 20}
+	properties["metadata"] = bson.M{"bsonType": "object"}
+	properties["emailVerified"] = bson.M{"bsonType": "bool"}
+	return schema
+}
+
+// usersEncryptedSchema drops the format checks of the profile fields that
+// may hold ciphertext. The service still validates them before encrypting.
+func usersEncryptedSchema() bson.M {
+	schema := usersProfileSchema()
+	properties := schema["properties"].(bson.M)
+	properties["phone"] = bson.M{"bsonType": "string"}
+	properties["displayName"] = bson.M{"bsonType": "string"}
+	return schema
+}
+
+// dataKeysSchema describes the wrapped data keys. A key that can not be
+// unwrapped makes every value encrypted with it unreadable.
+func dataKeysSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": bson.A{"_id", "masterKeyId", "wrappedKey", "createdAt"},
+		"properties": bson.M{
+			"_id":         bson.M{"bsonType": "string"},
+			"masterKeyId": bson.M{"bsonType": "string"},
+			"wrappedKey":  bson.M{"bsonType": "binData"},
+			"createdAt":   bson.M{"bsonType": "date"},
+			"rotatedAt":   bson.M{"bsonType": "date"},
+		},
+	}
+}
+
+func erasuresSchema() bson.M {
+	return bson.M{
+		"bsonType": "object",
+		"required": bson.A{"_id", "requestedBy", "startedAt"},
+		"properties": bson.M{
+			"_id":         bson.M{"bsonType": "string"},
+			"requestedBy": bson.M{"bsonType": "string"},
+			"startedAt":   bson.M{"bsonType": "date"},
+			"completedAt": bson.M{"bsonType": "date"},
+			"removed":     bson.M{"bsonType": "object"},
+			"proof":       bson.M{"bsonType": "string"},
+			"auditSeq":    bson.M{"bsonType": "long"},
+		},
+	}
+}
+
+func dropIndexes(collection string, names ...string) func(ctx context.Context, db *mongo.Database) error {
+	return func(ctx context.Context, db *mongo.Database) error {
+		for _, name := range names {
+			if _, err := db.Collection(collection).Indexes().DropOne(ctx, name); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// setValidator installs schema as the $jsonSchema validator of collection,
+// creating the collection when needed. A nil schema removes validation.
+// Validation is moderate so existing documents that predate the schema can
+// still be updated.
+func setValidator(ctx context.Context, db *mongo.Database, collection string, schema bson.M) error {
+	if err := db.CreateCollection(ctx, collection); err != nil && !isNamespaceExists(err) {
+		return err
+	}
+
+	validator := bson.M{}
+	level := "off"
+	if schema != nil {
+		validator = bson.M{"$jsonSchema": schema}
+		level = "moderate"
+	}
+	return db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: level},
+	}).Err()
+}
+
+func isNamespaceExists(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 48
+}
+
+func isNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 27 || cmdErr.Code == 26)
+}
@@ -0,0 +1,149 @@
+package otelsvc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/subhamproject/user-service/buildinfo"
+	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/utils"
+)
+
+// Supported values for OTEL_TRACES_EXPORTER.
+const (
+	ExporterNone     = "none"
+	ExporterStdout   = "stdout"
+	ExporterOtlpGrpc = "otlpgrpc"
+	ExporterOtlpHttp = "otlphttp"
+)
+
+// CollectorConfig describes how to reach the OpenTelemetry collector.
+type CollectorConfig struct {
+	// GrpcEndpoint is the host:port of the OTLP gRPC receiver.
+	GrpcEndpoint string
+	// HttpEndpoint is the host:port of the OTLP HTTP receiver.
+	HttpEndpoint string
+	// Insecure disables TLS towards the collector.
+	Insecure bool
+	// CACertFile verifies the collector certificate, the system pool is used when empty.
+	CACertFile string
+	// ClientCertFile and ClientKeyFile enable mutual TLS when both are set.
+	ClientCertFile string
+	ClientKeyFile  string
+	// Headers are sent with every export request, e.g. an api key.
+	Headers map[string]string
+}
+
+// ResourceConfig holds the attributes describing this service instance.
+type ResourceConfig struct {
+	ServiceName string
+	Environment string
+	Version     string
+	// Attributes are additional key/value pairs added to the resource.
+	Attributes map[string]string
+}
+
+// TracerConfig configures the tracer provider built by InitTracerProvider.
+type TracerConfig struct {
+	// Exporters lists the span exporters to install, see the Exporter constants.
+	Exporters []string
+	// Sampler is one of always_on, always_off, traceidratio, ratelimited or
+	// their parentbased_ variants.
+	Sampler string
+	// SamplerArg is the ratio for traceidratio or spans per second for ratelimited.
+	SamplerArg string
+	Collector  CollectorConfig
+	Resource   ResourceConfig
+}
+
+// LoadCollectorConfig reads the collector settings from the environment.
+func LoadCollectorConfig() CollectorConfig {
+	return CollectorConfig{
+		GrpcEndpoint:   utils.GetEnvParam("OTEL_COLLECTOR_URL", "localhost:4317"),
+		HttpEndpoint:   utils.GetEnvParam("OTEL_COLLECTOR_HTTP_URL", "localhost:4318"),
+		Insecure:       utils.GetEnvBoolParam("OTEL_EXPORTER_OTLP_INSECURE", true),
+		CACertFile:     utils.GetEnvParam("OTEL_EXPORTER_OTLP_CA_CERT", ""),
+		ClientCertFile: utils.GetEnvParam("OTEL_EXPORTER_OTLP_CLIENT_CERT", ""),
+		ClientKeyFile:  utils.GetEnvParam("OTEL_EXPORTER_OTLP_CLIENT_KEY", ""),
+		Headers:        parseKeyValues(utils.GetEnvParam("OTEL_EXPORTER_OTLP_HEADERS", "")),
+	}
+}
+
+// LoadResourceConfig reads the resource attributes from the environment.
+func LoadResourceConfig() ResourceConfig {
+	return ResourceConfig{
+		ServiceName: utils.GetEnvParam("OTEL_SERVICE_NAME", consts.ServiceName),
+		Environment: utils.GetEnvParam("DEPLOYMENT_ENVIRONMENT", consts.Environment),
+		Version:     utils.GetEnvParam("SERVICE_VERSION", buildinfo.Get().Version),
+		Attributes:  parseKeyValues(utils.GetEnvParam("OTEL_RESOURCE_ATTRIBUTES", "")),
+	}
+}
+
+// LoadTracerConfig reads the tracing settings from the environment. Without
+// OTEL_TRACES_EXPORTER spans go to the collector when OTEL_ENABLE is set, to
+// stdout in DEV_MODE and nowhere otherwise.
+func LoadTracerConfig() TracerConfig {
+	dflt := ExporterNone
+	if utils.GetEnvBoolParam("OTEL_ENABLE", false) {
+		dflt = ExporterOtlpGrpc
+	} else if utils.GetEnvBoolParam("DEV_MODE", true) {
+		dflt = ExporterStdout
+	}
+
+	var exporters []string
+	for _, e := range strings.Split(utils.GetEnvParam("OTEL_TRACES_EXPORTER", dflt), ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+			exporters = append(exporters, e)
+		}
+	}
+
+	return TracerConfig{
+		Exporters:  exporters,
+		Sampler:    strings.ToLower(utils.GetEnvParam("OTEL_TRACES_SAMPLER", "parentbased_always_on")),
+		SamplerArg: utils.GetEnvParam("OTEL_TRACES_SAMPLER_ARG", ""),
+		Collector:  LoadCollectorConfig(),
+		Resource:   LoadResourceConfig(),
+	}
+}
+
+// tlsConfig builds the client TLS configuration used towards the collector.
+func (c CollectorConfig) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CACertFile != "" {
+		pem, err := os.ReadFile(c.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read collector ca cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACertFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.ClientCertFile != "" && c.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load collector client cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// parseKeyValues parses the "k1=v1,k2=v2" format used by the OTEL_* variables.
+func parseKeyValues(s string) map[string]string {
+	kv := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			continue
+		}
+		kv[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return kv
+}
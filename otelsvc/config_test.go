@@ -0,0 +1,94 @@
+package otelsvc
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTracerConfigExporters(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"dev mode", map[string]string{"DEV_MODE": "true"}, []string{ExporterStdout}},
+		{"production", map[string]string{"DEV_MODE": "false"}, []string{ExporterNone}},
+		{"otel enabled", map[string]string{"OTEL_ENABLE": "true"}, []string{ExporterOtlpGrpc}},
+		{"explicit list", map[string]string{"OTEL_TRACES_EXPORTER": " OTLPHTTP, stdout,,"}, []string{ExporterOtlpHttp, ExporterStdout}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OTEL_ENABLE", "false")
+			t.Setenv("DEV_MODE", "true")
+			unsetenv(t, "OTEL_TRACES_EXPORTER")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if got := LoadTracerConfig().Exporters; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exporters %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTracerConfigSampler(t *testing.T) {
+	t.Setenv("OTEL_TRACES_SAMPLER", "ParentBased_TraceIDRatio")
+	t.Setenv("OTEL_TRACES_SAMPLER_ARG", "0.1")
+	cfg := LoadTracerConfig()
+	if cfg.Sampler != "parentbased_traceidratio" || cfg.SamplerArg != "0.1" {
+		t.Errorf("sampler %q arg %q", cfg.Sampler, cfg.SamplerArg)
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	got := parseKeyValues(" api-key = secret ,team=users,broken,=empty,x=a=b")
+	want := map[string]string{"api-key": "secret", "team": "users", "x": "a=b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := parseKeyValues(""); len(got) != 0 {
+		t.Errorf("empty input gave %v", got)
+	}
+}
+
+func TestCollectorTLSConfigErrors(t *testing.T) {
+	if _, err := (CollectorConfig{CACertFile: "/does/not/exist"}).tlsConfig(); err == nil {
+		t.Error("missing ca: want an error")
+	}
+	if _, err := (CollectorConfig{ClientCertFile: "/does/not/exist", ClientKeyFile: "/does/not/exist"}).tlsConfig(); err == nil {
+		t.Error("missing client certificate: want an error")
+	}
+	cfg, err := CollectorConfig{}.tlsConfig()
+	if err != nil || cfg.RootCAs != nil || len(cfg.Certificates) != 0 {
+		t.Errorf("defaults: %v, %v", cfg, err)
+	}
+}
+
+func TestNewResource(t *testing.T) {
+	res := newResource(ResourceConfig{
+		ServiceName: "user-service",
+		Environment: "test",
+		Version:     "1.2.3",
+		Attributes:  map[string]string{"team": "users"},
+	})
+	attrs := map[string]string{}
+	for _, kv := range res.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	for k, want := range map[string]string{
+		"service.name": "user-service", "service.version": "1.2.3",
+		"deployment.environment": "test", "team": "users",
+	} {
+		if attrs[k] != want {
+			t.Errorf("%s = %q, want %q", k, attrs[k], want)
+		}
+	}
+}
+
+// unsetenv removes key from the environment for the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
@@ -0,0 +1,379 @@
+package otelsvc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// LogExportConfig controls batching and memory usage of the OTLP log hook.
+type LogExportConfig struct {
+	// QueueSize is the maximum number of records buffered in memory. Records
+	// logged while the queue is full are dropped.
+	QueueSize int
+	// BatchSize is the maximum number of records sent in one export call.
+	BatchSize int
+	// BatchTimeout is the longest a record waits before its batch is sent.
+	BatchTimeout time.Duration
+	// ExportTimeout bounds a single export call to the collector.
+	ExportTimeout time.Duration
+}
+
+// LogHook is a logrus hook that ships log records to an OpenTelemetry
+// collector over OTLP gRPC. Records carry the service resource and the
+// trace/span ids of the span active in the entry context.
+type LogHook struct {
+	cfg      LogExportConfig
+	conn     *grpc.ClientConn
+	client   collogspb.LogsServiceClient
+	headers  metadata.MD
+	resource *resourcepb.Resource
+	queue    chan *logspb.LogRecord
+	flush    chan chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	once     sync.Once
+	dropped  uint64
+	failing  bool
+}
+
+// fatalFlushTimeout bounds how long a fatal or panic record holds up the
+// caller while it is exported, the process exits right after.
+const fatalFlushTimeout = 3 * time.Second
+
+// InitLogProvider attaches an OTLP log hook to the service logger so log
+// records are shipped to the collector alongside traces. The returned
+// function flushes pending records and must be called on shutdown.
+func InitLogProvider(collector CollectorConfig, res ResourceConfig, otelEnable bool) func() {
+	if !otelEnable {
+		return func() {}
+	}
+
+	cfg := LogExportConfig{
+		QueueSize:     utils.GetEnvIntParam("OTEL_LOGS_QUEUE_SIZE", 2048),
+		BatchSize:     utils.GetEnvIntParam("OTEL_LOGS_BATCH_SIZE", 512),
+		BatchTimeout:  utils.GetEnvDurationParam("OTEL_LOGS_BATCH_TIMEOUT", 5*time.Second),
+		ExportTimeout: utils.GetEnvDurationParam("OTEL_LOGS_EXPORT_TIMEOUT", 10*time.Second),
+	}
+	hook, err := NewLogHook(collector, newResource(res), cfg)
+	if err != nil {
+		reportErr(err, "failed to create otel log exporter")
+		return func() {}
+	}
+	logs.Log.AddHook(hook)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		reportErr(hook.Shutdown(ctx), "failed to shutdown log exporter")
+	}
+}
+
+// NewLogHook dials the collector gRPC endpoint and starts the background
+// batcher. The connection is established lazily so a collector that is down
+// does not block startup.
+func NewLogHook(collector CollectorConfig, res *resource.Resource, cfg LogExportConfig) (*LogHook, error) {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 2048
+	}
+	if cfg.BatchSize <= 0 || cfg.BatchSize > cfg.QueueSize {
+		cfg.BatchSize = cfg.QueueSize
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = 5 * time.Second
+	}
+	if cfg.ExportTimeout <= 0 {
+		cfg.ExportTimeout = 10 * time.Second
+	}
+
+	creds := insecure.NewCredentials()
+	if !collector.Insecure {
+		tlsCfg, err := collector.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsCfg)
+	}
+
+	conn, err := grpc.Dial(collector.GrpcEndpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	h := &LogHook{
+		cfg:      cfg,
+		conn:     conn,
+		client:   collogspb.NewLogsServiceClient(conn),
+		headers:  metadata.New(collector.Headers),
+		resource: &resourcepb.Resource{Attributes: resourceAttributes(res)},
+		queue:    make(chan *logspb.LogRecord, cfg.QueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.run()
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *LogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook. It never blocks the caller; when the queue
+// is full the record is dropped and counted. Fatal and panic records are
+// the exception: logrus exits or panics once the hooks ran, so they are
+// exported together with everything queued before Fire returns.
+func (h *LogHook) Fire(entry *logrus.Entry) error {
+	rec := toLogRecord(entry)
+	if entry.Level <= logrus.FatalLevel && h.flush != nil {
+		h.flushWith(rec)
+		return nil
+	}
+	select {
+	case h.queue <- rec:
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+	}
+	return nil
+}
+
+// flushWith queues rec and waits up to fatalFlushTimeout for the batcher to
+// export the queue.
+func (h *LogHook) flushWith(rec *logspb.LogRecord) {
+	timer := time.NewTimer(fatalFlushTimeout)
+	defer timer.Stop()
+
+	select {
+	case h.queue <- rec:
+	case <-timer.C:
+		atomic.AddUint64(&h.dropped, 1)
+		return
+	}
+	ack := make(chan struct{})
+	select {
+	case h.flush <- ack:
+	case <-timer.C:
+		return
+	}
+	select {
+	case <-ack:
+	case <-timer.C:
+	}
+}
+
+// Dropped returns the number of records discarded because the queue was full
+// or the collector rejected the batch.
+func (h *LogHook) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Shutdown flushes queued records and closes the collector connection.
+func (h *LogHook) Shutdown(ctx context.Context) error {
+	h.once.Do(func() { close(h.done) })
+
+	finished := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return h.conn.Close()
+}
+
+func (h *LogHook) run() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.cfg.BatchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]*logspb.LogRecord, 0, h.cfg.BatchSize)
+	for {
+		select {
+		case rec := <-h.queue:
+			batch = append(batch, rec)
+			if len(batch) >= h.cfg.BatchSize {
+				h.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				h.export(batch)
+				batch = batch[:0]
+			}
+		case ack := <-h.flush:
+			batch = h.drain(batch)
+			close(ack)
+		case <-h.done:
+			// drain whatever is still queued before exiting
+			h.drain(batch)
+			return
+		}
+	}
+}
+
+// drain exports batch and everything queued, returning the emptied batch.
+func (h *LogHook) drain(batch []*logspb.LogRecord) []*logspb.LogRecord {
+	for {
+		select {
+		case rec := <-h.queue:
+			batch = append(batch, rec)
+			if len(batch) >= h.cfg.BatchSize {
+				h.export(batch)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				h.export(batch)
+			}
+			return batch[:0]
+		}
+	}
+}
+
+func (h *LogHook) export(batch []*logspb.LogRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.ExportTimeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, h.headers)
+
+	records := make([]*logspb.LogRecord, len(batch))
+	copy(records, batch)
+
+	_, err := h.client.Export(ctx, &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: h.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: consts.ServiceName},
+				LogRecords: records,
+			}},
+		}},
+	})
+
+	// Only report state changes, otherwise every failed export would itself
+	// produce a log record for the next batch.
+	if err != nil {
+		atomic.AddUint64(&h.dropped, uint64(len(records)))
+		if !h.failing {
+			h.failing = true
+			reportErr(err, "failed to export logs to collector")
+		}
+		return
+	}
+	if h.failing {
+		h.failing = false
+		logs.FromContext(context.Background()).Infof("log export to collector recovered, %d records dropped so far", h.Dropped())
+	}
+}
+
+func toLogRecord(entry *logrus.Entry) *logspb.LogRecord {
+	rec := &logspb.LogRecord{
+		TimeUnixNano:         uint64(entry.Time.UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		SeverityNumber:       severityNumber(entry.Level),
+		SeverityText:         entry.Level.String(),
+		Body:                 stringValue(entry.Message),
+	}
+
+	for k, v := range entry.Data {
+		rec.Attributes = append(rec.Attributes, &commonpb.KeyValue{Key: k, Value: anyValue(v)})
+	}
+
+	if entry.Context != nil {
+		sc := trace.SpanContextFromContext(entry.Context)
+		if sc.IsValid() {
+			traceID := sc.TraceID()
+			spanID := sc.SpanID()
+			rec.TraceId = traceID[:]
+			rec.SpanId = spanID[:]
+			rec.Flags = uint32(sc.TraceFlags())
+		}
+	}
+	return rec
+}
+
+func severityNumber(lvl logrus.Level) logspb.SeverityNumber {
+	switch lvl {
+	case logrus.TraceLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_TRACE
+	case logrus.DebugLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG
+	case logrus.InfoLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_INFO
+	case logrus.WarnLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_WARN
+	case logrus.ErrorLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_ERROR
+	case logrus.FatalLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL
+	case logrus.PanicLevel:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_FATAL2
+	}
+	return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED
+}
+
+func resourceAttributes(res *resource.Resource) []*commonpb.KeyValue {
+	var attrs []*commonpb.KeyValue
+	iter := res.Iter()
+	for iter.Next() {
+		kv := iter.Attribute()
+		attrs = append(attrs, &commonpb.KeyValue{Key: string(kv.Key), Value: attributeValue(kv.Value)})
+	}
+	return attrs
+}
+
+func attributeValue(v attribute.Value) *commonpb.AnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.AsBool()}}
+	case attribute.INT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.AsInt64()}}
+	case attribute.FLOAT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.AsFloat64()}}
+	}
+	return stringValue(v.Emit())
+}
+
+func anyValue(v interface{}) *commonpb.AnyValue {
+	switch val := v.(type) {
+	case string:
+		return stringValue(val)
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: val}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(val)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: val}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: val}}
+	case error:
+		return stringValue(val.Error())
+	}
+	return stringValue(fmt.Sprint(v))
+}
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
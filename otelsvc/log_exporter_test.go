@@ -0,0 +1,259 @@
+package otelsvc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/trace"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// fakeCollector records the log export requests it receives.
+type fakeCollector struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	mu       sync.Mutex
+	requests []*collogspb.ExportLogsServiceRequest
+	headers  []metadata.MD
+}
+
+func (c *fakeCollector) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+	c.headers = append(c.headers, md)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func (c *fakeCollector) records() []*logspb.LogRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var recs []*logspb.LogRecord
+	for _, req := range c.requests {
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				recs = append(recs, sl.LogRecords...)
+			}
+		}
+	}
+	return recs
+}
+
+func startCollector(t *testing.T) (*fakeCollector, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	collector := &fakeCollector{}
+	collogspb.RegisterLogsServiceServer(srv, collector)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return collector, ln.Addr().String()
+}
+
+func newTestHook(t *testing.T, endpoint string, cfg LogExportConfig) *LogHook {
+	t.Helper()
+	res := resource.NewSchemaless(attribute.String("service.name", "user-service"))
+	hook, err := NewLogHook(CollectorConfig{
+		GrpcEndpoint: endpoint,
+		Insecure:     true,
+		Headers:      map[string]string{"api-key": "k"},
+	}, res, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+// infoEntry returns an info entry; a bare logrus entry is at panic level.
+func infoEntry() *logrus.Entry {
+	e := logrus.NewEntry(logrus.New())
+	e.Level = logrus.InfoLevel
+	return e
+}
+
+func TestLogHookExportsOnShutdown(t *testing.T) {
+	collector, endpoint := startCollector(t)
+	hook := newTestHook(t, endpoint, LogExportConfig{BatchSize: 10, BatchTimeout: time.Hour})
+
+	logger := logrus.New()
+	logger.AddHook(hook)
+	logger.SetOutput(nopWriter{})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(),
+		trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled}))
+	logger.WithContext(ctx).WithField("user", "100").Warn("first")
+	logger.Info("second")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hook.Shutdown(shutdownCtx); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := collector.records()
+	if len(recs) != 2 {
+		t.Fatalf("collector got %d records, want 2", len(recs))
+	}
+	first := recs[0]
+	if first.Body.GetStringValue() != "first" || first.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_WARN {
+		t.Errorf("first record: %v", first)
+	}
+	if !bytes.Equal(first.TraceId, traceID[:]) || !bytes.Equal(first.SpanId, spanID[:]) {
+		t.Errorf("trace context not exported: %x %x", first.TraceId, first.SpanId)
+	}
+	if len(first.Attributes) != 1 || first.Attributes[0].Key != "user" {
+		t.Errorf("attributes: %v", first.Attributes)
+	}
+	if len(recs[1].TraceId) != 0 {
+		t.Error("record without span has a trace id")
+	}
+	if got := collector.headers[0].Get("api-key"); len(got) != 1 || got[0] != "k" {
+		t.Errorf("headers: %v", collector.headers[0])
+	}
+	if hook.Dropped() != 0 {
+		t.Errorf("dropped %d records", hook.Dropped())
+	}
+}
+
+func TestLogHookBatches(t *testing.T) {
+	collector, endpoint := startCollector(t)
+	hook := newTestHook(t, endpoint, LogExportConfig{QueueSize: 100, BatchSize: 3, BatchTimeout: time.Hour})
+	for i := 0; i < 7; i++ {
+		hook.Fire(infoEntry())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hook.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	var sizes []int
+	for _, req := range collector.requests {
+		sizes = append(sizes, len(req.ResourceLogs[0].ScopeLogs[0].LogRecords))
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("batch sizes %v, want [3 3 1]", sizes)
+	}
+}
+
+func TestLogHookExportsFatalRightAway(t *testing.T) {
+	collector, endpoint := startCollector(t)
+	hook := newTestHook(t, endpoint, LogExportConfig{BatchSize: 10, BatchTimeout: time.Hour})
+	t.Cleanup(func() { hook.Shutdown(context.Background()) })
+
+	logger := logrus.New()
+	logger.AddHook(hook)
+	logger.SetOutput(nopWriter{})
+	exited := 0
+	logger.ExitFunc = func(int) {
+		// os.Exit would run now, the records must have been exported
+		exited = len(collector.records())
+	}
+	logger.Info("before")
+	logger.Fatal("dying")
+
+	if exited != 2 {
+		t.Errorf("%d records exported before exiting, want 2", exited)
+	}
+	recs := collector.records()
+	if len(recs) != 2 || recs[1].SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_FATAL {
+		t.Errorf("records %v", recs)
+	}
+
+	func() {
+		defer func() { recover() }()
+		logger.Panic("panicking")
+	}()
+	if recs := collector.records(); len(recs) != 3 {
+		t.Errorf("%d records exported after a panic, want 3", len(recs))
+	}
+}
+
+func TestLogHookDropsWhenQueueIsFull(t *testing.T) {
+	hook := &LogHook{queue: make(chan *logspb.LogRecord, 2)}
+	for i := 0; i < 5; i++ {
+		if err := hook.Fire(infoEntry()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hook.Dropped() != 3 {
+		t.Errorf("dropped %d, want 3", hook.Dropped())
+	}
+}
+
+func TestLogHookCountsFailedExports(t *testing.T) {
+	// nothing listens on the endpoint, exports fail once it is dialed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := ln.Addr().String()
+	ln.Close()
+
+	hook := newTestHook(t, endpoint, LogExportConfig{BatchSize: 10, ExportTimeout: time.Second})
+	hook.Fire(infoEntry())
+	hook.Fire(infoEntry())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	hook.Shutdown(ctx)
+	if hook.Dropped() != 2 {
+		t.Errorf("dropped %d, want 2", hook.Dropped())
+	}
+}
+
+func TestSeverityNumber(t *testing.T) {
+	tests := map[logrus.Level]logspb.SeverityNumber{
+		logrus.TraceLevel: logspb.SeverityNumber_SEVERITY_NUMBER_TRACE,
+		logrus.DebugLevel: logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+		logrus.InfoLevel:  logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		logrus.WarnLevel:  logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+		logrus.ErrorLevel: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+		logrus.FatalLevel: logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+		logrus.PanicLevel: logspb.SeverityNumber_SEVERITY_NUMBER_FATAL2,
+	}
+	for lvl, want := range tests {
+		if got := severityNumber(lvl); got != want {
+			t.Errorf("severityNumber(%s) = %v, want %v", lvl, got, want)
+		}
+	}
+}
+
+func TestAnyValue(t *testing.T) {
+	if got := anyValue(42).GetIntValue(); got != 42 {
+		t.Errorf("int: %d", got)
+	}
+	if got := anyValue(true).GetBoolValue(); !got {
+		t.Error("bool")
+	}
+	if got := anyValue(1.5).GetDoubleValue(); got != 1.5 {
+		t.Errorf("float: %g", got)
+	}
+	if got := anyValue(context.Canceled).GetStringValue(); got != "context canceled" {
+		t.Errorf("error: %q", got)
+	}
+	if got := anyValue([]int{1}).GetStringValue(); got != "[1]" {
+		t.Errorf("other: %q", got)
+	}
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
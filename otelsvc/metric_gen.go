@@ -0,0 +1,87 @@
+package otelsvc
+
+import (
+	"context"
+	"time"
+
+	"github.com/subhamproject/user-service/buildinfo"
+	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc/credentials"
+)
+
+// InitMeterProvider installs a global MeterProvider that periodically pushes
+// metrics to the collector over OTLP gRPC when otelEnable is set, and
+// registers the build_info metric. The returned function flushes pending
+// metrics and must be called on shutdown.
+func InitMeterProvider(collector CollectorConfig, res ResourceConfig, otelEnable bool) func() {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	opts := []sdkmetric.Option{sdkmetric.WithResource(newResource(res))}
+
+	if otelEnable {
+		exp, err := otelMetricExporter(ctx, collector)
+		if err != nil {
+			reportErr(err, "failed to create otel metric exporter")
+		} else {
+			interval := utils.GetEnvDurationParam("OTEL_METRICS_EXPORT_INTERVAL", time.Minute)
+			opts = append(opts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(interval))))
+		}
+	}
+
+	meterProvider := sdkmetric.NewMeterProvider(opts...)
+	global.SetMeterProvider(meterProvider)
+
+	reportErr(registerBuildInfo(meterProvider.Meter(consts.ServiceName)), "failed to register build_info metric")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		reportErr(meterProvider.Shutdown(ctx), "failed to shutdown MeterProvider")
+	}
+}
+
+func otelMetricExporter(ctx context.Context, cfg CollectorConfig) (sdkmetric.Exporter, error) {
+	opts := []otlpmetricgrpc.Option{
+		otlpmetricgrpc.WithEndpoint(cfg.GrpcEndpoint),
+		otlpmetricgrpc.WithHeaders(cfg.Headers),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else {
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// registerBuildInfo publishes a constant build_info gauge whose attributes
+// identify the running build, the usual way to join version information
+// onto other metrics.
+func registerBuildInfo(meter metric.Meter) error {
+	bi := buildinfo.Get()
+	attrs := metric.WithAttributes(
+		attribute.String("version", bi.Version),
+		attribute.String("git_commit", bi.GitCommit),
+		attribute.String("build_time", bi.BuildTime),
+		attribute.String("go_version", bi.GoVersion),
+	)
+
+	_, err := meter.Int64ObservableGauge("build_info",
+		metric.WithDescription("Build information of the running service, always 1"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(1, attrs)
+			return nil
+		}),
+	)
+	return err
+}
@@ -0,0 +1,109 @@
+package otelsvc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newSampler returns the sampler named by name. arg is the sampling ratio
+// for traceidratio and the number of traces per second for ratelimited.
+func newSampler(name, arg string) (tracesdk.Sampler, error) {
+	parentBased := strings.HasPrefix(name, "parentbased_")
+	var root tracesdk.Sampler
+
+	switch strings.TrimPrefix(name, "parentbased_") {
+	case "always_on", "":
+		root = tracesdk.AlwaysSample()
+	case "always_off":
+		root = tracesdk.NeverSample()
+	case "traceidratio":
+		ratio := 1.0
+		if arg != "" {
+			r, err := strconv.ParseFloat(arg, 64)
+			if err != nil || r < 0 || r > 1 {
+				return nil, fmt.Errorf("invalid sampling ratio %q", arg)
+			}
+			ratio = r
+		}
+		root = tracesdk.TraceIDRatioBased(ratio)
+	case "ratelimited":
+		perSecond := 10.0
+		if arg != "" {
+			r, err := strconv.ParseFloat(arg, 64)
+			if err != nil || r <= 0 {
+				return nil, fmt.Errorf("invalid sampling rate %q", arg)
+			}
+			perSecond = r
+		}
+		root = newRateLimitSampler(perSecond)
+	default:
+		return nil, fmt.Errorf("unknown sampler %q", name)
+	}
+
+	if parentBased {
+		return tracesdk.ParentBased(root), nil
+	}
+	return root, nil
+}
+
+// rateLimitSampler samples at most perSecond traces per second using a token
+// bucket that allows a burst of one second worth of traces.
+type rateLimitSampler struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+func newRateLimitSampler(perSecond float64) *rateLimitSampler {
+	burst := math.Max(perSecond, 1)
+	return &rateLimitSampler{
+		perSecond: perSecond,
+		burst:     burst,
+		tokens:    burst,
+		last:      time.Now(),
+	}
+}
+
+// ShouldSample implements tracesdk.Sampler.
+func (s *rateLimitSampler) ShouldSample(p tracesdk.SamplingParameters) tracesdk.SamplingResult {
+	decision := tracesdk.Drop
+	if s.allow() {
+		decision = tracesdk.RecordAndSample
+	}
+	return tracesdk.SamplingResult{
+		Decision:   decision,
+		Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+	}
+}
+
+// Description implements tracesdk.Sampler.
+func (s *rateLimitSampler) Description() string {
+	return fmt.Sprintf("RateLimited{%g}", s.perSecond)
+}
+
+func (s *rateLimitSampler) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.tokens += now.Sub(s.last).Seconds() * s.perSecond
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
@@ -0,0 +1,100 @@
+package otelsvc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewSampler(t *testing.T) {
+	tests := []struct {
+		name, arg string
+		want      string
+		wantErr   bool
+	}{
+		{"", "", "AlwaysOnSampler", false},
+		{"always_on", "", "AlwaysOnSampler", false},
+		{"always_off", "", "AlwaysOffSampler", false},
+		{"traceidratio", "0.25", "TraceIDRatioBased{0.25}", false},
+		{"traceidratio", "", "AlwaysOnSampler", false},
+		{"ratelimited", "5", "RateLimited{5}", false},
+		{"ratelimited", "", "RateLimited{10}", false},
+		{"parentbased_always_on", "", "ParentBased{root:AlwaysOnSampler,remoteParentSampled:AlwaysOnSampler,remoteParentNotSampled:AlwaysOffSampler,localParentSampled:AlwaysOnSampler,localParentNotSampled:AlwaysOffSampler}", false},
+		{"traceidratio", "1.5", "", true},
+		{"traceidratio", "half", "", true},
+		{"ratelimited", "0", "", true},
+		{"ratelimited", "-1", "", true},
+		{"sometimes", "", "", true},
+	}
+	for _, tt := range tests {
+		sampler, err := newSampler(tt.name, tt.arg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newSampler(%q, %q) error = %v, want error %t", tt.name, tt.arg, err, tt.wantErr)
+			continue
+		}
+		if err == nil && sampler.Description() != tt.want {
+			t.Errorf("newSampler(%q, %q) = %s, want %s", tt.name, tt.arg, sampler.Description(), tt.want)
+		}
+	}
+}
+
+func TestRateLimitSamplerAllowsBurstThenRefills(t *testing.T) {
+	s := newRateLimitSampler(2)
+	params := tracesdk.SamplingParameters{ParentContext: context.Background()}
+
+	sampled := 0
+	for i := 0; i < 10; i++ {
+		if s.ShouldSample(params).Decision == tracesdk.RecordAndSample {
+			sampled++
+		}
+	}
+	if sampled != 2 {
+		t.Fatalf("sampled %d of a burst, want 2", sampled)
+	}
+
+	// half a second at 2 per second earns one more trace
+	s.mu.Lock()
+	s.last = s.last.Add(-500 * time.Millisecond)
+	s.mu.Unlock()
+	if s.ShouldSample(params).Decision != tracesdk.RecordAndSample {
+		t.Error("no trace sampled after refill")
+	}
+	if s.ShouldSample(params).Decision != tracesdk.Drop {
+		t.Error("sampled beyond the refilled token")
+	}
+}
+
+func TestRateLimitSamplerBelowOnePerSecond(t *testing.T) {
+	s := newRateLimitSampler(0.5)
+	if !s.allow() {
+		t.Fatal("the first trace must be sampled")
+	}
+	if s.allow() {
+		t.Fatal("second trace sampled right away")
+	}
+	s.mu.Lock()
+	s.last = s.last.Add(-2 * time.Second)
+	s.mu.Unlock()
+	if !s.allow() {
+		t.Error("no trace sampled after two seconds")
+	}
+}
+
+func TestRateLimitSamplerKeepsTraceState(t *testing.T) {
+	ts, err := trace.ParseTraceState("vendor=value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceState: ts,
+	}))
+	res := newRateLimitSampler(1).ShouldSample(tracesdk.SamplingParameters{ParentContext: parent})
+	if res.Tracestate.String() != "vendor=value" {
+		t.Errorf("tracestate %q", res.Tracestate.String())
+	}
+}
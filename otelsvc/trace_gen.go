@@ -2,21 +2,22 @@ package otelsvc
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"time"
 
-	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/buildinfo"
+	"github.com/subhamproject/user-service/logs"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	tracesdk "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/credentials"
 )
 
 // StdoutTraceExporter returns a console exporter.
@@ -29,66 +30,96 @@ func StdoutTraceExporter() (*stdouttrace.Exporter, error) {
 	)
 }
 
-// OtelTraceExporter returns a Otel exporter.
-func OtelTraceExporter(ctx context.Context, url string) (*otlptrace.Exporter, error) {
-	log.Printf("connecting to otel %s", url)
-	conn, err := grpc.DialContext(ctx, url, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	reportErr(err, "failed to create gRPC connection to collector")
+// OtelTraceExporter returns an Otel exporter sending spans to the collector
+// over OTLP gRPC. The connection is made in the background so a collector
+// that is down does not block startup.
+func OtelTraceExporter(ctx context.Context, cfg CollectorConfig) (*otlptrace.Exporter, error) {
+	logs.FromContext(ctx).Infof("connecting to otel %s over grpc", cfg.GrpcEndpoint)
 
-	// Set up a trace exporter
-	traceExporter, err := newExporter(ctx, conn)
-	reportErr(err, "failed to create trace exporter")
-	return traceExporter, nil
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(cfg.GrpcEndpoint),
+		otlptracegrpc.WithHeaders(cfg.Headers),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	} else {
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsCfg)))
+	}
+	return otlptracegrpc.New(ctx, opts...)
 }
 
-func newExporter(ctx context.Context, conn *grpc.ClientConn) (*otlptrace.Exporter, error) {
-	return otlptracegrpc.New(ctx, otlptracegrpc.WithGRPCConn(conn))
-}
+// OtelHttpTraceExporter returns an Otel exporter sending spans to the
+// collector over OTLP HTTP.
+func OtelHttpTraceExporter(ctx context.Context, cfg CollectorConfig) (*otlptrace.Exporter, error) {
+	logs.FromContext(ctx).Infof("connecting to otel %s over http", cfg.HttpEndpoint)
 
-// InitTracerProvider returns an OpenTelemetry InitTracerProvider configured to use
-// the Jaeger exporter that will send spans to the provided url. The returned
-// InitTracerProvider will also use a Resource configured with all the information
-// about the application.
-func InitTracerProvider(url string, otelEnable bool) func() {
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.HttpEndpoint),
+		otlptracehttp.WithHeaders(cfg.Headers),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	} else {
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsCfg))
+	}
+	return otlptracehttp.New(ctx, opts...)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+func newExporter(ctx context.Context, name string, cfg CollectorConfig) (tracesdk.SpanExporter, error) {
+	switch name {
+	case ExporterStdout:
+		return StdoutTraceExporter()
+	case ExporterOtlpGrpc:
+		return OtelTraceExporter(ctx, cfg)
+	case ExporterOtlpHttp:
+		return OtelHttpTraceExporter(ctx, cfg)
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", name)
+}
 
-	// // Create the Jaeger exporter
-	// exp, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(url)))
-	// if err != nil {
-	// 	return nil, err
-	// }
+// InitTracerProvider installs a global OpenTelemetry TracerProvider built
+// from cfg: the configured sampler, one batching span processor per
+// exporter and a Resource describing the application. The returned function
+// flushes remaining spans and must be called on shutdown.
+func InitTracerProvider(cfg TracerConfig) func() {
 
-	stdoutExp, err := StdoutTraceExporter()
-	reportErr(err, "failed to create stdout trace exporter")
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 
-	var tracerProvider *tracesdk.TracerProvider
+	sampler, err := newSampler(cfg.Sampler, cfg.SamplerArg)
+	if err != nil {
+		reportErr(err, "invalid sampler configuration, falling back to parentbased_always_on")
+		sampler = tracesdk.ParentBased(tracesdk.AlwaysSample())
+	}
 
-	resources := resource.NewWithAttributes(
-		semconv.SchemaURL,
-		semconv.ServiceNameKey.String(consts.ServiceName),
-		attribute.String("environment", consts.Environment),
-		attribute.Int64("ID", consts.VersionId),
-	)
+	opts := []tracesdk.TracerProviderOption{
+		tracesdk.WithSampler(sampler),
+		// Record information about this application in a Resource.
+		tracesdk.WithResource(newResource(cfg.Resource)),
+	}
 
-	// Set up a Otel trace exporter if enabled
-	if otelEnable {
-		otelTraceExporter, err := OtelTraceExporter(ctx, url)
-		reportErr(err, "failed to create otel trace exporter")
-		tracerProvider = tracesdk.NewTracerProvider(
-			tracesdk.WithBatcher(stdoutExp),
-			tracesdk.WithBatcher(otelTraceExporter),
-			tracesdk.WithResource(resources),
-		)
-	} else {
-		tracerProvider = tracesdk.NewTracerProvider(
-			// Always be sure to batch in production.
-			tracesdk.WithBatcher(stdoutExp),
-			// Record information about this application in a Resource.
-			tracesdk.WithResource(resources),
-		)
+	for _, name := range cfg.Exporters {
+		if name == ExporterNone {
+			continue
+		}
+		exp, err := newExporter(ctx, name, cfg.Collector)
+		if err != nil {
+			reportErr(err, fmt.Sprintf("failed to create %s trace exporter", name))
+			continue
+		}
+		// Always be sure to batch in production.
+		opts = append(opts, tracesdk.WithBatcher(exp))
 	}
 
+	tracerProvider := tracesdk.NewTracerProvider(opts...)
+
 	// Set the global trace provider
 	otel.SetTracerProvider(tracerProvider)
 
@@ -96,15 +127,37 @@ func InitTracerProvider(url string, otelEnable bool) func() {
 	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
 	otel.SetTextMapPropagator(propagator)
 
+	logs.FromContext(ctx).Infof("tracing initialized, exporters %v, sampler %s", cfg.Exporters, sampler.Description())
+
 	return func() {
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
 		// Shutdown will flush any remaining spans and shut down the exporter.
 		reportErr(tracerProvider.Shutdown(ctx), "failed to shutdown TracerProvider")
-		cancel()
 	}
 }
 
+// newResource describes this application to the telemetry backend. It is
+// shared by the trace and log pipelines so both carry the same attributes.
+func newResource(cfg ResourceConfig) *resource.Resource {
+	bi := buildinfo.Get()
+	attrs := []attribute.KeyValue{
+		semconv.ServiceNameKey.String(cfg.ServiceName),
+		semconv.ServiceVersionKey.String(cfg.Version),
+		semconv.DeploymentEnvironmentKey.String(cfg.Environment),
+		attribute.String("build.git_commit", bi.GitCommit),
+		attribute.String("build.time", bi.BuildTime),
+		attribute.String("build.go_version", bi.GoVersion),
+	}
+	for k, v := range cfg.Attributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
 func reportErr(err error, message string) {
 	if err != nil {
-		log.Printf("%s: %v", message, err)
+		logs.FromContext(context.Background()).Errorf("%s: %v", message, err)
 	}
 }
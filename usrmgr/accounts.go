@@ -0,0 +1,53 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/mailer"
+	"github.com/subhamproject/user-service/utils"
+)
+
+var (
+	mailSender mailer.Mailer
+	publicURL  string
+)
+
+// InitAccounts sets up what the account flows need: the mailer, the token
+// signing secret, the login attempt store and their settings. It must run after InitMongoDB.
+func InitAccounts() error {
+	var err error
+	if mailSender, err = mailer.FromEnv(); err != nil {
+		return err
+	}
+	publicURL = strings.TrimSuffix(utils.GetEnvParam("PUBLIC_URL", "http://localhost:8082"), "/")
+
+	secret, err := utils.GetEnvSecretParam("TOKEN_SECRET", "")
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		if !utils.GetEnvBoolParam("DEV_MODE", true) {
+			return fmt.Errorf("TOKEN_SECRET is required outside DEV_MODE")
+		}
+		// tokens issued before a restart will not verify, which is fine
+		// for development
+		logs.FromContext(context.Background()).Warn("TOKEN_SECRET not set, using a random secret")
+		tokenSecret = make([]byte, 32)
+		if _, err := rand.Read(tokenSecret); err != nil {
+			return err
+		}
+	} else {
+		tokenSecret = []byte(secret)
+	}
+
+	verification = loadVerificationConfig()
+	lockout = loadLockoutConfig()
+	if loginAttempts, err = newAttemptStore(); err != nil {
+		return err
+	}
+	return nil
+}
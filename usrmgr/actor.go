@@ -0,0 +1,42 @@
+package usrmgr
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnonymousActor is recorded when a change can not be attributed.
+const AnonymousActor = "anonymous"
+
+// SystemActor is recorded for changes made by background jobs.
+const SystemActor = "system"
+
+// principalKey is the gin context key under which authentication
+// middleware stores the authenticated principal.
+const principalKey = "principal"
+
+type actorCtxKey struct{}
+
+// WithActor returns a copy of ctx recording who performs the operation.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorCtxKey{}, actor)
+}
+
+// ActorFromContext returns the actor recorded by WithActor.
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorCtxKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return AnonymousActor
+}
+
+// requestActor returns who sent the request, the principal set by the
+// authentication middleware. Headers sent by the client are never trusted
+// for it.
+func requestActor(c *gin.Context) string {
+	if principal := c.GetString(principalKey); principal != "" {
+		return principal
+	}
+	return AnonymousActor
+}
@@ -0,0 +1,32 @@
+package usrmgr
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestActorFromContext(t *testing.T) {
+	if got := ActorFromContext(context.Background()); got != AnonymousActor {
+		t.Errorf("actor = %q, want %q", got, AnonymousActor)
+	}
+	if got := ActorFromContext(WithActor(context.Background(), "alice")); got != "alice" {
+		t.Errorf("actor = %q, want alice", got)
+	}
+}
+
+func TestRequestActor(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("PUT", "/user?id=1", nil)
+	c.Request.Header.Set("X-Forwarded-User", "admin")
+
+	if got := requestActor(c); got != AnonymousActor {
+		t.Errorf("actor = %q, want the forwarded user to be ignored", got)
+	}
+	c.Set(principalKey, "key-owner")
+	if got := requestActor(c); got != "key-owner" {
+		t.Errorf("actor = %q, want the principal", got)
+	}
+}
@@ -0,0 +1,378 @@
+package usrmgr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+)
+
+// RegisterAdminRoutes adds the user service administration endpoints to the
+// admin listener router.
+func RegisterAdminRoutes(r gin.IRouter) {
+	r.Use(RequestContext())
+	r.GET("/deadletters", ListDeadLettersHandler)
+	r.POST("/deadletters/replay", ReplayDeadLettersHandler)
+	r.GET("/users", ListUsersAdminHandler)
+	r.POST("/users/restore", RestoreUserHandler)
+	r.GET("/users/export", ExportUserHandler)
+	r.POST("/users/erase", EraseUserHandler)
+	r.GET("/users/erasure", GetErasureHandler)
+	r.POST("/users/mfa/reset", ResetMFAHandler)
+	r.POST("/users/unlock", UnlockAccountHandler)
+	r.POST("/addresses/unblock", UnblockAddressHandler)
+	r.GET("/apikeys", ListAPIKeysHandler)
+	r.POST("/apikeys", CreateAPIKeyHandler)
+	r.DELETE("/apikeys", RevokeAPIKeyHandler)
+	r.POST("/apikeys/rotate", RotateAPIKeyHandler)
+	r.POST("/oidc/keys/rotate", RotateSigningKeysHandler)
+	r.POST("/encryption/rotate", RotateDataKeysHandler)
+	r.POST("/encryption/reencrypt", ReencryptUsersHandler)
+	r.GET("/audit", ListAuditHandler)
+	r.GET("/audit/verify", VerifyAuditHandler)
+}
+
+// RotateDataKeysHandler creates a new data key for field encryption right
+// away. Existing values move to it with the next re-encryption.
+func RotateDataKeysHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	rotated, err := RotateDataKeys(ctx, true)
+	if errors.Is(err, ErrEncryptionNotConfigured) {
+		c.JSON(http.StatusConflict, gin.H{"error": "field encryption is not enabled"})
+		return
+	}
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to rotate data keys, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to rotate data keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rotated": rotated})
+}
+
+// ReencryptUsersHandler re-encrypts the users not yet under the newest data
+// key without waiting for the background job.
+func ReencryptUsersHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	n, err := ReencryptUsers(ctx)
+	if errors.Is(err, ErrEncryptionNotConfigured) {
+		c.JSON(http.StatusConflict, gin.H{"error": "field encryption is not enabled"})
+		return
+	}
+	if err != nil {
+		logs.FromContext(ctx).Errorf("re-encryption failed after %d users, error - %v", n, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to re-encrypt users", "reencrypted": n})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reencrypted": n})
+}
+
+// ListAuditHandler queries the audit log, newest entries first. Older
+// pages are fetched with before set to the smallest seq returned.
+func ListAuditHandler(c *gin.Context) {
+	var filter AuditFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entries, err := QueryAudit(c.Request.Context(), filter)
+	if err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to query audit log, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to query audit log"})
+		return
+	}
+	// reading the log is itself audited, after the query so it does not
+	// show up in its own result
+	auditRead(c, c.Request.Context(), auditEvent{
+		Action: AuditLogRead, TargetType: AuditTargetAudit,
+		Details: auditDetails("actor", filter.Actor, "action", filter.Action, "targetType", filter.TargetType,
+			"targetId", filter.TargetID, "count", len(entries)),
+	})
+	c.JSON(http.StatusOK, entries)
+}
+
+// VerifyAuditHandler recomputes the hash chain of the audit log, from the
+// entry given by the from query parameter or from the start.
+func VerifyAuditHandler(c *gin.Context) {
+	var query struct {
+		From int64 `form:"from"`
+	}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := VerifyAuditChain(c.Request.Context(), query.From)
+	if err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to verify audit log, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to verify audit log"})
+		return
+	}
+	if !result.Valid {
+		logs.FromContext(c.Request.Context()).Errorf("audit log chain broken at entry %d: %s", result.BrokenAt, result.Reason)
+	}
+	auditRead(c, c.Request.Context(), auditEvent{
+		Action: AuditLogVerify, TargetType: AuditTargetAudit,
+		Details: auditDetails("from", query.From, "valid", result.Valid, "brokenAt", result.BrokenAt),
+	})
+	c.JSON(http.StatusOK, result)
+}
+
+// RotateSigningKeysHandler creates a new token signing key right away, for
+// example when the current one may have leaked. It signs once published
+// for OIDC_KEY_PREPUBLISH.
+func RotateSigningKeysHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	rotated, err := RotateSigningKeys(ctx, true)
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to rotate signing keys, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to rotate signing keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rotated": rotated})
+}
+
+// CreateAPIKeyHandler creates an API key. The response is the only time
+// the key is shown.
+func CreateAPIKeyHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	var req APIKeyRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	key, apiKey, err := CreateAPIKey(ctx, req)
+	if err != nil {
+		writeAPIKeyError(c, "create", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"key": key, "apiKey": apiKey})
+}
+
+// ListAPIKeysHandler lists API keys, optionally of one principal and
+// including revoked ones with includeRevoked=true.
+func ListAPIKeysHandler(c *gin.Context) {
+	keys, err := ListAPIKeys(c.Request.Context(), c.Query("principal"), c.Query("includeRevoked") == "true")
+	if err != nil {
+		writeAPIKeyError(c, "list", err)
+		return
+	}
+	auditRead(c, c.Request.Context(), auditEvent{
+		Action: AuditAPIKeyList, TargetType: AuditTargetAPIKey,
+		Details: auditDetails("principal", c.Query("principal"), "count", len(keys)),
+	})
+	c.JSON(http.StatusOK, keys)
+}
+
+// RevokeAPIKeyHandler revokes the API key given by the id query parameter.
+func RevokeAPIKeyHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	if err := RevokeAPIKey(ctx, c.Query("id")); err != nil {
+		writeAPIKeyError(c, "revoke", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RotateAPIKeyHandler replaces the API key given by the id query parameter
+// and returns the new key.
+func RotateAPIKeyHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	key, apiKey, err := RotateAPIKey(ctx, c.Query("id"))
+	if err != nil {
+		writeAPIKeyError(c, "rotate", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"key": key, "apiKey": apiKey})
+}
+
+func writeAPIKeyError(c *gin.Context, action string, err error) {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		logs.FromContext(c.Request.Context()).Errorf("unable to %s api keys, error - %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to " + action + " api key"})
+	}
+}
+
+// UnlockAccountHandler lifts the login lockout of the user given by the id
+// query parameter.
+func UnlockAccountHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	id := c.Query("id")
+	if err := UnlockAccount(ctx, id); err != nil {
+		writeUserError(c, ctx, "unlock", id, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// UnblockAddressHandler lifts the login block of the address given by the
+// ip query parameter.
+func UnblockAddressHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	ip := c.Query("ip")
+	if ip == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip is required"})
+		return
+	}
+	if err := UnblockAddress(ctx, ip); err != nil {
+		logs.FromContext(ctx).Errorf("unable to unblock %s, error - %v", ip, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to unblock address"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ResetMFAHandler removes the MFA enrollment of the user given by the id
+// query parameter, for users who lost their authenticator.
+func ResetMFAHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	id := c.Query("id")
+	if err := ResetMFA(ctx, id); err != nil {
+		writeUserError(c, ctx, "reset mfa of", id, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListUsersAdminHandler lists users, including soft deleted ones with
+// includeDeleted=true.
+func ListUsersAdminHandler(c *gin.Context) {
+	var filter UserFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.IncludeDeleted = c.Query("includeDeleted") == "true"
+	users, err := ListUsers(c.Request.Context(), filter)
+	if err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to list users, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	auditRead(c, c.Request.Context(), auditEvent{Action: AuditUserList, TargetType: AuditTargetUser, Details: filter.auditDetails(len(users))})
+	c.JSON(http.StatusOK, users)
+}
+
+// RestoreUserHandler restores the soft deleted user given by the id query
+// parameter.
+func RestoreUserHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	id := c.Query("id")
+
+	version, err := optionalIfMatch(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := RestoreUser(ctx, id, version)
+	if err != nil {
+		writeUserError(c, ctx, "restore", id, err)
+		return
+	}
+	c.Header("ETag", userETag(user.Version))
+	c.JSON(http.StatusOK, user)
+}
+
+// ExportUserHandler returns the data held about the user given by the id
+// query parameter, as JSON or with format=zip as a ZIP archive.
+func ExportUserHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	id := c.Query("id")
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "zip" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or zip"})
+		return
+	}
+
+	export, err := ExportUserData(ctx, id)
+	if err != nil {
+		writeUserError(c, ctx, "export", id, err)
+		return
+	}
+	if format == "json" {
+		c.JSON(http.StatusOK, export)
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.zip"`, id))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+	if err := export.WriteZip(c.Writer); err != nil {
+		logs.FromContext(ctx).Errorf("unable to write export of user %s, error - %v", id, err)
+	}
+}
+
+// EraseUserHandler erases the user given by the id query parameter, with
+// an optional {"reason": "..."} body, and returns the erasure record.
+func EraseUserHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	id := c.Query("id")
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	erasure, err := EraseUser(ctx, id, body.Reason)
+	if err != nil {
+		writeUserError(c, ctx, "erase", id, err)
+		return
+	}
+	c.JSON(http.StatusOK, erasure)
+}
+
+// GetErasureHandler returns the erasure record of the user given by the id
+// query parameter.
+func GetErasureHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	id := c.Query("id")
+	erasure, err := GetErasure(ctx, id)
+	if err != nil {
+		writeUserError(c, ctx, "get erasure of", id, err)
+		return
+	}
+	c.JSON(http.StatusOK, erasure)
+}
+
+func ListDeadLettersHandler(c *gin.Context) {
+	var filter DeadLetterFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deadLetters, err := ListDeadLetters(c.Request.Context(), filter)
+	if err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to list dead letters, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deadLetters)
+}
+
+func ReplayDeadLettersHandler(c *gin.Context) {
+	var filter DeadLetterFilter
+	if err := c.ShouldBindJSON(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if filter.Status == "" {
+		filter.Status = DeadLetterPending
+	}
+	result, err := ReplayDeadLetters(c.Request.Context(), filter)
+	if err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to replay dead letters, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "result": result})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
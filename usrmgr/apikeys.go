@@ -0,0 +1,331 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+)
+
+// API key scopes.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// apiKeyPrefix starts every key so leaked keys are easy to recognise in
+// logs and by secret scanners.
+const apiKeyPrefix = "usk_"
+
+// apiKeyKey is the gin context key of the APIKey a request authenticated
+// with.
+const apiKeyKey = "apikey"
+
+// scopesKey is the gin context key of the scopes granted to a non user
+// principal, an API key or a client certificate.
+const scopesKey = "scopes"
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid, expired or revoked api key")
+
+	apiKeyCollection *mongo.Collection
+
+	apiKeyScopes = map[string]bool{ScopeUsersRead: true, ScopeUsersWrite: true}
+)
+
+// APIKey is a credential of a service or job. Only the SHA-256 of its
+// secret is stored; the key itself is shown once, on creation.
+type APIKey struct {
+	ID           string     `bson:"_id" json:"id"`
+	Name         string     `bson:"name" json:"name"`
+	Principal    string     `bson:"principal" json:"principal"`
+	Scopes       []string   `bson:"scopes" json:"scopes"`
+	Hash         string     `bson:"hash" json:"-"`
+	CreatedAt    time.Time  `bson:"createdAt" json:"createdAt"`
+	CreatedBy    string     `bson:"createdBy" json:"createdBy"`
+	ExpiresAt    *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	LastUsedAt   *time.Time `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	LastUsedFrom string     `bson:"lastUsedFrom,omitempty" json:"lastUsedFrom,omitempty"`
+	RevokedAt    *time.Time `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+	RevokedBy    string     `bson:"revokedBy,omitempty" json:"revokedBy,omitempty"`
+	// RotatedTo is the key that replaced this one.
+	RotatedTo string `bson:"rotatedTo,omitempty" json:"rotatedTo,omitempty"`
+}
+
+// APIKeyRequest describes a key to create. Principal is who requests
+// made with the key are attributed to, e.g. order-service.
+type APIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Principal string     `json:"principal" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func (r APIKeyRequest) validate(now time.Time) error {
+	if strings.TrimSpace(r.Name) == "" {
+		return invalid("name", "must not be empty")
+	}
+	if strings.TrimSpace(r.Principal) == "" {
+		return invalid("principal", "must not be empty")
+	}
+	if len(r.Scopes) == 0 {
+		return invalid("scopes", "must not be empty")
+	}
+	for _, scope := range r.Scopes {
+		if !apiKeyScopes[scope] {
+			return invalid("scopes", "unknown scope %q", scope)
+		}
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+		return invalid("expiresAt", "must be in the future")
+	}
+	return nil
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a key id and a key usk_<id>_<secret>. The id is
+// public and used to look the key up, the secret is only stored hashed.
+func newAPIKeySecret() (id, key, hash string, err error) {
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	id = hex.EncodeToString(b[:8])
+	secret := base64.RawURLEncoding.EncodeToString(b[8:])
+	return id, apiKeyPrefix + id + "_" + secret, hashAPIKeySecret(secret), nil
+}
+
+// CreateAPIKey stores a new key and returns it together with its record.
+func CreateAPIKey(ctx context.Context, req APIKeyRequest) (string, APIKey, error) {
+
+	tracer := otel.Tracer("CreateAPIKeyServiceTrace")
+	ctx, span := tracer.Start(ctx, "CreateAPIKeyService")
+	defer span.End()
+
+	now := time.Now().UTC()
+	if err := req.validate(now); err != nil {
+		return "", APIKey{}, err
+	}
+	id, key, hash, err := newAPIKeySecret()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	apiKey := APIKey{
+		ID:        id,
+		Name:      strings.TrimSpace(req.Name),
+		Principal: strings.TrimSpace(req.Principal),
+		Scopes:    req.Scopes,
+		Hash:      hash,
+		CreatedAt: now,
+		CreatedBy: ActorFromContext(ctx),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if _, err := apiKeyCollection.InsertOne(ctx, apiKey); err != nil {
+		return "", APIKey{}, err
+	}
+	SendLogs(ctx, fmt.Sprintf("api key %s for %s created", id, apiKey.Principal))
+	recordAudit(ctx, auditEvent{Action: AuditAPIKeyCreate, TargetType: AuditTargetAPIKey, TargetID: id, After: apiKey})
+	return key, apiKey, nil
+}
+
+// ListAPIKeys returns the keys of principal, or of everyone when it is
+// empty. Revoked keys are left out unless includeRevoked is set.
+func ListAPIKeys(ctx context.Context, principal string, includeRevoked bool) ([]APIKey, error) {
+	filter := bson.M{}
+	if principal != "" {
+		filter["principal"] = principal
+	}
+	if !includeRevoked {
+		filter["revokedAt"] = bson.M{"$exists": false}
+	}
+	cur, err := apiKeyCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey stops the key given by its id from working.
+func RevokeAPIKey(ctx context.Context, id string) error {
+
+	tracer := otel.Tracer("RevokeAPIKeyServiceTrace")
+	ctx, span := tracer.Start(ctx, "RevokeAPIKeyService")
+	defer span.End()
+
+	res, err := apiKeyCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC(), "revokedBy": ActorFromContext(ctx)}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	SendLogs(ctx, fmt.Sprintf("api key %s revoked", id))
+	recordAudit(ctx, auditEvent{Action: AuditAPIKeyRevoke, TargetType: AuditTargetAPIKey, TargetID: id})
+	return nil
+}
+
+// RotateAPIKey replaces a key with a new one of the same name, principal,
+// scopes and lifetime. The old key keeps working for
+// API_KEY_ROTATION_GRACE so callers can switch over.
+func RotateAPIKey(ctx context.Context, id string) (string, APIKey, error) {
+
+	tracer := otel.Tracer("RotateAPIKeyServiceTrace")
+	ctx, span := tracer.Start(ctx, "RotateAPIKeyService")
+	defer span.End()
+
+	var old APIKey
+	err := apiKeyCollection.FindOne(ctx, bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}}).Decode(&old)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return "", APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	now := time.Now().UTC()
+	req := APIKeyRequest{Name: old.Name, Principal: old.Principal, Scopes: old.Scopes}
+	if old.ExpiresAt != nil {
+		expiresAt := now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+		req.ExpiresAt = &expiresAt
+	}
+	key, apiKey, err := CreateAPIKey(ctx, req)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	graceEnd := now.Add(utils.GetEnvDurationParam("API_KEY_ROTATION_GRACE", time.Hour))
+	set := bson.M{"rotatedTo": apiKey.ID}
+	if old.ExpiresAt == nil || old.ExpiresAt.After(graceEnd) {
+		set["expiresAt"] = graceEnd
+	}
+	if _, err := apiKeyCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		return "", APIKey{}, err
+	}
+	SendLogs(ctx, fmt.Sprintf("api key %s rotated to %s", id, apiKey.ID))
+	recordAudit(ctx, auditEvent{
+		Action: AuditAPIKeyRotate, TargetType: AuditTargetAPIKey, TargetID: id,
+		Details: auditDetails("rotatedTo", apiKey.ID, "graceEnd", graceEnd.Format(time.RFC3339)),
+	})
+	return key, apiKey, nil
+}
+
+// ValidateAPIKey returns the live record of key and notes its use.
+func ValidateAPIKey(ctx context.Context, key, remoteAddr string) (APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	now := time.Now().UTC()
+	var apiKey APIKey
+	err := apiKeyCollection.FindOne(ctx, bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}}).Decode(&apiKey)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey.Hash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if apiKey.ExpiresAt != nil && !apiKey.ExpiresAt.After(now) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	// busy keys are written at most once a minute
+	_, err = apiKeyCollection.UpdateOne(ctx,
+		bson.M{"_id": id, "$or": bson.A{
+			bson.M{"lastUsedAt": bson.M{"$lt": now.Add(-time.Minute)}},
+			bson.M{"lastUsedAt": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"lastUsedAt": now, "lastUsedFrom": remoteAddr}})
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to record use of api key %s, error - %v", id, err)
+	}
+	return apiKey, nil
+}
+
+// APIKeyAuth resolves an Authorization: ApiKey header to the principal of
+// the key. Requests without it pass through unchanged, invalid keys are
+// refused.
+func APIKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, key, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "ApiKey") {
+			c.Next()
+			return
+		}
+		apiKey, err := ValidateAPIKey(c.Request.Context(), strings.TrimSpace(key), c.ClientIP())
+		if errors.Is(err, ErrInvalidAPIKey) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "unable to check api key"})
+			return
+		}
+		c.Set(principalKey, apiKey.Principal)
+		c.Set(apiKeyKey, apiKey)
+		c.Set(scopesKey, apiKey.Scopes)
+		c.Next()
+	}
+}
+
+// RequireScope refuses requests lacking scope. Requests without a
+// principal get a 401, unless ALLOW_ANONYMOUS_ACCESS is set. Principals
+// with scopes, an API key or a mapped client certificate, need scope;
+// client certificates are not limited while HTTP_TLS_CLIENT_SCOPES is
+// unset.
+func RequireScope(scope string) gin.HandlerFunc {
+	allowAnonymous := utils.GetEnvBoolParam("ALLOW_ANONYMOUS_ACCESS", false)
+	return func(c *gin.Context) {
+		if c.GetString(principalKey) == "" {
+			if allowAnonymous {
+				c.Next()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			return
+		}
+		if v, ok := c.Get(scopesKey); ok && !hasScope(v.([]string), scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "principal lacks scope " + scope})
+			return
+		}
+		c.Next()
+	}
+}
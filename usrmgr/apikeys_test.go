@@ -0,0 +1,224 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestHashAPIKeySecret(t *testing.T) {
+	// SHA-256 of "abc", FIPS 180-2 appendix B.1
+	const want = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if got := hashAPIKeySecret("abc"); got != want {
+		t.Errorf("hash = %s, want %s", got, want)
+	}
+}
+
+func TestNewAPIKeySecret(t *testing.T) {
+	id, key, hash, err := newAPIKeySecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := strings.TrimPrefix(key, apiKeyPrefix+id+"_")
+	if rest == key || len(id) != 16 {
+		t.Fatalf("key %q does not look like usk_<id>_<secret> with id %q", key, id)
+	}
+	if hash != hashAPIKeySecret(rest) {
+		t.Error("hash is not the hash of the secret")
+	}
+	if strings.Contains(hash, rest) {
+		t.Error("hash contains the secret")
+	}
+	id2, key2, _, _ := newAPIKeySecret()
+	if id == id2 || key == key2 {
+		t.Error("keys repeat")
+	}
+}
+
+func TestAPIKeyRequestValidate(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	valid := APIKeyRequest{Name: "orders", Principal: "order-service", Scopes: []string{ScopeUsersRead}}
+	tests := []struct {
+		name   string
+		modify func(r *APIKeyRequest)
+		field  string
+	}{
+		{"valid", func(r *APIKeyRequest) {}, ""},
+		{"expiring", func(r *APIKeyRequest) { r.ExpiresAt = &future }, ""},
+		{"blank name", func(r *APIKeyRequest) { r.Name = " " }, "name"},
+		{"blank principal", func(r *APIKeyRequest) { r.Principal = "" }, "principal"},
+		{"no scopes", func(r *APIKeyRequest) { r.Scopes = nil }, "scopes"},
+		{"unknown scope", func(r *APIKeyRequest) { r.Scopes = []string{ScopeUsersRead, "users:admin"} }, "scopes"},
+		{"expired", func(r *APIKeyRequest) { r.ExpiresAt = &past }, "expiresAt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid
+			tt.modify(&r)
+			err := r.validate(now)
+			var verr *ValidationError
+			switch {
+			case tt.field == "" && err != nil:
+				t.Errorf("validate = %v", err)
+			case tt.field != "" && (!errors.As(err, &verr) || verr.Field != tt.field):
+				t.Errorf("validate = %v, want an error on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+// apiKeyRecord is the stored record of key with the secret secret.
+func apiKeyRecord(secret string, expiresAt *time.Time) bson.D {
+	d := bson.D{
+		{Key: "_id", Value: "0123456789abcdef"}, {Key: "name", Value: "orders"},
+		{Key: "principal", Value: "order-service"}, {Key: "scopes", Value: bson.A{ScopeUsersRead}},
+		{Key: "hash", Value: hashAPIKeySecret(secret)},
+	}
+	if expiresAt != nil {
+		d = append(d, bson.E{Key: "expiresAt", Value: *expiresAt})
+	}
+	return d
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	const key = apiKeyPrefix + "0123456789abcdef_s3cret"
+	past := time.Now().Add(-time.Minute)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name      string
+		key       string
+		responses []bson.D
+		want      error
+		commands  []string
+	}{
+		{"valid", key, []bson.D{found(apiKeyRecord("s3cret", nil)), updated(1)}, nil, []string{"find", "update"}},
+		{"wrong secret", apiKeyPrefix + "0123456789abcdef_guess", []bson.D{found(apiKeyRecord("s3cret", nil))}, ErrInvalidAPIKey, []string{"find"}},
+		{"expired", key, []bson.D{found(apiKeyRecord("s3cret", &past))}, ErrInvalidAPIKey, []string{"find"}},
+		{"unknown or revoked", key, []bson.D{found()}, ErrInvalidAPIKey, []string{"find"}},
+		{"no prefix", "0123456789abcdef_s3cret", nil, ErrInvalidAPIKey, nil},
+		{"no secret", apiKeyPrefix + "0123456789abcdef", nil, ErrInvalidAPIKey, nil},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockCollections(t, mt, &apiKeyCollection)
+			mt.AddMockResponses(tt.responses...)
+
+			apiKey, err := ValidateAPIKey(context.Background(), tt.key, "203.0.113.7")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ValidateAPIKey = %v, want %v", err, tt.want)
+			}
+			if err == nil && (apiKey.Principal != "order-service" || !hasScope(apiKey.Scopes, ScopeUsersRead)) {
+				t.Errorf("key %+v", apiKey)
+			}
+			if got := commands(mt); strings.Join(got, ",") != strings.Join(tt.commands, ",") {
+				t.Errorf("commands %v, want %v", got, tt.commands)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	handle := func(req *http.Request) (*httptest.ResponseRecorder, *gin.Context) {
+		var got *gin.Context
+		r := gin.New()
+		r.GET("/", APIKeyAuth(), func(c *gin.Context) { got = c })
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w, got
+	}
+
+	mt.Run("valid key", func(mt *mtest.T) {
+		useMockCollections(t, mt, &apiKeyCollection)
+		mt.AddMockResponses(found(apiKeyRecord("s3cret", nil)), updated(1))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "ApiKey "+apiKeyPrefix+"0123456789abcdef_s3cret")
+
+		w, c := handle(req)
+		if w.Code != http.StatusOK || c == nil {
+			t.Fatalf("status %d", w.Code)
+		}
+		if c.GetString(principalKey) != "order-service" || !hasScope(c.GetStringSlice(scopesKey), ScopeUsersRead) {
+			t.Errorf("principal %q with scopes %v", c.GetString(principalKey), c.GetStringSlice(scopesKey))
+		}
+	})
+	mt.Run("invalid key", func(mt *mtest.T) {
+		useMockCollections(t, mt, &apiKeyCollection)
+		mt.AddMockResponses(found())
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "apikey "+apiKeyPrefix+"0123456789abcdef_s3cret")
+
+		if w, _ := handle(req); w.Code != http.StatusUnauthorized {
+			t.Errorf("status %d, want 401", w.Code)
+		}
+	})
+	mt.Run("store error", func(mt *mtest.T) {
+		useMockCollections(t, mt, &apiKeyCollection)
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "boom"}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "ApiKey "+apiKeyPrefix+"0123456789abcdef_s3cret")
+
+		if w, _ := handle(req); w.Code != http.StatusInternalServerError {
+			t.Errorf("status %d, want 500", w.Code)
+		}
+	})
+	mt.Run("other scheme", func(mt *mtest.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer token")
+
+		w, c := handle(req)
+		if w.Code != http.StatusOK || c.GetString(principalKey) != "" {
+			t.Errorf("status %d, principal %q", w.Code, c.GetString(principalKey))
+		}
+	})
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		anonymous string
+		principal string
+		scopes    []string
+		want      int
+	}{
+		{"no principal", "", "", nil, http.StatusUnauthorized},
+		{"no principal, anonymous access allowed", "true", "", nil, http.StatusOK},
+		{"scope granted", "", "order-service", []string{ScopeUsersRead}, http.StatusOK},
+		{"scope missing", "", "order-service", []string{ScopeUsersWrite}, http.StatusForbidden},
+		{"no scopes", "", "order-service", []string{}, http.StatusForbidden},
+		{"unmapped client certificate", "", "spiffe://demo/batch", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOW_ANONYMOUS_ACCESS", tt.anonymous)
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				if tt.principal != "" {
+					c.Set(principalKey, tt.principal)
+				}
+				if tt.scopes != nil {
+					c.Set(scopesKey, tt.scopes)
+				}
+			}, RequireScope(ScopeUsersRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var attemptCollection *mongo.Collection
+
+// Attempts is the failed login record of a key, an account or an address.
+type Attempts struct {
+	Failures      int       `bson:"failures" json:"failures"`
+	WindowStart   time.Time `bson:"windowStart" json:"windowStart"`
+	LastFailureAt time.Time `bson:"lastFailureAt" json:"lastFailureAt"`
+	LockedUntil   time.Time `bson:"lockedUntil,omitempty" json:"lockedUntil,omitempty"`
+}
+
+// AttemptStore keeps failed login attempts. Records expire on their own
+// once neither their failures nor their lock matter any more.
+type AttemptStore interface {
+	// Get returns the record of key, the zero value when there is none.
+	Get(ctx context.Context, key string) (Attempts, error)
+	// Fail counts a failed attempt at now and returns the updated record.
+	// Failures older than window no longer count.
+	Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error)
+	// Lock refuses logins of key until until.
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Reset forgets the failures and the lock of key.
+	Reset(ctx context.Context, key string) error
+}
+
+// MongoAttemptStore keeps attempts in a collection with a TTL index on
+// expiresAt, so every instance of the service sees the same counts.
+type MongoAttemptStore struct {
+	Collection *mongo.Collection
+}
+
+func (s MongoAttemptStore) Get(ctx context.Context, key string) (Attempts, error) {
+	var a Attempts
+	err := s.Collection.FindOne(ctx, bson.M{"_id": key}).Decode(&a)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Attempts{}, nil
+	}
+	return a, err
+}
+
+func (s MongoAttemptStore) Fail(ctx context.Context, key string, now time.Time, window time.Duration) (Attempts, error) {
+	// all fields of one $set stage see the document as it was, so both
+	// conditions test the old window
+	inWindow := bson.M{"$gt": bson.A{"$windowStart", now.Add(-window)}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"failures":      bson.M{"$cond": bson.A{inWindow, bson.M{"$add": bson.A{"$failures", 1}}, 1}},
+		"windowStart":   bson.M{"$cond": bson.A{inWindow, "$windowStart", now}},
+		"lastFailureAt": now,
+		"expiresAt":     bson.M{"$max": bson.A{now.Add(window), "$lockedUntil"}},
+	}}}}
+	var a Attempts
+	err := s.Collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&a)
+	return a, err
+}
+
+func (s MongoAttemptStore) Lock(ctx context.Context, key string, until time.Time) error {
+	_, err := s.Collection.UpdateOne(ctx, bson.M{"_id": key},
+		bson.M{"$set": bson.M{"lockedUntil": until}, "$max": bson.M{"expiresAt": until}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+func (s MongoAttemptStore) Reset(ctx context.Context, key string) error {
+	_, err := s.Collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// MemoryAttemptStore keeps attempts in process. Counts are per instance
+// and lost on restart, which suits tests and single instance setups.
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	attempts  map[string]memoryAttempts
+	lastSweep time.Time
+}
+
+type memoryAttempts struct {
+	Attempts
+	expiresAt time.Time
+}
+
+// NewMemoryAttemptStore returns an empty in-process store.
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]memoryAttempts)}
+}
+
+func (s *MemoryAttemptStore) Get(_ context.Context, key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key].Attempts, nil
+}
+
+func (s *MemoryAttemptStore) Fail(_ context.Context, key string, now time.Time, window time.Duration) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	a := s.attempts[key]
+	if a.WindowStart.After(now.Add(-window)) {
+		a.Failures++
+	} else {
+		a.Failures = 1
+		a.WindowStart = now
+	}
+	a.LastFailureAt = now
+	a.expiresAt = now.Add(window)
+	if a.LockedUntil.After(a.expiresAt) {
+		a.expiresAt = a.LockedUntil
+	}
+	s.attempts[key] = a
+	return a.Attempts, nil
+}
+
+func (s *MemoryAttemptStore) Lock(_ context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.attempts[key]
+	a.LockedUntil = until
+	if until.After(a.expiresAt) {
+		a.expiresAt = until
+	}
+	s.attempts[key] = a
+	return nil
+}
+
+func (s *MemoryAttemptStore) Reset(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// sweep drops expired records, at most once a minute.
+func (s *MemoryAttemptStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, a := range s.attempts {
+		if a.expiresAt.Before(now) {
+			delete(s.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package usrmgr
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryAttemptStoreFail(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryAttemptStore()
+	start := time.Unix(1700000000, 0)
+	window := 10 * time.Minute
+
+	for i := 1; i <= 3; i++ {
+		now := start.Add(time.Duration(i) * time.Minute)
+		a, err := s.Fail(ctx, "k", now, window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Failures != i || !a.WindowStart.Equal(start.Add(time.Minute)) || !a.LastFailureAt.Equal(now) {
+			t.Errorf("failure %d: %+v", i, a)
+		}
+	}
+	if got, _ := s.Get(ctx, "k"); got.Failures != 3 {
+		t.Errorf("Get = %+v", got)
+	}
+	if got, _ := s.Get(ctx, "other"); got != (Attempts{}) {
+		t.Errorf("unknown key = %+v", got)
+	}
+
+	// the window started with the first failure, once it passed counting
+	// starts over
+	later := start.Add(time.Minute + window)
+	a, _ := s.Fail(ctx, "k", later, window)
+	if a.Failures != 1 || !a.WindowStart.Equal(later) {
+		t.Errorf("failure after the window: %+v", a)
+	}
+}
+
+func TestMemoryAttemptStoreLockAndReset(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryAttemptStore()
+	now := time.Unix(1700000000, 0)
+
+	s.Fail(ctx, "k", now, time.Minute)
+	until := now.Add(time.Hour)
+	if err := s.Lock(ctx, "k", until); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Get(ctx, "k"); !a.LockedUntil.Equal(until) || a.Failures != 1 {
+		t.Errorf("locked record %+v", a)
+	}
+	// a failure during the lock keeps it
+	if a, _ := s.Fail(ctx, "k", now.Add(time.Second), time.Minute); !a.LockedUntil.Equal(until) {
+		t.Errorf("lock lost on failure: %+v", a)
+	}
+
+	if err := s.Reset(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := s.Get(ctx, "k"); a != (Attempts{}) {
+		t.Errorf("record after reset %+v", a)
+	}
+}
+
+func TestMemoryAttemptStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryAttemptStore()
+	now := time.Unix(1700000000, 0)
+
+	s.Fail(ctx, "expiring", now, time.Minute)
+	s.Fail(ctx, "locked", now, time.Minute)
+	s.Lock(ctx, "locked", now.Add(time.Hour))
+
+	// the next failure after the window sweeps what expired
+	s.Fail(ctx, "other", now.Add(2*time.Minute), time.Minute)
+	if _, ok := s.attempts["expiring"]; ok {
+		t.Error("expired record kept")
+	}
+	if _, ok := s.attempts["locked"]; !ok {
+		t.Error("record dropped while locked")
+	}
+}
@@ -0,0 +1,497 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Audit actions.
+const (
+	AuditUserCreate       = "user.create"
+	AuditUserUpdate       = "user.update"
+	AuditUserDelete       = "user.delete"
+	AuditUserRestore      = "user.restore"
+	AuditUserPurge        = "user.purge"
+	AuditUserRead         = "user.read"
+	AuditUserList         = "user.list"
+	AuditUserExport       = "user.export"
+	AuditUserErase        = "user.erase"
+	AuditEmailVerify      = "user.verify_email"
+	AuditPasswordReset    = "user.password_reset"
+	AuditMFAEnable        = "user.mfa_enable"
+	AuditMFAReset         = "user.mfa_reset"
+	AuditRecoveryCodeUse  = "user.mfa_recovery_code_use"
+	AuditLogin            = "auth.login"
+	AuditLoginFailed      = "auth.login_failed"
+	AuditLogout           = "auth.logout"
+	AuditAccountLock      = "auth.account_lock"
+	AuditAccountUnlock    = "auth.account_unlock"
+	AuditAddressBlock     = "auth.address_block"
+	AuditAddressUnblock   = "auth.address_unblock"
+	AuditUserInfoRead     = "auth.userinfo_read"
+	AuditAPIKeyCreate     = "apikey.create"
+	AuditAPIKeyRevoke     = "apikey.revoke"
+	AuditAPIKeyRotate     = "apikey.rotate"
+	AuditAPIKeyList       = "apikey.list"
+	AuditSigningKeyRotate = "signing_key.rotate"
+	AuditDataKeyRotate    = "data_key.rotate"
+	AuditLogRead          = "audit.read"
+	AuditLogVerify        = "audit.verify"
+)
+
+// Audit target types.
+const (
+	AuditTargetUser       = "user"
+	AuditTargetAPIKey     = "apikey"
+	AuditTargetSigningKey = "signing_key"
+	AuditTargetDataKey    = "data_key"
+	AuditTargetAddress    = "address"
+	AuditTargetAudit      = "audit"
+)
+
+const auditAppendAttempts = 10
+
+var (
+	errAuditContention = errors.New("audit log busy, too many concurrent appends")
+
+	auditCollection *mongo.Collection
+)
+
+// AuditEntry is one record of the audit log. Entries are numbered without
+// gaps and each carries the hash of its predecessor, so removing or
+// changing an entry breaks the chain from there on. The personal data of
+// an entry, its changes, details and client address, is hashed separately
+// so it can be redacted when a user is erased without breaking the chain.
+type AuditEntry struct {
+	Seq        int64                  `bson:"_id" json:"seq"`
+	Time       time.Time              `bson:"time" json:"time"`
+	Actor      string                 `bson:"actor" json:"actor"`
+	Action     string                 `bson:"action" json:"action"`
+	TargetType string                 `bson:"targetType" json:"targetType"`
+	TargetID   string                 `bson:"targetId,omitempty" json:"targetId,omitempty"`
+	Changes    map[string]AuditChange `bson:"changes,omitempty" json:"changes,omitempty"`
+	Details    map[string]string      `bson:"details,omitempty" json:"details,omitempty"`
+	RequestID  string                 `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	IP         string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	TraceID    string                 `bson:"traceId,omitempty" json:"traceId,omitempty"`
+	// PersonalHash is the hash of Changes, Details and IP, which are
+	// removed and RedactedAt set when the user is erased.
+	PersonalHash string     `bson:"personalHash" json:"personalHash"`
+	RedactedAt   *time.Time `bson:"redactedAt,omitempty" json:"redactedAt,omitempty"`
+	PrevHash     string     `bson:"prevHash" json:"prevHash"`
+	Hash         string     `bson:"hash" json:"hash"`
+}
+
+// AuditChange is the JSON value of a field before and after a change,
+// empty when the field did not exist. The values are stored as JSON text
+// so they stay readable in the database.
+type AuditChange struct {
+	Before string `bson:"before,omitempty"`
+	After  string `bson:"after,omitempty"`
+}
+
+// MarshalJSON returns the values as JSON rather than strings of JSON.
+// Encrypted values are no JSON and are returned as strings.
+func (c AuditChange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Before json.RawMessage `json:"before,omitempty"`
+		After  json.RawMessage `json:"after,omitempty"`
+	}{auditJSONValue(c.Before), auditJSONValue(c.After)})
+}
+
+func auditJSONValue(v string) json.RawMessage {
+	if v == "" || json.Valid([]byte(v)) {
+		return json.RawMessage(v)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// digest returns the hash of the entry chained to PrevHash. It covers the
+// personal data through PersonalHash and all other fields but Hash and
+// RedactedAt; times are hashed in UTC as MongoDB returns them local.
+func (e AuditEntry) digest() (string, error) {
+	e.Changes, e.Details, e.IP = nil, nil, ""
+	e.Hash, e.RedactedAt = "", nil
+	e.Time = e.Time.UTC()
+	return hashJSON(e)
+}
+
+// personalDigest returns the hash of the personal data of the entry.
+func (e AuditEntry) personalDigest() (string, error) {
+	return hashJSON(struct {
+		Changes map[string]AuditChange `json:"changes,omitempty"`
+		Details map[string]string      `json:"details,omitempty"`
+		IP      string                 `json:"ip,omitempty"`
+	}{e.Changes, e.Details, e.IP})
+}
+
+// hasPersonalData tells whether the entry still holds personal data.
+func (e AuditEntry) hasPersonalData() bool {
+	return len(e.Changes) > 0 || len(e.Details) > 0 || e.IP != ""
+}
+
+func hashJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditEvent is what a caller records, the rest of the entry comes from
+// the context.
+type auditEvent struct {
+	Action     string
+	TargetType string
+	TargetID   string
+	// Before and After are diffed field by field on their JSON form, so
+	// fields hidden from JSON, like password hashes, never show up.
+	Before  interface{}
+	After   interface{}
+	Details map[string]string
+}
+
+// recordAudit appends ev to the audit log. A failure is logged but does
+// not fail the operation, which has happened already.
+func recordAudit(ctx context.Context, ev auditEvent) {
+	if auditCollection == nil || !utils.GetEnvBoolParam("AUDIT_ENABLE", true) {
+		return
+	}
+	if _, err := appendAudit(ctx, ev); err != nil {
+		logs.FromContext(ctx).Errorf("unable to write audit entry %s of %s %s, error - %v", ev.Action, ev.TargetType, ev.TargetID, err)
+	}
+}
+
+// auditRead records a sensitive read by the sender of request c.
+func auditRead(c *gin.Context, ctx context.Context, ev auditEvent) {
+	recordAudit(WithActor(ctx, requestActor(c)), ev)
+}
+
+// appendAudit writes ev to the audit log and returns the entry.
+func appendAudit(ctx context.Context, ev auditEvent) (AuditEntry, error) {
+	changes, err := auditDiff(ev.Before, ev.After)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	if ev.TargetType == AuditTargetUser {
+		if err := encryptAuditChanges(ctx, changes); err != nil {
+			return AuditEntry{}, err
+		}
+	}
+	info := requestInfoFromContext(ctx)
+	entry := AuditEntry{
+		Time:       time.Now().UTC().Truncate(time.Millisecond),
+		Actor:      ActorFromContext(ctx),
+		Action:     ev.Action,
+		TargetType: ev.TargetType,
+		TargetID:   ev.TargetID,
+		Changes:    changes,
+		Details:    ev.Details,
+		RequestID:  info.ID,
+		IP:         info.IP,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		entry.TraceID = sc.TraceID().String()
+	}
+	if entry.PersonalHash, err = entry.personalDigest(); err != nil {
+		return AuditEntry{}, err
+	}
+
+	// the unique _id serializes appends: whoever inserts a sequence number
+	// first wins, the others chain onto it and retry
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		var last AuditEntry
+		err := auditCollection.FindOne(ctx, bson.M{},
+			options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.M{"hash": 1})).Decode(&last)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return AuditEntry{}, err
+		}
+		entry.Seq = last.Seq + 1
+		entry.PrevHash = last.Hash
+		if entry.Hash, err = entry.digest(); err != nil {
+			return AuditEntry{}, err
+		}
+		_, err = auditCollection.InsertOne(ctx, entry)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return entry, err
+	}
+	return AuditEntry{}, errAuditContention
+}
+
+// auditDiff returns the top level JSON fields that differ between before
+// and after, either of which may be nil.
+func auditDiff(before, after interface{}) (map[string]AuditChange, error) {
+	if before == nil && after == nil {
+		return nil, nil
+	}
+	b, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]AuditChange)
+	for k, v := range b {
+		if string(a[k]) != string(v) {
+			changes[k] = AuditChange{Before: string(v), After: string(a[k])}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = AuditChange{After: string(v)}
+		}
+	}
+	return changes, nil
+}
+
+func jsonFields(v interface{}) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	if v == nil {
+		return fields, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// redactAudit removes the personal data of the entries matching filter
+// and returns how many were redacted. Their hashes stay valid, PersonalHash
+// still commits to what was removed.
+func redactAudit(ctx context.Context, filter bson.M) (int64, error) {
+	filter["redactedAt"] = bson.M{"$exists": false}
+	res, err := auditCollection.UpdateMany(ctx, filter, bson.M{
+		"$set":   bson.M{"redactedAt": time.Now().UTC()},
+		"$unset": bson.M{"changes": "", "details": "", "ip": ""},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// AuditFilter selects audit entries, newest first. Before pages backwards
+// through the log: pass the smallest seq of the previous page.
+type AuditFilter struct {
+	Actor      string    `form:"actor"`
+	Action     string    `form:"action"`
+	TargetType string    `form:"targetType"`
+	TargetID   string    `form:"targetId"`
+	RequestID  string    `form:"requestId"`
+	Since      time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until      time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Before     int64     `form:"before"`
+	Limit      int64     `form:"limit"`
+}
+
+func (f AuditFilter) query() bson.M {
+	q := bson.M{}
+	for field, v := range map[string]string{
+		"actor": f.Actor, "action": f.Action, "targetType": f.TargetType,
+		"targetId": f.TargetID, "requestId": f.RequestID,
+	} {
+		if v != "" {
+			q[field] = v
+		}
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := bson.M{}
+		if !f.Since.IsZero() {
+			t["$gte"] = f.Since
+		}
+		if !f.Until.IsZero() {
+			t["$lt"] = f.Until
+		}
+		q["time"] = t
+	}
+	if f.Before > 0 {
+		q["_id"] = bson.M{"$lt": f.Before}
+	}
+	return q
+}
+
+// QueryAudit returns the entries matching filter, at most 1000.
+func QueryAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	cur, err := auditCollection.Find(ctx, filter.query(),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	return decodeAuditEntries(ctx, cur)
+}
+
+// decodeAuditEntries reads the entries of cur, decrypting the changes of
+// users.
+func decodeAuditEntries(ctx context.Context, cur *mongo.Cursor) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	if err := cur.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.TargetType != AuditTargetUser {
+			continue
+		}
+		if err := decryptAuditChanges(ctx, e.Changes); err != nil {
+			return nil, fmt.Errorf("audit entry %d: %w", e.Seq, err)
+		}
+	}
+	return entries, nil
+}
+
+// AuditVerification is the result of checking the hash chain.
+type AuditVerification struct {
+	Checked int64 `json:"checked"`
+	Valid   bool  `json:"valid"`
+	// BrokenAt is the first entry that is missing or does not match.
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyAuditChain recomputes the hashes of the log from entry from on,
+// the whole log when from is 0.
+func VerifyAuditChain(ctx context.Context, from int64) (AuditVerification, error) {
+	if from < 1 {
+		from = 1
+	}
+	var prevHash string
+	if from > 1 {
+		var prev AuditEntry
+		err := auditCollection.FindOne(ctx, bson.M{"_id": from - 1}).Decode(&prev)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return AuditVerification{BrokenAt: from - 1, Reason: "entry missing"}, nil
+		}
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		prevHash = prev.Hash
+	}
+
+	cur, err := auditCollection.Find(ctx, bson.M{"_id": bson.M{"$gte": from}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return AuditVerification{}, err
+	}
+	defer cur.Close(ctx)
+
+	result := AuditVerification{Valid: true}
+	expected := from
+	for cur.Next(ctx) {
+		var e AuditEntry
+		if err := cur.Decode(&e); err != nil {
+			return AuditVerification{}, err
+		}
+		digest, err := e.digest()
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		personal, err := e.personalDigest()
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		reason := ""
+		switch {
+		case e.Seq != expected:
+			reason = "entry missing"
+		case e.PrevHash != prevHash:
+			reason = "chain broken"
+		case e.Hash != digest:
+			reason = "entry modified"
+		case e.RedactedAt == nil && e.PersonalHash != personal:
+			reason = "entry modified"
+		case e.RedactedAt != nil && e.hasPersonalData():
+			reason = "redacted entry modified"
+		}
+		if reason != "" {
+			result.Valid, result.BrokenAt, result.Reason = false, expected, reason
+			return result, nil
+		}
+		result.Checked++
+		prevHash = e.Hash
+		expected++
+	}
+	return result, cur.Err()
+}
+
+// requestInfo identifies the HTTP request an operation is part of.
+type requestInfo struct {
+	ID string
+	IP string
+}
+
+type requestInfoCtxKey struct{}
+
+func withRequestInfo(ctx context.Context, info requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoCtxKey{}, info)
+}
+
+func requestInfoFromContext(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoCtxKey{}).(requestInfo)
+	return info
+}
+
+// RequestContext records the request id and client address in the request
+// context for the audit log. The id is taken from X-Request-ID, as set by
+// nginx, or generated, and returned in the response either way.
+func RequestContext() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err == nil {
+				id = hex.EncodeToString(b)
+			}
+		}
+		c.Header("X-Request-ID", id)
+		ctx := withRequestInfo(c.Request.Context(), requestInfo{ID: id, IP: c.ClientIP()})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// auditDetails builds details from key value pairs, leaving out zero
+// values.
+func auditDetails(kv ...interface{}) map[string]string {
+	details := make(map[string]string)
+	for i := 0; i+1 < len(kv); i += 2 {
+		if v := kv[i+1]; v != nil && !reflect.ValueOf(v).IsZero() {
+			details[fmt.Sprint(kv[i])] = fmt.Sprint(v)
+		}
+	}
+	if len(details) == 0 {
+		return nil
+	}
+	return details
+}
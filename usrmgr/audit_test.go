@@ -0,0 +1,394 @@
+package usrmgr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// auditChain returns n correctly chained entries starting at seq 1.
+func auditChain(t *testing.T, n int) []AuditEntry {
+	t.Helper()
+	entries := make([]AuditEntry, 0, n)
+	prev := ""
+	for i := 1; i <= n; i++ {
+		e := AuditEntry{
+			Seq: int64(i), Time: time.Unix(1700000000+int64(i), 0).UTC(),
+			Actor: "admin", Action: AuditUserUpdate, TargetType: AuditTargetUser, TargetID: "u1",
+			Changes: map[string]AuditChange{"name": {Before: `"jane"`, After: `"janet"`}},
+			Details: map[string]string{"reason": "typo"}, IP: "203.0.113.7", PrevHash: prev,
+		}
+		e = sealAuditEntry(t, e)
+		prev = e.Hash
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// sealAuditEntry sets the hashes of e as appendAudit does.
+func sealAuditEntry(t *testing.T, e AuditEntry) AuditEntry {
+	t.Helper()
+	var err error
+	if e.PersonalHash, err = e.personalDigest(); err != nil {
+		t.Fatal(err)
+	}
+	if e.Hash, err = e.digest(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// redacted returns e as redactAudit leaves it.
+func redacted(e AuditEntry) AuditEntry {
+	at := time.Unix(1800000000, 0).UTC()
+	e.Changes, e.Details, e.IP, e.RedactedAt = nil, nil, "", &at
+	return e
+}
+
+// auditDocs returns entries as stored documents.
+func auditDocs(t *testing.T, entries ...AuditEntry) []bson.D {
+	t.Helper()
+	docs := make([]bson.D, 0, len(entries))
+	for _, e := range entries {
+		raw, err := bson.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d bson.D
+		if err := bson.Unmarshal(raw, &d); err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, d)
+	}
+	return docs
+}
+
+func TestAuditDigest(t *testing.T) {
+	e := auditChain(t, 1)[0]
+	digest, _ := e.digest()
+	if digest != e.Hash || len(digest) != 64 {
+		t.Fatalf("digest %q", digest)
+	}
+
+	// personal data and redaction are covered by PersonalHash only
+	for name, modify := range map[string]func(e *AuditEntry){
+		"changes":  func(e *AuditEntry) { e.Changes = nil },
+		"details":  func(e *AuditEntry) { e.Details = map[string]string{"reason": "other"} },
+		"ip":       func(e *AuditEntry) { e.IP = "" },
+		"redacted": func(e *AuditEntry) { at := time.Now(); e.RedactedAt = &at },
+		"timezone": func(e *AuditEntry) { e.Time = e.Time.In(time.FixedZone("x", 3600)) },
+		"hash":     func(e *AuditEntry) { e.Hash = "" },
+	} {
+		c := e
+		modify(&c)
+		if got, _ := c.digest(); got != digest {
+			t.Errorf("digest changes with %s", name)
+		}
+	}
+	for name, modify := range map[string]func(e *AuditEntry){
+		"seq":          func(e *AuditEntry) { e.Seq++ },
+		"time":         func(e *AuditEntry) { e.Time = e.Time.Add(time.Millisecond) },
+		"actor":        func(e *AuditEntry) { e.Actor = "mallory" },
+		"action":       func(e *AuditEntry) { e.Action = AuditUserDelete },
+		"target":       func(e *AuditEntry) { e.TargetID = "u2" },
+		"request":      func(e *AuditEntry) { e.RequestID = "r1" },
+		"trace":        func(e *AuditEntry) { e.TraceID = "t1" },
+		"prevHash":     func(e *AuditEntry) { e.PrevHash = "x" },
+		"personalHash": func(e *AuditEntry) { e.PersonalHash = "x" },
+	} {
+		c := e
+		modify(&c)
+		if got, _ := c.digest(); got == digest {
+			t.Errorf("digest does not cover %s", name)
+		}
+	}
+
+	personal, _ := e.personalDigest()
+	c := e
+	c.IP = "198.51.100.1"
+	if got, _ := c.personalDigest(); got == personal {
+		t.Error("personal digest does not cover the address")
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	type profile struct {
+		Name     string   `json:"name"`
+		Email    string   `json:"email,omitempty"`
+		Labels   []string `json:"labels,omitempty"`
+		Password string   `json:"-"`
+	}
+	changes, err := auditDiff(
+		profile{Name: "jane", Email: "jane@example.com", Password: "old"},
+		profile{Name: "janet", Labels: []string{"vip"}, Password: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]AuditChange{
+		"name":   {Before: `"jane"`, After: `"janet"`},
+		"email":  {Before: `"jane@example.com"`},
+		"labels": {After: `["vip"]`},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes %v, want %v", changes, want)
+	}
+
+	created, _ := auditDiff(nil, profile{Name: "jane"})
+	if !reflect.DeepEqual(created, map[string]AuditChange{"name": {After: `"jane"`}}) {
+		t.Errorf("creation %v", created)
+	}
+	if none, err := auditDiff(nil, nil); none != nil || err != nil {
+		t.Errorf("no values = %v, %v", none, err)
+	}
+	if same, _ := auditDiff(profile{Name: "jane"}, profile{Name: "jane", Password: "x"}); len(same) != 0 {
+		t.Errorf("unchanged values %v", same)
+	}
+}
+
+func TestAuditChangeJSON(t *testing.T) {
+	b, err := json.Marshal(map[string]AuditChange{"name": {Before: `"jane"`, After: `"janet"`}, "email": {After: `"j@example.com"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"email":{"after":"j@example.com"},"name":{"before":"jane","after":"janet"}}`; string(b) != want {
+		t.Errorf("json %s, want %s", b, want)
+	}
+}
+
+func TestAuditDetails(t *testing.T) {
+	got := auditDetails("session", "s1", "scope", "", "count", 0, "forced", true, "dangling")
+	if want := map[string]string{"session": "s1", "forced": "true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("details %v, want %v", got, want)
+	}
+	if got := auditDetails("scope", ""); got != nil {
+		t.Errorf("details %v, want nil", got)
+	}
+}
+
+func TestUserFilterAuditDetails(t *testing.T) {
+	got := UserFilter{Status: "active", Email: " Jane@Example.com"}.auditDetails(2)
+	want := map[string]string{"status": "active", "emailHash": emailHash("jane@example.com"), "count": "2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("details %v, want %v", got, want)
+	}
+	for _, v := range got {
+		if strings.Contains(strings.ToLower(v), "jane") {
+			t.Errorf("email kept in plaintext: %v", got)
+		}
+	}
+	if emailHash("") != "" {
+		t.Error("empty email hashed")
+	}
+}
+
+func TestAppendAudit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+	duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"})
+	last := func(seq int64, hash string) bson.D {
+		return found(bson.D{{Key: "_id", Value: seq}, {Key: "hash", Value: hash}})
+	}
+	ctx := withRequestInfo(WithActor(context.Background(), "admin"), requestInfo{ID: "r1", IP: "203.0.113.7"})
+	ev := auditEvent{
+		Action: AuditUserUpdate, TargetType: AuditTargetUser, TargetID: "u1",
+		Before: User{ID: "u1", Name: "jane", PasswordHash: "h1"}, After: User{ID: "u1", Name: "janet", PasswordHash: "h2"},
+	}
+
+	mt.Run("first entry", func(mt *mtest.T) {
+		useMockCollections(t, mt, &auditCollection)
+		mt.AddMockResponses(found(), mtest.CreateSuccessResponse())
+
+		e, err := appendAudit(ctx, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Seq != 1 || e.PrevHash != "" || e.Actor != "admin" || e.RequestID != "r1" || e.IP != "203.0.113.7" {
+			t.Errorf("entry %+v", e)
+		}
+		if digest, _ := e.digest(); e.Hash != digest {
+			t.Error("hash is not the digest")
+		}
+		if personal, _ := e.personalDigest(); e.PersonalHash != personal {
+			t.Error("personal hash is not the personal digest")
+		}
+		if _, ok := e.Changes["passwordHash"]; ok || len(e.Changes) != 1 {
+			t.Errorf("changes %v", e.Changes)
+		}
+	})
+	mt.Run("concurrent append", func(mt *mtest.T) {
+		useMockCollections(t, mt, &auditCollection)
+		mt.AddMockResponses(last(1, "h1"), duplicate, last(2, "h2"), mtest.CreateSuccessResponse())
+
+		e, err := appendAudit(ctx, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Seq != 3 || e.PrevHash != "h2" {
+			t.Errorf("entry %d chained to %q, want 3 chained to h2", e.Seq, e.PrevHash)
+		}
+	})
+	mt.Run("contention", func(mt *mtest.T) {
+		useMockCollections(t, mt, &auditCollection)
+		for i := 0; i < auditAppendAttempts; i++ {
+			mt.AddMockResponses(last(int64(i+1), "h"), duplicate)
+		}
+		if _, err := appendAudit(ctx, ev); !errors.Is(err, errAuditContention) {
+			t.Errorf("appendAudit = %v, want errAuditContention", err)
+		}
+	})
+}
+
+func TestRecordAuditDisabled(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("disabled", func(mt *mtest.T) {
+		useMockCollections(t, mt, &auditCollection)
+		t.Setenv("AUDIT_ENABLE", "false")
+		recordAudit(context.Background(), auditEvent{Action: AuditLogin, TargetType: AuditTargetUser, TargetID: "u1"})
+		if got := commands(mt); len(got) != 0 {
+			t.Errorf("commands %v", got)
+		}
+	})
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	chain := auditChain(t, 4)
+	modified := chain[1]
+	modified.Actor = "mallory"
+	tampered := chain[1]
+	tampered.IP = "198.51.100.1"
+	halfRedacted := redacted(chain[1])
+	halfRedacted.Details = chain[1].Details
+	reordered := sealAuditEntry(t, AuditEntry{Seq: 2, Time: chain[1].Time, Actor: "admin", PrevHash: "forged"})
+
+	tests := []struct {
+		name     string
+		from     int64
+		prev     []AuditEntry
+		entries  []AuditEntry
+		want     AuditVerification
+		commands int
+	}{
+		{name: "valid", entries: chain, want: AuditVerification{Checked: 4, Valid: true}},
+		{name: "redacted", entries: []AuditEntry{chain[0], redacted(chain[1]), chain[2]}, want: AuditVerification{Checked: 3, Valid: true}},
+		{name: "empty", want: AuditVerification{Valid: true}},
+		{name: "deleted entry", entries: []AuditEntry{chain[0], chain[2], chain[3]}, want: AuditVerification{Checked: 1, BrokenAt: 2, Reason: "entry missing"}},
+		{name: "modified entry", entries: []AuditEntry{chain[0], modified, chain[2]}, want: AuditVerification{Checked: 1, BrokenAt: 2, Reason: "entry modified"}},
+		{name: "modified personal data", entries: []AuditEntry{chain[0], tampered}, want: AuditVerification{Checked: 1, BrokenAt: 2, Reason: "entry modified"}},
+		{name: "partly redacted", entries: []AuditEntry{chain[0], halfRedacted}, want: AuditVerification{Checked: 1, BrokenAt: 2, Reason: "redacted entry modified"}},
+		{name: "replaced entry", entries: []AuditEntry{chain[0], reordered}, want: AuditVerification{Checked: 1, BrokenAt: 2, Reason: "chain broken"}},
+		{name: "from the middle", from: 3, prev: chain[1:2], entries: chain[2:], want: AuditVerification{Checked: 2, Valid: true}},
+		{name: "from the middle, wrong predecessor", from: 3, prev: chain[0:1], entries: chain[2:], want: AuditVerification{BrokenAt: 3, Reason: "chain broken"}},
+		{name: "predecessor missing", from: 3, prev: []AuditEntry{}, want: AuditVerification{BrokenAt: 2, Reason: "entry missing"}},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockCollections(t, mt, &auditCollection)
+			if tt.prev != nil {
+				mt.AddMockResponses(found(auditDocs(t, tt.prev...)...))
+			}
+			mt.AddMockResponses(found(auditDocs(t, tt.entries...)...))
+
+			got, err := VerifyAuditChain(context.Background(), tt.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("VerifyAuditChain = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactAudit(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("redact", func(mt *mtest.T) {
+		useMockCollections(t, mt, &auditCollection)
+		mt.AddMockResponses(updated(3))
+
+		n, err := redactAudit(context.Background(), bson.M{"targetId": "u1"})
+		if err != nil || n != 3 {
+			t.Fatalf("redactAudit = %d, %v", n, err)
+		}
+		update := lastUpdate(t, mt)
+		if _, err := update.LookupErr("q", "redactedAt", "$exists"); err != nil {
+			t.Error("redacted entries are redacted again")
+		}
+		unset := update.Lookup("u", "$unset").Document()
+		for _, field := range []string{"changes", "details", "ip"} {
+			if _, err := unset.LookupErr(field); err != nil {
+				t.Errorf("%s not removed", field)
+			}
+		}
+		if _, err := update.LookupErr("u", "$set", "redactedAt"); err != nil {
+			t.Error("redactedAt not set")
+		}
+	})
+}
+
+func TestAuditFilterQuery(t *testing.T) {
+	since := time.Unix(1700000000, 0)
+	q := AuditFilter{Actor: "admin", TargetID: "u1", Since: since, Before: 42}.query()
+	want := bson.M{"actor": "admin", "targetId": "u1", "time": bson.M{"$gte": since}, "_id": bson.M{"$lt": int64(42)}}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("query %v, want %v", q, want)
+	}
+	if q := (AuditFilter{}).query(); len(q) != 0 {
+		t.Errorf("empty filter %v", q)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"given", "req-1", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("x", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var info requestInfo
+			r := gin.New()
+			r.GET("/", RequestContext(), func(c *gin.Context) { info = requestInfoFromContext(c.Request.Context()) })
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "203.0.113.7:4000"
+			if tt.header != "" {
+				req.Header.Set("X-Request-ID", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if info.IP != "203.0.113.7" {
+				t.Errorf("ip %q", info.IP)
+			}
+			if got := w.Header().Get("X-Request-ID"); got != info.ID {
+				t.Errorf("response id %q, context id %q", got, info.ID)
+			}
+			if tt.keep && info.ID != tt.header {
+				t.Errorf("id %q, want %q", info.ID, tt.header)
+			}
+			if !tt.keep && (info.ID == tt.header || len(info.ID) != 32) {
+				t.Errorf("generated id %q", info.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func LoginHandler(c *gin.Context) {
+	tracer := otel.Tracer("LoginHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "LoginHandler")
+	defer span.End()
+
+	var req struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := Login(ctx, req.Email, req.Password, c.Request.UserAgent(), c.ClientIP())
+	writeLoginResult(c, ctx, result, err)
+}
+
+// LoginMFAHandler completes a login of a user with MFA.
+func LoginMFAHandler(c *gin.Context) {
+	tracer := otel.Tracer("LoginMFAHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "LoginMFAHandler")
+	defer span.End()
+
+	var req struct {
+		Challenge string `json:"mfaChallenge" binding:"required"`
+		Code      string `json:"code" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := CompleteMFALogin(ctx, req.Challenge, req.Code, c.Request.UserAgent(), c.ClientIP())
+	writeLoginResult(c, ctx, result, err)
+}
+
+func writeLoginResult(c *gin.Context, ctx context.Context, result LoginResult, err error) {
+	var rateLimitErr *RateLimitError
+	switch {
+	case errors.As(err, &rateLimitErr):
+		c.Header("Retry-After", strconv.Itoa(int(rateLimitErr.RetryAfter.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrInvalidMFACode), errors.Is(err, ErrInvalidToken):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrUserInactive):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		logs.FromContext(ctx).Errorf("login failed, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to log in"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// StartMFAEnrollmentHandler returns a new TOTP secret and its otpauth://
+// URI, which clients show as a QR code.
+func StartMFAEnrollmentHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	enrollment, err := StartMFAEnrollment(ctx, c.GetString(principalKey))
+	if err != nil {
+		writeUserError(c, ctx, "start mfa enrollment of", c.GetString(principalKey), err)
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+// ActivateMFAHandler enables MFA with a first code of the authenticator and
+// returns the recovery codes. The session used for enrollment is ended as
+// it may have been limited to it.
+func ActivateMFAHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := ActivateMFA(ctx, c.GetString(principalKey), req.Code)
+	if err != nil {
+		writeUserError(c, ctx, "activate mfa of", c.GetString(principalKey), err)
+		return
+	}
+	if token, ok := bearerToken(c); ok {
+		if err := RevokeSession(ctx, token); err != nil {
+			logs.FromContext(ctx).Errorf("unable to end enrollment session, error - %v", err)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// LogoutHandler revokes the session the request was authenticated with.
+func LogoutHandler(c *gin.Context) {
+	ctx := WithActor(c.Request.Context(), requestActor(c))
+	token, _ := bearerToken(c)
+	if err := RevokeSession(ctx, token); err != nil {
+		logs.FromContext(ctx).Errorf("logout failed, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to log out"})
+		return
+	}
+	recordAudit(ctx, auditEvent{
+		Action: AuditLogout, TargetType: AuditTargetUser, TargetID: c.GetString(principalKey),
+		Details: auditDetails("session", sessionID(token)),
+	})
+	c.Status(http.StatusNoContent)
+}
+
+// ForgotPasswordHandler always answers 202 so it can not be used to find
+// out which emails are registered. The work happens after the response,
+// keeping the response time independent of the email as well.
+func ForgotPasswordHandler(c *gin.Context) {
+	tracer := otel.Tracer("ForgotPasswordHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "ForgotPasswordHandler")
+	defer span.End()
+
+	var req struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// keep the trace but not the cancellation of the request
+	bgCtx := trace.ContextWithSpanContext(context.Background(), span.SpanContext())
+	go func() {
+		bgCtx, cancel := context.WithTimeout(bgCtx, 30*time.Second)
+		defer cancel()
+		if err := ForgotPassword(bgCtx, req.Email); err != nil {
+			logs.FromContext(bgCtx).Errorf("password reset request failed, error - %v", err)
+		}
+	}()
+
+	logs.FromContext(ctx).Debug("password reset requested")
+	c.JSON(http.StatusAccepted, gin.H{"status": "if the email is registered a reset link has been sent"})
+}
+
+// resetPasswordForm posts the new password of the link's token to
+// POST /password/reset.
+var resetPasswordForm = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Reset your password</title></head>
+<body>
+<form id="reset">
+<input type="hidden" name="token" value="{{.}}">
+<p><label>New password <input type="password" name="password" autocomplete="new-password" required></label></p>
+<p><label>MFA code, if enabled <input name="mfaCode" autocomplete="one-time-code"></label></p>
+<p><button>Reset password</button></p>
+</form>
+<p id="result"></p>
+<script>
+document.getElementById("reset").addEventListener("submit", async function (e) {
+	e.preventDefault();
+	const form = new FormData(e.target);
+	const res = await fetch(location.pathname, {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify({token: form.get("token"), password: form.get("password"), mfaCode: form.get("mfaCode")}),
+	});
+	document.getElementById("result").textContent = res.ok ? "Your password has been reset." : (await res.json()).error;
+});
+</script>
+</body>
+</html>
+`))
+
+// ResetPasswordFormHandler serves the form the emailed reset link opens
+// when PASSWORD_RESET_URL does not point to a frontend.
+func ResetPasswordFormHandler(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+	// the token is in the URL, keep it out of caches and referrers
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	if err := resetPasswordForm.Execute(c.Writer, token); err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to render the password reset form, error - %v", err)
+	}
+}
+
+func ResetPasswordHandler(c *gin.Context) {
+	tracer := otel.Tracer("ResetPasswordHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "ResetPasswordHandler")
+	defer span.End()
+
+	var req struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+		MFACode  string `json:"mfaCode"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ResetPassword(ctx, req.Token, req.Password, req.MFACode); err != nil {
+		writeUserError(c, ctx, "reset password of", "", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,308 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/mailer"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+)
+
+// Password event types.
+const (
+	EventPasswordResetRequested = "PasswordResetRequested"
+	EventPasswordReset          = "PasswordReset"
+)
+
+var (
+	ErrUserInactive    = errors.New("user is not active")
+	ErrMFACodeRequired = errors.New("mfa code required")
+)
+
+// findUserByEmail returns the user owning email.
+func findUserByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	q, err := userFieldQuery(ctx, "email", strings.ToLower(strings.TrimSpace(email)))
+	if err != nil {
+		return user, err
+	}
+	filter := bson.D{{Key: "email", Value: q}, deletedFilter(false)}
+	err = userCollection.FindOne(ctx, filter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// LoginResult is the outcome of a successful password check. Users with
+// MFA get an MFAChallenge to complete with CompleteMFALogin instead of a
+// session; users who must use MFA but have not enrolled get a session
+// limited to enrollment.
+type LoginResult struct {
+	Token        string   `json:"token,omitempty"`
+	Session      *Session `json:"session,omitempty"`
+	MFAChallenge string   `json:"mfaChallenge,omitempty"`
+	// AccessToken and IDToken are signed JWTs other services can validate
+	// with the JWKS. Sessions limited to MFA enrollment get none.
+	AccessToken string `json:"accessToken,omitempty"`
+	IDToken     string `json:"idToken,omitempty"`
+}
+
+// Login checks the credentials and starts a session. Unknown users, users
+// without a password and wrong passwords all fail with
+// ErrInvalidCredentials after the same amount of work. Repeated failures
+// delay and then lock the account and the address with a RateLimitError.
+func Login(ctx context.Context, email, password, userAgent, remoteAddr string) (LoginResult, error) {
+
+	tracer := otel.Tracer("LoginServiceTrace")
+	ctx, span := tracer.Start(ctx, "LoginService")
+	defer span.End()
+
+	if err := checkLoginAllowed(ctx, email, remoteAddr); err != nil {
+		return LoginResult{}, err
+	}
+	user, err := findUserByEmail(ctx, email)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return LoginResult{}, err
+	}
+	if err != nil || user.PasswordHash == "" {
+		checkDummyPassword(password)
+		recordLoginFailure(ctx, email, remoteAddr, user.ID)
+		return LoginResult{}, ErrInvalidCredentials
+	}
+	ok, err := checkPassword(user.PasswordHash, password)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if !ok {
+		recordLoginFailure(ctx, email, remoteAddr, user.ID)
+		return LoginResult{}, ErrInvalidCredentials
+	}
+	if user.Status != UserStatusActive {
+		return LoginResult{}, ErrUserInactive
+	}
+
+	if user.mfaEnabled() {
+		ttl := utils.GetEnvDurationParam("MFA_CHALLENGE_TTL", 5*time.Minute)
+		challenge, err := issueToken(ctx, TokenMFAChallenge, user.ID, "", ttl)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{MFAChallenge: challenge}, nil
+	}
+
+	recordLoginSuccess(ctx, email)
+	scope := ""
+	if mfaRequired(user) {
+		scope = SessionScopeMFAEnrollment
+	}
+	return startSession(ctx, user.ID, scope, userAgent, remoteAddr, []string{"pwd"})
+}
+
+// CompleteMFALogin finishes a login with the challenge returned by Login
+// and a TOTP or recovery code. A challenge can be tried only once, a wrong
+// code requires logging in with the password again.
+func CompleteMFALogin(ctx context.Context, challenge, code, userAgent, remoteAddr string) (LoginResult, error) {
+
+	tracer := otel.Tracer("CompleteMFALoginServiceTrace")
+	ctx, span := tracer.Start(ctx, "CompleteMFALoginService")
+	defer span.End()
+
+	claims, err := redeemToken(ctx, TokenMFAChallenge, challenge)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	user, err := GetUserByID(ctx, claims.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return LoginResult{}, ErrInvalidToken
+	}
+	if err != nil {
+		return LoginResult{}, err
+	}
+	if user.Status != UserStatusActive {
+		return LoginResult{}, ErrUserInactive
+	}
+	if err := checkLoginAllowed(ctx, user.Email, remoteAddr); err != nil {
+		return LoginResult{}, err
+	}
+	if err := verifyMFA(WithActor(ctx, user.ID), user, code); err != nil {
+		if errors.Is(err, ErrInvalidMFACode) {
+			recordLoginFailure(ctx, user.Email, remoteAddr, user.ID)
+		}
+		return LoginResult{}, err
+	}
+	recordLoginSuccess(ctx, user.Email)
+	return startSession(ctx, user.ID, "", userAgent, remoteAddr, []string{"pwd", "otp"})
+}
+
+// startSession creates the session of a login and, for full access, its
+// tokens. amr lists the authentication methods used.
+func startSession(ctx context.Context, userID, scope, userAgent, remoteAddr string, amr []string) (LoginResult, error) {
+	token, session, err := CreateSession(ctx, userID, scope, userAgent, remoteAddr)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	result := LoginResult{Token: token, Session: &session}
+	if scope == "" {
+		if result.AccessToken, result.IDToken, err = issueTokens(ctx, session, amr); err != nil {
+			return LoginResult{}, err
+		}
+	}
+	SendLogs(ctx, fmt.Sprintf("user %s logged in", userID))
+	recordAudit(WithActor(ctx, userID), auditEvent{
+		Action: AuditLogin, TargetType: AuditTargetUser, TargetID: userID,
+		Details: auditDetails("session", session.ID, "scope", scope, "amr", strings.Join(amr, " ")),
+	})
+	return result, nil
+}
+
+// passwordResetLink returns the link mailed to reset a password: the form
+// at PASSWORD_RESET_URL, by default the one served by the service, with the
+// token added to its query.
+func passwordResetLink(token string) string {
+	link := utils.GetEnvParam("PASSWORD_RESET_URL", publicURL+"/password/reset")
+	u, err := url.Parse(link)
+	if err != nil {
+		return link + "?token=" + url.QueryEscape(token)
+	}
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// ForgotPassword mails a password reset link to the owner of email. Links
+// only go to verified addresses, an unverified one may belong to someone
+// else. It reports nothing about whether the email is known: unknown or
+// unverified emails and rate limited requests are only logged.
+func ForgotPassword(ctx context.Context, email string) error {
+
+	tracer := otel.Tracer("ForgotPasswordServiceTrace")
+	ctx, span := tracer.Start(ctx, "ForgotPasswordService")
+	defer span.End()
+
+	user, err := findUserByEmail(ctx, email)
+	if errors.Is(err, ErrUserNotFound) {
+		logs.FromContext(ctx).Debug("password reset requested for an unknown email")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !user.EmailVerified {
+		logs.FromContext(ctx).Warnf("password reset of user %s refused, email not verified", user.ID)
+		return nil
+	}
+
+	now := time.Now().UTC()
+	dayAgo := now.Add(-24 * time.Hour)
+	n, _, last, err := recentTokens(ctx, TokenPasswordReset, user.ID, dayAgo)
+	if err != nil {
+		return err
+	}
+	interval := utils.GetEnvDurationParam("PASSWORD_RESET_INTERVAL", time.Minute)
+	max := utils.GetEnvIntParam("PASSWORD_RESET_MAX", 5)
+	if (n > 0 && now.Sub(last) < interval) || (max > 0 && n >= int64(max)) {
+		logs.FromContext(ctx).Warnf("password reset of user %s rate limited", user.ID)
+		return nil
+	}
+
+	ttl := utils.GetEnvDurationParam("PASSWORD_RESET_TOKEN_TTL", 30*time.Minute)
+	token, err := issueToken(ctx, TokenPasswordReset, user.ID, user.Email, ttl)
+	if err != nil {
+		return err
+	}
+	link := passwordResetLink(token)
+	err = mailSender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\na password reset was requested for your account. Choose a new password at\n\n%s\n\n"+
+			"The link expires in %s. If you did not ask for it you can ignore this email.\n", user.Name, link, ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = PublishEvent(ctx, Event{Type: EventPasswordResetRequested, UserID: user.ID, Actor: user.ID})
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to publish %s event of user %s: %v", EventPasswordResetRequested, user.ID, err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and revokes every
+// session of the user. The token is only used up once the new password
+// passed the policy, so a rejected password can be corrected. Users with
+// MFA also need a TOTP or recovery code, missing it fails with
+// ErrMFACodeRequired; a wrong code uses the token up, like a failed MFA
+// login.
+func ResetPassword(ctx context.Context, token, password, mfaCode string) error {
+
+	tracer := otel.Tracer("ResetPasswordServiceTrace")
+	ctx, span := tracer.Start(ctx, "ResetPasswordService")
+	defer span.End()
+
+	claims, err := parseToken(TokenPasswordReset, token)
+	if err != nil {
+		return err
+	}
+	user, err := GetUserByID(ctx, claims.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return ErrInvalidToken
+	}
+	if err != nil {
+		return err
+	}
+	// the link went to an address the user no longer has, or that is not
+	// verified anymore
+	if user.Email != claims.Email || !user.EmailVerified {
+		return ErrInvalidToken
+	}
+	if err := validatePassword(user, password); err != nil {
+		return err
+	}
+	if user.mfaEnabled() && mfaCode == "" {
+		return ErrMFACodeRequired
+	}
+	if err := useToken(ctx, claims); err != nil {
+		return err
+	}
+
+	ctx = WithActor(ctx, user.ID)
+	if user.mfaEnabled() {
+		if err := verifyMFA(ctx, user, mfaCode); err != nil {
+			return err
+		}
+	}
+	if err := setPassword(ctx, user.ID, password); err != nil {
+		return err
+	}
+	revoked, err := RevokeUserSessions(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	SendLogs(ctx, fmt.Sprintf("user %s reset password, %d sessions revoked", user.ID, revoked))
+	recordAudit(ctx, auditEvent{
+		Action: AuditPasswordReset, TargetType: AuditTargetUser, TargetID: user.ID,
+		Details: auditDetails("sessionsRevoked", revoked),
+	})
+	err = PublishEvent(ctx, Event{
+		Type:   EventPasswordReset,
+		UserID: user.ID,
+		Actor:  user.ID,
+		Data:   map[string]interface{}{"sessionsRevoked": revoked},
+	})
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to publish %s event of user %s: %v", EventPasswordReset, user.ID, err)
+	}
+	return nil
+}
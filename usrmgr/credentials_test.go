@@ -0,0 +1,244 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/mailer"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+type recordingMailer struct {
+	sent []mailer.Message
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func useRecordingMailer(t *testing.T) *recordingMailer {
+	t.Helper()
+	m := &recordingMailer{}
+	prev := mailSender
+	mailSender = m
+	t.Cleanup(func() { mailSender = prev })
+	return m
+}
+
+func resetUser(verified bool) bson.D {
+	return bson.D{
+		{Key: "id", Value: "u1"}, {Key: "name", Value: "jane"},
+		{Key: "email", Value: "jane@example.com"}, {Key: "emailVerified", Value: verified},
+		{Key: "status", Value: UserStatusActive}, {Key: "version", Value: int64(1)},
+	}
+}
+
+func withMFA(user bson.D) bson.D {
+	return append(user, bson.E{Key: "mfa", Value: bson.D{
+		{Key: "enabled", Value: true},
+		{Key: "secret", Value: "JBSWY3DPEHPK3PXP"},
+	}})
+}
+
+func resetToken(email string) string {
+	return signedToken(tokenClaims{
+		Purpose: TokenPasswordReset, UserID: "u1", Email: email, Nonce: "nonce",
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	})
+}
+
+// commands returns the names of the commands sent to the mocked deployment.
+func commands(mt *mtest.T) []string {
+	var names []string
+	for _, ev := range mt.GetAllStartedEvents() {
+		names = append(names, ev.CommandName)
+	}
+	return names
+}
+
+func TestForgotPassword(t *testing.T) {
+	useTestProducer(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("unverified email", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found(resetUser(false)))
+
+		if err := ForgotPassword(context.Background(), "jane@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent.sent) != 0 {
+			t.Error("reset link mailed to an unverified address")
+		}
+		if got := commands(mt); len(got) != 1 {
+			t.Errorf("commands %v, want no token issued", got)
+		}
+	})
+	mt.Run("verified email", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found(resetUser(true)), found(), mtest.CreateSuccessResponse())
+
+		if err := ForgotPassword(context.Background(), "Jane@Example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent.sent) != 1 || sent.sent[0].To != "jane@example.com" || !strings.Contains(sent.sent[0].Body, "/password/reset?token=") {
+			t.Errorf("sent %+v", sent.sent)
+		}
+	})
+	mt.Run("unknown email", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found())
+
+		if err := ForgotPassword(context.Background(), "nobody@example.com"); err != nil || len(sent.sent) != 0 {
+			t.Errorf("ForgotPassword = %v, sent %d", err, len(sent.sent))
+		}
+	})
+}
+
+func TestPasswordResetLinkResolves(t *testing.T) {
+	useTestProducer(t)
+	prev := publicURL
+	publicURL = "http://localhost:8082"
+	t.Cleanup(func() { publicURL = prev })
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("default form", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found(resetUser(true)), found(), mtest.CreateSuccessResponse())
+		if err := ForgotPassword(context.Background(), "jane@example.com"); err != nil || len(sent.sent) != 1 {
+			t.Fatalf("ForgotPassword = %v, sent %d", err, len(sent.sent))
+		}
+		raw := regexp.MustCompile(`https?://\S+`).FindString(sent.sent[0].Body)
+		link, err := url.Parse(raw)
+		if err != nil || link.Query().Get("token") == "" {
+			t.Fatalf("link %q", raw)
+		}
+
+		r := gin.New()
+		r.GET("/password/reset", ResetPasswordFormHandler)
+		r.POST("/password/reset", ResetPasswordHandler)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, link.RequestURI(), nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<form id="reset">`) {
+			t.Fatalf("GET %s = %d %s", link.RequestURI(), w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), `value="`+link.Query().Get("token")+`"`) {
+			t.Error("form does not carry the token")
+		}
+		if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Referrer-Policy") != "no-referrer" {
+			t.Errorf("headers %v", w.Header())
+		}
+	})
+	mt.Run("frontend", func(mt *mtest.T) {
+		t.Setenv("PASSWORD_RESET_URL", "https://app.example.com/reset?lang=en")
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found(resetUser(true)), found(), mtest.CreateSuccessResponse())
+		if err := ForgotPassword(context.Background(), "jane@example.com"); err != nil || len(sent.sent) != 1 {
+			t.Fatalf("ForgotPassword = %v, sent %d", err, len(sent.sent))
+		}
+		link, err := url.Parse(regexp.MustCompile(`https?://\S+`).FindString(sent.sent[0].Body))
+		if err != nil || link.Host != "app.example.com" || link.Path != "/reset" ||
+			link.Query().Get("lang") != "en" || link.Query().Get("token") == "" {
+			t.Errorf("link %v", link)
+		}
+	})
+}
+
+func TestResetPasswordFormHandlerRequiresToken(t *testing.T) {
+	w := serve(ResetPasswordFormHandler, httptest.NewRequest(http.MethodGet, "/password/reset", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d", w.Code)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	useTestProducer(t)
+	const password = "correct horse battery staple"
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name      string
+		email     string
+		code      string
+		responses []bson.D
+		want      error
+		commands  []string
+	}{
+		{
+			name:      "unverified email",
+			email:     "jane@example.com",
+			responses: []bson.D{found(resetUser(false))},
+			want:      ErrInvalidToken,
+			commands:  []string{"find"},
+		},
+		{
+			name:      "email changed after the token was issued",
+			email:     "old@example.com",
+			responses: []bson.D{found(resetUser(true))},
+			want:      ErrInvalidToken,
+			commands:  []string{"find"},
+		},
+		{
+			name:      "token reused",
+			email:     "jane@example.com",
+			responses: []bson.D{found(resetUser(true)), tokenUsed(false)},
+			want:      ErrInvalidToken,
+			commands:  []string{"find", "findAndModify"},
+		},
+		{
+			name:      "mfa code missing",
+			email:     "jane@example.com",
+			responses: []bson.D{found(withMFA(resetUser(true)))},
+			want:      ErrMFACodeRequired,
+			commands:  []string{"find"},
+		},
+		{
+			// the token is used up before the code is checked
+			name:      "mfa code wrong",
+			email:     "jane@example.com",
+			code:      "000000",
+			responses: []bson.D{found(withMFA(resetUser(true))), tokenUsed(true), updated(0)},
+			want:      ErrInvalidMFACode,
+			commands:  []string{"find", "findAndModify", "update"},
+		},
+		{
+			name:      "reset",
+			email:     "jane@example.com",
+			responses: []bson.D{found(resetUser(true)), tokenUsed(true), updated(1), updated(2)},
+			commands:  []string{"find", "findAndModify", "update", "update"},
+		},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useTestTokens(t, mt)
+			useMockCollections(t, mt, &userCollection, &sessionCollection)
+			mt.AddMockResponses(tt.responses...)
+
+			err := ResetPassword(context.Background(), resetToken(tt.email), password, tt.code)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ResetPassword = %v, want %v", err, tt.want)
+			}
+			if got := commands(mt); strings.Join(got, ",") != strings.Join(tt.commands, ",") {
+				t.Errorf("commands %v, want %v", got, tt.commands)
+			}
+		})
+	}
+}
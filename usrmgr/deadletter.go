@@ -0,0 +1,211 @@
+package usrmgr
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"github.com/subhamproject/user-service/logs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Dead letter states.
+const (
+	DeadLetterPending  = "pending"
+	DeadLetterReplayed = "replayed"
+)
+
+var deadLetterCollection *mongo.Collection
+
+// DeadLetter is an event that could not be delivered to Kafka after the
+// writer exhausted its retries.
+type DeadLetter struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Topic       string             `bson:"topic" json:"topic"`
+	Key         string             `bson:"key,omitempty" json:"key,omitempty"`
+	Value       string             `bson:"value" json:"value"`
+	Headers     map[string]string  `bson:"headers,omitempty" json:"headers,omitempty"`
+	Error       string             `bson:"error" json:"error"`
+	Status      string             `bson:"status" json:"status"`
+	FailedAt    time.Time          `bson:"failedAt" json:"failedAt"`
+	ReplayCount int                `bson:"replayCount" json:"replayCount"`
+	ReplayedAt  *time.Time         `bson:"replayedAt,omitempty" json:"replayedAt,omitempty"`
+}
+
+// DeadLetterFilter selects dead letters to inspect or replay. Zero values
+// are ignored. Contains searches the stored values, in which encrypted user
+// fields are ciphertext and only match by id or event type.
+type DeadLetterFilter struct {
+	IDs      []string  `json:"ids,omitempty" form:"id"`
+	Status   string    `json:"status,omitempty" form:"status"`
+	Since    time.Time `json:"since,omitempty" form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Until    time.Time `json:"until,omitempty" form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+	Contains string    `json:"contains,omitempty" form:"contains"`
+	Limit    int64     `json:"limit,omitempty" form:"limit"`
+}
+
+// ReplayResult summarizes a replay run.
+type ReplayResult struct {
+	Replayed int      `json:"replayed"`
+	Failed   int      `json:"failed"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+func (f DeadLetterFilter) query() (bson.M, error) {
+	q := bson.M{}
+	if len(f.IDs) > 0 {
+		ids := make([]primitive.ObjectID, 0, len(f.IDs))
+		for _, id := range f.IDs {
+			oid, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dead letter id %q", id)
+			}
+			ids = append(ids, oid)
+		}
+		q["_id"] = bson.M{"$in": ids}
+	}
+	if f.Status != "" {
+		q["status"] = f.Status
+	}
+	failedAt := bson.M{}
+	if !f.Since.IsZero() {
+		failedAt["$gte"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		failedAt["$lt"] = f.Until
+	}
+	if len(failedAt) > 0 {
+		q["failedAt"] = failedAt
+	}
+	if f.Contains != "" {
+		q["value"] = bson.M{"$regex": regexp.QuoteMeta(f.Contains), "$options": "i"}
+	}
+	return q, nil
+}
+
+// saveDeadLetters stores msgs in the dead letter collection. It is the
+// failure handler of the event producer, so when the store itself is
+// unavailable the events are written to the log as a last resort.
+func saveDeadLetters(ctx context.Context, msgs []kafka.Message, cause error) {
+	logger := logs.FromContext(ctx).WithField("count", len(msgs))
+	logger.Errorf("failed to deliver events to kafka, moving them to the dead letter store: %v", cause)
+
+	if len(msgs) == 0 {
+		return
+	}
+
+	docs := make([]interface{}, 0, len(msgs))
+	now := time.Now().UTC()
+	for _, msg := range msgs {
+		dl := DeadLetter{
+			Topic:    topic,
+			Key:      string(msg.Key),
+			Value:    string(msg.Value),
+			Error:    cause.Error(),
+			Status:   DeadLetterPending,
+			FailedAt: now,
+		}
+		if len(msg.Headers) > 0 {
+			dl.Headers = map[string]string{}
+			for _, h := range msg.Headers {
+				dl.Headers[h.Key] = string(h.Value)
+			}
+		}
+		docs = append(docs, dl)
+	}
+
+	// the request context may already be done, the store must not depend on it
+	storeCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if deadLetterCollection == nil {
+		logDeadLetters(logger, msgs, fmt.Errorf("dead letter store not initialized"))
+		return
+	}
+	if _, err := deadLetterCollection.InsertMany(storeCtx, docs); err != nil {
+		logDeadLetters(logger, msgs, err)
+	}
+}
+
+// logDeadLetters logs the events that could not be stored. Their values
+// may hold personal data and are left out.
+func logDeadLetters(logger *logrus.Entry, msgs []kafka.Message, err error) {
+	for _, msg := range msgs {
+		logger.Errorf("unable to store dead letter (%v), lost event on topic %s with key %q, %d bytes", err, topic, msg.Key, len(msg.Value))
+	}
+}
+
+// ListDeadLetters returns the dead letters matching filter, oldest first.
+func ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]DeadLetter, error) {
+	q, err := filter.query()
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "failedAt", Value: 1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+
+	cursor, err := deadLetterCollection.Find(ctx, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	deadLetters := []DeadLetter{}
+	if err = cursor.All(ctx, &deadLetters); err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+// ReplayDeadLetters writes the dead letters matching filter back to the main
+// topic, one by one and bypassing the producer queue, and marks the ones
+// that were delivered as replayed. It stops at the first entry that cannot
+// be marked, since replaying again would deliver that event twice, and
+// returns the marking error along with the result so far.
+func ReplayDeadLetters(ctx context.Context, filter DeadLetterFilter) (ReplayResult, error) {
+	deadLetters, err := ListDeadLetters(ctx, filter)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+
+	result, err := replayDeadLetters(ctx, deadLetters, kafkaWriter, markDeadLetterReplayed)
+	logs.FromContext(ctx).Infof("replayed %d dead letters, %d failed", result.Replayed, result.Failed)
+	return result, err
+}
+
+func replayDeadLetters(ctx context.Context, deadLetters []DeadLetter, w messageWriter, mark func(context.Context, primitive.ObjectID) error) (ReplayResult, error) {
+	var result ReplayResult
+	for _, dl := range deadLetters {
+		msg := kafka.Message{Key: []byte(dl.Key), Value: []byte(dl.Value)}
+		for k, v := range dl.Headers {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+		}
+
+		if err := w.WriteMessages(ctx, msg); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", dl.ID.Hex(), err))
+			continue
+		}
+
+		if err := mark(ctx, dl.ID); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: replayed but not marked: %v", dl.ID.Hex(), err))
+			return result, fmt.Errorf("unable to mark dead letter %s as replayed: %w", dl.ID.Hex(), err)
+		}
+		result.Replayed++
+	}
+	return result, nil
+}
+
+func markDeadLetterReplayed(ctx context.Context, id primitive.ObjectID) error {
+	_, err := deadLetterCollection.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{"status": DeadLetterReplayed, "replayedAt": time.Now().UTC()},
+		"$inc": bson.M{"replayCount": 1},
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package usrmgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDeadLetterFilterQuery(t *testing.T) {
+	id := primitive.NewObjectID()
+	since := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	q, err := DeadLetterFilter{IDs: []string{id.Hex()}, Status: DeadLetterPending, Since: since, Contains: "a.b"}.query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"_id":      bson.M{"$in": []primitive.ObjectID{id}},
+		"status":   DeadLetterPending,
+		"failedAt": bson.M{"$gte": since},
+		"value":    bson.M{"$regex": `a\.b`, "$options": "i"},
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("query = %v, want %v", q, want)
+	}
+
+	if q, _ := (DeadLetterFilter{}).query(); len(q) != 0 {
+		t.Errorf("empty filter query = %v", q)
+	}
+	if _, err := (DeadLetterFilter{IDs: []string{"nope"}}).query(); err == nil {
+		t.Error("invalid id accepted")
+	}
+}
+
+// keyWriter fails the messages whose key is in fail.
+type keyWriter struct {
+	fail    map[string]bool
+	written []string
+}
+
+func (w *keyWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, m := range msgs {
+		if w.fail[string(m.Key)] {
+			return errors.New("broker down")
+		}
+		w.written = append(w.written, string(m.Key))
+	}
+	return nil
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	dls := []DeadLetter{
+		{ID: primitive.NewObjectID(), Key: "a", Headers: map[string]string{"h": "v"}},
+		{ID: primitive.NewObjectID(), Key: "b"},
+		{ID: primitive.NewObjectID(), Key: "c"},
+	}
+	w := &keyWriter{fail: map[string]bool{"b": true}}
+	var marked []primitive.ObjectID
+	mark := func(_ context.Context, id primitive.ObjectID) error {
+		marked = append(marked, id)
+		return nil
+	}
+
+	result, err := replayDeadLetters(context.Background(), dls, w, mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Replayed != 2 || result.Failed != 1 || len(result.Errors) != 1 {
+		t.Errorf("result = %+v, want 2 replayed and 1 failed", result)
+	}
+	if !reflect.DeepEqual(marked, []primitive.ObjectID{dls[0].ID, dls[2].ID}) {
+		t.Errorf("marked %v, want only the delivered entries", marked)
+	}
+}
+
+func TestReplayDeadLettersMarkFailure(t *testing.T) {
+	dls := []DeadLetter{
+		{ID: primitive.NewObjectID(), Key: "a"},
+		{ID: primitive.NewObjectID(), Key: "b"},
+		{ID: primitive.NewObjectID(), Key: "c"},
+	}
+	storeDown := errors.New("store down")
+	w := &keyWriter{}
+	mark := func(_ context.Context, id primitive.ObjectID) error {
+		if id == dls[1].ID {
+			return storeDown
+		}
+		return nil
+	}
+
+	result, err := replayDeadLetters(context.Background(), dls, w, mark)
+	if !errors.Is(err, storeDown) {
+		t.Fatalf("err = %v, want the marking error", err)
+	}
+	if result.Replayed != 1 || result.Failed != 1 {
+		t.Errorf("result = %+v, want the unmarked entry counted as failed", result)
+	}
+	if !reflect.DeepEqual(w.written, []string{"a", "b"}) {
+		t.Errorf("written %v, want the replay to stop after the unmarked entry", w.written)
+	}
+}
+
+func TestLogDeadLettersLeavesValuesOut(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	msgs := []kafka.Message{{Key: []byte("u1"), Value: []byte(`{"data":{"name":"jane"}}`)}}
+	logDeadLetters(logrus.NewEntry(logger), msgs, errors.New("mongo down"))
+
+	out := buf.String()
+	if strings.Contains(out, "jane") {
+		t.Errorf("value logged: %s", out)
+	}
+	if !strings.Contains(out, `key \"u1\"`) || !strings.Contains(out, "24 bytes") {
+		t.Errorf("log %s, want key and size", out)
+	}
+}
@@ -0,0 +1,597 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/subhamproject/user-service/fieldcrypt"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+)
+
+var (
+	ErrEncryptionNotConfigured = errors.New("encrypted field found but field encryption is not enabled")
+
+	dataKeyCollection *mongo.Collection
+	// fieldEncryption is nil while FIELD_ENCRYPTION_ENABLE is off.
+	fieldEncryption *fieldEncryptor
+)
+
+// encryptableFields are the user fields that can be encrypted. Fields the
+// service looks users up by must use deterministic encryption.
+var encryptableFields = map[string]bool{"name": false, "email": true, "phone": false, "displayName": false}
+
+// dataKeyRecord is a data key as stored, wrapped by a master key of the
+// key provider. Data keys are never deleted: backups may still need them.
+type dataKeyRecord struct {
+	ID          string     `bson:"_id"`
+	MasterKeyID string     `bson:"masterKeyId"`
+	WrappedKey  []byte     `bson:"wrappedKey"`
+	CreatedAt   time.Time  `bson:"createdAt"`
+	RotatedAt   *time.Time `bson:"rotatedAt,omitempty"`
+}
+
+// fieldEncryptor encrypts the configured user fields with the newest data
+// key. The keys are cached, reloading at most once a minute so every
+// instance picks up rotations.
+type fieldEncryptor struct {
+	provider      fieldcrypt.KeyProvider
+	fields        map[string]bool
+	deterministic map[string]bool
+
+	mu       sync.Mutex
+	keys     map[string]fieldcrypt.DataKey
+	current  fieldcrypt.DataKey
+	loadedAt time.Time
+}
+
+// InitFieldEncryption sets up encryption of the FIELD_ENCRYPTION_FIELDS of
+// users and creates the first data key if there is none. It must run
+// before users are read or written.
+func InitFieldEncryption(ctx context.Context) error {
+	if !utils.GetEnvBoolParam("FIELD_ENCRYPTION_ENABLE", false) {
+		fieldEncryption = nil
+		return nil
+	}
+	provider, err := fieldcrypt.FromEnv()
+	if err != nil {
+		return err
+	}
+	enc := &fieldEncryptor{
+		provider:      provider,
+		fields:        map[string]bool{},
+		deterministic: map[string]bool{},
+		keys:          map[string]fieldcrypt.DataKey{},
+	}
+	for _, f := range strings.Split(utils.GetEnvParam("FIELD_ENCRYPTION_FIELDS", "name,email,phone,displayName"), ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		queried, ok := encryptableFields[f]
+		if !ok {
+			return fmt.Errorf("FIELD_ENCRYPTION_FIELDS: %q can not be encrypted", f)
+		}
+		enc.fields[f] = true
+		enc.deterministic[f] = queried
+	}
+	fieldEncryption = enc
+
+	if _, err := RotateDataKeys(WithActor(ctx, SystemActor), false); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (e *fieldEncryptor) load(ctx context.Context) error {
+	cur, err := dataKeyCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var records []dataKeyRecord
+	if err := cur.All(ctx, &records); err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("no data key, run InitFieldEncryption")
+	}
+	for _, r := range records {
+		if _, ok := e.keys[r.ID]; ok {
+			continue
+		}
+		k, err := e.unwrap(ctx, r)
+		if err != nil {
+			return err
+		}
+		e.keys[r.ID] = k
+	}
+	e.current = e.keys[records[len(records)-1].ID]
+	e.loadedAt = time.Now()
+	return nil
+}
+
+func (e *fieldEncryptor) unwrap(ctx context.Context, r dataKeyRecord) (fieldcrypt.DataKey, error) {
+	raw, err := e.provider.UnwrapKey(ctx, r.MasterKeyID, r.WrappedKey)
+	if err != nil {
+		return fieldcrypt.DataKey{}, fmt.Errorf("data key %s: %w", r.ID, err)
+	}
+	return fieldcrypt.NewDataKey(r.ID, raw)
+}
+
+// currentKey returns the data key new values are encrypted with.
+func (e *fieldEncryptor) currentKey(ctx context.Context) (fieldcrypt.DataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.loadedAt) >= time.Minute {
+		if err := e.load(ctx); err != nil {
+			return fieldcrypt.DataKey{}, err
+		}
+	}
+	return e.current, nil
+}
+
+// key returns the data key id, loading it when created by another instance.
+func (e *fieldEncryptor) key(ctx context.Context, id string) (fieldcrypt.DataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if k, ok := e.keys[id]; ok {
+		return k, nil
+	}
+	if err := e.load(ctx); err != nil {
+		return fieldcrypt.DataKey{}, err
+	}
+	if k, ok := e.keys[id]; ok {
+		return k, nil
+	}
+	return fieldcrypt.DataKey{}, fmt.Errorf("data key %s: %w", id, fieldcrypt.ErrUnknownKey)
+}
+
+// allKeys returns every data key, for lookups of deterministic values.
+func (e *fieldEncryptor) allKeys(ctx context.Context) ([]fieldcrypt.DataKey, error) {
+	if _, err := e.currentKey(ctx); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	keys := make([]fieldcrypt.DataKey, 0, len(e.keys))
+	for _, k := range e.keys {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (e *fieldEncryptor) invalidate() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loadedAt = time.Time{}
+}
+
+func (e *fieldEncryptor) encrypt(ctx context.Context, field, value string) (string, error) {
+	if e == nil || !e.fields[field] || value == "" || fieldcrypt.IsEncrypted(value) {
+		return value, nil
+	}
+	k, err := e.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	if e.deterministic[field] {
+		return k.EncryptDeterministic(field, value), nil
+	}
+	return k.Encrypt(field, value)
+}
+
+// encryptSecret encrypts a credential of the user, such as a TOTP secret.
+// Credentials are encrypted whenever field encryption is enabled, whatever
+// FIELD_ENCRYPTION_FIELDS lists.
+func (e *fieldEncryptor) encryptSecret(ctx context.Context, field, value string) (string, error) {
+	if e == nil || value == "" || fieldcrypt.IsEncrypted(value) {
+		return value, nil
+	}
+	k, err := e.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(field, value)
+}
+
+// decrypt returns the plaintext of value. Values stored before the field
+// was encrypted are returned as they are.
+func (e *fieldEncryptor) decrypt(ctx context.Context, field, value string) (string, error) {
+	id, ok := fieldcrypt.KeyID(value)
+	if !ok {
+		return value, nil
+	}
+	if e == nil {
+		return "", ErrEncryptionNotConfigured
+	}
+	k, err := e.key(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return k.Decrypt(field, value)
+}
+
+// userFieldQuery returns the filter value matching users whose field is
+// value. Deterministic values are matched under every data key and in
+// plaintext, as re-encryption may not have reached every user yet.
+func userFieldQuery(ctx context.Context, field, value string) (interface{}, error) {
+	e := fieldEncryption
+	if e == nil || !e.fields[field] {
+		return value, nil
+	}
+	if !e.deterministic[field] {
+		return nil, fmt.Errorf("users can not be looked up by the encrypted field %s", field)
+	}
+	keys, err := e.allKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values := bson.A{value}
+	for _, k := range keys {
+		values = append(values, k.EncryptDeterministic(field, value))
+	}
+	return bson.M{"$in": values}, nil
+}
+
+// encryptUserFields encrypts the configured fields among the values of an
+// update in place.
+func encryptUserFields(ctx context.Context, fields bson.M) error {
+	for field, v := range fields {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		encrypted, err := fieldEncryption.encrypt(ctx, field, s)
+		if err != nil {
+			return err
+		}
+		fields[field] = encrypted
+	}
+	return nil
+}
+
+// encryptAuditChanges encrypts the changed values of encrypted user fields,
+// the audit log must not keep what the users collection encrypts.
+func encryptAuditChanges(ctx context.Context, changes map[string]AuditChange) error {
+	return transformAuditChanges(changes, func(field, v string) (string, error) {
+		return fieldEncryption.encrypt(ctx, field, v)
+	})
+}
+
+// decryptAuditChanges reverses encryptAuditChanges.
+func decryptAuditChanges(ctx context.Context, changes map[string]AuditChange) error {
+	return transformAuditChanges(changes, func(field, v string) (string, error) {
+		return fieldEncryption.decrypt(ctx, field, v)
+	})
+}
+
+func transformAuditChanges(changes map[string]AuditChange, f func(field, v string) (string, error)) error {
+	for field, c := range changes {
+		if _, ok := encryptableFields[field]; !ok {
+			continue
+		}
+		var err error
+		if c.Before, err = f(field, c.Before); err != nil {
+			return err
+		}
+		if c.After, err = f(field, c.After); err != nil {
+			return err
+		}
+		changes[field] = c
+	}
+	return nil
+}
+
+// checkEmailAvailable refuses an email another user has under an older
+// data key. The unique index only compares values under the same key, so
+// this covers the time until re-encryption has finished.
+func checkEmailAvailable(ctx context.Context, email, userID string) error {
+	e := fieldEncryption
+	if email == "" || e == nil || !e.fields["email"] {
+		return nil
+	}
+	q, err := userFieldQuery(ctx, "email", email)
+	if err != nil {
+		return err
+	}
+	n, err := userCollection.CountDocuments(ctx, bson.M{"email": q, "id": bson.M{"$ne": userID}})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// userDocument is User without its BSON hooks.
+type userDocument User
+
+func (d *userDocument) encryptableFields() map[string]*string {
+	return map[string]*string{"name": &d.Name, "email": &d.Email, "phone": &d.Phone, "displayName": &d.DisplayName}
+}
+
+// cryptoTimeout bounds loading data keys from the BSON hooks, which have no
+// context of their own.
+const cryptoTimeout = 10 * time.Second
+
+// MarshalBSON stores the user with the configured fields encrypted.
+func (u User) MarshalBSON() ([]byte, error) {
+	doc := userDocument(u)
+	if fieldEncryption != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), cryptoTimeout)
+		defer cancel()
+		for field, v := range doc.encryptableFields() {
+			encrypted, err := fieldEncryption.encrypt(ctx, field, *v)
+			if err != nil {
+				return nil, fmt.Errorf("encrypt user %s: %w", u.ID, err)
+			}
+			*v = encrypted
+		}
+	}
+	return bson.Marshal(doc)
+}
+
+// UnmarshalBSON reads a stored user, decrypting its encrypted fields.
+func (u *User) UnmarshalBSON(data []byte) error {
+	var doc userDocument
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cryptoTimeout)
+	defer cancel()
+	for field, v := range doc.encryptableFields() {
+		plaintext, err := fieldEncryption.decrypt(ctx, field, *v)
+		if err != nil {
+			return fmt.Errorf("decrypt %s of user %s: %w", field, doc.ID, err)
+		}
+		*v = plaintext
+	}
+	*u = User(doc)
+	return nil
+}
+
+// RotateDataKeys creates a new data key once the newest one is older than
+// FIELD_ENCRYPTION_KEY_ROTATION_INTERVAL, or right away with force, and
+// wraps the data keys still under an older master key with the current
+// one. Without any data key one is created. It returns whether a key was
+// created; values are moved to it by ReencryptUsers.
+func RotateDataKeys(ctx context.Context, force bool) (bool, error) {
+
+	tracer := otel.Tracer("RotateDataKeysServiceTrace")
+	ctx, span := tracer.Start(ctx, "RotateDataKeysService")
+	defer span.End()
+
+	e := fieldEncryption
+	if e == nil {
+		return false, ErrEncryptionNotConfigured
+	}
+	if err := rewrapDataKeys(ctx, e); err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	var newest dataKeyRecord
+	err := dataKeyCollection.FindOne(ctx, bson.M{},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})).Decode(&newest)
+	first := errors.Is(err, mongo.ErrNoDocuments)
+	if err != nil && !first {
+		return false, err
+	}
+	if !first {
+		interval := utils.GetEnvDurationParam("FIELD_ENCRYPTION_KEY_ROTATION_INTERVAL", 90*24*time.Hour)
+		if !force && now.Sub(newest.CreatedAt) < interval {
+			return false, nil
+		}
+		// only one instance gets to rotate the newest key
+		res, err := dataKeyCollection.UpdateOne(ctx,
+			bson.M{"_id": newest.ID, "rotatedAt": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"rotatedAt": now}})
+		if err != nil {
+			return false, err
+		}
+		if res.ModifiedCount == 0 {
+			return false, nil
+		}
+	}
+
+	raw, err := fieldcrypt.GenerateKey()
+	if err != nil {
+		return false, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return false, err
+	}
+	masterKeyID := e.provider.CurrentKeyID()
+	wrapped, err := e.provider.WrapKey(ctx, masterKeyID, raw)
+	if err != nil {
+		return false, err
+	}
+	record := dataKeyRecord{ID: hex.EncodeToString(id), MasterKeyID: masterKeyID, WrappedKey: wrapped, CreatedAt: now}
+	// instances starting together may each create a first key, the newer
+	// one encrypts and values under the other are re-encrypted
+	if _, err := dataKeyCollection.InsertOne(ctx, record); err != nil {
+		return false, err
+	}
+	e.invalidate()
+
+	recordAudit(ctx, auditEvent{
+		Action: AuditDataKeyRotate, TargetType: AuditTargetDataKey, TargetID: record.ID,
+		Details: auditDetails("masterKey", masterKeyID, "forced", force),
+	})
+	SendLogs(ctx, fmt.Sprintf("data key %s created under master key %s", record.ID, masterKeyID))
+	return true, nil
+}
+
+// rewrapDataKeys wraps the data keys under an older master key with the
+// current one, so old master keys can be retired from the provider.
+func rewrapDataKeys(ctx context.Context, e *fieldEncryptor) error {
+	masterKeyID := e.provider.CurrentKeyID()
+	cur, err := dataKeyCollection.Find(ctx, bson.M{"masterKeyId": bson.M{"$ne": masterKeyID}})
+	if err != nil {
+		return err
+	}
+	var records []dataKeyRecord
+	if err := cur.All(ctx, &records); err != nil {
+		return err
+	}
+	for _, r := range records {
+		raw, err := e.provider.UnwrapKey(ctx, r.MasterKeyID, r.WrappedKey)
+		if err != nil {
+			return fmt.Errorf("data key %s: %w", r.ID, err)
+		}
+		wrapped, err := e.provider.WrapKey(ctx, masterKeyID, raw)
+		if err != nil {
+			return err
+		}
+		_, err = dataKeyCollection.UpdateOne(ctx,
+			bson.M{"_id": r.ID, "masterKeyId": r.MasterKeyID},
+			bson.M{"$set": bson.M{"masterKeyId": masterKeyID, "wrappedKey": wrapped}})
+		if err != nil {
+			return err
+		}
+		logs.FromContext(ctx).Infof("data key %s rewrapped from master key %s to %s", r.ID, r.MasterKeyID, masterKeyID)
+	}
+	return nil
+}
+
+// ReencryptUsers encrypts the configured fields and TOTP secrets still in
+// plaintext or under an older data key with the current one. Users changed
+// meanwhile are left for the next run. The version is kept, the user did
+// not change. It returns how many users were re-encrypted.
+func ReencryptUsers(ctx context.Context) (int, error) {
+
+	tracer := otel.Tracer("ReencryptUsersServiceTrace")
+	ctx, span := tracer.Start(ctx, "ReencryptUsersService")
+	defer span.End()
+
+	e := fieldEncryption
+	if e == nil {
+		return 0, ErrEncryptionNotConfigured
+	}
+	current, err := e.currentKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+	fields := []string{"mfa.secret", "mfa.pendingSecret"}
+	for field := range e.fields {
+		fields = append(fields, field)
+	}
+	stale := bson.A{}
+	for _, field := range fields {
+		// empty values stay empty, they would match forever otherwise
+		stale = append(stale, bson.M{field: bson.M{
+			"$type": "string",
+			"$ne":   "",
+			"$not":  primitive.Regex{Pattern: fieldcrypt.KeyPattern(current.ID)},
+		}})
+	}
+	cur, err := userCollection.Find(ctx, bson.M{"$or": stale})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	reencrypted := 0
+	for cur.Next(ctx) {
+		var user User
+		if err := cur.Decode(&user); err != nil {
+			return reencrypted, err
+		}
+		doc := userDocument(user)
+		set := bson.M{}
+		for field, v := range doc.encryptableFields() {
+			if e.fields[field] && *v != "" {
+				set[field] = *v
+			}
+		}
+		if err := encryptUserFields(ctx, set); err != nil {
+			return reencrypted, err
+		}
+		if user.MFA != nil {
+			secrets := map[string]string{"mfa.secret": user.MFA.Secret, "mfa.pendingSecret": user.MFA.PendingSecret}
+			for field, v := range secrets {
+				if v == "" {
+					continue
+				}
+				if id, _ := fieldcrypt.KeyID(v); id == current.ID {
+					continue
+				}
+				if set[field], err = reencryptMFASecret(ctx, v); err != nil {
+					return reencrypted, err
+				}
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		res, err := userCollection.UpdateOne(ctx, bson.M{"id": user.ID, "version": user.Version}, bson.M{"$set": set})
+		if err != nil {
+			return reencrypted, err
+		}
+		if res.ModifiedCount > 0 {
+			reencrypted++
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return reencrypted, err
+	}
+	if reencrypted > 0 {
+		SendLogs(ctx, fmt.Sprintf("%d users re-encrypted with data key %s", reencrypted, current.ID))
+	}
+	return reencrypted, nil
+}
+
+// reencryptMFASecret moves a TOTP secret to the current data key.
+func reencryptMFASecret(ctx context.Context, stored string) (string, error) {
+	secret, err := fieldEncryption.decrypt(ctx, mfaSecretField, stored)
+	if err != nil {
+		return "", err
+	}
+	return fieldEncryption.encryptSecret(ctx, mfaSecretField, secret)
+}
+
+// StartEncryptionJob rotates the data keys when due and re-encrypts users
+// every interval until the returned function is called.
+func StartEncryptionJob(interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(WithActor(context.Background(), SystemActor))
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := RotateDataKeys(ctx, false); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, mongo.ErrClientDisconnected) {
+				logs.FromContext(ctx).Errorf("data key rotation failed: %v", err)
+			}
+			if n, err := ReencryptUsers(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, mongo.ErrClientDisconnected) {
+				logs.FromContext(ctx).Errorf("re-encryption of users failed after %d users: %v", n, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
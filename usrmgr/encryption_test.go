@@ -0,0 +1,519 @@
+package usrmgr
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subhamproject/user-service/fieldcrypt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// useTestKeyProvider gives the test encryptor a local key provider with
+// master keys m1 and, current, m2.
+func useTestKeyProvider(t *testing.T) *fieldcrypt.LocalKeyProvider {
+	t.Helper()
+	var keyfile strings.Builder
+	for i, id := range []string{"m1", "m2"} {
+		keyfile.WriteString(id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, fieldcrypt.KeySize)) + "\n")
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(keyfile.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := fieldcrypt.NewLocalKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldEncryption.provider = p
+	return p
+}
+
+// dataKeyDoc is a stored data key wrapped by masterKey.
+func dataKeyDoc(t *testing.T, p fieldcrypt.KeyProvider, id, masterKey string, raw []byte, createdAt time.Time) bson.D {
+	t.Helper()
+	wrapped, err := p.WrapKey(context.Background(), masterKey, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bson.D{
+		{Key: "_id", Value: id}, {Key: "masterKeyId", Value: masterKey},
+		{Key: "wrappedKey", Value: wrapped}, {Key: "createdAt", Value: createdAt},
+	}
+}
+
+func TestUserBSONEncryption(t *testing.T) {
+	key := useTestEncryption(t, "name", "email")
+	user := User{ID: "u1", Name: "jane", Email: "jane@example.com", Phone: "+14155552671", Status: UserStatusActive}
+
+	raw, err := bson.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := bson.Raw(raw)
+	name := doc.Lookup("name").StringValue()
+	if !strings.HasPrefix(name, "enc:v1:k1:") {
+		t.Errorf("name stored as %q", name)
+	}
+	if email := doc.Lookup("email").StringValue(); email != key.EncryptDeterministic("email", "jane@example.com") {
+		t.Errorf("email stored as %q, want deterministic", email)
+	}
+	if phone := doc.Lookup("phone").StringValue(); phone != user.Phone {
+		t.Errorf("phone stored as %q, not configured", phone)
+	}
+	if id := doc.Lookup("id").StringValue(); id != "u1" {
+		t.Errorf("id stored as %q", id)
+	}
+
+	var got User
+	if err := bson.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("decoded %+v, want %+v", got, user)
+	}
+
+	// users stored before encryption was enabled
+	plain, _ := bson.Marshal(bson.D{{Key: "id", Value: "u2"}, {Key: "name", Value: "john"}})
+	if err := bson.Unmarshal(plain, &got); err != nil || got.Name != "john" {
+		t.Errorf("plaintext user decoded as %q, %v", got.Name, err)
+	}
+
+	fieldEncryption = nil
+	if err := bson.Unmarshal(raw, &got); !errors.Is(err, ErrEncryptionNotConfigured) {
+		t.Errorf("encrypted user without encryption = %v, want ErrEncryptionNotConfigured", err)
+	}
+	if raw, _ := bson.Marshal(user); bson.Raw(raw).Lookup("name").StringValue() != "jane" {
+		t.Error("name encrypted while encryption is disabled")
+	}
+}
+
+func TestUserFieldQuery(t *testing.T) {
+	ctx := context.Background()
+	if q, err := userFieldQuery(ctx, "email", "jane@example.com"); err != nil || q != "jane@example.com" {
+		t.Errorf("query without encryption = %v, %v", q, err)
+	}
+
+	key := useTestEncryption(t, "name", "email")
+	older, _ := fieldcrypt.NewDataKey("k0", bytes.Repeat([]byte{7}, fieldcrypt.KeySize))
+	fieldEncryption.keys[older.ID] = older
+
+	q, err := userFieldQuery(ctx, "email", "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, _ := q.(bson.M)["$in"].(bson.A)
+	want := map[interface{}]bool{
+		"jane@example.com": true,
+		key.EncryptDeterministic("email", "jane@example.com"):   true,
+		older.EncryptDeterministic("email", "jane@example.com"): true,
+	}
+	if len(in) != len(want) {
+		t.Fatalf("query %v", q)
+	}
+	for _, v := range in {
+		if !want[v] {
+			t.Errorf("unexpected value %v", v)
+		}
+	}
+
+	if _, err := userFieldQuery(ctx, "name", "jane"); err == nil {
+		t.Error("lookup by a randomly encrypted field accepted")
+	}
+	if q, _ := userFieldQuery(ctx, "phone", "+14155552671"); q != "+14155552671" {
+		t.Errorf("query of an unencrypted field %v", q)
+	}
+}
+
+func TestEncryptUserFields(t *testing.T) {
+	key := useTestEncryption(t, "name")
+	fields := bson.M{"name": "jane", "phone": "+14155552671", "version": int64(2), "displayName": ""}
+	if err := encryptUserFields(context.Background(), fields); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := key.Decrypt("name", fields["name"].(string)); err != nil || name != "jane" {
+		t.Errorf("name %v: %q, %v", fields["name"], name, err)
+	}
+	if fields["phone"] != "+14155552671" || fields["version"] != int64(2) || fields["displayName"] != "" {
+		t.Errorf("fields %v", fields)
+	}
+
+	// already encrypted values are left alone
+	stored := fields["name"]
+	_ = encryptUserFields(context.Background(), fields)
+	if fields["name"] != stored {
+		t.Error("name encrypted twice")
+	}
+}
+
+func TestAuditChangesEncryption(t *testing.T) {
+	ctx := context.Background()
+	key := useTestEncryption(t, "email")
+	changes := map[string]AuditChange{
+		"email":  {Before: `"jane@example.com"`, After: `"j@example.com"`},
+		"name":   {Before: `"jane"`, After: `"janet"`},
+		"status": {Before: `"active"`, After: `"disabled"`},
+	}
+	if err := encryptAuditChanges(ctx, changes); err != nil {
+		t.Fatal(err)
+	}
+	if email := changes["email"]; email.Before != key.EncryptDeterministic("email", `"jane@example.com"`) || !fieldcrypt.IsEncrypted(email.After) {
+		t.Errorf("email change %+v", email)
+	}
+	if changes["name"].Before != `"jane"` || changes["status"].After != `"disabled"` {
+		t.Errorf("changes of unencrypted fields %v", changes)
+	}
+
+	// encrypted values are served as strings
+	b, err := json.Marshal(changes["email"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served map[string]string
+	if err := json.Unmarshal(b, &served); err != nil || served["before"] != changes["email"].Before {
+		t.Errorf("json %s, %v", b, err)
+	}
+
+	if err := decryptAuditChanges(ctx, changes); err != nil {
+		t.Fatal(err)
+	}
+	if email := changes["email"]; email != (AuditChange{Before: `"jane@example.com"`, After: `"j@example.com"`}) {
+		t.Errorf("decrypted email change %+v", email)
+	}
+}
+
+func TestAppendAuditEncrypted(t *testing.T) {
+	key := useTestEncryption(t, "name")
+	ctx := WithActor(context.Background(), "admin")
+	ev := auditEvent{
+		Action: AuditUserUpdate, TargetType: AuditTargetUser, TargetID: "u1",
+		Before: User{ID: "u1", Name: "jane"}, After: User{ID: "u1", Name: "janet"},
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("encrypted changes", func(mt *mtest.T) {
+		useMockCollections(t, mt, &auditCollection)
+		mt.AddMockResponses(found(), mtest.CreateSuccessResponse())
+
+		e, err := appendAudit(ctx, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := e.Changes["name"]
+		if !fieldcrypt.IsEncrypted(c.Before) || !fieldcrypt.IsEncrypted(c.After) {
+			t.Fatalf("name change stored as %+v", c)
+		}
+		if after, err := key.Decrypt("name", c.After); err != nil || after != `"janet"` {
+			t.Errorf("after decrypts to %q, %v", after, err)
+		}
+
+		// the chain covers the stored ciphertexts
+		mt.AddMockResponses(found(auditDocs(t, e)...))
+		if v, err := VerifyAuditChain(context.Background(), 0); err != nil || !v.Valid {
+			t.Errorf("VerifyAuditChain = %+v, %v", v, err)
+		}
+
+		mt.AddMockResponses(found(auditDocs(t, e)...))
+		entries, err := QueryAudit(context.Background(), AuditFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entries[0].Changes["name"]; got != (AuditChange{Before: `"jane"`, After: `"janet"`}) {
+			t.Errorf("queried change %+v", got)
+		}
+	})
+}
+
+func TestCheckEmailAvailable(t *testing.T) {
+	useTestEncryption(t, "email")
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name  string
+		count int
+		want  error
+	}{
+		{"available", 0, nil},
+		{"taken under an older key", 1, ErrEmailTaken},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockCollections(t, mt, &userCollection)
+			mt.AddMockResponses(sessionCount(tt.count))
+
+			if err := checkEmailAvailable(context.Background(), "jane@example.com", "u1"); err != tt.want {
+				t.Fatalf("checkEmailAvailable = %v, want %v", err, tt.want)
+			}
+			match := mt.GetStartedEvent().Command.Lookup("pipeline").Array().Index(0).Value().Document().Lookup("$match").Document()
+			if _, err := match.LookupErr("email", "$in"); err != nil {
+				t.Errorf("filter %s", match)
+			}
+			if id := match.Lookup("id", "$ne").StringValue(); id != "u1" {
+				t.Errorf("user itself not excluded: %s", match)
+			}
+		})
+	}
+}
+
+func TestFieldEncryptorKeys(t *testing.T) {
+	useTestEncryption(t)
+	p := useTestKeyProvider(t)
+	e := fieldEncryption
+	e.keys, e.current, e.loadedAt = map[string]fieldcrypt.DataKey{}, fieldcrypt.DataKey{}, time.Time{}
+	older, newer := bytes.Repeat([]byte{3}, fieldcrypt.KeySize), bytes.Repeat([]byte{4}, fieldcrypt.KeySize)
+	now := time.Now()
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("load", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		records := found(dataKeyDoc(t, p, "a", "m1", older, now.Add(-time.Hour)), dataKeyDoc(t, p, "b", "m2", newer, now))
+		mt.AddMockResponses(records, records)
+		ctx := context.Background()
+
+		current, err := e.currentKey(ctx)
+		if err != nil || current.ID != "b" {
+			t.Fatalf("current key %s, %v; want the newest", current.ID, err)
+		}
+		want, _ := fieldcrypt.NewDataKey("a", older)
+		k, err := e.key(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := want.EncryptDeterministic("email", "x"); c != k.EncryptDeterministic("email", "x") {
+			t.Error("unwrapped key differs")
+		}
+		if got := commands(mt); len(got) != 1 {
+			t.Errorf("commands %v, want a single load", got)
+		}
+		// unknown keys may come from another instance
+		if _, err := e.key(ctx, "c"); !errors.Is(err, fieldcrypt.ErrUnknownKey) {
+			t.Errorf("unknown key = %v", err)
+		}
+		if got := commands(mt); len(got) != 2 {
+			t.Errorf("commands %v, want a reload", got)
+		}
+	})
+	mt.Run("no keys", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found())
+		e.loadedAt = time.Time{}
+		if err := e.load(context.Background()); err == nil {
+			t.Error("loaded without data keys")
+		}
+	})
+}
+
+func TestRotateDataKeys(t *testing.T) {
+	useTestProducer(t)
+	useTestEncryption(t)
+	p := useTestKeyProvider(t)
+	t.Setenv("FIELD_ENCRYPTION_KEY_ROTATION_INTERVAL", "720h")
+	raw := bytes.Repeat([]byte{5}, fieldcrypt.KeySize)
+	newest := func(age time.Duration) bson.D {
+		return found(bson.D{{Key: "_id", Value: "k1"}, {Key: "masterKeyId", Value: "m2"}, {Key: "createdAt", Value: time.Now().Add(-age)}})
+	}
+	inserted := func(t *testing.T, mt *mtest.T) bson.Raw {
+		t.Helper()
+		for _, ev := range mt.GetAllStartedEvents() {
+			if ev.CommandName == "insert" {
+				return ev.Command.Lookup("documents").Array().Index(0).Value().Document()
+			}
+		}
+		t.Fatal("no key inserted")
+		return nil
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("first key", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found(), found(), mtest.CreateSuccessResponse())
+
+		created, err := RotateDataKeys(context.Background(), false)
+		if err != nil || !created {
+			t.Fatalf("RotateDataKeys = %v, %v", created, err)
+		}
+		doc := inserted(t, mt)
+		if master := doc.Lookup("masterKeyId").StringValue(); master != "m2" {
+			t.Errorf("wrapped with %s, want the current master key", master)
+		}
+		_, wrapped := doc.Lookup("wrappedKey").Binary()
+		if key, err := p.UnwrapKey(context.Background(), "m2", wrapped); err != nil || len(key) != fieldcrypt.KeySize {
+			t.Errorf("wrapped key unwraps to %d bytes, %v", len(key), err)
+		}
+		if !fieldEncryption.loadedAt.IsZero() {
+			t.Error("keys not reloaded after rotation")
+		}
+	})
+	mt.Run("not due", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found(), newest(time.Hour))
+
+		if created, err := RotateDataKeys(context.Background(), false); err != nil || created {
+			t.Errorf("RotateDataKeys = %v, %v; want nothing done", created, err)
+		}
+	})
+	mt.Run("due", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found(), newest(800*time.Hour), updated(1), mtest.CreateSuccessResponse())
+
+		if created, err := RotateDataKeys(context.Background(), false); err != nil || !created {
+			t.Fatalf("RotateDataKeys = %v, %v", created, err)
+		}
+		if got := strings.Join(commands(mt), ","); got != "find,find,update,insert" {
+			t.Errorf("commands %s", got)
+		}
+	})
+	mt.Run("forced", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found(), newest(time.Hour), updated(1), mtest.CreateSuccessResponse())
+
+		if created, err := RotateDataKeys(context.Background(), true); err != nil || !created {
+			t.Errorf("RotateDataKeys = %v, %v", created, err)
+		}
+	})
+	mt.Run("rotated by another instance", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found(), newest(800*time.Hour), updated(0))
+
+		if created, err := RotateDataKeys(context.Background(), false); err != nil || created {
+			t.Errorf("RotateDataKeys = %v, %v; want nothing done", created, err)
+		}
+	})
+	mt.Run("rewrap", func(mt *mtest.T) {
+		useMockCollections(t, mt, &dataKeyCollection)
+		mt.AddMockResponses(found(dataKeyDoc(t, p, "k0", "m1", raw, time.Now())), updated(1), newest(time.Hour))
+
+		if _, err := RotateDataKeys(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+		update := lastUpdate(t, mt)
+		if master := update.Lookup("q", "masterKeyId").StringValue(); master != "m1" {
+			t.Errorf("rewrap filter %s", update.Lookup("q"))
+		}
+		if master := update.Lookup("u", "$set", "masterKeyId").StringValue(); master != "m2" {
+			t.Errorf("rewrapped with %s, want m2", master)
+		}
+		_, wrapped := update.Lookup("u", "$set", "wrappedKey").Binary()
+		if key, err := p.UnwrapKey(context.Background(), "m2", wrapped); err != nil || !bytes.Equal(key, raw) {
+			t.Errorf("rewrapped key %x, %v", key, err)
+		}
+	})
+}
+
+func TestRotateDataKeysDisabled(t *testing.T) {
+	prev := fieldEncryption
+	fieldEncryption = nil
+	t.Cleanup(func() { fieldEncryption = prev })
+	if _, err := RotateDataKeys(context.Background(), true); !errors.Is(err, ErrEncryptionNotConfigured) {
+		t.Errorf("RotateDataKeys = %v, want ErrEncryptionNotConfigured", err)
+	}
+	if _, err := ReencryptUsers(context.Background()); !errors.Is(err, ErrEncryptionNotConfigured) {
+		t.Errorf("ReencryptUsers = %v, want ErrEncryptionNotConfigured", err)
+	}
+}
+
+func TestReencryptUsersFields(t *testing.T) {
+	useTestProducer(t)
+	key := useTestEncryption(t, "name", "email")
+	older, _ := fieldcrypt.NewDataKey("k0", bytes.Repeat([]byte{7}, fieldcrypt.KeySize))
+	fieldEncryption.keys[older.ID] = older
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("older key and plaintext", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		stale := resetUser(true)
+		for i := range stale {
+			if stale[i].Key == "email" {
+				stale[i].Value = older.EncryptDeterministic("email", "jane@example.com")
+			}
+		}
+		mt.AddMockResponses(found(stale), updated(1))
+
+		n, err := ReencryptUsers(context.Background())
+		if err != nil || n != 1 {
+			t.Fatalf("ReencryptUsers = %d, %v", n, err)
+		}
+		query := mt.GetStartedEvent().Command.Lookup("filter", "$or").Array()
+		values, _ := query.Values()
+		if len(values) != 4 {
+			t.Errorf("stale query %s", query)
+		}
+		update := lastUpdate(t, mt)
+		if v := update.Lookup("q", "version").Int64(); v != 1 {
+			t.Errorf("update filter version %d", v)
+		}
+		if email := update.Lookup("u", "$set", "email").StringValue(); email != key.EncryptDeterministic("email", "jane@example.com") {
+			t.Errorf("email re-encrypted as %q", email)
+		}
+		if name, err := key.Decrypt("name", update.Lookup("u", "$set", "name").StringValue()); err != nil || name != "jane" {
+			t.Errorf("name encrypted as %q, %v", name, err)
+		}
+		if _, err := update.LookupErr("u", "$inc"); err == nil {
+			t.Error("version incremented")
+		}
+		for _, clause := range values {
+			if ne, err := clause.Document().Index(0).Value().Document().LookupErr("$ne"); err != nil || ne.StringValue() != "" {
+				t.Errorf("stale clause %s matches empty values", clause)
+			}
+		}
+	})
+	mt.Run("empty values", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		empty := bson.D{
+			{Key: "id", Value: "u1"}, {Key: "name", Value: ""}, {Key: "email", Value: ""},
+			{Key: "status", Value: UserStatusActive}, {Key: "version", Value: int64(1)},
+		}
+		mt.AddMockResponses(found(empty))
+
+		n, err := ReencryptUsers(context.Background())
+		if err != nil || n != 0 {
+			t.Fatalf("ReencryptUsers = %d, %v", n, err)
+		}
+		if got := commands(mt); len(got) != 1 || got[0] != "find" {
+			t.Errorf("commands %v, want no update", got)
+		}
+	})
+}
+
+func TestUserEventEncrypted(t *testing.T) {
+	w := useTestProducer(t)
+	key := useTestEncryption(t, "name", "email")
+	user := User{ID: "u1", Name: "jane", Email: "jane@example.com", Phone: "+4915112345678"}
+	publishUserEvent(context.Background(), EventUserCreated, user)
+
+	if len(w.batches) != 1 || len(w.batches[0]) != 1 {
+		t.Fatalf("batches %v", w.batches)
+	}
+	var ev struct {
+		Data User `json:"data"`
+	}
+	if err := json.Unmarshal(w.batches[0][0].Value, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Data.Email != key.EncryptDeterministic("email", "jane@example.com") {
+		t.Errorf("email sent as %q", ev.Data.Email)
+	}
+	if name, err := key.Decrypt("name", ev.Data.Name); err != nil || name != "jane" {
+		t.Errorf("name sent as %q, %v", ev.Data.Name, err)
+	}
+	if ev.Data.Phone != user.Phone {
+		t.Errorf("phone, not encrypted, sent as %q", ev.Data.Phone)
+	}
+	if user.Name != "jane" {
+		t.Error("the user passed in was changed")
+	}
+}
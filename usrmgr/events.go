@@ -0,0 +1,80 @@
+package usrmgr
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/subhamproject/user-service/logs"
+)
+
+// Event types published to the user topic.
+const (
+	EventUserCreated  = "UserCreated"
+	EventUserUpdated  = "UserUpdated"
+	EventUserDeleted  = "UserDeleted"
+	EventUserRestored = "UserRestored"
+	EventUserPurged   = "UserPurged"
+	EventUserErased   = "UserErased"
+)
+
+// Event is a structured user lifecycle event. Unlike the free text messages
+// of SendLogs, events are keyed by user id so consumers see the events of a
+// user in order.
+type Event struct {
+	Type   string      `json:"type"`
+	UserID string      `json:"userId"`
+	Time   time.Time   `json:"time"`
+	Actor  string      `json:"actor,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// PublishEvent sends ev to Kafka, setting its time when missing.
+func PublishEvent(ctx context.Context, ev Event) error {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	val, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	logs.FromContext(ctx).WithField("event", ev.Type).Debugf("publishing event for user %s", ev.UserID)
+	return producer.Send(ctx, kafka.Message{
+		Key:     []byte(ev.UserID),
+		Value:   val,
+		Headers: []kafka.Header{{Key: "event-type", Value: []byte(ev.Type)}},
+	})
+}
+
+// publishUserEvent publishes an event of type carrying the user, failures
+// are logged as the change itself has been stored.
+func publishUserEvent(ctx context.Context, eventType string, user User) {
+	data, err := eventUser(ctx, user)
+	if err == nil {
+		err = PublishEvent(ctx, Event{
+			Type:   eventType,
+			UserID: user.ID,
+			Actor:  ActorFromContext(ctx),
+			Data:   data,
+		})
+	}
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to publish %s event of user %s: %v", eventType, user.ID, err)
+	}
+}
+
+// eventUser returns the user as events carry it, with the fields encrypted
+// in the users collection encrypted as well, so neither the topic nor the
+// dead letter store keeps them in plaintext.
+func eventUser(ctx context.Context, user User) (User, error) {
+	doc := userDocument(user)
+	for field, v := range doc.encryptableFields() {
+		encrypted, err := fieldEncryption.encrypt(ctx, field, *v)
+		if err != nil {
+			return User{}, err
+		}
+		*v = encrypted
+	}
+	return User(doc), nil
+}
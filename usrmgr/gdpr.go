@@ -0,0 +1,420 @@
+package usrmgr
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+)
+
+const userIDAttempts = 5
+
+var (
+	ErrUserErased              = errors.New("user has been erased")
+	ErrNoErasure               = errors.New("user has not been erased")
+	ErrOrderServiceUnavailable = errors.New("order service unavailable")
+
+	erasureCollection *mongo.Collection
+)
+
+// UserExport is everything the service holds about a user, as handed out
+// for a data subject access request.
+type UserExport struct {
+	GeneratedAt time.Time       `json:"generatedAt"`
+	User        User            `json:"user"`
+	Orders      interface{}     `json:"orders"`
+	Sessions    []Session       `json:"sessions"`
+	APIKeys     []APIKey        `json:"apiKeys"`
+	Tokens      []ExportedToken `json:"tokens"`
+	Audit       []AuditEntry    `json:"audit"`
+}
+
+// ExportedToken describes a verification or password reset token issued
+// to the user, without the token itself.
+type ExportedToken struct {
+	Purpose   string     `json:"purpose"`
+	Email     string     `json:"email,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt,omitempty"`
+}
+
+// exportManifest lists the files of a ZIP export with their SHA-256, so
+// the recipient can check the archive is complete.
+type exportManifest struct {
+	UserID      string            `json:"userId"`
+	GeneratedAt time.Time         `json:"generatedAt"`
+	Files       map[string]string `json:"files"`
+}
+
+// ExportUserData collects the data held about the user, soft deleted or
+// not: the profile, sessions, API keys, issued tokens, the audit entries
+// about or by the user and the orders from the order service. The export
+// fails rather than leaving out the orders when the order service is down.
+func ExportUserData(ctx context.Context, id string) (UserExport, error) {
+
+	tracer := otel.Tracer("ExportUserDataServiceTrace")
+	ctx, span := tracer.Start(ctx, "ExportUserDataService")
+	defer span.End()
+	SendLogs(ctx, fmt.Sprintf("received request to export data of user %s", id))
+
+	export := UserExport{GeneratedAt: time.Now().UTC().Truncate(time.Second)}
+	err := userCollection.FindOne(ctx, bson.M{"id": id}).Decode(&export.User)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := GetErasure(ctx, id); err == nil {
+			return UserExport{}, ErrUserErased
+		}
+		return UserExport{}, ErrUserNotFound
+	}
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	if export.Orders, err = fetchUserOrders(ctx, id); err != nil {
+		return UserExport{}, fmt.Errorf("%w: %v", ErrOrderServiceUnavailable, err)
+	}
+
+	export.Sessions = []Session{}
+	if err := findAll(ctx, sessionCollection, bson.M{"userId": id}, &export.Sessions); err != nil {
+		return UserExport{}, err
+	}
+	export.APIKeys = []APIKey{}
+	if err := findAll(ctx, apiKeyCollection, bson.M{"principal": id}, &export.APIKeys); err != nil {
+		return UserExport{}, err
+	}
+	var tokens []tokenRecord
+	if err := findAll(ctx, tokenCollection, bson.M{"userId": id}, &tokens); err != nil {
+		return UserExport{}, err
+	}
+	export.Tokens = make([]ExportedToken, 0, len(tokens))
+	for _, t := range tokens {
+		export.Tokens = append(export.Tokens, ExportedToken{
+			Purpose: t.Purpose, Email: t.Email, CreatedAt: t.CreatedAt, ExpiresAt: t.ExpiresAt, UsedAt: t.UsedAt,
+		})
+	}
+
+	keyIDs := make([]string, 0, len(export.APIKeys))
+	for _, k := range export.APIKeys {
+		keyIDs = append(keyIDs, k.ID)
+	}
+	cur, err := auditCollection.Find(ctx, userAuditFilter(id, export.User.Email, keyIDs),
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return UserExport{}, err
+	}
+	if export.Audit, err = decodeAuditEntries(ctx, cur); err != nil {
+		return UserExport{}, err
+	}
+
+	SendLogs(ctx, fmt.Sprintf("data of user %s successfully exported", id))
+	recordAudit(ctx, auditEvent{
+		Action: AuditUserExport, TargetType: AuditTargetUser, TargetID: id,
+		Details: auditDetails("sessions", len(export.Sessions), "apiKeys", len(export.APIKeys),
+			"tokens", len(export.Tokens), "auditEntries", len(export.Audit)),
+	})
+	return export, nil
+}
+
+// WriteZip writes the export as a ZIP archive with one JSON file per part
+// and a manifest.json of their hashes.
+func (e UserExport) WriteZip(w io.Writer) error {
+	parts := []struct {
+		name  string
+		value interface{}
+	}{
+		{"user.json", e.User},
+		{"orders.json", e.Orders},
+		{"sessions.json", e.Sessions},
+		{"apikeys.json", e.APIKeys},
+		{"tokens.json", e.Tokens},
+		{"audit.json", e.Audit},
+	}
+	manifest := exportManifest{UserID: e.User.ID, GeneratedAt: e.GeneratedAt, Files: map[string]string{}}
+
+	zw := zip.NewWriter(w)
+	for _, part := range parts {
+		b, err := json.MarshalIndent(part.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		manifest.Files[part.name] = hex.EncodeToString(sum[:])
+		if err := writeZipFile(zw, part.name, e.GeneratedAt, b); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "manifest.json", e.GeneratedAt, b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, modified time.Time, b []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+// Erasure records the erasure of a user. It outlives the user as the
+// tombstone that keeps the id from being reused and as proof that the
+// erasure was carried out.
+type Erasure struct {
+	UserID      string     `bson:"_id" json:"userId"`
+	RequestedBy string     `bson:"requestedBy" json:"requestedBy"`
+	Reason      string     `bson:"reason,omitempty" json:"reason,omitempty"`
+	RequestID   string     `bson:"requestId,omitempty" json:"requestId,omitempty"`
+	StartedAt   time.Time  `bson:"startedAt" json:"startedAt"`
+	CompletedAt *time.Time `bson:"completedAt,omitempty" json:"completedAt,omitempty"`
+	// Removed counts the deleted or redacted records per collection.
+	Removed map[string]int64 `bson:"removed,omitempty" json:"removed,omitempty"`
+	// Proof is the hash of the record, which is also written to audit log
+	// entry AuditSeq, so the record can not be changed unnoticed.
+	Proof    string `bson:"proof,omitempty" json:"proof,omitempty"`
+	AuditSeq int64  `bson:"auditSeq,omitempty" json:"auditSeq,omitempty"`
+}
+
+// digest returns the hash of the erasure, without Proof and AuditSeq.
+func (e Erasure) digest() (string, error) {
+	e.Proof, e.AuditSeq = "", 0
+	e.StartedAt = e.StartedAt.UTC()
+	if e.CompletedAt != nil {
+		completed := e.CompletedAt.UTC()
+		e.CompletedAt = &completed
+	}
+	return hashJSON(e)
+}
+
+// erasureStep removes one kind of data of the user and returns how many
+// records it removed.
+type erasureStep struct {
+	name string
+	run  func(ctx context.Context) (int64, error)
+}
+
+// EraseUser deletes the user and everything held about it: sessions,
+// tokens, API keys, undelivered events and login attempts. Its audit
+// entries are kept, their personal data redacted. A UserErased event tells
+// downstream services to erase the user too. Every step can be repeated,
+// so an erasure that failed half way is finished by calling EraseUser
+// again; a completed erasure is returned as it is.
+func EraseUser(ctx context.Context, id, reason string) (Erasure, error) {
+
+	tracer := otel.Tracer("EraseUserServiceTrace")
+	ctx, span := tracer.Start(ctx, "EraseUserService")
+	defer span.End()
+	SendLogs(ctx, fmt.Sprintf("received request to erase user %s", id))
+
+	erasure, err := GetErasure(ctx, id)
+	if err == nil && erasure.CompletedAt != nil {
+		return erasure, nil
+	}
+	if err != nil && !errors.Is(err, ErrNoErasure) {
+		return Erasure{}, err
+	}
+
+	var user User
+	switch err := userCollection.FindOne(ctx, bson.M{"id": id}).Decode(&user); {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		if erasure.UserID == "" {
+			return Erasure{}, ErrUserNotFound
+		}
+	case err != nil:
+		return Erasure{}, err
+	}
+
+	// the record goes first, from then on the id is never handed out again
+	err = erasureCollection.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$setOnInsert": bson.M{
+		"requestedBy": ActorFromContext(ctx),
+		"reason":      reason,
+		"requestId":   requestInfoFromContext(ctx).ID,
+		"startedAt":   time.Now().UTC().Truncate(time.Millisecond),
+	}}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&erasure)
+	if err != nil {
+		return Erasure{}, err
+	}
+
+	// the audit entries of the API keys are found through the keys, so
+	// they are redacted before the keys are deleted
+	var keys []APIKey
+	if err := findAll(ctx, apiKeyCollection, bson.M{"principal": id}, &keys); err != nil {
+		return Erasure{}, err
+	}
+	keyIDs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		keyIDs = append(keyIDs, k.ID)
+	}
+
+	steps := []erasureStep{
+		{"sessions", func(ctx context.Context) (int64, error) {
+			return deleteAll(ctx, sessionCollection, bson.M{"userId": id})
+		}},
+		{"tokens", func(ctx context.Context) (int64, error) {
+			return deleteAll(ctx, tokenCollection, bson.M{"userId": id})
+		}},
+		{"auditEntries", func(ctx context.Context) (int64, error) {
+			return redactAudit(ctx, userAuditFilter(id, user.Email, keyIDs))
+		}},
+		{"apiKeys", func(ctx context.Context) (int64, error) {
+			return deleteAll(ctx, apiKeyCollection, bson.M{"principal": id})
+		}},
+		{"deadLetters", func(ctx context.Context) (int64, error) {
+			return deleteAll(ctx, deadLetterCollection, userDeadLetterFilter(id, user.Name))
+		}},
+		{"loginAttempts", func(ctx context.Context) (int64, error) {
+			if user.Email == "" {
+				return 0, nil
+			}
+			if loginAttempts != nil {
+				return 0, loginAttempts.Reset(ctx, accountKey(user.Email))
+			}
+			return deleteAll(ctx, attemptCollection, bson.M{"_id": accountKey(user.Email)})
+		}},
+		{"users", func(ctx context.Context) (int64, error) {
+			return deleteAll(ctx, userCollection, bson.M{"id": id})
+		}},
+	}
+	removed := make(map[string]int64, len(steps))
+	for _, step := range steps {
+		n, err := step.run(ctx)
+		if err != nil {
+			return Erasure{}, fmt.Errorf("erasing %s of user %s: %w", step.name, id, err)
+		}
+		removed[step.name] = n
+	}
+
+	completed := time.Now().UTC().Truncate(time.Millisecond)
+	erasure.CompletedAt, erasure.Removed = &completed, removed
+	if erasure.Proof, err = erasure.digest(); err != nil {
+		return Erasure{}, err
+	}
+	_, err = erasureCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"completedAt": completed,
+		"removed":     removed,
+		"proof":       erasure.Proof,
+	}})
+	if err != nil {
+		return Erasure{}, err
+	}
+	SendLogs(ctx, fmt.Sprintf("user %s successfully erased", id))
+
+	// the event carries no personal data, consumers only need the id
+	err = PublishEvent(ctx, Event{
+		Type:   EventUserErased,
+		UserID: id,
+		Actor:  ActorFromContext(ctx),
+		Data:   map[string]interface{}{"erasedAt": completed},
+	})
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to publish erasure of user %s: %v", id, err)
+	}
+
+	if auditCollection != nil && utils.GetEnvBoolParam("AUDIT_ENABLE", true) {
+		entry, err := appendAudit(ctx, auditEvent{
+			Action: AuditUserErase, TargetType: AuditTargetUser, TargetID: id,
+			Details: auditDetails("proof", erasure.Proof),
+		})
+		if err == nil {
+			erasure.AuditSeq = entry.Seq
+			_, err = erasureCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"auditSeq": entry.Seq}})
+		}
+		if err != nil {
+			logs.FromContext(ctx).Errorf("unable to record erasure of user %s in the audit log, error - %v", id, err)
+		}
+	}
+	return erasure, nil
+}
+
+// GetErasure returns the erasure record of the user, ErrNoErasure when the
+// user has not been erased.
+func GetErasure(ctx context.Context, id string) (Erasure, error) {
+	var erasure Erasure
+	err := erasureCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&erasure)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Erasure{}, ErrNoErasure
+	}
+	return erasure, err
+}
+
+// newUserID returns an id for a new user, skipping the ids of erased
+// users.
+func newUserID(ctx context.Context) (string, error) {
+	for attempt := 0; attempt < userIDAttempts; attempt++ {
+		id := genUserId()
+		n, err := erasureCollection.CountDocuments(ctx, bson.M{"_id": id})
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return id, nil
+		}
+	}
+	return "", errors.New("unable to generate an unused user id")
+}
+
+// userAuditFilter matches the audit entries about the user, made by it or
+// about its API keys, and the listings filtered by its email, by hash or in
+// plaintext as entries written before the hash kept it.
+func userAuditFilter(id, email string, apiKeyIDs []string) bson.M {
+	or := bson.A{
+		bson.M{"targetType": AuditTargetUser, "targetId": id},
+		bson.M{"actor": id},
+	}
+	if len(apiKeyIDs) > 0 {
+		or = append(or, bson.M{"targetType": AuditTargetAPIKey, "targetId": bson.M{"$in": apiKeyIDs}})
+	}
+	if email != "" {
+		or = append(or, bson.M{"details.emailHash": emailHash(email)}, bson.M{"details.email": email})
+	}
+	return bson.M{"$or": or}
+}
+
+// userDeadLetterFilter matches the undelivered events of the user and the
+// log messages naming it, by id or, as written before they only named ids,
+// by name.
+func userDeadLetterFilter(id, name string) bson.M {
+	or := bson.A{
+		bson.M{"key": id},
+		bson.M{"value": primitive.Regex{Pattern: `\b` + regexp.QuoteMeta(id) + `\b`}},
+	}
+	if name != "" {
+		or = append(or, bson.M{"value": "received request to create new user " + name})
+	}
+	return bson.M{"$or": or}
+}
+
+func findAll(ctx context.Context, coll *mongo.Collection, filter bson.M, results interface{}) error {
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	return cur.All(ctx, results)
+}
+
+func deleteAll(ctx context.Context, coll *mongo.Collection, filter bson.M) (int64, error) {
+	res, err := coll.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
@@ -0,0 +1,404 @@
+package usrmgr
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// deleted is the reply to a delete command that removed n documents.
+func deleted(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n})
+}
+
+// useOrderService points the order service at a server answering body.
+func useOrderService(t *testing.T, body string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	t.Setenv("ORDER_SVC_HOST", u.Hostname())
+	t.Setenv("ORDER_SVC_PORT", u.Port())
+}
+
+func TestUserAuditFilter(t *testing.T) {
+	got := userAuditFilter("u1", "jane@example.com", []string{"ak1"})
+	want := bson.M{"$or": bson.A{
+		bson.M{"targetType": AuditTargetUser, "targetId": "u1"},
+		bson.M{"actor": "u1"},
+		bson.M{"targetType": AuditTargetAPIKey, "targetId": bson.M{"$in": []string{"ak1"}}},
+		bson.M{"details.emailHash": emailHash("jane@example.com")},
+		bson.M{"details.email": "jane@example.com"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filter %v, want %v", got, want)
+	}
+	if or := userAuditFilter("u1", "", nil)["$or"].(bson.A); len(or) != 2 {
+		t.Errorf("filter without email and keys %v", or)
+	}
+}
+
+func TestUserDeadLetterFilter(t *testing.T) {
+	got := userDeadLetterFilter("123", "jane")
+	want := bson.M{"$or": bson.A{
+		bson.M{"key": "123"},
+		bson.M{"value": primitive.Regex{Pattern: `\b123\b`}},
+		bson.M{"value": "received request to create new user jane"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filter %v, want %v", got, want)
+	}
+	re := regexp.MustCompile(got["$or"].(bson.A)[1].(bson.M)["value"].(primitive.Regex).Pattern)
+	if !re.MatchString("user 123 logged in") || re.MatchString("user 1234 logged in") {
+		t.Error("id pattern does not match the id alone")
+	}
+	if or := userDeadLetterFilter("123", "")["$or"].(bson.A); len(or) != 2 {
+		t.Errorf("filter without name %v", or)
+	}
+}
+
+func TestErasureDigest(t *testing.T) {
+	started := time.Unix(1700000000, 0).UTC()
+	completed := started.Add(time.Minute)
+	e := Erasure{
+		UserID: "u1", RequestedBy: "admin", Reason: "art. 17", StartedAt: started, CompletedAt: &completed,
+		Removed: map[string]int64{"sessions": 2, "users": 1},
+	}
+	digest, err := e.digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := e
+	c.Proof, c.AuditSeq = digest, 42
+	local := completed.In(time.FixedZone("x", 3600))
+	c.StartedAt, c.CompletedAt = started.In(time.FixedZone("x", 3600)), &local
+	if got, _ := c.digest(); got != digest {
+		t.Error("digest changes with the proof, audit entry or time zone")
+	}
+	for name, modify := range map[string]func(e *Erasure){
+		"user":      func(e *Erasure) { e.UserID = "u2" },
+		"requester": func(e *Erasure) { e.RequestedBy = "mallory" },
+		"removed":   func(e *Erasure) { e.Removed = map[string]int64{"sessions": 1, "users": 1} },
+		"completed": func(e *Erasure) { later := completed.Add(time.Second); e.CompletedAt = &later },
+	} {
+		c := e
+		modify(&c)
+		if got, _ := c.digest(); got == digest {
+			t.Errorf("digest does not cover %s", name)
+		}
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	generated := time.Unix(1700000000, 0).UTC()
+	export := UserExport{
+		GeneratedAt: generated,
+		User:        User{ID: "u1", Name: "jane", PasswordHash: "$argon2id$secret"},
+		Orders:      []interface{}{map[string]interface{}{"id": "o1"}},
+		Sessions:    []Session{{ID: "s1", UserID: "u1"}},
+		APIKeys:     []APIKey{{ID: "ak1", Principal: "u1", Hash: "keyhash"}},
+		Tokens:      []ExportedToken{{Purpose: "verify_email"}},
+		Audit:       []AuditEntry{{Seq: 1, Action: AuditUserCreate}},
+	}
+	var buf bytes.Buffer
+	if err := export.WriteZip(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+		if !f.Modified.Equal(generated) {
+			t.Errorf("%s modified %v", f.Name, f.Modified)
+		}
+	}
+
+	var manifest exportManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.UserID != "u1" || !manifest.GeneratedAt.Equal(generated) || len(manifest.Files) != 6 {
+		t.Errorf("manifest %+v", manifest)
+	}
+	for name, sum := range manifest.Files {
+		b, ok := files[name]
+		got := sha256.Sum256(b)
+		if !ok || hex.EncodeToString(got[:]) != sum {
+			t.Errorf("%s does not match the manifest", name)
+		}
+	}
+	if len(files) != 7 {
+		t.Errorf("%d files", len(files))
+	}
+	for _, secret := range []string{"$argon2id$secret", "keyhash"} {
+		for name, b := range files {
+			if bytes.Contains(b, []byte(secret)) {
+				t.Errorf("%s contains %s", name, secret)
+			}
+		}
+	}
+}
+
+func TestExportUserData(t *testing.T) {
+	useTestProducer(t)
+	t.Setenv("AUDIT_ENABLE", "false")
+	useOrderService(t, `[{"id":"o1"}]`)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("export", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &sessionCollection, &apiKeyCollection, &tokenCollection, &auditCollection)
+		created := time.Unix(1700000000, 0).UTC()
+		mt.AddMockResponses(
+			found(resetUser(true)),
+			found(bson.D{{Key: "_id", Value: "s1"}, {Key: "userId", Value: "u1"}}),
+			found(bson.D{{Key: "_id", Value: "ak1"}, {Key: "principal", Value: "u1"}, {Key: "hash", Value: "keyhash"}}),
+			found(bson.D{{Key: "_id", Value: "nonce"}, {Key: "purpose", Value: "verify_email"}, {Key: "userId", Value: "u1"}, {Key: "createdAt", Value: created}}),
+			found(auditDocs(t, auditChain(t, 1)...)...),
+		)
+
+		export, err := ExportUserData(context.Background(), "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if export.User.ID != "u1" || len(export.Sessions) != 1 || len(export.APIKeys) != 1 || len(export.Audit) != 1 {
+			t.Errorf("export %+v", export)
+		}
+		if !reflect.DeepEqual(export.Orders, []interface{}{map[string]interface{}{"id": "o1"}}) {
+			t.Errorf("orders %v", export.Orders)
+		}
+		if want := []ExportedToken{{Purpose: "verify_email", CreatedAt: created}}; !reflect.DeepEqual(export.Tokens, want) {
+			t.Errorf("tokens %+v", export.Tokens)
+		}
+
+		var auditFind bson.Raw
+		for _, ev := range mt.GetAllStartedEvents() {
+			if ev.CommandName == "find" {
+				auditFind = ev.Command
+			}
+		}
+		or, _ := auditFind.Lookup("filter", "$or").Array().Values()
+		if len(or) != 5 {
+			t.Errorf("audit filter %s, want the user, its actions, API keys and email, hashed and plain", auditFind.Lookup("filter"))
+		}
+	})
+	mt.Run("order service down", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		t.Setenv("ORDER_SVC_PORT", "1")
+		mt.AddMockResponses(found(resetUser(true)))
+
+		if _, err := ExportUserData(context.Background(), "u1"); !errors.Is(err, ErrOrderServiceUnavailable) {
+			t.Errorf("ExportUserData = %v, want ErrOrderServiceUnavailable", err)
+		}
+	})
+	mt.Run("erased", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &erasureCollection)
+		mt.AddMockResponses(found(), found(bson.D{{Key: "_id", Value: "u1"}}))
+
+		if _, err := ExportUserData(context.Background(), "u1"); !errors.Is(err, ErrUserErased) {
+			t.Errorf("ExportUserData = %v, want ErrUserErased", err)
+		}
+	})
+	mt.Run("not found", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &erasureCollection)
+		mt.AddMockResponses(found(), found())
+
+		if _, err := ExportUserData(context.Background(), "u1"); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("ExportUserData = %v, want ErrUserNotFound", err)
+		}
+	})
+}
+
+func TestEraseUser(t *testing.T) {
+	started := time.Now().UTC().Truncate(time.Millisecond)
+	erasureDoc := bson.D{{Key: "_id", Value: "u1"}, {Key: "requestedBy", Value: "admin"}, {Key: "startedAt", Value: started}}
+	upserted := mtest.CreateSuccessResponse(bson.E{Key: "value", Value: erasureDoc})
+	ctx := WithActor(context.Background(), "admin")
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("erase", func(mt *mtest.T) {
+		w := useTestProducer(t)
+		useTestLockout(t, lockout)
+		useMockCollections(t, mt, &userCollection, &erasureCollection, &sessionCollection, &tokenCollection,
+			&auditCollection, &apiKeyCollection, &deadLetterCollection)
+		mt.AddMockResponses(
+			found(), found(resetUser(true)), upserted,
+			found(bson.D{{Key: "_id", Value: "ak1"}, {Key: "principal", Value: "u1"}}),
+			deleted(2), deleted(1), updated(5), deleted(1), deleted(0), deleted(1),
+			updated(1),
+			found(), mtest.CreateSuccessResponse(), updated(1),
+		)
+
+		erasure, err := EraseUser(ctx, "u1", "art. 17")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int64{"sessions": 2, "tokens": 1, "auditEntries": 5, "apiKeys": 1, "deadLetters": 0, "loginAttempts": 0, "users": 1}
+		if !reflect.DeepEqual(erasure.Removed, want) {
+			t.Errorf("removed %v, want %v", erasure.Removed, want)
+		}
+		if proof, _ := erasure.digest(); erasure.CompletedAt == nil || erasure.Proof != proof {
+			t.Errorf("erasure %+v without a valid proof", erasure)
+		}
+		if erasure.AuditSeq != 1 {
+			t.Errorf("audit entry %d", erasure.AuditSeq)
+		}
+		if got := strings.Join(commands(mt), ","); got != "find,find,findAndModify,find,delete,delete,update,delete,delete,delete,update,find,insert,update" {
+			t.Errorf("commands %s", got)
+		}
+
+		// the audit entries of the API keys are redacted too
+		for _, ev := range mt.GetAllStartedEvents() {
+			if ev.CommandName != "update" {
+				continue
+			}
+			or, _ := ev.Command.Lookup("updates").Array().Index(0).Value().Document().Lookup("q", "$or").Array().Values()
+			if len(or) != 5 {
+				t.Errorf("redaction filter has %d clauses, want 5", len(or))
+			}
+			break
+		}
+		// the dead letters naming the user are deleted, the only delete by $or
+		deadLetterClauses := -1
+		for _, ev := range mt.GetAllStartedEvents() {
+			if ev.CommandName != "delete" {
+				continue
+			}
+			q := ev.Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").Document()
+			if or, err := q.LookupErr("$or"); err == nil {
+				values, _ := or.Array().Values()
+				deadLetterClauses = len(values)
+			}
+		}
+		if deadLetterClauses != 3 {
+			t.Errorf("dead letter filter has %d clauses, want key, id and name", deadLetterClauses)
+		}
+
+		var events []string
+		for _, batch := range w.batches {
+			for _, msg := range batch {
+				if len(msg.Headers) == 1 && string(msg.Headers[0].Value) == EventUserErased {
+					events = append(events, string(msg.Value))
+					if string(msg.Key) != "u1" || bytes.Contains(msg.Value, []byte("jane")) {
+						t.Errorf("event %s: %s", msg.Key, msg.Value)
+					}
+				}
+			}
+		}
+		if len(events) != 1 {
+			t.Errorf("%d UserErased events", len(events))
+		}
+	})
+	mt.Run("already erased", func(mt *mtest.T) {
+		useTestProducer(t)
+		useMockCollections(t, mt, &erasureCollection)
+		completed := started.Add(time.Minute)
+		mt.AddMockResponses(found(append(erasureDoc, bson.E{Key: "completedAt", Value: completed}, bson.E{Key: "proof", Value: "p"})))
+
+		erasure, err := EraseUser(ctx, "u1", "")
+		if err != nil || erasure.Proof != "p" {
+			t.Fatalf("EraseUser = %+v, %v", erasure, err)
+		}
+		if got := commands(mt); len(got) != 1 {
+			t.Errorf("commands %v, want the record only", got)
+		}
+	})
+	mt.Run("finishes an interrupted erasure", func(mt *mtest.T) {
+		useTestProducer(t)
+		useMockCollections(t, mt, &userCollection, &erasureCollection, &sessionCollection, &tokenCollection,
+			&auditCollection, &apiKeyCollection, &deadLetterCollection)
+		t.Setenv("AUDIT_ENABLE", "false")
+		mt.AddMockResponses(
+			found(erasureDoc), found(), upserted, found(),
+			deleted(0), deleted(0), updated(0), deleted(0), deleted(0), deleted(0),
+			updated(1),
+		)
+
+		erasure, err := EraseUser(ctx, "u1", "")
+		if err != nil || erasure.CompletedAt == nil {
+			t.Fatalf("EraseUser = %+v, %v", erasure, err)
+		}
+	})
+	mt.Run("unknown user", func(mt *mtest.T) {
+		useTestProducer(t)
+		useMockCollections(t, mt, &userCollection, &erasureCollection)
+		mt.AddMockResponses(found(), found())
+
+		if _, err := EraseUser(ctx, "u1", ""); !errors.Is(err, ErrUserNotFound) {
+			t.Errorf("EraseUser = %v, want ErrUserNotFound", err)
+		}
+	})
+	mt.Run("failed step", func(mt *mtest.T) {
+		useTestProducer(t)
+		useMockCollections(t, mt, &userCollection, &erasureCollection, &sessionCollection, &apiKeyCollection)
+		mt.AddMockResponses(found(), found(resetUser(true)), upserted, found(),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "boom"}))
+
+		_, err := EraseUser(ctx, "u1", "")
+		if err == nil || !strings.Contains(err.Error(), "erasing sessions of user u1") {
+			t.Errorf("EraseUser = %v", err)
+		}
+		// the erasure is not marked complete
+		for _, c := range commands(mt) {
+			if c == "update" {
+				t.Error("erasure completed")
+			}
+		}
+	})
+}
+
+func TestNewUserID(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("skips erased ids", func(mt *mtest.T) {
+		useMockCollections(t, mt, &erasureCollection)
+		mt.AddMockResponses(sessionCount(1), sessionCount(0))
+
+		id, err := newUserID(context.Background())
+		if err != nil || id == "" {
+			t.Fatalf("newUserID = %q, %v", id, err)
+		}
+		if got := commands(mt); len(got) != 2 {
+			t.Errorf("commands %v", got)
+		}
+	})
+	mt.Run("gives up", func(mt *mtest.T) {
+		useMockCollections(t, mt, &erasureCollection)
+		for i := 0; i < userIDAttempts; i++ {
+			mt.AddMockResponses(sessionCount(1))
+		}
+		if _, err := newUserID(context.Background()); err == nil {
+			t.Error("id of an erased user handed out")
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jwtPart encodes v as a JWT header or payload.
+func jwtPart(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signWith signs header and payload with k, whatever the header says.
+func signWith(k signingKey, header, payload string) string {
+	sum := sha256.Sum256([]byte(header + "." + payload))
+	sig, _ := rsa.SignPKCS1v15(nil, k.key, crypto.SHA256, sum[:])
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestSignJWT(t *testing.T) {
+	k := testSigningKey(t, 0)
+	useTestKeyring(t, k)
+	claims := registeredClaims{Issuer: "https://users.example.com", Subject: "u1", Audience: "user-service", IssuedAt: 1, ExpiresAt: 2}
+
+	token, err := signJWT(context.Background(), jwtTypeAccess, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q", token)
+	}
+	var header jwtHeader
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(raw, &header); err != nil || header != (jwtHeader{Algorithm: "RS256", Type: jwtTypeAccess, KeyID: k.ID}) {
+		t.Errorf("header %s", raw)
+	}
+
+	// any RS256 verifier holding the public key accepts it
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := rsa.VerifyPKCS1v15(&k.key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("signature: %v", err)
+	}
+
+	var got registeredClaims
+	if err := verifyJWT(context.Background(), token, jwtTypeAccess, &got); err != nil || got != claims {
+		t.Errorf("verifyJWT = %+v, %v", got, err)
+	}
+}
+
+func TestSignJWTWithoutKey(t *testing.T) {
+	useTestKeyring(t)
+	if _, err := signJWT(context.Background(), jwtTypeAccess, registeredClaims{}); !errors.Is(err, ErrNoSigningKey) {
+		t.Errorf("signJWT = %v, want ErrNoSigningKey", err)
+	}
+}
+
+func TestVerifyJWTRejects(t *testing.T) {
+	k, other := testSigningKey(t, 0), testSigningKey(t, 1)
+	useTestKeyring(t, k)
+	payload := jwtPart(registeredClaims{Subject: "u1"})
+	header := jwtPart(jwtHeader{Algorithm: "RS256", Type: jwtTypeAccess, KeyID: k.ID})
+	valid := signWith(k, header, payload)
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"tampered payload", parts[0] + "." + jwtPart(registeredClaims{Subject: "admin"}) + "." + parts[2]},
+		{"signed by another key", signWith(other, header, payload)},
+		{"unknown key", signWith(other, jwtPart(jwtHeader{Algorithm: "RS256", Type: jwtTypeAccess, KeyID: other.ID}), payload)},
+		{"other type", signWith(k, jwtPart(jwtHeader{Algorithm: "RS256", Type: jwtTypeID, KeyID: k.ID}), payload)},
+		{"alg none", jwtPart(jwtHeader{Algorithm: "none", Type: jwtTypeAccess, KeyID: k.ID}) + "." + payload + "."},
+		{"alg HS256", signWith(k, jwtPart(jwtHeader{Algorithm: "HS256", Type: jwtTypeAccess, KeyID: k.ID}), payload)},
+		{"no signature", parts[0] + "." + parts[1] + "."},
+		{"two parts", parts[0] + "." + parts[1]},
+		{"bad header", "e30K!." + parts[1] + "." + parts[2]},
+		{"header not json", base64.RawURLEncoding.EncodeToString([]byte("nope")) + "." + parts[1] + "." + parts[2]},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		var claims registeredClaims
+		if err := verifyJWT(context.Background(), tt.token, jwtTypeAccess, &claims); !errors.Is(err, ErrInvalidJWT) {
+			t.Errorf("%s: verifyJWT = %v, want ErrInvalidJWT", tt.name, err)
+		}
+	}
+
+	var claims registeredClaims
+	if err := verifyJWT(context.Background(), valid, jwtTypeAccess, &claims); err != nil || claims.Subject != "u1" {
+		t.Errorf("valid token: %+v, %v", claims, err)
+	}
+}
+
+func TestVerifyJWTRetiredKey(t *testing.T) {
+	old, current := testSigningKey(t, 0), testSigningKey(t, 1)
+	useTestKeyring(t, old)
+	token, err := signJWT(context.Background(), jwtTypeID, registeredClaims{Subject: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// still published during the overlap
+	useTestKeyring(t, old, current)
+	var claims registeredClaims
+	if err := verifyJWT(context.Background(), token, jwtTypeID, &claims); err != nil {
+		t.Errorf("token of a published older key refused: %v", err)
+	}
+	// gone once expired
+	useTestKeyring(t, current)
+	if err := verifyJWT(context.Background(), token, jwtTypeID, &claims); !errors.Is(err, ErrInvalidJWT) {
+		t.Errorf("token of an expired key = %v, want ErrInvalidJWT", err)
+	}
+}
+
+func TestRegisteredClaimsValid(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := registeredClaims{
+		Issuer: "https://users.example.com", Subject: "u1", Audience: "user-service",
+		IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	tests := []struct {
+		name   string
+		modify func(c *registeredClaims)
+		want   bool
+	}{
+		{"valid", func(c *registeredClaims) {}, true},
+		{"issued slightly ahead", func(c *registeredClaims) { c.IssuedAt = now.Add(30 * time.Second).Unix() }, true},
+		{"issued in the future", func(c *registeredClaims) { c.IssuedAt = now.Add(2 * time.Minute).Unix() }, false},
+		{"expired", func(c *registeredClaims) { c.ExpiresAt = now.Unix() }, false},
+		{"other issuer", func(c *registeredClaims) { c.Issuer = "https://evil.example.com" }, false},
+		{"other audience", func(c *registeredClaims) { c.Audience = "order-service" }, false},
+		{"no subject", func(c *registeredClaims) { c.Subject = "" }, false},
+	}
+	for _, tt := range tests {
+		c := valid
+		tt.modify(&c)
+		if got := c.valid("https://users.example.com", "user-service", now); got != tt.want {
+			t.Errorf("%s: valid = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
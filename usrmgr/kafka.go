@@ -5,146 +5,250 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
+	"github.com/subhamproject/user-service/logs"
 	"github.com/subhamproject/user-service/utils"
 )
 
 var (
 	kafkaWriter *kafka.Writer
-	topic       string
+	producer    *eventProducer
+	// kafkaDialer carries the TLS and SASL settings shared by every writer
+	// and reader of the service.
+	kafkaDialer  *kafka.Dialer
+	kafkaBrokers []string
+	topic        string
 )
 
-func SendLogs(val string) {
-	fmt.Println("writing event to kafka", val)
+// SendLogs publishes an event to the Kafka topic. Delivery failures are
+// reported through the producer and never fail the calling request.
+func SendLogs(ctx context.Context, val string) {
+	logs.FromContext(ctx).WithField("event", val).Debug("writing event to kafka")
 	msg := kafka.Message{
-		Partition: int(kafka.PatternTypeAny),
-		Value:     []byte(val),
-	}
-
-	err := kafkaWriter.WriteMessages(context.TODO(), msg)
-	if err != nil {
-		log.Fatalln(err)
-	} else {
-		fmt.Println("sucessfully sent message to kafka, event is: ", val)
+		Value: []byte(val),
 	}
+	producer.Send(ctx, msg)
 }
 
-func getSslKafkaWriter(kafkaURL, topic string) *kafka.Writer {
-	clientCertFile := utils.GetEnvParam("KAFKA_CLIENT_CERT", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/kafka.user.cert")
-	clientKeyFile := utils.GetEnvParam("KAFKA_CLIENT_KEY", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/kafka.user.key")
-	// caCertFile := GetEnvParam("KAFKA_CA_CERT", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/kafka.user.pem")
-	servers := strings.Split(kafkaURL, ",")
-	cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+// getKafkaTLSConfig builds the client TLS configuration used to talk to the
+// brokers. The broker certificate is verified against KAFKA_CA_CERT (or the
+// system roots). With clientCert the client certificate used for mTLS is
+// loaded and reloaded when rotated on disk.
+func getKafkaTLSConfig(clientCert bool) (*tls.Config, error) {
+	caCertFile := utils.GetEnvParam("KAFKA_CA_CERT", "")
+	serverName := utils.GetEnvParam("KAFKA_TLS_SERVER_NAME", "")
+	reloadInterval := utils.GetEnvDurationParam("KAFKA_CERT_RELOAD_INTERVAL", 30*time.Second)
+
+	minVersion, err := utils.ParseTLSVersion(utils.GetEnvParam("KAFKA_TLS_MIN_VERSION", "1.2"))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	cipherSuites, err := utils.ParseCipherSuites(utils.GetEnvParam("KAFKA_TLS_CIPHER_SUITES", ""))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: true}
 
-	dialer := &kafka.Dialer{
-		Timeout:   10 * time.Second,
-		DualStack: true,
-		TLS:       cfg,
+	cfg := &tls.Config{
+		// when empty kafka-go verifies against the host name of each broker
+		ServerName:   serverName,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
 	}
 
-	w := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  servers,
-		Topic:    topic,
-		Balancer: &kafka.Hash{},
-		Dialer:   dialer,
-	})
-	w.AllowAutoTopicCreation = true
+	if caCertFile != "" {
+		pool, err := utils.LoadCertPool(caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
 
-	return w
+	if clientCert {
+		clientCertFile := utils.GetEnvParam("KAFKA_CLIENT_CERT", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/kafka.user.cert")
+		clientKeyFile := utils.GetEnvParam("KAFKA_CLIENT_KEY", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/kafka.user.key")
+		reloader, err := utils.NewCertReloader(clientCertFile, clientKeyFile, reloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load kafka client certificate: %w", err)
+		}
+		reloader.OnReloadError = func(err error) {
+			logs.FromContext(context.Background()).Error(err)
+		}
+		cfg.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return cfg, nil
 }
 
-func getKafkaWriter(kafkaURL, topic string) *kafka.Writer {
-	fmt.Println("initializing non ssl kafka writer")
+func getKafkaWriter(kafkaURL, topic string, dialer *kafka.Dialer) *kafka.Writer {
 	servers := strings.Split(kafkaURL, ",")
 
 	w := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:  servers,
 		Topic:    topic,
 		Balancer: &kafka.Hash{},
+		Dialer:   dialer,
 	})
-	w.AllowAutoTopicCreation = true
-
-	// w := &kafka.Writer{
-	// 	Addr:                   kafka.TCP(kafkaURL),
-	// 	Topic:                  topic,
-	// 	AllowAutoTopicCreation: true,
-	// }
 
 	return w
 }
 
 func InitKafka() {
-	devMode := utils.GetEnvBoolParam("DEV_MODE", true)
-	fmt.Println("initializing kafka connection. devmode: ", devMode)
+	logger := logs.FromContext(context.Background())
+	authMode := getKafkaAuthMode()
 	kafkaURL := utils.GetEnvParam("KAFKA_SERVERS", "localhost:9092")
-	servers := strings.Split(kafkaURL, ",")
-	fmt.Println("kafka servers: ", servers)
+	kafkaBrokers = strings.Split(kafkaURL, ",")
+	autoCreate := utils.GetEnvBoolParam("KAFKA_TOPIC_AUTO_CREATE", true)
+	logger.WithField("authMode", authMode).WithField("servers", kafkaBrokers).Info("initializing kafka connection")
+
+	var err error
+	kafkaDialer, err = getKafkaDialer(authMode)
+	if err != nil {
+		logger.Fatal("kafka auth configuration error: ", err)
+	}
 
 	// get kafka writer using environment variables.
 	topic = utils.GetEnvParam("KAFKA_TOPIC", "demoTopic")
-	if devMode {
-		kafkaWriter = getKafkaWriter(kafkaURL, topic)
-	} else {
-		kafkaWriter = getSslKafkaWriter(kafkaURL, topic)
+	kafkaWriter = getKafkaWriter(kafkaURL, topic, kafkaDialer)
+	kafkaWriter.AllowAutoTopicCreation = autoCreate
+
+	producerCfg := loadProducerConfig()
+	if err := configureWriter(kafkaWriter, producerCfg); err != nil {
+		logger.Fatal("kafka producer configuration error: ", err)
 	}
+	producer = newEventProducer(kafkaWriter, producerCfg)
+	producer.onFailure = saveDeadLetters
 
-	fmt.Println("init kafka writer - ", kafkaWriter)
+	logger.WithField("topic", topic).Info("initialized kafka writer")
 
-	if err := pingKafka(); err != nil {
-		log.Fatal("kafka ping error: ", err)
+	if err := waitForKafka(autoCreate); err != nil {
+		logger.Fatal("kafka connectivity check error: ", err)
 	}
 }
 
+// CloseKafka flushes queued events and closes the writer.
 func CloseKafka() {
+	ctx, cancel := context.WithTimeout(context.Background(), utils.GetEnvDurationParam("KAFKA_FLUSH_TIMEOUT", 10*time.Second))
+	defer cancel()
+
+	if err := producer.Close(ctx); err != nil {
+		logs.FromContext(ctx).Error(err)
+	}
 	if err := kafkaWriter.Close(); err != nil {
-		log.Fatal("failed to close writer:", err)
+		logs.FromContext(ctx).Error("failed to close writer: ", err)
+	}
+}
+
+// CheckKafka verifies that a broker is reachable and the topic exists using
+// metadata requests only, so no message is ever produced. It is used on
+// startup and by the readiness probe.
+func CheckKafka(ctx context.Context) error {
+	conn, err := dialKafka(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return fmt.Errorf("unable to describe topic %s: %w", topic, err)
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no partitions", topic)
 	}
+	return nil
 }
 
-func pingKafka() error {
+// dialKafka connects to the first reachable broker.
+func dialKafka(ctx context.Context) (*kafka.Conn, error) {
+	var err error
+	for _, broker := range kafkaBrokers {
+		var conn *kafka.Conn
+		conn, err = kafkaDialer.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no kafka broker reachable: %w", err)
+}
+
+// ensureKafkaTopic creates the topic with the configured partitions and
+// replication factor when it does not exist yet.
+func ensureKafkaTopic(ctx context.Context) error {
+	err := CheckKafka(ctx)
+	if !errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return err
+	}
+
+	conn, err := dialKafka(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	messages := []kafka.Message{
-		{
-			Key:   []byte("Key-A"),
-			Value: []byte("Hello World!"),
-		},
-		{
-			Key:   []byte("Key-B"),
-			Value: []byte("One!"),
-		},
-		{
-			Key:   []byte("Key-C"),
-			Value: []byte("Two!"),
-		},
+	controller, err := conn.Controller()
+	if err != nil {
+		return fmt.Errorf("unable to find kafka controller: %w", err)
+	}
+	ctrlConn, err := kafkaDialer.DialContext(ctx, "tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		return fmt.Errorf("unable to connect to kafka controller: %w", err)
 	}
+	defer ctrlConn.Close()
+
+	err = ctrlConn.CreateTopics(kafka.TopicConfig{
+		Topic:             topic,
+		NumPartitions:     utils.GetEnvIntParam("KAFKA_TOPIC_PARTITIONS", 1),
+		ReplicationFactor: utils.GetEnvIntParam("KAFKA_TOPIC_REPLICATION_FACTOR", 1),
+	})
+	return topicCreated(ctx, topic, err)
+}
+
+// topicCreated reports the outcome of creating topic. Another instance
+// may have created it in the meantime, which is not an error.
+func topicCreated(ctx context.Context, topic string, err error) error {
+	switch {
+	case err == nil:
+		logs.FromContext(ctx).Infof("created kafka topic %s", topic)
+		return nil
+	case errors.Is(err, kafka.TopicAlreadyExists):
+		logs.FromContext(ctx).Infof("kafka topic %s already exists", topic)
+		return nil
+	}
+	return fmt.Errorf("unable to create topic %s: %w", topic, err)
+}
+
+// waitForKafka checks connectivity on startup, retrying with backoff while
+// the brokers come up.
+func waitForKafka(autoCreate bool) error {
+	retries := utils.GetEnvIntParam("KAFKA_CONNECT_RETRIES", 5)
+	backoff := 500 * time.Millisecond
 
 	var err error
-	const retries = 3
 	for i := 0; i < retries; i++ {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-
-		// attempt to create topic prior to publishing the message
-		err = kafkaWriter.WriteMessages(ctx, messages...)
-		if errors.Is(err, kafka.LeaderNotAvailable) || errors.Is(err, context.DeadlineExceeded) {
-			time.Sleep(time.Millisecond * 250)
-			continue
+		if autoCreate {
+			err = ensureKafkaTopic(ctx)
+		} else {
+			err = CheckKafka(ctx)
+		}
+		cancel()
+		if err == nil {
+			return nil
 		}
 
-		if err != nil {
-			log.Fatalf("unexpected error %v", err)
+		logs.FromContext(context.Background()).Warnf("kafka not ready (attempt %d/%d): %v", i+1, retries, err)
+		if i == retries-1 {
+			break
 		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
 	return err
 }
@@ -0,0 +1,91 @@
+package usrmgr
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/subhamproject/user-service/utils"
+)
+
+// Supported values for KAFKA_AUTH_MODE.
+const (
+	KafkaAuthNone        = "none"
+	KafkaAuthMTLS        = "mtls"
+	KafkaAuthSaslPlain   = "sasl_plain"
+	KafkaAuthScramSHA256 = "scram_sha256"
+	KafkaAuthScramSHA512 = "scram_sha512"
+)
+
+// getKafkaAuthMode returns the configured authentication mode. Without
+// KAFKA_AUTH_MODE, DEV_MODE talks plaintext and everything else uses mTLS.
+func getKafkaAuthMode() string {
+	dflt := KafkaAuthMTLS
+	if utils.GetEnvBoolParam("DEV_MODE", true) {
+		dflt = KafkaAuthNone
+	}
+	return strings.ToLower(utils.GetEnvParam("KAFKA_AUTH_MODE", dflt))
+}
+
+// getKafkaDialer returns the dialer shared by every Kafka writer and reader
+// of the service, configured for the given authentication mode. SASL modes
+// run over TLS unless KAFKA_TLS_ENABLE is false.
+func getKafkaDialer(mode string) (*kafka.Dialer, error) {
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+	}
+
+	switch mode {
+	case KafkaAuthNone:
+		return dialer, nil
+	case KafkaAuthMTLS:
+		cfg, err := getKafkaTLSConfig(true)
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLS = cfg
+		return dialer, nil
+	case KafkaAuthSaslPlain, KafkaAuthScramSHA256, KafkaAuthScramSHA512:
+		mechanism, err := getSaslMechanism(mode)
+		if err != nil {
+			return nil, err
+		}
+		dialer.SASLMechanism = mechanism
+		if utils.GetEnvBoolParam("KAFKA_TLS_ENABLE", true) {
+			cfg, err := getKafkaTLSConfig(false)
+			if err != nil {
+				return nil, err
+			}
+			dialer.TLS = cfg
+		}
+		return dialer, nil
+	}
+	return nil, fmt.Errorf("unknown kafka auth mode %q", mode)
+}
+
+func getSaslMechanism(mode string) (sasl.Mechanism, error) {
+	user, err := utils.GetEnvSecretParam("KAFKA_SASL_USERNAME", "")
+	if err != nil {
+		return nil, err
+	}
+	pass, err := utils.GetEnvSecretParam("KAFKA_SASL_PASSWORD", "")
+	if err != nil {
+		return nil, err
+	}
+	if user == "" || pass == "" {
+		return nil, fmt.Errorf("kafka auth mode %s requires KAFKA_SASL_USERNAME and KAFKA_SASL_PASSWORD", mode)
+	}
+
+	switch mode {
+	case KafkaAuthScramSHA256:
+		return scram.Mechanism(scram.SHA256, user, pass)
+	case KafkaAuthScramSHA512:
+		return scram.Mechanism(scram.SHA512, user, pass)
+	}
+	return plain.Mechanism{Username: user, Password: pass}, nil
+}
@@ -0,0 +1,107 @@
+package usrmgr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// unsetenv removes key from the environment for the test.
+func unsetenv(t *testing.T, key string) {
+	t.Helper()
+	t.Setenv(key, "")
+	os.Unsetenv(key)
+}
+
+func TestGetKafkaAuthMode(t *testing.T) {
+	unsetenv(t, "KAFKA_AUTH_MODE")
+	t.Setenv("DEV_MODE", "true")
+	if got := getKafkaAuthMode(); got != KafkaAuthNone {
+		t.Errorf("dev mode default %q, want none", got)
+	}
+	t.Setenv("DEV_MODE", "false")
+	if got := getKafkaAuthMode(); got != KafkaAuthMTLS {
+		t.Errorf("production default %q, want mtls", got)
+	}
+	t.Setenv("KAFKA_AUTH_MODE", "SCRAM_SHA512")
+	if got := getKafkaAuthMode(); got != KafkaAuthScramSHA512 {
+		t.Errorf("explicit mode %q", got)
+	}
+}
+
+func TestGetKafkaDialerSasl(t *testing.T) {
+	t.Setenv("KAFKA_SASL_USERNAME", "svc")
+	t.Setenv("KAFKA_SASL_PASSWORD", "pw")
+	t.Setenv("KAFKA_TLS_ENABLE", "false")
+
+	tests := map[string]string{
+		KafkaAuthSaslPlain:   "PLAIN",
+		KafkaAuthScramSHA256: "SCRAM-SHA-256",
+		KafkaAuthScramSHA512: "SCRAM-SHA-512",
+	}
+	for mode, want := range tests {
+		dialer, err := getKafkaDialer(mode)
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if dialer.SASLMechanism == nil || dialer.SASLMechanism.Name() != want {
+			t.Errorf("%s: mechanism %v, want %s", mode, dialer.SASLMechanism, want)
+		}
+		if dialer.TLS != nil {
+			t.Errorf("%s: tls enabled with KAFKA_TLS_ENABLE=false", mode)
+		}
+	}
+
+	plainMechanism, _ := getSaslMechanism(KafkaAuthSaslPlain)
+	if m := plainMechanism.(plain.Mechanism); m.Username != "svc" || m.Password != "pw" {
+		t.Errorf("plain credentials %+v", m)
+	}
+}
+
+func TestGetKafkaDialerSaslOverTLS(t *testing.T) {
+	t.Setenv("KAFKA_SASL_USERNAME", "svc")
+	t.Setenv("KAFKA_SASL_PASSWORD", "pw")
+	unsetenv(t, "KAFKA_TLS_ENABLE")
+	dialer, err := getKafkaDialer(KafkaAuthScramSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.TLS == nil || dialer.TLS.GetClientCertificate != nil {
+		t.Errorf("sasl needs tls without a client certificate, got %+v", dialer.TLS)
+	}
+}
+
+func TestGetKafkaDialerPasswordFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KAFKA_SASL_USERNAME", "svc")
+	unsetenv(t, "KAFKA_SASL_PASSWORD")
+	t.Setenv("KAFKA_SASL_PASSWORD_FILE", file)
+
+	mechanism, err := getSaslMechanism(KafkaAuthSaslPlain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := mechanism.(plain.Mechanism); m.Password != "from-file" {
+		t.Errorf("password %q, want the file content", m.Password)
+	}
+}
+
+func TestGetKafkaDialerErrors(t *testing.T) {
+	unsetenv(t, "KAFKA_SASL_USERNAME")
+	unsetenv(t, "KAFKA_SASL_PASSWORD")
+	unsetenv(t, "KAFKA_SASL_PASSWORD_FILE")
+	if _, err := getKafkaDialer(KafkaAuthSaslPlain); err == nil {
+		t.Error("sasl without credentials: want an error")
+	}
+	if _, err := getKafkaDialer("kerberos"); err == nil {
+		t.Error("unknown mode: want an error")
+	}
+	if d, err := getKafkaDialer(KafkaAuthNone); err != nil || d.TLS != nil || d.SASLMechanism != nil {
+		t.Errorf("none: %+v, %v", d, err)
+	}
+}
@@ -0,0 +1,286 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+)
+
+// Supported values for KAFKA_PRODUCER_MODE and KAFKA_QUEUE_FULL_POLICY.
+const (
+	ProducerModeSync  = "sync"
+	ProducerModeAsync = "async"
+
+	QueueFullDrop  = "drop"
+	QueueFullBlock = "block"
+)
+
+var (
+	errProducerClosed = errors.New("kafka producer closed")
+	errQueueFull      = errors.New("kafka producer queue full")
+
+	producerStats = expvar.NewMap("kafka_producer")
+)
+
+// producerConfig controls how events are handed to Kafka.
+type producerConfig struct {
+	Mode         string
+	QueueSize    int
+	BatchSize    int
+	BatchTimeout time.Duration
+	WriteTimeout time.Duration
+	FullPolicy   string
+}
+
+func loadProducerConfig() producerConfig {
+	return producerConfig{
+		Mode:         strings.ToLower(utils.GetEnvParam("KAFKA_PRODUCER_MODE", ProducerModeAsync)),
+		QueueSize:    utils.GetEnvIntParam("KAFKA_QUEUE_SIZE", 10000),
+		BatchSize:    utils.GetEnvIntParam("KAFKA_BATCH_SIZE", 100),
+		BatchTimeout: utils.GetEnvDurationParam("KAFKA_BATCH_TIMEOUT", time.Second),
+		WriteTimeout: utils.GetEnvDurationParam("KAFKA_WRITE_TIMEOUT", 10*time.Second),
+		FullPolicy:   strings.ToLower(utils.GetEnvParam("KAFKA_QUEUE_FULL_POLICY", QueueFullDrop)),
+	}
+}
+
+// configureWriter applies the acks and compression settings to w.
+func configureWriter(w *kafka.Writer, cfg producerConfig) error {
+	switch strings.ToLower(utils.GetEnvParam("KAFKA_REQUIRED_ACKS", "all")) {
+	case "all", "-1":
+		w.RequiredAcks = kafka.RequireAll
+	case "one", "1":
+		w.RequiredAcks = kafka.RequireOne
+	case "none", "0":
+		w.RequiredAcks = kafka.RequireNone
+	default:
+		return fmt.Errorf("invalid KAFKA_REQUIRED_ACKS")
+	}
+
+	switch strings.ToLower(utils.GetEnvParam("KAFKA_COMPRESSION", "none")) {
+	case "none", "":
+	case "gzip":
+		w.Compression = kafka.Gzip
+	case "snappy":
+		w.Compression = kafka.Snappy
+	case "lz4":
+		w.Compression = kafka.Lz4
+	case "zstd":
+		w.Compression = kafka.Zstd
+	default:
+		return fmt.Errorf("invalid KAFKA_COMPRESSION")
+	}
+
+	// Batching happens in the producer queue, the writer only has to flush
+	// what it is handed without waiting for more messages.
+	w.BatchSize = cfg.BatchSize
+	w.BatchTimeout = 10 * time.Millisecond
+	w.WriteTimeout = cfg.WriteTimeout
+	// events still failing after MaxAttempts go to the failure handler
+	w.MaxAttempts = utils.GetEnvIntParam("KAFKA_MAX_ATTEMPTS", 10)
+	return nil
+}
+
+// messageWriter writes messages to Kafka, it is implemented by
+// kafka.Writer.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// eventProducer publishes events to Kafka. In async mode events go through
+// a bounded in-memory queue and are written in batches by a background
+// worker so request handlers never wait on Kafka.
+type eventProducer struct {
+	cfg    producerConfig
+	writer messageWriter
+	queue  chan kafka.Message
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// mu is held shared by Send while it hands over a message and
+	// exclusively by Close, so no message is queued once the worker has
+	// drained the queue.
+	mu     sync.RWMutex
+	closed bool
+
+	// onFailure is called with the messages that could not be delivered.
+	onFailure func(ctx context.Context, msgs []kafka.Message, err error)
+}
+
+func newEventProducer(w messageWriter, cfg producerConfig) *eventProducer {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+	if cfg.BatchSize <= 0 || cfg.BatchSize > cfg.QueueSize {
+		cfg.BatchSize = cfg.QueueSize
+	}
+	if cfg.BatchTimeout <= 0 {
+		cfg.BatchTimeout = time.Second
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10 * time.Second
+	}
+
+	p := &eventProducer{
+		cfg:       cfg,
+		writer:    w,
+		done:      make(chan struct{}),
+		onFailure: logDeliveryFailure,
+	}
+	if cfg.Mode == ProducerModeAsync {
+		p.queue = make(chan kafka.Message, cfg.QueueSize)
+		p.wg.Add(1)
+		go p.run()
+	}
+	return p
+}
+
+// Send publishes msg. In sync mode it waits for the write and returns its
+// error; in async mode it enqueues the message and, when the queue is full,
+// either drops it or blocks until there is room or ctx is done, depending
+// on the policy. Messages that are not delivered go to the failure handler
+// either way.
+func (p *eventProducer) Send(ctx context.Context, msg kafka.Message) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		p.fail(ctx, []kafka.Message{msg}, errProducerClosed)
+		return errProducerClosed
+	}
+
+	if p.cfg.Mode != ProducerModeAsync {
+		return p.write(ctx, []kafka.Message{msg})
+	}
+
+	select {
+	case p.queue <- msg:
+		producerStats.Add("queued", 1)
+		return nil
+	default:
+	}
+
+	if p.cfg.FullPolicy == QueueFullBlock {
+		select {
+		case p.queue <- msg:
+			producerStats.Add("queued", 1)
+			return nil
+		case <-ctx.Done():
+		}
+	}
+
+	producerStats.Add("dropped", 1)
+	p.fail(ctx, []kafka.Message{msg}, errQueueFull)
+	return errQueueFull
+}
+
+// Close stops accepting events and flushes the queue, waiting at most until
+// ctx is done.
+func (p *eventProducer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	p.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("unable to flush kafka producer: %w", ctx.Err())
+	}
+}
+
+func (p *eventProducer) run() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.BatchTimeout)
+	defer ticker.Stop()
+
+	batch := make([]kafka.Message, 0, p.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			p.write(context.Background(), batch)
+			batch = make([]kafka.Message, 0, p.cfg.BatchSize)
+		}
+	}
+
+	for {
+		select {
+		case msg := <-p.queue:
+			batch = append(batch, msg)
+			if len(batch) >= p.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-p.done:
+			for {
+				select {
+				case msg := <-p.queue:
+					batch = append(batch, msg)
+					if len(batch) >= p.cfg.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes msgs and hands those that failed to the failure handler.
+func (p *eventProducer) write(ctx context.Context, msgs []kafka.Message) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.WriteTimeout)
+	defer cancel()
+
+	err := p.writer.WriteMessages(ctx, msgs...)
+	if err == nil {
+		producerStats.Add("sent", int64(len(msgs)))
+		return nil
+	}
+
+	failed := msgs
+	// WriteErrors reports which messages of a batch failed, the others were
+	// delivered.
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) && len(writeErrs) == len(msgs) {
+		failed = nil
+		for i, e := range writeErrs {
+			if e != nil {
+				failed = append(failed, msgs[i])
+			}
+		}
+	}
+	producerStats.Add("sent", int64(len(msgs)-len(failed)))
+	producerStats.Add("failed", int64(len(failed)))
+	p.fail(ctx, failed, err)
+	return err
+}
+
+func (p *eventProducer) fail(ctx context.Context, msgs []kafka.Message, err error) {
+	if p.onFailure != nil {
+		p.onFailure(ctx, msgs, err)
+	}
+}
+
+func logDeliveryFailure(ctx context.Context, msgs []kafka.Message, err error) {
+	logs.FromContext(ctx).WithField("count", len(msgs)).Errorf("failed to deliver events to kafka: %v", err)
+}
@@ -0,0 +1,267 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// fakeWriter records written messages. Writes fail with err, or only the
+// messages whose key is in failKeys when errs is set.
+type fakeWriter struct {
+	mu       sync.Mutex
+	batches  [][]kafka.Message
+	err      error
+	failKeys map[string]bool
+	block    chan struct{}
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if w.block != nil {
+		<-w.block
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, append([]kafka.Message(nil), msgs...))
+	if w.failKeys != nil {
+		errs := make(kafka.WriteErrors, len(msgs))
+		failed := false
+		for i, m := range msgs {
+			if w.failKeys[string(m.Key)] {
+				errs[i], failed = errors.New("broker error"), true
+			}
+		}
+		if failed {
+			return errs
+		}
+		return nil
+	}
+	return w.err
+}
+
+func (w *fakeWriter) written() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := 0
+	for _, b := range w.batches {
+		n += len(b)
+	}
+	return n
+}
+
+// failures collects what the producer hands to its failure handler.
+type failures struct {
+	mu   sync.Mutex
+	msgs []kafka.Message
+	errs []error
+}
+
+func (f *failures) handle(_ context.Context, msgs []kafka.Message, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.msgs = append(f.msgs, msgs...)
+	f.errs = append(f.errs, err)
+}
+
+func (f *failures) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.msgs)
+}
+
+func newTestProducer(w messageWriter, cfg producerConfig) (*eventProducer, *failures) {
+	p := newEventProducer(w, cfg)
+	f := &failures{}
+	p.onFailure = f.handle
+	return p, f
+}
+
+func closeProducer(t *testing.T, p *eventProducer) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func msg(key string) kafka.Message {
+	return kafka.Message{Key: []byte(key), Value: []byte("event")}
+}
+
+func TestProducerSyncReturnsWriteError(t *testing.T) {
+	brokerDown := errors.New("broker down")
+	w := &fakeWriter{err: brokerDown}
+	p, f := newTestProducer(w, producerConfig{Mode: ProducerModeSync})
+
+	if err := p.Send(context.Background(), msg("1")); !errors.Is(err, brokerDown) {
+		t.Errorf("Send = %v, want %v", err, brokerDown)
+	}
+	if f.count() != 1 {
+		t.Errorf("%d messages handed to the failure handler, want 1", f.count())
+	}
+
+	w.err = nil
+	if err := p.Send(context.Background(), msg("2")); err != nil {
+		t.Errorf("Send = %v", err)
+	}
+	closeProducer(t, p)
+}
+
+func TestProducerAsyncBatchesAndFlushesOnClose(t *testing.T) {
+	w := &fakeWriter{}
+	p, f := newTestProducer(w, producerConfig{Mode: ProducerModeAsync, QueueSize: 100, BatchSize: 4, BatchTimeout: time.Hour})
+	for i := 0; i < 10; i++ {
+		if err := p.Send(context.Background(), msg("k")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeProducer(t, p)
+
+	if w.written() != 10 || f.count() != 0 {
+		t.Fatalf("written %d, failed %d, want 10 and 0", w.written(), f.count())
+	}
+	for _, b := range w.batches {
+		if len(b) > 4 {
+			t.Errorf("batch of %d exceeds the batch size", len(b))
+		}
+	}
+}
+
+func TestProducerAsyncFlushesOnTimeout(t *testing.T) {
+	w := &fakeWriter{}
+	p, _ := newTestProducer(w, producerConfig{Mode: ProducerModeAsync, BatchSize: 100, BatchTimeout: 10 * time.Millisecond})
+	defer closeProducer(t, p)
+	p.Send(context.Background(), msg("k"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.written() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("partial batch not flushed after the batch timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProducerSendAfterClose(t *testing.T) {
+	for _, mode := range []string{ProducerModeSync, ProducerModeAsync} {
+		w := &fakeWriter{}
+		p, f := newTestProducer(w, producerConfig{Mode: mode})
+		closeProducer(t, p)
+		if err := p.Send(context.Background(), msg("late")); !errors.Is(err, errProducerClosed) {
+			t.Errorf("%s: Send after Close = %v, want %v", mode, err, errProducerClosed)
+		}
+		if f.count() != 1 || w.written() != 0 {
+			t.Errorf("%s: failed %d written %d, want the message in the failure handler", mode, f.count(), w.written())
+		}
+		if err := p.Close(context.Background()); err != nil {
+			t.Errorf("%s: second Close = %v", mode, err)
+		}
+	}
+}
+
+// Every message sent concurrently with Close is either written or handed to
+// the failure handler, none is lost in the queue.
+func TestProducerCloseRaceLosesNothing(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		w := &fakeWriter{}
+		p, f := newTestProducer(w, producerConfig{Mode: ProducerModeAsync, QueueSize: 1000, BatchSize: 10, BatchTimeout: time.Millisecond})
+
+		const senders, perSender = 8, 50
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perSender; j++ {
+					p.Send(context.Background(), msg("k"))
+				}
+			}()
+		}
+		time.Sleep(time.Duration(round%5) * 100 * time.Microsecond)
+		closeProducer(t, p)
+		wg.Wait()
+
+		if got := w.written() + f.count(); got != senders*perSender {
+			t.Fatalf("round %d: %d messages accounted for, want %d", round, got, senders*perSender)
+		}
+	}
+}
+
+func TestProducerQueueFullDrops(t *testing.T) {
+	w := &fakeWriter{block: make(chan struct{})}
+	p, f := newTestProducer(w, producerConfig{Mode: ProducerModeAsync, QueueSize: 1, BatchSize: 1, FullPolicy: QueueFullDrop})
+
+	// the worker takes the first message and blocks writing it, the second
+	// fills the queue
+	p.Send(context.Background(), msg("1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.queue) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Send(context.Background(), msg("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(context.Background(), msg("3")); !errors.Is(err, errQueueFull) {
+		t.Errorf("Send to a full queue = %v, want %v", err, errQueueFull)
+	}
+	if f.count() != 1 || string(f.msgs[0].Key) != "3" {
+		t.Errorf("failure handler got %v", f.msgs)
+	}
+	close(w.block)
+	closeProducer(t, p)
+}
+
+func TestProducerQueueFullBlocksUntilContextDone(t *testing.T) {
+	w := &fakeWriter{block: make(chan struct{})}
+	p, f := newTestProducer(w, producerConfig{Mode: ProducerModeAsync, QueueSize: 1, BatchSize: 1, FullPolicy: QueueFullBlock})
+	p.Send(context.Background(), msg("1"))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.queue) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	p.Send(context.Background(), msg("2"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Send(ctx, msg("3")); !errors.Is(err, errQueueFull) {
+		t.Errorf("Send = %v, want %v", err, errQueueFull)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("Send did not block until the context was done")
+	}
+	if f.count() != 1 {
+		t.Errorf("failure handler got %d messages, want 1", f.count())
+	}
+	close(w.block)
+	closeProducer(t, p)
+}
+
+func TestProducerPartialBatchFailure(t *testing.T) {
+	w := &fakeWriter{failKeys: map[string]bool{"bad": true}}
+	p, f := newTestProducer(w, producerConfig{Mode: ProducerModeSync})
+	err := p.write(context.Background(), []kafka.Message{msg("good"), msg("bad"), msg("good")})
+	if err == nil {
+		t.Fatal("want the write error")
+	}
+	if f.count() != 1 || string(f.msgs[0].Key) != "bad" {
+		t.Errorf("failure handler got %v, want only the failed message", f.msgs)
+	}
+	closeProducer(t, p)
+}
+
+// useTestProducer routes the events of the service to a fake writer for the
+// duration of the test.
+func useTestProducer(t *testing.T) *fakeWriter {
+	t.Helper()
+	w := &fakeWriter{}
+	prev := producer
+	producer = newEventProducer(w, producerConfig{Mode: ProducerModeSync})
+	t.Cleanup(func() { producer = prev })
+	return w
+}
@@ -0,0 +1,118 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/subhamproject/user-service/logs"
+)
+
+func TestGetKafkaTLSConfig(t *testing.T) {
+	t.Setenv("KAFKA_TLS_MIN_VERSION", "1.3")
+	t.Setenv("KAFKA_TLS_SERVER_NAME", "kafka.internal")
+	cfg, err := getKafkaTLSConfig(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 || cfg.ServerName != "kafka.internal" {
+		t.Errorf("got min version %x and server name %q", cfg.MinVersion, cfg.ServerName)
+	}
+	if cfg.InsecureSkipVerify {
+		t.Error("broker certificates must be verified")
+	}
+	if cfg.GetClientCertificate != nil {
+		t.Error("no client certificate was requested")
+	}
+}
+
+func TestGetKafkaTLSConfigErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	tests := []struct {
+		name       string
+		env        map[string]string
+		clientCert bool
+	}{
+		{"unknown version", map[string]string{"KAFKA_TLS_MIN_VERSION": "1.9"}, false},
+		{"unknown cipher", map[string]string{"KAFKA_TLS_CIPHER_SUITES": "TLS_NOPE"}, false},
+		{"missing ca", map[string]string{"KAFKA_CA_CERT": missing}, false},
+		{"missing client certificate", map[string]string{"KAFKA_CLIENT_CERT": missing, "KAFKA_CLIENT_KEY": missing}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, err := getKafkaTLSConfig(tt.clientCert); err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+}
+
+func TestTopicCreated(t *testing.T) {
+	hook := logtest.NewLocal(logs.Log)
+	defer hook.Reset()
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+		wantLog string
+	}{
+		{"created", nil, false, "created kafka topic users"},
+		{"already exists", kafka.TopicAlreadyExists, false, "kafka topic users already exists"},
+		{"wrapped already exists", fmt.Errorf("create: %w", kafka.TopicAlreadyExists), false, "kafka topic users already exists"},
+		{"failed", kafka.InvalidReplicationFactor, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			err := topicCreated(context.Background(), "users", tt.err)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("error %v does not wrap %v", err, tt.err)
+				}
+				if len(hook.AllEntries()) != 0 {
+					t.Errorf("logged %q on failure", hook.LastEntry().Message)
+				}
+				return
+			}
+			if entry := hook.LastEntry(); entry == nil || entry.Message != tt.wantLog {
+				t.Errorf("logged %v, want %q", entry, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestWaitForKafkaGivesUp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := ln.Addr().String()
+	ln.Close()
+	prevBrokers, prevDialer := kafkaBrokers, kafkaDialer
+	kafkaBrokers, kafkaDialer = []string{broker}, &kafka.Dialer{}
+	t.Cleanup(func() { kafkaBrokers, kafkaDialer = prevBrokers, prevDialer })
+	t.Setenv("KAFKA_CONNECT_RETRIES", "2")
+
+	start := time.Now()
+	if err := waitForKafka(false); err == nil {
+		t.Fatal("unreachable brokers accepted")
+	}
+	// a single backoff between the two attempts, none after the last
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed >= time.Second {
+		t.Errorf("gave up after %v, want 500ms", elapsed)
+	}
+}
@@ -0,0 +1,236 @@
+package usrmgr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.opentelemetry.io/otel"
+)
+
+// Lockout event types.
+const (
+	EventAccountLocked         = "AccountLocked"
+	EventAccountUnlocked       = "AccountUnlocked"
+	EventLoginAddressBlocked   = "LoginAddressBlocked"
+	EventLoginAddressUnblocked = "LoginAddressUnblocked"
+)
+
+var (
+	loginAttempts AttemptStore
+	lockout       lockoutConfig
+
+	// lockoutClock is the time source of the lockout checks, tests can
+	// replace it with a fake clock.
+	lockoutClock = time.Now
+)
+
+type lockoutConfig struct {
+	MaxFailures   int
+	IPMaxFailures int
+	Window        time.Duration
+	LockDuration  time.Duration
+	DelayBase     time.Duration
+	DelayMax      time.Duration
+}
+
+func loadLockoutConfig() lockoutConfig {
+	return lockoutConfig{
+		MaxFailures:   utils.GetEnvIntParam("LOGIN_MAX_FAILURES", 5),
+		IPMaxFailures: utils.GetEnvIntParam("LOGIN_IP_MAX_FAILURES", 50),
+		Window:        utils.GetEnvDurationParam("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LockDuration:  utils.GetEnvDurationParam("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		DelayBase:     utils.GetEnvDurationParam("LOGIN_DELAY_BASE", time.Second),
+		DelayMax:      utils.GetEnvDurationParam("LOGIN_DELAY_MAX", 30*time.Second),
+	}
+}
+
+// newAttemptStore returns the store selected by LOGIN_ATTEMPT_STORE. The
+// memory store only counts attempts reaching this instance.
+func newAttemptStore() (AttemptStore, error) {
+	switch store := utils.GetEnvParam("LOGIN_ATTEMPT_STORE", "mongo"); store {
+	case "mongo":
+		return MongoAttemptStore{Collection: attemptCollection}, nil
+	case "memory":
+		return NewMemoryAttemptStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown LOGIN_ATTEMPT_STORE %q", store)
+	}
+}
+
+// TrustedProxies returns the addresses and CIDRs of TRUSTED_PROXIES, the
+// only peers whose X-Forwarded-For is believed. The client address keys
+// address lockouts and is audited, so by default no proxy is trusted and
+// the peer address is used.
+func TrustedProxies() []string {
+	var proxies []string
+	for _, p := range strings.Split(utils.GetEnvParam("TRUSTED_PROXIES", ""), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// accountKey is the attempt key of an account. Unknown emails are tracked
+// the same way, so lockouts do not tell which emails are registered.
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func addressKey(addr string) string {
+	return "ip:" + addr
+}
+
+// loginDelay is how long an account has to wait after its latest failure,
+// doubling with every failure up to DelayMax.
+func (cfg lockoutConfig) loginDelay(failures int) time.Duration {
+	if failures <= 0 || cfg.DelayBase <= 0 {
+		return 0
+	}
+	delay := cfg.DelayBase
+	for i := 1; i < failures && delay < cfg.DelayMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.DelayMax {
+		delay = cfg.DelayMax
+	}
+	return delay
+}
+
+// checkLoginAllowed refuses a login with a RateLimitError while the
+// account or the address is locked, or the account is still within the
+// delay of its latest failure.
+func checkLoginAllowed(ctx context.Context, email, addr string) error {
+	now := lockoutClock()
+
+	account, err := loginAttempts.Get(ctx, accountKey(email))
+	if err != nil {
+		return err
+	}
+	if account.LockedUntil.After(now) {
+		return &RateLimitError{RetryAfter: account.LockedUntil.Sub(now)}
+	}
+	if account.WindowStart.After(now.Add(-lockout.Window)) {
+		if wait := account.LastFailureAt.Add(lockout.loginDelay(account.Failures)).Sub(now); wait > 0 {
+			return &RateLimitError{RetryAfter: wait}
+		}
+	}
+
+	if addr == "" {
+		return nil
+	}
+	address, err := loginAttempts.Get(ctx, addressKey(addr))
+	if err != nil {
+		return err
+	}
+	if address.LockedUntil.After(now) {
+		return &RateLimitError{RetryAfter: address.LockedUntil.Sub(now)}
+	}
+	return nil
+}
+
+// recordLoginFailure counts a failed login of the account and the address
+// and locks whichever reached its limit. userID is empty for unknown
+// emails. Store errors are only logged, the login has failed anyway.
+func recordLoginFailure(ctx context.Context, email, addr, userID string) {
+	now := lockoutClock()
+	log := logs.FromContext(ctx)
+	recordAudit(ctx, auditEvent{Action: AuditLoginFailed, TargetType: AuditTargetUser, TargetID: userID})
+
+	account, err := loginAttempts.Fail(ctx, accountKey(email), now, lockout.Window)
+	if err != nil {
+		log.Errorf("unable to record failed login, error - %v", err)
+	} else if lockout.MaxFailures > 0 && account.Failures >= lockout.MaxFailures && !account.LockedUntil.After(now) {
+		if err := loginAttempts.Lock(ctx, accountKey(email), now.Add(lockout.LockDuration)); err != nil {
+			log.Errorf("unable to lock account, error - %v", err)
+		} else {
+			log.Warnf("account of user %q locked after %d failed logins", userID, account.Failures)
+			recordAudit(ctx, auditEvent{
+				Action: AuditAccountLock, TargetType: AuditTargetUser, TargetID: userID,
+				Details: auditDetails("failures", account.Failures, "lockedUntil", now.Add(lockout.LockDuration).Format(time.RFC3339)),
+			})
+			publishLockoutEvent(ctx, EventAccountLocked, userID, map[string]interface{}{
+				"failures": account.Failures, "lockedUntil": now.Add(lockout.LockDuration),
+			})
+		}
+	}
+
+	if addr == "" {
+		return
+	}
+	address, err := loginAttempts.Fail(ctx, addressKey(addr), now, lockout.Window)
+	if err != nil {
+		log.Errorf("unable to record failed login, error - %v", err)
+	} else if lockout.IPMaxFailures > 0 && address.Failures >= lockout.IPMaxFailures && !address.LockedUntil.After(now) {
+		if err := loginAttempts.Lock(ctx, addressKey(addr), now.Add(lockout.LockDuration)); err != nil {
+			log.Errorf("unable to block address, error - %v", err)
+		} else {
+			log.Warnf("logins from %s blocked after %d failures", addr, address.Failures)
+			recordAudit(ctx, auditEvent{
+				Action: AuditAddressBlock, TargetType: AuditTargetAddress, TargetID: addr,
+				Details: auditDetails("failures", address.Failures, "lockedUntil", now.Add(lockout.LockDuration).Format(time.RFC3339)),
+			})
+			publishLockoutEvent(ctx, EventLoginAddressBlocked, "", map[string]interface{}{
+				"address": addr, "failures": address.Failures, "lockedUntil": now.Add(lockout.LockDuration),
+			})
+		}
+	}
+}
+
+// recordLoginSuccess forgets the failures of the account. The address
+// keeps its count, one valid account must not clear a spraying address.
+func recordLoginSuccess(ctx context.Context, email string) {
+	if err := loginAttempts.Reset(ctx, accountKey(email)); err != nil {
+		logs.FromContext(ctx).Errorf("unable to reset failed logins, error - %v", err)
+	}
+}
+
+// UnlockAccount lifts the lockout of a user and forgets its failures.
+func UnlockAccount(ctx context.Context, userID string) error {
+
+	tracer := otel.Tracer("UnlockAccountServiceTrace")
+	ctx, span := tracer.Start(ctx, "UnlockAccountService")
+	defer span.End()
+
+	user, err := GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	if err := loginAttempts.Reset(ctx, accountKey(user.Email)); err != nil {
+		return err
+	}
+	SendLogs(ctx, fmt.Sprintf("account of user %s unlocked", userID))
+	recordAudit(ctx, auditEvent{Action: AuditAccountUnlock, TargetType: AuditTargetUser, TargetID: userID})
+	publishLockoutEvent(ctx, EventAccountUnlocked, userID, nil)
+	return nil
+}
+
+// UnblockAddress lifts the block of logins from addr.
+func UnblockAddress(ctx context.Context, addr string) error {
+
+	tracer := otel.Tracer("UnblockAddressServiceTrace")
+	ctx, span := tracer.Start(ctx, "UnblockAddressService")
+	defer span.End()
+
+	if err := loginAttempts.Reset(ctx, addressKey(addr)); err != nil {
+		return err
+	}
+	SendLogs(ctx, fmt.Sprintf("logins from %s unblocked", addr))
+	recordAudit(ctx, auditEvent{Action: AuditAddressUnblock, TargetType: AuditTargetAddress, TargetID: addr})
+	publishLockoutEvent(ctx, EventLoginAddressUnblocked, "", map[string]interface{}{"address": addr})
+	return nil
+}
+
+func publishLockoutEvent(ctx context.Context, eventType, userID string, data map[string]interface{}) {
+	err := PublishEvent(ctx, Event{Type: eventType, UserID: userID, Actor: ActorFromContext(ctx), Data: data})
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to publish %s event: %v", eventType, err)
+	}
+}
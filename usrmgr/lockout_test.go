@@ -0,0 +1,203 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lockoutClockAt is a fake lockout clock tests move forward.
+type lockoutClockAt struct{ now time.Time }
+
+func (c *lockoutClockAt) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// useTestLockout counts attempts in memory with cfg and a fake clock.
+func useTestLockout(t *testing.T, cfg lockoutConfig) *lockoutClockAt {
+	t.Helper()
+	clock := &lockoutClockAt{now: time.Unix(1700000000, 0)}
+	prevStore, prevCfg, prevClock := loginAttempts, lockout, lockoutClock
+	loginAttempts, lockout = NewMemoryAttemptStore(), cfg
+	lockoutClock = func() time.Time { return clock.now }
+	t.Cleanup(func() { loginAttempts, lockout, lockoutClock = prevStore, prevCfg, prevClock })
+	return clock
+}
+
+// retryAfter returns the wait of a RateLimitError, 0 for nil.
+func retryAfter(t *testing.T, err error) time.Duration {
+	t.Helper()
+	if err == nil {
+		return 0
+	}
+	var rl *RateLimitError
+	if !errors.As(err, &rl) {
+		t.Fatalf("error %v, want a RateLimitError", err)
+	}
+	return rl.RetryAfter
+}
+
+func TestLoginDelay(t *testing.T) {
+	cfg := lockoutConfig{DelayBase: time.Second, DelayMax: 30 * time.Second}
+	want := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for failures, w := range want {
+		if got := cfg.loginDelay(failures); got != w {
+			t.Errorf("delay after %d failures = %v, want %v", failures, got, w)
+		}
+	}
+	if got := (lockoutConfig{DelayMax: time.Minute}).loginDelay(3); got != 0 {
+		t.Errorf("delay without base = %v", got)
+	}
+	if got := cfg.loginDelay(1000); got != 30*time.Second {
+		t.Errorf("delay after many failures = %v", got)
+	}
+}
+
+func TestProgressiveLockout(t *testing.T) {
+	useTestProducer(t)
+	clock := useTestLockout(t, lockoutConfig{
+		MaxFailures: 4, IPMaxFailures: 100, Window: 15 * time.Minute,
+		LockDuration: 10 * time.Minute, DelayBase: time.Second, DelayMax: 3 * time.Second,
+	})
+	ctx := context.Background()
+	const email, addr = "jane@example.com", "203.0.113.7"
+
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		recordLoginFailure(ctx, email, addr, "u1")
+		if got := retryAfter(t, checkLoginAllowed(ctx, email, addr)); got != delay {
+			t.Fatalf("wait after failure %d = %v, want %v", i+1, got, delay)
+		}
+		clock.advance(delay - time.Millisecond)
+		if retryAfter(t, checkLoginAllowed(ctx, email, addr)) == 0 {
+			t.Fatalf("login allowed before the delay after failure %d passed", i+1)
+		}
+		clock.advance(time.Millisecond)
+		if err := checkLoginAllowed(ctx, email, addr); err != nil {
+			t.Fatalf("login refused after the delay of failure %d: %v", i+1, err)
+		}
+	}
+
+	recordLoginFailure(ctx, email, addr, "u1")
+	if got := retryAfter(t, checkLoginAllowed(ctx, email, addr)); got != 10*time.Minute {
+		t.Fatalf("lock after the last failure = %v, want the lockout duration", got)
+	}
+	// other accounts from the same address are not affected
+	if err := checkLoginAllowed(ctx, "john@example.com", addr); err != nil {
+		t.Errorf("other account refused: %v", err)
+	}
+	// the lock holds whatever the case of the email
+	if retryAfter(t, checkLoginAllowed(ctx, " Jane@Example.com", "")) == 0 {
+		t.Error("lock bypassed by changing the case of the email")
+	}
+
+	clock.advance(10 * time.Minute)
+	if err := checkLoginAllowed(ctx, email, addr); err != nil {
+		t.Errorf("login refused once the lock expired: %v", err)
+	}
+}
+
+func TestLockoutWindowExpiry(t *testing.T) {
+	useTestProducer(t)
+	clock := useTestLockout(t, lockoutConfig{
+		MaxFailures: 3, Window: time.Minute, LockDuration: time.Hour,
+		DelayBase: time.Second, DelayMax: time.Second,
+	})
+	ctx := context.Background()
+
+	recordLoginFailure(ctx, "jane@example.com", "", "u1")
+	recordLoginFailure(ctx, "jane@example.com", "", "u1")
+	clock.advance(time.Minute)
+	recordLoginFailure(ctx, "jane@example.com", "", "u1")
+	clock.advance(time.Second)
+	if err := checkLoginAllowed(ctx, "jane@example.com", ""); err != nil {
+		t.Errorf("failures of an earlier window locked the account: %v", err)
+	}
+}
+
+func TestAddressLockout(t *testing.T) {
+	useTestProducer(t)
+	clock := useTestLockout(t, lockoutConfig{
+		MaxFailures: 100, IPMaxFailures: 3, Window: time.Hour, LockDuration: 5 * time.Minute,
+	})
+	ctx := context.Background()
+	const addr = "203.0.113.7"
+
+	// spraying one password over many accounts
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		recordLoginFailure(ctx, email, addr, "")
+	}
+	if got := retryAfter(t, checkLoginAllowed(ctx, "d@example.com", addr)); got != 5*time.Minute {
+		t.Errorf("wait of a blocked address = %v", got)
+	}
+	if err := checkLoginAllowed(ctx, "d@example.com", "198.51.100.1"); err != nil {
+		t.Errorf("other address refused: %v", err)
+	}
+
+	// a valid login does not clear the address
+	recordLoginSuccess(ctx, "a@example.com")
+	if retryAfter(t, checkLoginAllowed(ctx, "a@example.com", addr)) == 0 {
+		t.Error("address unblocked by a successful login")
+	}
+	clock.advance(5 * time.Minute)
+	if err := checkLoginAllowed(ctx, "a@example.com", addr); err != nil {
+		t.Errorf("address still blocked once the lock expired: %v", err)
+	}
+}
+
+func TestLoginSuccessResetsAccount(t *testing.T) {
+	useTestProducer(t)
+	useTestLockout(t, lockoutConfig{MaxFailures: 5, Window: time.Hour, DelayBase: time.Minute, DelayMax: time.Hour})
+	ctx := context.Background()
+
+	recordLoginFailure(ctx, "jane@example.com", "", "u1")
+	recordLoginSuccess(ctx, "jane@example.com")
+	if err := checkLoginAllowed(ctx, "jane@example.com", ""); err != nil {
+		t.Errorf("delay kept after a successful login: %v", err)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", " 10.0.0.0/8, ,192.0.2.1")
+	if got, want := TrustedProxies(), []string{"10.0.0.0/8", "192.0.2.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TrustedProxies = %v, want %v", got, want)
+	}
+	t.Setenv("TRUSTED_PROXIES", "")
+	if got := TrustedProxies(); got != nil {
+		t.Errorf("TrustedProxies = %v, want none", got)
+	}
+}
+
+func TestClientIPBehindProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		peer    string
+		want    string
+	}{
+		{"no trusted proxy", nil, "10.1.2.3:4000", "10.1.2.3"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.1.2.3:4000", "203.0.113.7"},
+		{"untrusted peer", []string{"10.0.0.0/8"}, "198.51.100.1:4000", "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			if err := r.SetTrustedProxies(tt.proxies); err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			r.GET("/", func(c *gin.Context) { got = c.ClientIP() })
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			r.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("ClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel"
+)
+
+// MFA event types.
+const (
+	EventMFAEnabled          = "MFAEnabled"
+	EventMFAReset            = "MFAReset"
+	EventMFARecoveryCodeUsed = "MFARecoveryCodeUsed"
+)
+
+const recoveryCodeCount = 10
+
+// mfaSecretField binds encrypted TOTP secrets to their use. The pending and
+// the active secret share it, so activation moves the ciphertext as is.
+const mfaSecretField = "mfa.secret"
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("mfa is already enabled")
+	ErrMFANotEnrolling   = errors.New("mfa enrollment has not been started")
+	ErrInvalidMFACode    = errors.New("invalid mfa code")
+
+	// mfaClock is the time source of code checks, tests can replace it
+	// with a fake clock.
+	mfaClock = time.Now
+)
+
+// MFAState is the TOTP enrollment of a user. Secrets and recovery code
+// hashes never leave the service; with field encryption enabled the
+// secrets are stored encrypted and only decrypted to check a code.
+type MFAState struct {
+	Enabled       bool       `bson:"enabled" json:"enabled"`
+	EnrolledAt    *time.Time `bson:"enrolledAt,omitempty" json:"enrolledAt,omitempty"`
+	Secret        string     `bson:"secret,omitempty" json:"-"`
+	PendingSecret string     `bson:"pendingSecret,omitempty" json:"-"`
+	LastStep      int64      `bson:"lastStep,omitempty" json:"-"`
+	RecoveryCodes []string   `bson:"recoveryCodes,omitempty" json:"-"`
+}
+
+// MFAEnrollment is what a user needs to set up an authenticator app.
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func (u User) mfaEnabled() bool {
+	return u.MFA != nil && u.MFA.Enabled
+}
+
+// mfaRequired tells whether the user must use MFA, which is the case for
+// users carrying one of the MFA_REQUIRED_LABELS.
+func mfaRequired(u User) bool {
+	required := utils.GetEnvParam("MFA_REQUIRED_LABELS", "admin")
+	for _, label := range strings.Split(required, ",") {
+		label = strings.ToLower(strings.TrimSpace(label))
+		for _, l := range u.Labels {
+			if label != "" && l == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartMFAEnrollment creates a new secret for the user. It only takes
+// effect once ActivateMFA confirmed the app produces matching codes.
+func StartMFAEnrollment(ctx context.Context, userID string) (MFAEnrollment, error) {
+
+	tracer := otel.Tracer("StartMFAEnrollmentServiceTrace")
+	ctx, span := tracer.Start(ctx, "StartMFAEnrollmentService")
+	defer span.End()
+
+	user, err := GetUserByID(ctx, userID)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	if user.mfaEnabled() {
+		return MFAEnrollment{}, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	stored, err := fieldEncryption.encryptSecret(ctx, mfaSecretField, secret)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	_, err = userCollection.UpdateOne(ctx,
+		bson.D{{Key: "id", Value: userID}, deletedFilter(false)},
+		bson.M{"$set": bson.M{"mfa.pendingSecret": stored}})
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.ID
+	}
+	issuer := utils.GetEnvParam("MFA_ISSUER", consts.ServiceName)
+	return MFAEnrollment{Secret: secret, URI: totpURI(issuer, account, secret)}, nil
+}
+
+// ActivateMFA enables MFA once code matches the pending secret and returns
+// the recovery codes. They are only stored hashed, so this is the only
+// time they can be shown.
+func ActivateMFA(ctx context.Context, userID, code string) ([]string, error) {
+
+	tracer := otel.Tracer("ActivateMFAServiceTrace")
+	ctx, span := tracer.Start(ctx, "ActivateMFAService")
+	defer span.End()
+
+	user, err := GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.mfaEnabled() {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.MFA == nil || user.MFA.PendingSecret == "" {
+		return nil, ErrMFANotEnrolling
+	}
+	stored := user.MFA.PendingSecret
+	secret, err := fieldEncryption.decrypt(ctx, mfaSecretField, stored)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := matchTOTP(secret, code, mfaClock(), 0)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	now := mfaClock().UTC()
+	res, err := userCollection.UpdateOne(ctx,
+		bson.D{{Key: "id", Value: userID}, {Key: "mfa.pendingSecret", Value: stored}, deletedFilter(false)},
+		bson.M{
+			"$set": bson.M{
+				"mfa": MFAState{
+					Enabled:       true,
+					EnrolledAt:    &now,
+					Secret:        stored,
+					LastStep:      step,
+					RecoveryCodes: hashes,
+				},
+				"updatedAt": now,
+				"updatedBy": ActorFromContext(ctx),
+			},
+			"$inc": bson.M{"version": 1},
+		})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		// enrollment restarted in the meantime
+		return nil, ErrMFANotEnrolling
+	}
+
+	recordAudit(ctx, auditEvent{Action: AuditMFAEnable, TargetType: AuditTargetUser, TargetID: userID})
+	publishMFAEvent(ctx, EventMFAEnabled, userID)
+	return codes, nil
+}
+
+// verifyMFA checks a TOTP or recovery code of the user. Each TOTP time step
+// and each recovery code can only be used once.
+func verifyMFA(ctx context.Context, user User, code string) error {
+	if !user.mfaEnabled() {
+		return ErrInvalidMFACode
+	}
+
+	secret, err := fieldEncryption.decrypt(ctx, mfaSecretField, user.MFA.Secret)
+	if err != nil {
+		return err
+	}
+	if step, ok := matchTOTP(secret, code, mfaClock(), user.MFA.LastStep); ok {
+		res, err := userCollection.UpdateOne(ctx,
+			bson.M{"id": user.ID, "$or": bson.A{
+				bson.M{"mfa.lastStep": bson.M{"$lt": step}},
+				bson.M{"mfa.lastStep": bson.M{"$exists": false}},
+			}},
+			bson.M{"$set": bson.M{"mfa.lastStep": step}})
+		if err != nil {
+			return err
+		}
+		if res.ModifiedCount == 0 {
+			// a concurrent login used the same code
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	hash := hashRecoveryCode(code)
+	res, err := userCollection.UpdateOne(ctx,
+		bson.M{"id": user.ID, "mfa.recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"mfa.recoveryCodes": hash}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount == 0 {
+		return ErrInvalidMFACode
+	}
+	logs.FromContext(ctx).Infof("user %s used a recovery code, %d left", user.ID, len(user.MFA.RecoveryCodes)-1)
+	recordAudit(ctx, auditEvent{
+		Action: AuditRecoveryCodeUse, TargetType: AuditTargetUser, TargetID: user.ID,
+		Details: auditDetails("remaining", len(user.MFA.RecoveryCodes)-1),
+	})
+	publishMFAEvent(ctx, EventMFARecoveryCodeUsed, user.ID)
+	return nil
+}
+
+// ResetMFA removes the MFA enrollment of a user who lost its authenticator
+// and recovery codes, and revokes its sessions.
+func ResetMFA(ctx context.Context, userID string) error {
+
+	tracer := otel.Tracer("ResetMFAServiceTrace")
+	ctx, span := tracer.Start(ctx, "ResetMFAService")
+	defer span.End()
+
+	res, err := userCollection.UpdateOne(ctx,
+		bson.D{{Key: "id", Value: userID}, deletedFilter(false)},
+		bson.M{
+			"$unset": bson.M{"mfa": ""},
+			"$set":   bson.M{"updatedAt": time.Now().UTC(), "updatedBy": ActorFromContext(ctx)},
+			"$inc":   bson.M{"version": 1},
+		})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := RevokeUserSessions(ctx, userID); err != nil {
+		return err
+	}
+
+	SendLogs(ctx, fmt.Sprintf("mfa of user %s reset", userID))
+	recordAudit(ctx, auditEvent{Action: AuditMFAReset, TargetType: AuditTargetUser, TargetID: userID})
+	publishMFAEvent(ctx, EventMFAReset, userID)
+	return nil
+}
+
+// newRecoveryCodes returns recovery codes formatted xxxx-xxxx-xxxx-xxxx and
+// their hashes. With 80 random bits a plain hash is enough.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func publishMFAEvent(ctx context.Context, eventType, userID string) {
+	err := PublishEvent(ctx, Event{Type: eventType, UserID: userID, Actor: ActorFromContext(ctx)})
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to publish %s event of user %s: %v", eventType, userID, err)
+	}
+}
@@ -0,0 +1,318 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/subhamproject/user-service/fieldcrypt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// mfaNow is the fake time of the MFA tests.
+var mfaNow = time.Unix(1111111111, 0)
+
+func useMFAClock(t *testing.T, now time.Time) {
+	t.Helper()
+	prev := mfaClock
+	mfaClock = func() time.Time { return now }
+	t.Cleanup(func() { mfaClock = prev })
+}
+
+// useTestEncryption enables field encryption of fields with a single data
+// key that is never reloaded.
+func useTestEncryption(t *testing.T, fields ...string) fieldcrypt.DataKey {
+	t.Helper()
+	key, err := fieldcrypt.NewDataKey("k1", make([]byte, fieldcrypt.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := &fieldEncryptor{
+		fields:        map[string]bool{},
+		deterministic: map[string]bool{},
+		keys:          map[string]fieldcrypt.DataKey{key.ID: key},
+		current:       key,
+		loadedAt:      time.Now().Add(time.Hour),
+	}
+	for _, f := range fields {
+		enc.fields[f] = true
+		enc.deterministic[f] = encryptableFields[f]
+	}
+	prev := fieldEncryption
+	fieldEncryption = enc
+	t.Cleanup(func() { fieldEncryption = prev })
+	return key
+}
+
+func mfaUser(mfa bson.D) bson.D {
+	return append(resetUser(true), bson.E{Key: "mfa", Value: mfa})
+}
+
+// lastUpdate returns the first update statement of the last update command.
+func lastUpdate(t *testing.T, mt *mtest.T) bson.Raw {
+	t.Helper()
+	events := mt.GetAllStartedEvents()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].CommandName == "update" {
+			return events[i].Command.Lookup("updates").Array().Index(0).Value().Document()
+		}
+	}
+	t.Fatal("no update command")
+	return nil
+}
+
+func TestStartMFAEnrollmentEncryptsSecret(t *testing.T) {
+	useTestProducer(t)
+	key := useTestEncryption(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("enroll", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(resetUser(true)), updated(1))
+
+		enrollment, err := StartMFAEnrollment(context.Background(), "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored := lastUpdate(t, mt).Lookup("u", "$set", "mfa.pendingSecret").StringValue()
+		if stored == enrollment.Secret || !fieldcrypt.IsEncrypted(stored) {
+			t.Fatalf("pending secret stored as %q", stored)
+		}
+		if secret, err := key.Decrypt(mfaSecretField, stored); err != nil || secret != enrollment.Secret {
+			t.Errorf("stored secret decrypts to %q, %v", secret, err)
+		}
+		if !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+			t.Errorf("uri %s", enrollment.URI)
+		}
+	})
+}
+
+func TestActivateMFA(t *testing.T) {
+	useTestProducer(t)
+	useMFAClock(t, mfaNow)
+	key := useTestEncryption(t)
+	pending, err := key.Encrypt(mfaSecretField, rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(rfcSecret, totpStep(mfaNow))
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("activated", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(mfaUser(bson.D{{Key: "pendingSecret", Value: pending}})), updated(1))
+
+		codes, err := ActivateMFA(WithActor(context.Background(), "u1"), "u1", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(codes) != recoveryCodeCount {
+			t.Errorf("%d recovery codes", len(codes))
+		}
+		update := lastUpdate(t, mt)
+		if got := update.Lookup("q", "mfa.pendingSecret").StringValue(); got != pending {
+			t.Errorf("update filter on pending secret %q", got)
+		}
+		set := update.Lookup("u", "$set").Document()
+		if got := set.Lookup("mfa", "secret").StringValue(); got != pending {
+			t.Errorf("secret stored as %q, want the encrypted pending secret", got)
+		}
+		if got := set.Lookup("mfa", "lastStep").Int64(); got != totpStep(mfaNow) {
+			t.Errorf("last step %d", got)
+		}
+		if got := set.Lookup("mfa", "recoveryCodes").Array().Index(0).Value().StringValue(); got != hashRecoveryCode(codes[0]) {
+			t.Errorf("recovery code stored as %q", got)
+		}
+		if got := set.Lookup("updatedAt").Time(); !got.Equal(mfaNow) {
+			t.Errorf("updatedAt = %v", got)
+		}
+		if got := set.Lookup("updatedBy").StringValue(); got != "u1" {
+			t.Errorf("updatedBy = %q", got)
+		}
+		if got := update.Lookup("u", "$inc", "version").Int32(); got != 1 {
+			t.Errorf("version incremented by %d", got)
+		}
+	})
+	mt.Run("wrong code", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(mfaUser(bson.D{{Key: "pendingSecret", Value: pending}})))
+
+		if _, err := ActivateMFA(context.Background(), "u1", "000000"); !errors.Is(err, ErrInvalidMFACode) {
+			t.Errorf("ActivateMFA = %v, want ErrInvalidMFACode", err)
+		}
+	})
+	mt.Run("not enrolling", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(resetUser(true)))
+
+		if _, err := ActivateMFA(context.Background(), "u1", code); !errors.Is(err, ErrMFANotEnrolling) {
+			t.Errorf("ActivateMFA = %v, want ErrMFANotEnrolling", err)
+		}
+	})
+	mt.Run("already enabled", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(mfaUser(bson.D{{Key: "enabled", Value: true}, {Key: "secret", Value: pending}})))
+
+		if _, err := ActivateMFA(context.Background(), "u1", code); !errors.Is(err, ErrMFAAlreadyEnabled) {
+			t.Errorf("ActivateMFA = %v, want ErrMFAAlreadyEnabled", err)
+		}
+	})
+	mt.Run("enrollment restarted", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(mfaUser(bson.D{{Key: "pendingSecret", Value: pending}})), updated(0))
+
+		if _, err := ActivateMFA(context.Background(), "u1", code); !errors.Is(err, ErrMFANotEnrolling) {
+			t.Errorf("ActivateMFA = %v, want ErrMFANotEnrolling", err)
+		}
+	})
+}
+
+func TestVerifyMFA(t *testing.T) {
+	useTestProducer(t)
+	useMFAClock(t, mfaNow)
+	key := useTestEncryption(t)
+	secret, err := key.Encrypt(mfaSecretField, rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := totpStep(mfaNow)
+	code, _ := totpCode(rfcSecret, step)
+	user := func(lastStep int64, recoveryCodes ...string) User {
+		return User{ID: "u1", MFA: &MFAState{Enabled: true, Secret: secret, LastStep: lastStep, RecoveryCodes: recoveryCodes}}
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("totp", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(updated(1))
+
+		if err := verifyMFA(context.Background(), user(step-1), code); err != nil {
+			t.Fatal(err)
+		}
+		if got := lastUpdate(t, mt).Lookup("u", "$set", "mfa.lastStep").Int64(); got != step {
+			t.Errorf("last step set to %d, want %d", got, step)
+		}
+	})
+	mt.Run("replayed totp", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		// not a valid step anymore, so it is tried as recovery code
+		mt.AddMockResponses(updated(0))
+
+		if err := verifyMFA(context.Background(), user(step), code); !errors.Is(err, ErrInvalidMFACode) {
+			t.Errorf("verifyMFA = %v, want ErrInvalidMFACode", err)
+		}
+		if _, err := lastUpdate(t, mt).LookupErr("u", "$pull"); err != nil {
+			t.Error("replayed code not tried as recovery code")
+		}
+	})
+	mt.Run("concurrent use", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(updated(0))
+
+		if err := verifyMFA(context.Background(), user(0), code); !errors.Is(err, ErrInvalidMFACode) {
+			t.Errorf("verifyMFA = %v, want ErrInvalidMFACode", err)
+		}
+	})
+	mt.Run("recovery code", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(updated(1))
+
+		err := verifyMFA(context.Background(), user(0, hashRecoveryCode("abcd-efgh-ijkl-mnop")), "ABCD-EFGH-IJKL-MNOP")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lastUpdate(t, mt).Lookup("u", "$pull", "mfa.recoveryCodes").StringValue(); got != hashRecoveryCode("abcdefghijklmnop") {
+			t.Errorf("pulled %q", got)
+		}
+	})
+	mt.Run("plaintext secret", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(updated(1))
+
+		u := user(0)
+		u.MFA.Secret = rfcSecret
+		if err := verifyMFA(context.Background(), u, code); err != nil {
+			t.Errorf("secret stored before encryption refused: %v", err)
+		}
+	})
+	mt.Run("not enabled", func(mt *mtest.T) {
+		if err := verifyMFA(context.Background(), User{ID: "u1"}, code); !errors.Is(err, ErrInvalidMFACode) {
+			t.Errorf("verifyMFA = %v, want ErrInvalidMFACode", err)
+		}
+	})
+}
+
+func TestVerifyMFAEncryptionDisabled(t *testing.T) {
+	useMFAClock(t, mfaNow)
+	key := useTestEncryption(t)
+	secret, _ := key.Encrypt(mfaSecretField, rfcSecret)
+	fieldEncryption = nil
+
+	code, _ := totpCode(rfcSecret, totpStep(mfaNow))
+	u := User{ID: "u1", MFA: &MFAState{Enabled: true, Secret: secret}}
+	if err := verifyMFA(context.Background(), u, code); !errors.Is(err, ErrEncryptionNotConfigured) {
+		t.Errorf("verifyMFA = %v, want ErrEncryptionNotConfigured", err)
+	}
+}
+
+func TestReencryptUsersMFASecret(t *testing.T) {
+	useTestProducer(t)
+	key := useTestEncryption(t)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("plaintext secret", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(mfaUser(bson.D{{Key: "enabled", Value: true}, {Key: "secret", Value: rfcSecret}})), updated(1))
+
+		n, err := ReencryptUsers(context.Background())
+		if err != nil || n != 1 {
+			t.Fatalf("ReencryptUsers = %d, %v", n, err)
+		}
+		stored := lastUpdate(t, mt).Lookup("u", "$set", "mfa.secret").StringValue()
+		if secret, err := key.Decrypt(mfaSecretField, stored); err != nil || secret != rfcSecret {
+			t.Errorf("secret re-encrypted as %q: %q, %v", stored, secret, err)
+		}
+	})
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("%d codes, %d hashes", len(codes), len(hashes))
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 || code != strings.ToLower(code) {
+			t.Errorf("code %q not formatted xxxx-xxxx-xxxx-xxxx", code)
+		}
+		if hashes[i] != hashRecoveryCode(code) || strings.Contains(hashes[i], code) {
+			t.Errorf("hash of %q = %q", code, hashes[i])
+		}
+		if seen[code] {
+			t.Errorf("code %q repeated", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := hashRecoveryCode("abcd-efgh-ijkl-mnop")
+	for _, code := range []string{"abcdefghijklmnop", " ABCD-EFGH-IJKL-MNOP ", "abcd-efghijkl-mnop"} {
+		if got := hashRecoveryCode(code); got != want {
+			t.Errorf("hash of %q differs", code)
+		}
+	}
+	if hashRecoveryCode("abcd-efgh-ijkl-mnoq") == want {
+		t.Error("different codes hash the same")
+	}
+}
@@ -2,14 +2,15 @@ package usrmgr
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"time"
 
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/migrations"
 	"github.com/subhamproject/user-service/utils"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 )
 
@@ -17,7 +18,7 @@ var userCollection *mongo.Collection
 
 // This is a user defined method to close resources.
 // This method closes mongoDB connection and cancel context.
-func close(client *mongo.Client, ctx context.Context,
+func closeConnection(client *mongo.Client, ctx context.Context,
 	cancel context.CancelFunc) {
 
 	// CancelFunc to cancel to context
@@ -41,55 +42,79 @@ func close(client *mongo.Client, ctx context.Context,
 // context.Context will be used set deadlines for process.
 // context.CancelFunc will be used to cancel context and
 // resource associated with it.
-func connectLocal(uri, user, pass string) (*mongo.Client, context.Context,
+func connect(opts *options.ClientOptions, cfg mongoConfig) (*mongo.Client, context.Context,
 	context.CancelFunc, error) {
 
 	// ctx will be used to set deadline for process, here
-	// deadline will of 30 seconds.
-	ctx, cancel := context.WithTimeout(context.Background(),
-		30*time.Second)
+	// deadline is the connect timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
 
-	credential := options.Credential{
-		Username: user,
-		Password: pass,
-	}
-	opts := options.Client().ApplyURI(uri).SetAuth(credential)
-
-	//Add instrumentation to client options
+	// Add instrumentation to client options
 	opts.Monitor = otelmongo.NewMonitor()
-	// mongo.Connect return mongo.Client method
+
 	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		logs.FromContext(ctx).Fatal("connect failed! ", err)
+		return nil, ctx, cancel, err
+	}
+	logs.FromContext(ctx).Info("connect successful!")
 
 	return client, ctx, cancel, err
 }
 
-func connect(uri string) (*mongo.Client, context.Context,
-	context.CancelFunc, error) {
+// mongoClientOptions builds the client options from MONGO_URL, which is
+// used as is. Credentials and certificates never go into the URI: DEV_MODE
+// authenticates with MONGO_USERNAME and MONGO_PASSWORD, everything else
+// with the client certificate over TLS.
+func mongoClientOptions(devMode bool, cfg mongoConfig) (*options.ClientOptions, error) {
+	// DEV_MODE only changes the default URI, a configured MONGO_URL is
+	// always used
+	dfltURI := "mongodb://mongo1:27011,mongo2:27012,mongo3:27013/demo?replicaSet=rs0"
+	if devMode {
+		dfltURI = "mongodb://localhost:27017"
+	}
+	opts := options.Client().ApplyURI(utils.GetEnvParam("MONGO_URL", dfltURI))
 
-	// ctx will be used to set deadline for process, here
-	// deadline will of 30 seconds.
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if devMode {
+		user := utils.GetEnvParam("MONGO_USERNAME", "root")
+		pass, err := utils.GetEnvSecretParam("MONGO_PASSWORD", "rootpassword")
+		if err != nil {
+			return nil, err
+		}
+		opts.SetAuth(options.Credential{Username: user, Password: pass})
+	} else {
+		tlsConfig, err := mongoTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig).SetAuth(options.Credential{AuthMechanism: "MONGODB-X509"})
+	}
 
-	credential := options.Credential{
-		AuthMechanism: "MONGODB-X509",
+	if err := cfg.apply(opts); err != nil {
+		return nil, err
 	}
-	clientOpts := options.Client().ApplyURI(uri).SetAuth(credential)
-	// Add instrumentation to client options
-	clientOpts.Monitor = otelmongo.NewMonitor()
+	return opts, opts.Validate()
+}
+
+// mongoTLSConfig verifies the servers against MONGO_CA_CERT and presents
+// the certificate and key of the PEM file MONGO_CLIENT_CERT_KEY.
+func mongoTLSConfig() (*tls.Config, error) {
+	caFilePath := utils.GetEnvParam("MONGO_CA_CERT", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/mongoCA.crt")
+	certificateKeyFilePath := utils.GetEnvParam("MONGO_CLIENT_CERT_KEY", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/mongo-client.pem")
 
-	client, err := mongo.Connect(ctx, clientOpts)
+	pool, err := utils.LoadCertPool(caFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
+	cert, err := tls.LoadX509KeyPair(certificateKeyFilePath, certificateKeyFilePath)
 	if err != nil {
-		fmt.Println("connect failed!")
-		log.Fatal(err)
-		return nil, ctx, cancel, err
+		return nil, fmt.Errorf("unable to load mongodb client certificate: %w", err)
 	}
-	fmt.Println("connect successful!")
-
-	return client, ctx, cancel, err
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
 // This is a user defined method that accepts
@@ -100,40 +125,37 @@ func ping(client *mongo.Client, ctx context.Context) error {
 	// mongo.Client has Ping to ping mongoDB, deadline of
 	// the Ping method will be determined by cxt
 	// Ping method return error if any occurred, then
-	// the error can be handled.
-	if err := client.Ping(ctx, readpref.Primary()); err != nil {
-		fmt.Println("ping failed!")
-		log.Fatal(err)
+	// the error can be handled. A nil read preference uses
+	// the one configured on the client.
+	if err := client.Ping(ctx, nil); err != nil {
+		logs.FromContext(ctx).Fatal("ping failed! ", err)
 		return err
 	}
-	fmt.Println("ping  successful!")
+	logs.FromContext(ctx).Info("ping successful!")
 	return nil
 }
 
+// CheckMongoDB pings a member matching the configured read preference, it
+// is used by the readiness probe.
+func CheckMongoDB(ctx context.Context) error {
+	if userCollection == nil {
+		return fmt.Errorf("mongodb not initialized")
+	}
+	return userCollection.Database().Client().Ping(ctx, nil)
+}
+
 func InitMongoDB() (*mongo.Client, context.Context,
 	context.CancelFunc, error) {
 
-	devMode := utils.GetEnvBoolParam("DEV_MODE", true)
-	user := utils.GetEnvParam("MONGO_USERNAME", "root")
-	pass := utils.GetEnvParam("MONGO_PASSWORD", "rootpassword")
-	caFilePath := utils.GetEnvParam("MONGO_CA_CERT", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/mongoCA.crt")
-	certificateKeyFilePath := utils.GetEnvParam("MONGO_CLIENT_CERT_KEY", "/home/om/go/src/github.com/subhamproject/devops-demo/certs/mongo-client.pem")
-	uri := utils.GetEnvParam("MONGO_URL", "mongodb://%s:%s@mongo1:27011,mongo2:27012,mongo3:27013/demo?replicaSet=rs0&tlsCAFile=%s&tlsCertificateKeyFile=%s")
-
-	var client *mongo.Client
-	var ctx context.Context
-	var cFunc context.CancelFunc
-	var err error
-
-	if devMode {
-		uri = "mongodb://localhost:27017"
-		client, ctx, cFunc, err = connectLocal(uri, user, pass)
-	} else {
-		uri = fmt.Sprintf(uri, user, pass, caFilePath, certificateKeyFilePath)
-		client, ctx, cFunc, err = connect(uri)
+	cfg := loadMongoConfig()
+	opts, err := mongoClientOptions(utils.GetEnvBoolParam("DEV_MODE", true), cfg)
+	if err != nil {
+		panic(err)
 	}
+
 	// Get Client, Context, CancelFunc and
 	// err from connect method.
+	client, ctx, cFunc, err := connect(opts, cfg)
 	if err != nil {
 		panic(err)
 	}
@@ -141,16 +163,49 @@ func InitMongoDB() (*mongo.Client, context.Context,
 	// Ping mongoDB with Ping method
 	ping(client, ctx)
 
-	userCollection = client.Database("demo").Collection("users")
+	db := client.Database(cfg.Database)
+	userCollection = db.Collection(cfg.UsersCollection)
+	deadLetterCollection = db.Collection(cfg.DeadLettersCollection)
+	tokenCollection = db.Collection(cfg.TokensCollection)
+	sessionCollection = db.Collection(cfg.SessionsCollection)
+	attemptCollection = db.Collection(cfg.AttemptsCollection)
+	apiKeyCollection = db.Collection(cfg.APIKeysCollection)
+	signingKeyCollection = db.Collection(cfg.SigningKeysCollection)
+	auditCollection = db.Collection(cfg.AuditCollection)
+	dataKeyCollection = db.Collection(cfg.DataKeysCollection)
+	erasureCollection = db.Collection(cfg.ErasuresCollection)
 
 	return client, ctx, cFunc, err
 }
 
+// NewMigrator returns the schema migrator of the service database.
+func NewMigrator() *migrations.Migrator {
+	collections := migrations.Collections{
+		Users:       userCollection.Name(),
+		DeadLetters: deadLetterCollection.Name(),
+		Tokens:      tokenCollection.Name(),
+		Sessions:    sessionCollection.Name(),
+		Attempts:    attemptCollection.Name(),
+		APIKeys:     apiKeyCollection.Name(),
+		SigningKeys: signingKeyCollection.Name(),
+		Audit:       auditCollection.Name(),
+		DataKeys:    dataKeyCollection.Name(),
+		Erasures:    erasureCollection.Name(),
+	}
+	lockTTL := utils.GetEnvDurationParam("MONGO_MIGRATION_LOCK_TTL", 5*time.Minute)
+	return migrations.New(userCollection.Database(), migrations.All(collections), lockTTL)
+}
+
+// MigrateMongoDB applies the pending schema migrations.
+func MigrateMongoDB(ctx context.Context) error {
+	return NewMigrator().Up(ctx)
+}
+
 func CloseMongoDB(client *mongo.Client, ctx context.Context, cancel context.CancelFunc) {
 
 	// Release resource when the main
 	// function is returned.
-	close(client, ctx, cancel)
+	closeConnection(client, ctx, cancel)
 
-	fmt.Println("mongodb connected closed")
+	logs.FromContext(ctx).Info("mongodb connection closed")
 }
@@ -0,0 +1,125 @@
+package usrmgr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// mongoConfig holds the database names and client tuning. Empty or zero
+// client settings leave the value of the URI, or the driver default, alone.
+type mongoConfig struct {
+	Database              string
+	UsersCollection       string
+	DeadLettersCollection string
+	TokensCollection      string
+	SessionsCollection    string
+	AttemptsCollection    string
+	APIKeysCollection     string
+	SigningKeysCollection string
+	AuditCollection       string
+	DataKeysCollection    string
+	ErasuresCollection    string
+
+	ReadPreference      string
+	ReadConcern         string
+	WriteConcern        string
+	WriteConcernTimeout time.Duration
+
+	MaxPoolSize            int
+	MinPoolSize            int
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	SocketTimeout          time.Duration
+}
+
+func loadMongoConfig() mongoConfig {
+	return mongoConfig{
+		Database:              utils.GetEnvParam("MONGO_DATABASE", "demo"),
+		UsersCollection:       utils.GetEnvParam("MONGO_USERS_COLLECTION", "users"),
+		DeadLettersCollection: utils.GetEnvParam("MONGO_DEAD_LETTERS_COLLECTION", "dead_letters"),
+		TokensCollection:      utils.GetEnvParam("MONGO_TOKENS_COLLECTION", "user_tokens"),
+		SessionsCollection:    utils.GetEnvParam("MONGO_SESSIONS_COLLECTION", "sessions"),
+		AttemptsCollection:    utils.GetEnvParam("MONGO_LOGIN_ATTEMPTS_COLLECTION", "login_attempts"),
+		APIKeysCollection:     utils.GetEnvParam("MONGO_API_KEYS_COLLECTION", "api_keys"),
+		SigningKeysCollection: utils.GetEnvParam("MONGO_SIGNING_KEYS_COLLECTION", "signing_keys"),
+		AuditCollection:       utils.GetEnvParam("MONGO_AUDIT_COLLECTION", "audit_log"),
+		DataKeysCollection:    utils.GetEnvParam("MONGO_DATA_KEYS_COLLECTION", "data_keys"),
+		ErasuresCollection:    utils.GetEnvParam("MONGO_ERASURES_COLLECTION", "erasures"),
+
+		ReadPreference:      utils.GetEnvParam("MONGO_READ_PREFERENCE", ""),
+		ReadConcern:         utils.GetEnvParam("MONGO_READ_CONCERN", ""),
+		WriteConcern:        utils.GetEnvParam("MONGO_WRITE_CONCERN", ""),
+		WriteConcernTimeout: utils.GetEnvDurationParam("MONGO_WRITE_CONCERN_TIMEOUT", 0),
+
+		MaxPoolSize:            utils.GetEnvIntParam("MONGO_MAX_POOL_SIZE", 0),
+		MinPoolSize:            utils.GetEnvIntParam("MONGO_MIN_POOL_SIZE", 0),
+		ConnectTimeout:         utils.GetEnvDurationParam("MONGO_CONNECT_TIMEOUT", 30*time.Second),
+		ServerSelectionTimeout: utils.GetEnvDurationParam("MONGO_SERVER_SELECTION_TIMEOUT", 0),
+		SocketTimeout:          utils.GetEnvDurationParam("MONGO_SOCKET_TIMEOUT", 0),
+	}
+}
+
+// apply sets the configured client settings on opts.
+func (c mongoConfig) apply(opts *options.ClientOptions) error {
+	if c.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(c.ReadPreference)
+		if err != nil {
+			return fmt.Errorf("invalid MONGO_READ_PREFERENCE: %w", err)
+		}
+		rp, err := readpref.New(mode)
+		if err != nil {
+			return fmt.Errorf("invalid MONGO_READ_PREFERENCE: %w", err)
+		}
+		opts.SetReadPreference(rp)
+	}
+
+	switch strings.ToLower(c.ReadConcern) {
+	case "":
+	case "local", "majority", "linearizable", "available", "snapshot":
+		opts.SetReadConcern(readconcern.New(readconcern.Level(strings.ToLower(c.ReadConcern))))
+	default:
+		return fmt.Errorf("invalid MONGO_READ_CONCERN %q", c.ReadConcern)
+	}
+
+	if c.WriteConcern != "" || c.WriteConcernTimeout > 0 {
+		var wcOpts []writeconcern.Option
+		if strings.EqualFold(c.WriteConcern, "majority") {
+			wcOpts = append(wcOpts, writeconcern.WMajority())
+		} else if c.WriteConcern != "" {
+			w, err := strconv.Atoi(c.WriteConcern)
+			if err != nil || w < 0 {
+				return fmt.Errorf("invalid MONGO_WRITE_CONCERN %q, expected majority or a number", c.WriteConcern)
+			}
+			wcOpts = append(wcOpts, writeconcern.W(w))
+		}
+		if c.WriteConcernTimeout > 0 {
+			wcOpts = append(wcOpts, writeconcern.WTimeout(c.WriteConcernTimeout))
+		}
+		opts.SetWriteConcern(writeconcern.New(wcOpts...))
+	}
+
+	if c.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(uint64(c.MaxPoolSize))
+	}
+	if c.MinPoolSize > 0 {
+		opts.SetMinPoolSize(uint64(c.MinPoolSize))
+	}
+	if c.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(c.ConnectTimeout)
+	}
+	if c.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(c.ServerSelectionTimeout)
+	}
+	if c.SocketTimeout > 0 {
+		opts.SetSocketTimeout(c.SocketTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package usrmgr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// writeTestCert writes a self-signed certificate with its key to a single
+// PEM file and returns the path.
+func writeTestCert(t *testing.T, cn string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	file := filepath.Join(t.TempDir(), cn+".pem")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestMongoClientOptionsDevMode(t *testing.T) {
+	t.Setenv("MONGO_URL", "mongodb://db.local:27017/?replicaSet=rs0")
+	t.Setenv("MONGO_USERNAME", "app")
+	t.Setenv("MONGO_PASSWORD", "s3cret%s")
+
+	opts, err := mongoClientOptions(true, mongoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.GetURI() != "mongodb://db.local:27017/?replicaSet=rs0" {
+		t.Errorf("uri = %q, want MONGO_URL unchanged", opts.GetURI())
+	}
+	if opts.Auth == nil || opts.Auth.Username != "app" || opts.Auth.Password != "s3cret%s" {
+		t.Errorf("auth = %+v", opts.Auth)
+	}
+	if opts.TLSConfig != nil {
+		t.Error("tls configured in DEV_MODE")
+	}
+}
+
+func TestMongoClientOptionsPasswordFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(file, []byte("from-file\n"), 0o600)
+	t.Setenv("MONGO_PASSWORD_FILE", file)
+	unsetenv(t, "MONGO_URL")
+
+	opts, err := mongoClientOptions(true, mongoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Auth.Password != "from-file" {
+		t.Errorf("password = %q", opts.Auth.Password)
+	}
+}
+
+func TestMongoClientOptionsTLS(t *testing.T) {
+	uri := "mongodb://mongo1:27011/demo?replicaSet=rs0"
+	t.Setenv("MONGO_URL", uri)
+	t.Setenv("MONGO_PASSWORD", "rootpassword")
+	t.Setenv("MONGO_CA_CERT", writeTestCert(t, "ca"))
+	t.Setenv("MONGO_CLIENT_CERT_KEY", writeTestCert(t, "client"))
+
+	opts, err := mongoClientOptions(false, mongoConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the URI used to be formatted with the credentials
+	if opts.GetURI() != uri || strings.Contains(opts.GetURI(), "EXTRA") {
+		t.Errorf("uri = %q, want MONGO_URL unchanged", opts.GetURI())
+	}
+	if opts.Auth == nil || opts.Auth.AuthMechanism != "MONGODB-X509" || opts.Auth.Password != "" {
+		t.Errorf("auth = %+v, want x509 without password", opts.Auth)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil || len(opts.TLSConfig.Certificates) != 1 {
+		t.Fatalf("tls = %+v, want the CA and client certificate", opts.TLSConfig)
+	}
+	if opts.TLSConfig.InsecureSkipVerify {
+		t.Error("server certificates must be verified")
+	}
+}
+
+func TestMongoClientOptionsErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	cert := writeTestCert(t, "valid")
+	tests := []struct {
+		name string
+		env  map[string]string
+		cfg  mongoConfig
+	}{
+		{"missing ca", map[string]string{"MONGO_CA_CERT": missing, "MONGO_CLIENT_CERT_KEY": cert}, mongoConfig{}},
+		{"missing client certificate", map[string]string{"MONGO_CA_CERT": cert, "MONGO_CLIENT_CERT_KEY": missing}, mongoConfig{}},
+		{"invalid uri", map[string]string{"MONGO_URL": "postgres://db", "MONGO_CA_CERT": cert, "MONGO_CLIENT_CERT_KEY": cert}, mongoConfig{}},
+		{"invalid read preference", map[string]string{"MONGO_CA_CERT": cert, "MONGO_CLIENT_CERT_KEY": cert}, mongoConfig{ReadPreference: "fastest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unsetenv(t, "MONGO_URL")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, err := mongoClientOptions(false, tt.cfg); err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+}
+
+func TestMongoConfigApply(t *testing.T) {
+	opts := options.Client().ApplyURI("mongodb://localhost:27017/?maxPoolSize=10")
+	err := mongoConfig{
+		ReadPreference: "secondaryPreferred",
+		ReadConcern:    "Majority",
+		WriteConcern:   "2",
+		MinPoolSize:    5,
+	}.apply(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Errorf("read preference = %v", opts.ReadPreference.Mode())
+	}
+	if opts.ReadConcern.GetLevel() != "majority" {
+		t.Errorf("read concern = %q", opts.ReadConcern.GetLevel())
+	}
+	if *opts.MinPoolSize != 5 || *opts.MaxPoolSize != 10 {
+		t.Errorf("pool sizes %d-%d, want the unset max from the uri", *opts.MinPoolSize, *opts.MaxPoolSize)
+	}
+
+	for _, cfg := range []mongoConfig{{ReadConcern: "eventual"}, {WriteConcern: "-1"}, {WriteConcern: "all"}} {
+		if err := cfg.apply(options.Client()); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+}
+
+// useMockCollections points the given collections at the mocked deployment
+// of mt for the duration of the test.
+func useMockCollections(t *testing.T, mt *mtest.T, colls ...**mongo.Collection) {
+	t.Helper()
+	for _, c := range colls {
+		c, prev := c, *c
+		*c = mt.Coll
+		t.Cleanup(func() { *c = prev })
+	}
+}
+
+// updated is the reply to an update command that matched and modified n
+// documents.
+func updated(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+// found is the reply to a find command returning docs.
+func found(docs ...bson.D) bson.D {
+	return mtest.CreateCursorResponse(0, "demo.users", mtest.FirstBatch, docs...)
+}
@@ -0,0 +1,203 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/subhamproject/user-service/consts"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel"
+)
+
+// JWT types of the tokens issued at login.
+const (
+	jwtTypeAccess = "at+jwt"
+	jwtTypeID     = "JWT"
+)
+
+var oidc oidcConfig
+
+type oidcConfig struct {
+	Issuer   string
+	Audience string
+	TokenTTL time.Duration
+}
+
+func loadOIDCConfig() oidcConfig {
+	return oidcConfig{
+		Issuer:   strings.TrimSuffix(utils.GetEnvParam("OIDC_ISSUER", publicURL), "/"),
+		Audience: utils.GetEnvParam("OIDC_AUDIENCE", consts.ServiceName),
+		TokenTTL: utils.GetEnvDurationParam("OIDC_TOKEN_TTL", time.Hour),
+	}
+}
+
+// InitOIDC loads the token settings and makes sure a signing key exists.
+// It must run after InitAccounts.
+func InitOIDC(ctx context.Context) error {
+	oidc = loadOIDCConfig()
+	_, err := RotateSigningKeys(WithActor(ctx, SystemActor), false)
+	return err
+}
+
+// accessClaims are the claims of the access tokens userinfo accepts and
+// other services can validate against the JWKS.
+type accessClaims struct {
+	registeredClaims
+	SessionID string   `json:"sid"`
+	Scope     string   `json:"scope"`
+	AuthTime  int64    `json:"auth_time"`
+	AMR       []string `json:"amr"`
+}
+
+// idClaims are the claims of the ID token, the profile of the user.
+type idClaims struct {
+	registeredClaims
+	profileClaims
+	SessionID string   `json:"sid"`
+	AuthTime  int64    `json:"auth_time"`
+	AMR       []string `json:"amr"`
+}
+
+// UserInfo are the standard OpenID Connect claims derived from a user.
+type UserInfo struct {
+	Subject string `json:"sub"`
+	profileClaims
+}
+
+type profileClaims struct {
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     *bool  `json:"email_verified,omitempty"`
+	PhoneNumber       string `json:"phone_number,omitempty"`
+	Locale            string `json:"locale,omitempty"`
+	ZoneInfo          string `json:"zoneinfo,omitempty"`
+	UpdatedAt         int64  `json:"updated_at,omitempty"`
+}
+
+func userInfo(u User) UserInfo {
+	info := UserInfo{Subject: u.ID, profileClaims: profileClaims{
+		Name:              u.DisplayName,
+		PreferredUsername: u.Name,
+		Email:             u.Email,
+		PhoneNumber:       u.Phone,
+		Locale:            u.Locale,
+		ZoneInfo:          u.Timezone,
+	}}
+	if info.Name == "" {
+		info.Name = u.Name
+	}
+	if u.Email != "" {
+		verified := u.EmailVerified
+		info.EmailVerified = &verified
+	}
+	if !u.UpdatedAt.IsZero() {
+		info.UpdatedAt = u.UpdatedAt.Unix()
+	}
+	return info
+}
+
+// issueTokens returns an access token and an ID token for the session. They
+// expire with the session at the latest.
+func issueTokens(ctx context.Context, session Session, amr []string) (string, string, error) {
+	user, err := GetUserByID(ctx, session.UserID)
+	if err != nil {
+		return "", "", err
+	}
+
+	expiresAt := session.CreatedAt.Add(oidc.TokenTTL)
+	if session.ExpiresAt.Before(expiresAt) {
+		expiresAt = session.ExpiresAt
+	}
+	registered := registeredClaims{
+		Issuer:    oidc.Issuer,
+		Subject:   user.ID,
+		Audience:  oidc.Audience,
+		IssuedAt:  session.CreatedAt.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}
+
+	accessToken, err := signJWT(ctx, jwtTypeAccess, accessClaims{
+		registeredClaims: registered,
+		SessionID:        session.ID,
+		Scope:            "openid profile email phone",
+		AuthTime:         session.CreatedAt.Unix(),
+		AMR:              amr,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	idToken, err := signJWT(ctx, jwtTypeID, idClaims{
+		registeredClaims: registered,
+		profileClaims:    userInfo(user).profileClaims,
+		SessionID:        session.ID,
+		AuthTime:         session.CreatedAt.Unix(),
+		AMR:              amr,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, idToken, nil
+}
+
+// GetUserInfo returns the claims of the user an access token was issued
+// to. Unlike services validating the token offline it also refuses tokens
+// of ended sessions.
+func GetUserInfo(ctx context.Context, accessToken string) (UserInfo, error) {
+
+	tracer := otel.Tracer("GetUserInfoServiceTrace")
+	ctx, span := tracer.Start(ctx, "GetUserInfoService")
+	defer span.End()
+
+	var claims accessClaims
+	if err := verifyJWT(ctx, accessToken, jwtTypeAccess, &claims); err != nil {
+		return UserInfo{}, err
+	}
+	now := time.Now().UTC()
+	if !claims.valid(oidc.Issuer, oidc.Audience, now) {
+		return UserInfo{}, ErrInvalidJWT
+	}
+	n, err := sessionCollection.CountDocuments(ctx, bson.M{
+		"_id":       claims.SessionID,
+		"userId":    claims.Subject,
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": now},
+	})
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if n == 0 {
+		return UserInfo{}, ErrInvalidJWT
+	}
+
+	user, err := GetUserByID(ctx, claims.Subject)
+	if errors.Is(err, ErrUserNotFound) {
+		return UserInfo{}, ErrInvalidJWT
+	}
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return userInfo(user), nil
+}
+
+// DiscoveryDocument returns the OpenID provider metadata. The service
+// issues tokens at its own login rather than through an authorization
+// endpoint, so only the parts relevant to validating them are listed.
+func DiscoveryDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"issuer":                                oidc.Issuer,
+		"jwks_uri":                              oidc.Issuer + "/.well-known/jwks.json",
+		"userinfo_endpoint":                     oidc.Issuer + "/userinfo",
+		"response_types_supported":              []string{"id_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "phone"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "amr", "sid", "name", "preferred_username",
+			"email", "email_verified", "phone_number", "locale", "zoneinfo", "updated_at",
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func useTestOIDC(t *testing.T) {
+	t.Helper()
+	prev := oidc
+	oidc = oidcConfig{Issuer: "https://users.example.com", Audience: "user-service", TokenTTL: time.Hour}
+	t.Cleanup(func() { oidc = prev })
+	useTestKeyring(t, testSigningKey(t, 0))
+}
+
+// sessionCount is the reply to a count of sessions.
+func sessionCount(n int) bson.D {
+	if n == 0 {
+		return found()
+	}
+	return found(bson.D{{Key: "_id", Value: 1}, {Key: "n", Value: n}})
+}
+
+func TestUserInfoClaims(t *testing.T) {
+	updatedAt := time.Unix(1700000000, 0)
+	info := userInfo(User{
+		ID: "u1", Name: "jane", Email: "jane@example.com", EmailVerified: true, Phone: "+14155552671",
+		Locale: "en-US", Timezone: "Europe/Berlin", UpdatedAt: updatedAt,
+	})
+	verified := true
+	want := UserInfo{Subject: "u1", profileClaims: profileClaims{
+		Name: "jane", PreferredUsername: "jane", Email: "jane@example.com", EmailVerified: &verified,
+		PhoneNumber: "+14155552671", Locale: "en-US", ZoneInfo: "Europe/Berlin", UpdatedAt: updatedAt.Unix(),
+	}}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("userInfo = %+v, want %+v", info, want)
+	}
+
+	info = userInfo(User{ID: "u2", Name: "john", DisplayName: "John Doe"})
+	if info.Name != "John Doe" || info.PreferredUsername != "john" || info.EmailVerified != nil || info.UpdatedAt != 0 {
+		t.Errorf("userInfo without email = %+v", info)
+	}
+}
+
+func TestIssueTokens(t *testing.T) {
+	useTestProducer(t)
+	useTestOIDC(t)
+	created := time.Now().UTC().Truncate(time.Second)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("tokens", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection)
+		mt.AddMockResponses(found(resetUser(true)))
+		session := Session{ID: "s1", UserID: "u1", CreatedAt: created, ExpiresAt: created.Add(30 * time.Minute)}
+
+		access, id, err := issueTokens(context.Background(), session, []string{"pwd", "otp"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ac accessClaims
+		if err := verifyJWT(context.Background(), access, jwtTypeAccess, &ac); err != nil {
+			t.Fatal(err)
+		}
+		if !ac.valid(oidc.Issuer, oidc.Audience, created) || ac.Subject != "u1" || ac.SessionID != "s1" ||
+			!reflect.DeepEqual(ac.AMR, []string{"pwd", "otp"}) || ac.AuthTime != created.Unix() {
+			t.Errorf("access claims %+v", ac)
+		}
+		// the session ends before the token ttl
+		if ac.ExpiresAt != created.Add(30*time.Minute).Unix() {
+			t.Errorf("access token expires at %d, want with the session", ac.ExpiresAt)
+		}
+
+		var ic idClaims
+		if err := verifyJWT(context.Background(), id, jwtTypeID, &ic); err != nil {
+			t.Fatal(err)
+		}
+		if ic.Email != "jane@example.com" || ic.EmailVerified == nil || !*ic.EmailVerified || ic.SessionID != "s1" {
+			t.Errorf("id claims %+v", ic)
+		}
+		// the token types are not interchangeable
+		if err := verifyJWT(context.Background(), id, jwtTypeAccess, &ac); !errors.Is(err, ErrInvalidJWT) {
+			t.Errorf("id token accepted as access token: %v", err)
+		}
+	})
+}
+
+func TestGetUserInfo(t *testing.T) {
+	useTestProducer(t)
+	useTestOIDC(t)
+	now := time.Now()
+	token := func(t *testing.T, modify func(c *accessClaims)) string {
+		c := accessClaims{
+			registeredClaims: registeredClaims{
+				Issuer: oidc.Issuer, Subject: "u1", Audience: oidc.Audience,
+				IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix(),
+			},
+			SessionID: "s1",
+		}
+		modify(&c)
+		s, err := signJWT(context.Background(), jwtTypeAccess, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name      string
+		modify    func(c *accessClaims)
+		responses []bson.D
+		want      error
+	}{
+		{"live session", func(c *accessClaims) {}, []bson.D{sessionCount(1), found(resetUser(true))}, nil},
+		{"ended session", func(c *accessClaims) {}, []bson.D{sessionCount(0)}, ErrInvalidJWT},
+		{"deleted user", func(c *accessClaims) {}, []bson.D{sessionCount(1), found()}, ErrInvalidJWT},
+		{"expired", func(c *accessClaims) { c.ExpiresAt = now.Add(-time.Second).Unix() }, nil, ErrInvalidJWT},
+		{"other audience", func(c *accessClaims) { c.Audience = "order-service" }, nil, ErrInvalidJWT},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			useMockCollections(t, mt, &userCollection, &sessionCollection)
+			mt.AddMockResponses(tt.responses...)
+
+			info, err := GetUserInfo(context.Background(), token(t, tt.modify))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("GetUserInfo = %v, want %v", err, tt.want)
+			}
+			if err == nil && (info.Subject != "u1" || info.Email != "jane@example.com") {
+				t.Errorf("info %+v", info)
+			}
+		})
+	}
+}
+
+func TestUserInfoHandlerUnauthorized(t *testing.T) {
+	useTestOIDC(t)
+	req := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	w := serve(UserInfoHandler, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("status %d, WWW-Authenticate %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer not.a.jwt")
+	w = serve(UserInfoHandler, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+		t.Errorf("status %d, WWW-Authenticate %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestDiscoveryDocument(t *testing.T) {
+	useTestOIDC(t)
+	doc := DiscoveryDocument()
+	if doc["issuer"] != "https://users.example.com" || doc["jwks_uri"] != "https://users.example.com/.well-known/jwks.json" {
+		t.Errorf("discovery %v", doc)
+	}
+	if algs := doc["id_token_signing_alg_values_supported"]; !reflect.DeepEqual(algs, []string{"RS256"}) {
+		t.Errorf("algorithms %v", algs)
+	}
+}
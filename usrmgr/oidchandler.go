@@ -0,0 +1,57 @@
+package usrmgr
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+	"go.opentelemetry.io/otel"
+)
+
+// DiscoveryHandler serves the OpenID provider metadata.
+func DiscoveryHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.JSON(http.StatusOK, DiscoveryDocument())
+}
+
+// JWKSHandler serves the public signing keys. The short cache time keeps
+// verifiers within OIDC_KEY_PREPUBLISH of new keys.
+func JWKSHandler(c *gin.Context) {
+	jwks, err := PublishedJWKs(c.Request.Context())
+	if err != nil {
+		logs.FromContext(c.Request.Context()).Errorf("unable to load signing keys, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to load signing keys"})
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": jwks})
+}
+
+// UserInfoHandler returns the claims of the user of the access token sent
+// as bearer token.
+func UserInfoHandler(c *gin.Context) {
+	tracer := otel.Tracer("UserInfoHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "UserInfoHandler")
+	defer span.End()
+
+	token, ok := bearerToken(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+		return
+	}
+	info, err := GetUserInfo(ctx, token)
+	if errors.Is(err, ErrInvalidJWT) {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logs.FromContext(ctx).Errorf("unable to get userinfo, error - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to get userinfo"})
+		return
+	}
+	recordAudit(WithActor(ctx, info.Subject), auditEvent{Action: AuditUserInfoRead, TargetType: AuditTargetUser, TargetID: info.Subject})
+	c.JSON(http.StatusOK, info)
+}
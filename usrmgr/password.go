@@ -0,0 +1,149 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters of new hashes. Stored hashes carry their own
+// parameters so these can be raised later.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 2
+	argonKeyLen  = 32
+	argonSaltLen = 16
+
+	maxPasswordLength = 256
+)
+
+var (
+	errBadHash = errors.New("malformed password hash")
+
+	// commonPasswords are refused whatever the length policy says.
+	commonPasswords = map[string]bool{
+		"123456789012": true, "password1234": true, "qwertyuiopas": true,
+		"passwordpassword": true, "111111111111": true, "iloveyou1234": true,
+		"administrator": true, "letmeinletmein": true, "changeme1234": true,
+		"welcome12345": true, "1q2w3e4r5t6y": true, "qwerty123456": true,
+	}
+)
+
+// hashPassword returns the argon2id hash of password in PHC string format.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPassword tells whether password matches hash.
+func checkPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errBadHash
+	}
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errBadHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false, errBadHash
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[4])
+	if err != nil {
+		return false, errBadHash
+	}
+	key, err := enc.DecodeString(parts[5])
+	if err != nil {
+		return false, errBadHash
+	}
+
+	other := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// checkDummyPassword spends the time of a password check. It is used when
+// a login names an unknown user, so the response time does not reveal
+// whether the user exists.
+func checkDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("user-service-dummy-password")
+	})
+	checkPassword(dummyHash, password)
+}
+
+// validatePassword enforces the password policy for user.
+func validatePassword(user User, password string) error {
+	minLength := utils.GetEnvIntParam("PASSWORD_MIN_LENGTH", 12)
+	length := utf8.RuneCountInString(password)
+	if length < minLength {
+		return invalid("password", "shorter than %d characters", minLength)
+	}
+	if length > maxPasswordLength {
+		return invalid("password", "longer than %d characters", maxPasswordLength)
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return invalid("password", "too common")
+	}
+	if local, _, ok := strings.Cut(user.Email, "@"); ok && len(local) >= 3 && strings.Contains(lower, strings.ToLower(local)) {
+		return invalid("password", "must not contain the email address")
+	}
+	if name := strings.ToLower(strings.TrimSpace(user.Name)); len(name) >= 3 && strings.Contains(lower, name) {
+		return invalid("password", "must not contain the user name")
+	}
+	return nil
+}
+
+// setPassword stores the hash of password for the user.
+func setPassword(ctx context.Context, id, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	res, err := userCollection.UpdateOne(ctx,
+		bson.D{{Key: "id", Value: id}, deletedFilter(false)},
+		bson.M{
+			"$set": bson.M{
+				"passwordHash":      hash,
+				"passwordChangedAt": now,
+				"updatedAt":         now,
+				"updatedBy":         ActorFromContext(ctx),
+			},
+			"$inc": bson.M{"version": 1},
+		})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
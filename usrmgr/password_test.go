@@ -0,0 +1,82 @@
+package usrmgr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("hash %q does not carry the argon2id parameters", hash)
+	}
+	if ok, err := checkPassword(hash, "correct horse battery staple"); !ok || err != nil {
+		t.Errorf("checkPassword = %v, %v", ok, err)
+	}
+	if ok, _ := checkPassword(hash, "correct horse battery stapler"); ok {
+		t.Error("wrong password accepted")
+	}
+
+	other, _ := hashPassword("correct horse battery staple")
+	if other == hash {
+		t.Error("hashes of the same password share a salt")
+	}
+}
+
+// Hashes are verified with their own parameters, here those of the
+// reference implementation's example.
+func TestCheckPasswordReferenceVector(t *testing.T) {
+	const hash = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	if ok, err := checkPassword(hash, "password"); !ok || err != nil {
+		t.Errorf("checkPassword = %v, %v", ok, err)
+	}
+	if ok, _ := checkPassword(hash, "Password"); ok {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestCheckPasswordMalformed(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$2a$10$abcdefghijklmnopqrstuuvwxyz",
+		"$argon2i$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=16$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=lots$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$!!$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$!!",
+	} {
+		if ok, err := checkPassword(hash, "password"); ok || err != errBadHash {
+			t.Errorf("checkPassword(%q) = %v, %v, want %v", hash, ok, err, errBadHash)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	unsetenv(t, "PASSWORD_MIN_LENGTH")
+	user := User{Name: "jane", Email: "jane.doe@example.com"}
+	tests := map[string]bool{
+		"short":                        false,
+		"Password1234":                 false, // common, case insensitive
+		"my-jane.doe-secret":           false, // contains the email
+		"xx-JANE-xx-secret":            false, // contains the name
+		strings.Repeat("x", 257):       false,
+		"correct horse battery staple": true,
+		"twelve chars":                 true,
+		"ünïcödé pässwörd":             true,
+		strings.Repeat("x", 256):       true,
+	}
+	for password, valid := range tests {
+		if err := validatePassword(user, password); (err == nil) != valid {
+			t.Errorf("validatePassword(%q) = %v", password, err)
+		}
+	}
+
+	t.Setenv("PASSWORD_MIN_LENGTH", "20")
+	if err := validatePassword(user, "twelve chars"); err == nil {
+		t.Error("PASSWORD_MIN_LENGTH not applied")
+	}
+}
@@ -0,0 +1,246 @@
+package usrmgr
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	// zone data is embedded so timezones validate on images without tzdata
+	_ "time/tzdata"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/language"
+)
+
+// Account states.
+const (
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+	UserStatusPending   = "pending"
+)
+
+const (
+	maxDisplayName   = 100
+	maxLabels        = 20
+	maxMetadataKeys  = 50
+	maxMetadataKey   = 64
+	maxMetadataValue = 1024
+)
+
+var (
+	ErrEmailTaken = errors.New("email is already used by another user")
+
+	e164Pattern  = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	labelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+	phoneFormat  = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "")
+)
+
+// ValidationError reports an invalid profile field.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// normalizeEmail returns the lower cased bare address of email.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", invalid("email", "%q is not an email address", email)
+	}
+	return strings.ToLower(email), nil
+}
+
+// normalizePhone strips common separators and requires E.164 format.
+func normalizePhone(phone string) (string, error) {
+	normalized := phoneFormat.Replace(strings.TrimSpace(phone))
+	if !e164Pattern.MatchString(normalized) {
+		return "", invalid("phone", "%q is not an E.164 number such as +14155552671", phone)
+	}
+	return normalized, nil
+}
+
+func validateDisplayName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxDisplayName {
+		return "", invalid("displayName", "longer than %d characters", maxDisplayName)
+	}
+	return name, nil
+}
+
+// normalizeLocale returns the canonical BCP 47 form of locale.
+func normalizeLocale(locale string) (string, error) {
+	tag, err := language.Parse(strings.TrimSpace(locale))
+	if err != nil {
+		return "", invalid("locale", "%q is not a BCP 47 language tag", locale)
+	}
+	return tag.String(), nil
+}
+
+func validateTimezone(tz string) (string, error) {
+	tz = strings.TrimSpace(tz)
+	if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+		return "", invalid("timezone", "%q is not an IANA timezone", tz)
+	}
+	return tz, nil
+}
+
+func validateStatus(status string) (string, error) {
+	status = strings.ToLower(strings.TrimSpace(status))
+	switch status {
+	case UserStatusActive, UserStatusSuspended, UserStatusPending:
+		return status, nil
+	}
+	return "", invalid("status", "must be %s, %s or %s", UserStatusActive, UserStatusSuspended, UserStatusPending)
+}
+
+// normalizeLabels lower cases, dedupes and sorts labels.
+func normalizeLabels(labels []string) ([]string, error) {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, l := range labels {
+		l = strings.ToLower(strings.TrimSpace(l))
+		if !labelPattern.MatchString(l) {
+			return nil, invalid("labels", "%q must be lower case letters, digits, '.', '_' or '-'", l)
+		}
+		if !seen[l] {
+			seen[l] = true
+			normalized = append(normalized, l)
+		}
+	}
+	if len(normalized) > maxLabels {
+		return nil, invalid("labels", "more than %d labels", maxLabels)
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return invalid("metadata", "more than %d keys", maxMetadataKeys)
+	}
+	for k, v := range metadata {
+		// keys become document field names
+		if k == "" || len(k) > maxMetadataKey || strings.ContainsAny(k, ".$") {
+			return invalid("metadata", "key %q must be 1 to %d characters without '.' or '$'", k, maxMetadataKey)
+		}
+		if len(v) > maxMetadataValue {
+			return invalid("metadata", "value of %q longer than %d bytes", k, maxMetadataValue)
+		}
+	}
+	return nil
+}
+
+// normalizeProfile validates and normalizes the profile fields of a new user.
+func (u *User) normalizeProfile() error {
+	var err error
+	if strings.TrimSpace(u.Name) == "" {
+		return invalid("name", "is required")
+	}
+	if u.Email != "" {
+		if u.Email, err = normalizeEmail(u.Email); err != nil {
+			return err
+		}
+	}
+	if u.Phone != "" {
+		if u.Phone, err = normalizePhone(u.Phone); err != nil {
+			return err
+		}
+	}
+	if u.DisplayName, err = validateDisplayName(u.DisplayName); err != nil {
+		return err
+	}
+	if u.Locale != "" {
+		if u.Locale, err = normalizeLocale(u.Locale); err != nil {
+			return err
+		}
+	}
+	if u.Timezone != "" {
+		if u.Timezone, err = validateTimezone(u.Timezone); err != nil {
+			return err
+		}
+	}
+	if u.Status == "" {
+		u.Status = UserStatusActive
+	}
+	if u.Status, err = validateStatus(u.Status); err != nil {
+		return err
+	}
+	if u.Labels, err = normalizeLabels(u.Labels); err != nil {
+		return err
+	}
+	return validateMetadata(u.Metadata)
+}
+
+// fields validates upd and returns the fields to set and to unset. Empty
+// strings clear optional fields.
+func (upd UserUpdate) fields() (set, unset map[string]interface{}, err error) {
+	set, unset = map[string]interface{}{}, map[string]interface{}{}
+	optional := func(field string, value *string, normalize func(string) (string, error)) {
+		if value == nil || err != nil {
+			return
+		}
+		if *value == "" {
+			unset[field] = ""
+			return
+		}
+		var v string
+		if v, err = normalize(*value); err == nil {
+			set[field] = v
+		}
+	}
+
+	if upd.Name != nil {
+		if strings.TrimSpace(*upd.Name) == "" {
+			return nil, nil, invalid("name", "is required")
+		}
+		set["name"] = *upd.Name
+	}
+	optional("email", upd.Email, normalizeEmail)
+	optional("phone", upd.Phone, normalizePhone)
+	optional("displayName", upd.DisplayName, validateDisplayName)
+	optional("locale", upd.Locale, normalizeLocale)
+	optional("timezone", upd.Timezone, validateTimezone)
+	if err != nil {
+		return nil, nil, err
+	}
+	if upd.Status != nil {
+		status, err := validateStatus(*upd.Status)
+		if err != nil {
+			return nil, nil, err
+		}
+		set["status"] = status
+	}
+	if upd.Labels != nil {
+		labels, err := normalizeLabels(*upd.Labels)
+		if err != nil {
+			return nil, nil, err
+		}
+		set["labels"] = labels
+	}
+	if upd.Metadata != nil {
+		if err := validateMetadata(*upd.Metadata); err != nil {
+			return nil, nil, err
+		}
+		set["metadata"] = *upd.Metadata
+	}
+	return set, unset, nil
+}
+
+// isDuplicateEmail tells whether err is a violation of the unique email
+// index.
+func isDuplicateEmail(err error) bool {
+	return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "email_unique")
+}
@@ -0,0 +1,186 @@
+package usrmgr
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{" Jane.Doe@Example.COM ", "jane.doe@example.com", false},
+		{"jane+tag@example.com", "jane+tag@example.com", false},
+		{"Jane <jane@example.com>", "", true},
+		{"jane@", "", true},
+		{"jane", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeEmail(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("normalizeEmail(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"+1 (415) 555-2671", "+14155552671", false},
+		{"+44.20.7946.0958", "+442079460958", false},
+		{"4155552671", "", true},
+		{"+0123", "", true},
+		{"+1234567890123456", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizePhone(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("normalizePhone(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestProfileFieldValidation(t *testing.T) {
+	if got, err := normalizeLocale("en-us"); got != "en-US" || err != nil {
+		t.Errorf("normalizeLocale = %q, %v", got, err)
+	}
+	if _, err := normalizeLocale("not a locale"); err == nil {
+		t.Error("invalid locale accepted")
+	}
+	for _, tz := range []string{"", "Local", "Mars/Olympus"} {
+		if _, err := validateTimezone(tz); err == nil {
+			t.Errorf("timezone %q accepted", tz)
+		}
+	}
+	if got, err := validateTimezone(" Europe/Berlin "); got != "Europe/Berlin" || err != nil {
+		t.Errorf("validateTimezone = %q, %v", got, err)
+	}
+	if got, err := validateStatus(" Suspended"); got != UserStatusSuspended || err != nil {
+		t.Errorf("validateStatus = %q, %v", got, err)
+	}
+	if _, err := validateStatus("banned"); err == nil {
+		t.Error("unknown status accepted")
+	}
+	if _, err := validateDisplayName(strings.Repeat("é", maxDisplayName+1)); err == nil {
+		t.Error("long display name accepted")
+	}
+	if _, err := validateDisplayName(strings.Repeat("é", maxDisplayName)); err != nil {
+		t.Errorf("display name of %d characters rejected: %v", maxDisplayName, err)
+	}
+}
+
+func TestNormalizeLabels(t *testing.T) {
+	got, err := normalizeLabels([]string{" VIP ", "beta", "vip", "eu-west.1"})
+	if err != nil || !reflect.DeepEqual(got, []string{"beta", "eu-west.1", "vip"}) {
+		t.Errorf("normalizeLabels = %v, %v", got, err)
+	}
+	if got, _ := normalizeLabels(nil); got == nil || len(got) != 0 {
+		t.Errorf("normalizeLabels(nil) = %#v, want an empty list", got)
+	}
+	for _, l := range []string{"-vip", "has space", "ünicode", ""} {
+		if _, err := normalizeLabels([]string{l}); err == nil {
+			t.Errorf("label %q accepted", l)
+		}
+	}
+	many := make([]string, maxLabels+1)
+	for i := range many {
+		many[i] = fmt.Sprintf("l%d", i)
+	}
+	if _, err := normalizeLabels(many); err == nil {
+		t.Error("too many labels accepted")
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	for _, m := range []map[string]string{
+		{"": "v"},
+		{"a.b": "v"},
+		{"$where": "v"},
+		{strings.Repeat("k", maxMetadataKey+1): "v"},
+		{"k": strings.Repeat("v", maxMetadataValue+1)},
+	} {
+		if err := validateMetadata(m); err == nil {
+			t.Errorf("metadata %v accepted", m)
+		}
+	}
+	if err := validateMetadata(map[string]string{"plan": "pro"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNormalizeProfile(t *testing.T) {
+	u := User{Name: "jane", Email: "Jane@Example.com", Phone: "+1 415 555 2671", Labels: []string{"VIP"}}
+	if err := u.normalizeProfile(); err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "jane@example.com" || u.Phone != "+14155552671" || u.Status != UserStatusActive || u.Labels[0] != "vip" {
+		t.Errorf("normalized to %+v", u)
+	}
+
+	var validationErr *ValidationError
+	err := (&User{Name: " "}).normalizeProfile()
+	if !errors.As(err, &validationErr) || validationErr.Field != "name" {
+		t.Errorf("blank name: %v", err)
+	}
+	err = (&User{Name: "jane", Phone: "555"}).normalizeProfile()
+	if !errors.As(err, &validationErr) || validationErr.Field != "phone" {
+		t.Errorf("invalid phone: %v", err)
+	}
+}
+
+func TestUserUpdateFields(t *testing.T) {
+	str := func(s string) *string { return &s }
+	labels := []string{"B", "a"}
+	set, unset, err := UserUpdate{
+		Name:     str("jane"),
+		Email:    str("JANE@example.com"),
+		Phone:    str(""),
+		Status:   str("Pending"),
+		Labels:   &labels,
+		Timezone: str(""),
+	}.fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSet := map[string]interface{}{
+		"name": "jane", "email": "jane@example.com", "status": UserStatusPending, "labels": []string{"a", "b"},
+	}
+	if !reflect.DeepEqual(set, wantSet) {
+		t.Errorf("set = %v, want %v", set, wantSet)
+	}
+	if !reflect.DeepEqual(unset, map[string]interface{}{"phone": "", "timezone": ""}) {
+		t.Errorf("unset = %v", unset)
+	}
+
+	for _, upd := range []UserUpdate{
+		{Name: str("")},
+		{Email: str("nope")},
+		{Locale: str("!!")},
+		{Status: str("gone")},
+		{Metadata: &map[string]string{"a.b": "c"}},
+	} {
+		if _, _, err := upd.fields(); err == nil {
+			t.Errorf("%+v accepted", upd)
+		}
+	}
+}
+
+func TestIsDuplicateEmail(t *testing.T) {
+	dup := func(index string) error {
+		return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "E11000 duplicate key error index: " + index}}}
+	}
+	if !isDuplicateEmail(dup("email_unique")) {
+		t.Error("duplicate email not detected")
+	}
+	if isDuplicateEmail(dup("id_unique")) || isDuplicateEmail(errors.New("email_unique")) {
+		t.Error("other errors reported as duplicate email")
+	}
+}
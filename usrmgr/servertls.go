@@ -0,0 +1,145 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+)
+
+// HTTPServerTLSConfig returns the TLS configuration of the HTTP server, nil
+// when HTTP_TLS_ENABLE is off and the server speaks plain HTTP. The server
+// certificate is reloaded when rotated on disk. With HTTP_TLS_CLIENT_CA
+// client certificates are verified against it.
+func HTTPServerTLSConfig() (*tls.Config, error) {
+	if !utils.GetEnvBoolParam("HTTP_TLS_ENABLE", false) {
+		return nil, nil
+	}
+
+	minVersion, err := utils.ParseTLSVersion(utils.GetEnvParam("HTTP_TLS_MIN_VERSION", "1.2"))
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := utils.ParseCipherSuites(utils.GetEnvParam("HTTP_TLS_CIPHER_SUITES", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := utils.NewCertReloader(
+		utils.GetEnvParam("HTTP_TLS_CERT", "certs/user.cert"),
+		utils.GetEnvParam("HTTP_TLS_KEY", "certs/user.key"),
+		utils.GetEnvDurationParam("HTTP_TLS_CERT_RELOAD_INTERVAL", 30*time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server certificate: %w", err)
+	}
+	reloader.OnReloadError = func(err error) {
+		logs.FromContext(context.Background()).Error(err)
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+
+	clientCA := utils.GetEnvParam("HTTP_TLS_CLIENT_CA", "")
+	if clientCA == "" {
+		return cfg, nil
+	}
+	pool, err := utils.LoadCertPool(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	switch mode := utils.GetEnvParam("HTTP_TLS_CLIENT_AUTH", "require"); mode {
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown HTTP_TLS_CLIENT_AUTH %q", mode)
+	}
+	return cfg, nil
+}
+
+// clientCertIdentity returns the identity of a verified client certificate
+// as selected by HTTP_TLS_CLIENT_IDENTITY: the first URI SAN (e.g. a SPIFFE
+// ID) or DNS SAN with "san", the subject common name with "cn".
+func clientCertIdentity(cert *x509.Certificate, source string) string {
+	if source == "san" {
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// parseIdentityScopes parses HTTP_TLS_CLIENT_SCOPES, a ; separated list of
+// identity=scope,scope entries.
+func parseIdentityScopes(s string) (map[string][]string, error) {
+	scopes := make(map[string][]string)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		identity, list, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(identity) == "" {
+			return nil, fmt.Errorf("invalid HTTP_TLS_CLIENT_SCOPES entry %q", entry)
+		}
+		var granted []string
+		for _, scope := range strings.Split(list, ",") {
+			scope = strings.TrimSpace(scope)
+			if !apiKeyScopes[scope] {
+				return nil, fmt.Errorf("unknown scope %q in HTTP_TLS_CLIENT_SCOPES", scope)
+			}
+			granted = append(granted, scope)
+		}
+		scopes[strings.TrimSpace(identity)] = granted
+	}
+	return scopes, nil
+}
+
+// ClientCertAuth makes the identity of a verified client certificate the
+// principal of the request. When HTTP_TLS_CLIENT_SCOPES is set the identity
+// is limited to the scopes listed for it, unlisted identities get none.
+// Requests without a certificate pass through unchanged.
+func ClientCertAuth() (gin.HandlerFunc, error) {
+	source := utils.GetEnvParam("HTTP_TLS_CLIENT_IDENTITY", "san")
+	if source != "san" && source != "cn" {
+		return nil, fmt.Errorf("unknown HTTP_TLS_CLIENT_IDENTITY %q", source)
+	}
+	mapping := utils.GetEnvParam("HTTP_TLS_CLIENT_SCOPES", "")
+	scopes, err := parseIdentityScopes(mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(c *gin.Context) {
+		state := c.Request.TLS
+		// only chains verified against HTTP_TLS_CLIENT_CA are trusted
+		if state == nil || len(state.VerifiedChains) == 0 {
+			c.Next()
+			return
+		}
+		identity := clientCertIdentity(state.VerifiedChains[0][0], source)
+		if identity == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "client certificate carries no identity"})
+			return
+		}
+		c.Set(principalKey, identity)
+		if mapping != "" {
+			c.Set(scopesKey, scopes[identity])
+		}
+		c.Next()
+	}, nil
+}
@@ -0,0 +1,188 @@
+package usrmgr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHTTPServerTLSConfigDisabled(t *testing.T) {
+	t.Setenv("HTTP_TLS_ENABLE", "false")
+	cfg, err := HTTPServerTLSConfig()
+	if cfg != nil || err != nil {
+		t.Errorf("HTTPServerTLSConfig = %v, %v; want plain HTTP", cfg, err)
+	}
+}
+
+func TestHTTPServerTLSConfig(t *testing.T) {
+	cert := writeTestCert(t, "user")
+	tests := []struct {
+		name       string
+		env        map[string]string
+		clientAuth tls.ClientAuthType
+		wantErr    bool
+	}{
+		{name: "server only", clientAuth: tls.NoClientCert},
+		{name: "client certificates required", env: map[string]string{"HTTP_TLS_CLIENT_CA": cert}, clientAuth: tls.RequireAndVerifyClientCert},
+		{name: "client certificates optional", env: map[string]string{"HTTP_TLS_CLIENT_CA": cert, "HTTP_TLS_CLIENT_AUTH": "optional"}, clientAuth: tls.VerifyClientCertIfGiven},
+		{name: "unknown client auth", env: map[string]string{"HTTP_TLS_CLIENT_CA": cert, "HTTP_TLS_CLIENT_AUTH": "maybe"}, wantErr: true},
+		{name: "missing client ca", env: map[string]string{"HTTP_TLS_CLIENT_CA": cert + ".missing"}, wantErr: true},
+		{name: "missing certificate", env: map[string]string{"HTTP_TLS_CERT": cert + ".missing"}, wantErr: true},
+		{name: "unknown min version", env: map[string]string{"HTTP_TLS_MIN_VERSION": "0.9"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HTTP_TLS_ENABLE", "true")
+			t.Setenv("HTTP_TLS_CERT", cert)
+			t.Setenv("HTTP_TLS_KEY", cert)
+			unsetenv(t, "HTTP_TLS_CLIENT_CA")
+			unsetenv(t, "HTTP_TLS_CLIENT_AUTH")
+			unsetenv(t, "HTTP_TLS_MIN_VERSION")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			cfg, err := HTTPServerTLSConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("configuration accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ClientAuth != tt.clientAuth || (tt.clientAuth != tls.NoClientCert) != (cfg.ClientCAs != nil) {
+				t.Errorf("client auth %v with CAs %v", cfg.ClientAuth, cfg.ClientCAs != nil)
+			}
+			if cfg.MinVersion != tls.VersionTLS12 {
+				t.Errorf("min version %x", cfg.MinVersion)
+			}
+			if c, err := cfg.GetCertificate(nil); err != nil || c == nil {
+				t.Errorf("server certificate %v, %v", c, err)
+			}
+		})
+	}
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://demo/order-service")
+	tests := []struct {
+		name   string
+		cert   x509.Certificate
+		source string
+		want   string
+	}{
+		{"uri san", x509.Certificate{URIs: []*url.URL{spiffe}, DNSNames: []string{"orders"}, Subject: pkix.Name{CommonName: "cn"}}, "san", "spiffe://demo/order-service"},
+		{"dns san", x509.Certificate{DNSNames: []string{"orders", "other"}, Subject: pkix.Name{CommonName: "cn"}}, "san", "orders"},
+		{"no san", x509.Certificate{Subject: pkix.Name{CommonName: "cn"}}, "san", "cn"},
+		{"common name", x509.Certificate{URIs: []*url.URL{spiffe}, Subject: pkix.Name{CommonName: "cn"}}, "cn", "cn"},
+		{"nothing", x509.Certificate{}, "san", ""},
+	}
+	for _, tt := range tests {
+		if got := clientCertIdentity(&tt.cert, tt.source); got != tt.want {
+			t.Errorf("%s: identity %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseIdentityScopes(t *testing.T) {
+	got, err := parseIdentityScopes(" spiffe://demo/order-service=users:read; batch = users:read, users:write ;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"spiffe://demo/order-service": {ScopeUsersRead},
+		"batch":                       {ScopeUsersRead, ScopeUsersWrite},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("scopes %v, want %v", got, want)
+	}
+	for _, s := range []string{"batch", "=users:read", "batch=users:admin", "batch="} {
+		if _, err := parseIdentityScopes(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://demo/order-service")
+	verified := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	tests := []struct {
+		name          string
+		scopes        string
+		tls           *tls.ConnectionState
+		want          int
+		principal     string
+		wantScopes    []string
+		wantScopesSet bool
+	}{
+		{name: "plain http", tls: nil, want: http.StatusOK},
+		{name: "unverified certificate", tls: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{URIs: []*url.URL{spiffe}}}}, want: http.StatusOK},
+		{name: "verified", tls: verified(&x509.Certificate{URIs: []*url.URL{spiffe}}), want: http.StatusOK, principal: "spiffe://demo/order-service"},
+		{
+			name: "mapped identity", scopes: "spiffe://demo/order-service=users:read",
+			tls: verified(&x509.Certificate{URIs: []*url.URL{spiffe}}), want: http.StatusOK,
+			principal: "spiffe://demo/order-service", wantScopes: []string{ScopeUsersRead}, wantScopesSet: true,
+		},
+		{
+			name: "unlisted identity", scopes: "batch=users:read",
+			tls: verified(&x509.Certificate{URIs: []*url.URL{spiffe}}), want: http.StatusOK,
+			principal: "spiffe://demo/order-service", wantScopesSet: true,
+		},
+		{name: "no identity", tls: verified(&x509.Certificate{}), want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HTTP_TLS_CLIENT_IDENTITY", "san")
+			t.Setenv("HTTP_TLS_CLIENT_SCOPES", tt.scopes)
+			auth, err := ClientCertAuth()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got *gin.Context
+			r := gin.New()
+			r.GET("/", auth, func(c *gin.Context) { got = c })
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = tt.tls
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if got == nil {
+				return
+			}
+			if p := got.GetString(principalKey); p != tt.principal {
+				t.Errorf("principal %q, want %q", p, tt.principal)
+			}
+			scopes, ok := got.Get(scopesKey)
+			if ok != tt.wantScopesSet || (ok && !reflect.DeepEqual(scopes.([]string), tt.wantScopes)) {
+				t.Errorf("scopes %v (set %v), want %v (set %v)", scopes, ok, tt.wantScopes, tt.wantScopesSet)
+			}
+		})
+	}
+}
+
+func TestClientCertAuthConfig(t *testing.T) {
+	t.Setenv("HTTP_TLS_CLIENT_IDENTITY", "email")
+	t.Setenv("HTTP_TLS_CLIENT_SCOPES", "")
+	if _, err := ClientCertAuth(); err == nil {
+		t.Error("unknown identity source accepted")
+	}
+	t.Setenv("HTTP_TLS_CLIENT_IDENTITY", "cn")
+	t.Setenv("HTTP_TLS_CLIENT_SCOPES", "batch=users:admin")
+	if _, err := ClientCertAuth(); err == nil {
+		t.Error("unknown scope accepted")
+	}
+}
@@ -0,0 +1,147 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// sessionKey is the gin context key of the authenticated Session.
+const sessionKey = "session"
+
+// SessionScopeMFAEnrollment limits a session to setting up MFA. It is
+// given to users who must use MFA but have not enrolled yet.
+const SessionScopeMFAEnrollment = "mfa_enrollment"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrInvalidSession     = errors.New("invalid or expired session")
+
+	sessionCollection *mongo.Collection
+)
+
+// Session is a login of a user. Only the SHA-256 of the bearer token is
+// stored, so a leaked collection can not be replayed.
+type Session struct {
+	ID         string     `bson:"_id" json:"-"`
+	UserID     string     `bson:"userId" json:"userId"`
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  time.Time  `bson:"expiresAt" json:"expiresAt"`
+	LastSeenAt time.Time  `bson:"lastSeenAt" json:"lastSeenAt"`
+	RevokedAt  *time.Time `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+	UserAgent  string     `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	RemoteAddr string     `bson:"remoteAddr,omitempty" json:"remoteAddr,omitempty"`
+	// Scope restricts what the session may be used for, empty is full access.
+	Scope string `bson:"scope,omitempty" json:"scope,omitempty"`
+}
+
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a session for the user and returns its bearer token.
+func CreateSession(ctx context.Context, userID, scope, userAgent, remoteAddr string) (string, Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", Session{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:         sessionID(token),
+		UserID:     userID,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(utils.GetEnvDurationParam("SESSION_TTL", 24*time.Hour)),
+		LastSeenAt: now,
+		UserAgent:  userAgent,
+		RemoteAddr: remoteAddr,
+		Scope:      scope,
+	}
+	if _, err := sessionCollection.InsertOne(ctx, session); err != nil {
+		return "", Session{}, err
+	}
+	return token, session, nil
+}
+
+// ValidateSession returns the live session of token.
+func ValidateSession(ctx context.Context, token string) (Session, error) {
+	now := time.Now().UTC()
+	var session Session
+	err := sessionCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": sessionID(token), "revokedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"lastSeenAt": now}}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Session{}, ErrInvalidSession
+	}
+	return session, err
+}
+
+// RevokeSession ends the session of token.
+func RevokeSession(ctx context.Context, token string) error {
+	_, err := sessionCollection.UpdateOne(ctx,
+		bson.M{"_id": sessionID(token), "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	return err
+}
+
+// RevokeUserSessions ends every session of the user and returns how many
+// were live.
+func RevokeUserSessions(ctx context.Context, userID string) (int64, error) {
+	res, err := sessionCollection.UpdateMany(ctx,
+		bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
+
+// EnrollmentSessionAuth requires a session bearer token, of full access
+// or limited to MFA enrollment, and records the user as the principal of
+// the request.
+func EnrollmentSessionAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+			return
+		}
+		session, err := ValidateSession(c.Request.Context(), token)
+		if errors.Is(err, ErrInvalidSession) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "unable to check session"})
+			return
+		}
+		if session.Scope != "" && session.Scope != SessionScopeMFAEnrollment {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "session is limited to " + session.Scope})
+			return
+		}
+		c.Set(principalKey, session.UserID)
+		c.Set(sessionKey, session)
+		c.Next()
+	}
+}
+
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
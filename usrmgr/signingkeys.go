@@ -0,0 +1,316 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+)
+
+const signingKeyBits = 2048
+
+var (
+	ErrNoSigningKey = errors.New("no active signing key")
+
+	signingKeyCollection *mongo.Collection
+	keys                 = &keyring{}
+)
+
+// signingKey is an RSA key tokens are signed with. A key is published in
+// the JWKS from its creation until expiresAt, but only signs from
+// activatesAt on, so verifiers learn it before the first token shows up.
+// expiresAt is set once a successor activates, leaving the key published
+// for the lifetime of the last tokens it signed.
+type signingKey struct {
+	ID          string     `bson:"_id"`
+	Algorithm   string     `bson:"alg"`
+	PrivateKey  string     `bson:"privateKey"`
+	CreatedAt   time.Time  `bson:"createdAt"`
+	ActivatesAt time.Time  `bson:"activatesAt"`
+	ExpiresAt   *time.Time `bson:"expiresAt,omitempty"`
+	RotatedAt   *time.Time `bson:"rotatedAt,omitempty"`
+
+	key *rsa.PrivateKey
+}
+
+// JWK is the public part of a signing key as published in the JWKS.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+func (k signingKey) jwk() JWK {
+	pub := k.key.PublicKey
+	return JWK{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: k.Algorithm,
+		KeyID:     k.ID,
+		N:         base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+type signingKeyConfig struct {
+	RotationInterval time.Duration
+	Prepublish       time.Duration
+	Overlap          time.Duration
+}
+
+func loadSigningKeyConfig() signingKeyConfig {
+	return signingKeyConfig{
+		RotationInterval: utils.GetEnvDurationParam("OIDC_KEY_ROTATION_INTERVAL", 30*24*time.Hour),
+		Prepublish:       utils.GetEnvDurationParam("OIDC_KEY_PREPUBLISH", time.Hour),
+		Overlap:          utils.GetEnvDurationParam("OIDC_KEY_OVERLAP", 24*time.Hour),
+	}
+}
+
+// newSigningKey generates a key activating at activatesAt. Its id is the
+// RFC 7638 style thumbprint of the public key.
+func newSigningKey(now, activatesAt time.Time) (signingKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return signingKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return signingKey{}, err
+	}
+	k := signingKey{
+		Algorithm:   "RS256",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:   now,
+		ActivatesAt: activatesAt,
+		key:         priv,
+	}
+	jwk := k.jwk()
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)))
+	k.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return k, nil
+}
+
+func (k *signingKey) parse() error {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return fmt.Errorf("signing key %s is not PEM encoded", k.ID)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("signing key %s: %w", k.ID, err)
+	}
+	priv, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("signing key %s is not an RSA key", k.ID)
+	}
+	k.key = priv
+	return nil
+}
+
+// keyring caches the published signing keys, reloading them at most once
+// a minute so every instance picks up rotations.
+type keyring struct {
+	mu       sync.Mutex
+	keys     []signingKey
+	loadedAt time.Time
+}
+
+func (r *keyring) published(ctx context.Context) ([]signingKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.loadedAt) < time.Minute {
+		return r.keys, nil
+	}
+
+	now := time.Now().UTC()
+	cur, err := signingKeyCollection.Find(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": now}},
+		}},
+		options.Find().SetSort(bson.D{{Key: "activatesAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var loaded []signingKey
+	if err := cur.All(ctx, &loaded); err != nil {
+		return nil, err
+	}
+	for i := range loaded {
+		if err := loaded[i].parse(); err != nil {
+			return nil, err
+		}
+	}
+	r.keys = loaded
+	r.loadedAt = time.Now()
+	return loaded, nil
+}
+
+// invalidate makes the next use reload the keys.
+func (r *keyring) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loadedAt = time.Time{}
+}
+
+// signing returns the key tokens are signed with, the latest activated.
+func (r *keyring) signing(ctx context.Context) (signingKey, error) {
+	published, err := r.published(ctx)
+	if err != nil {
+		return signingKey{}, err
+	}
+	now := time.Now()
+	for i := len(published) - 1; i >= 0; i-- {
+		if !published[i].ActivatesAt.After(now) {
+			return published[i], nil
+		}
+	}
+	return signingKey{}, ErrNoSigningKey
+}
+
+// lookup returns the published key with id kid.
+func (r *keyring) lookup(ctx context.Context, kid string) (signingKey, bool, error) {
+	published, err := r.published(ctx)
+	if err != nil {
+		return signingKey{}, false, err
+	}
+	for _, k := range published {
+		if k.ID == kid {
+			return k, true, nil
+		}
+	}
+	return signingKey{}, false, nil
+}
+
+// PublishedJWKs returns the public keys verifiers should accept.
+func PublishedJWKs(ctx context.Context) ([]JWK, error) {
+	published, err := keys.published(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jwks := make([]JWK, 0, len(published))
+	for _, k := range published {
+		jwks = append(jwks, k.jwk())
+	}
+	return jwks, nil
+}
+
+// RotateSigningKeys creates a new signing key once the newest one is older
+// than OIDC_KEY_ROTATION_INTERVAL, or right away with force. The new key is
+// published OIDC_KEY_PREPUBLISH before it signs, and its predecessors stay
+// published OIDC_KEY_OVERLAP after. Without any key one is created that
+// signs immediately. It returns whether a key was created.
+func RotateSigningKeys(ctx context.Context, force bool) (bool, error) {
+
+	tracer := otel.Tracer("RotateSigningKeysServiceTrace")
+	ctx, span := tracer.Start(ctx, "RotateSigningKeysService")
+	defer span.End()
+
+	cfg := loadSigningKeyConfig()
+	now := time.Now().UTC()
+
+	var newest signingKey
+	err := signingKeyCollection.FindOne(ctx, bson.M{},
+		options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})).Decode(&newest)
+	first := errors.Is(err, mongo.ErrNoDocuments)
+	if err != nil && !first {
+		return false, err
+	}
+
+	activatesAt := now
+	if !first {
+		if !force && now.Sub(newest.CreatedAt) < cfg.RotationInterval {
+			return false, nil
+		}
+		// only one instance gets to rotate the newest key
+		res, err := signingKeyCollection.UpdateOne(ctx,
+			bson.M{"_id": newest.ID, "rotatedAt": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"rotatedAt": now}})
+		if err != nil {
+			return false, err
+		}
+		if res.ModifiedCount == 0 {
+			return false, nil
+		}
+		activatesAt = now.Add(cfg.Prepublish)
+	}
+
+	k, err := newSigningKey(now, activatesAt)
+	if err != nil {
+		return false, err
+	}
+	// instances starting together may each create a first key, the later
+	// one signs and the next rotation retires both
+	if _, err := signingKeyCollection.InsertOne(ctx, k); err != nil {
+		return false, err
+	}
+
+	if !first {
+		retireAt := activatesAt.Add(cfg.Overlap)
+		_, err = signingKeyCollection.UpdateMany(ctx,
+			bson.M{"_id": bson.M{"$ne": k.ID}, "$or": bson.A{
+				bson.M{"expiresAt": bson.M{"$exists": false}},
+				bson.M{"expiresAt": bson.M{"$gt": retireAt}},
+			}},
+			bson.M{"$set": bson.M{"expiresAt": retireAt}})
+		if err != nil {
+			return false, err
+		}
+	}
+	keys.invalidate()
+
+	recordAudit(ctx, auditEvent{
+		Action: AuditSigningKeyRotate, TargetType: AuditTargetSigningKey, TargetID: k.ID,
+		Details: auditDetails("activatesAt", activatesAt.Format(time.RFC3339), "forced", force),
+	})
+	SendLogs(ctx, fmt.Sprintf("signing key %s created, signing from %s", k.ID, activatesAt.Format(time.RFC3339)))
+	return true, nil
+}
+
+// StartKeyRotationJob rotates the signing keys when due, checking every
+// interval, until the returned function is called.
+func StartKeyRotationJob(interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(WithActor(context.Background(), SystemActor))
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := RotateSigningKeys(ctx, false); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, mongo.ErrClientDisconnected) {
+				logs.FromContext(ctx).Errorf("signing key rotation failed: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
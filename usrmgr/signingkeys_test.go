@@ -0,0 +1,279 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+var (
+	testSigningKeysOnce sync.Once
+	testSigningKeys     [2]signingKey
+)
+
+// testSigningKey returns one of two signing keys shared by the tests, RSA
+// key generation being slow. Both are active.
+func testSigningKey(t *testing.T, i int) signingKey {
+	t.Helper()
+	testSigningKeysOnce.Do(func() {
+		for j := range testSigningKeys {
+			k, err := newSigningKey(time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+			if err != nil {
+				panic(err)
+			}
+			testSigningKeys[j] = k
+		}
+	})
+	return testSigningKeys[i]
+}
+
+// useTestKeyring replaces the signing keys with published, which are not
+// reloaded until the keyring is invalidated.
+func useTestKeyring(t *testing.T, published ...signingKey) {
+	t.Helper()
+	prev := keys
+	keys = &keyring{keys: published, loadedAt: time.Now().Add(time.Hour)}
+	t.Cleanup(func() { keys = prev })
+}
+
+func TestNewSigningKey(t *testing.T) {
+	k := testSigningKey(t, 0)
+	if k.Algorithm != "RS256" || k.key.N.BitLen() != signingKeyBits {
+		t.Errorf("key %s with %d bits", k.Algorithm, k.key.N.BitLen())
+	}
+
+	// RFC 7638: SHA-256 of the required members in lexicographic order
+	jwk := k.jwk()
+	canonical, _ := json.Marshal(map[string]string{"e": jwk.E, "kty": "RSA", "n": jwk.N})
+	sum := sha256.Sum256(canonical)
+	if want := base64.RawURLEncoding.EncodeToString(sum[:]); k.ID != want {
+		t.Errorf("key id %s, want thumbprint %s", k.ID, want)
+	}
+	if testSigningKey(t, 1).ID == k.ID {
+		t.Error("different keys share an id")
+	}
+}
+
+func TestSigningKeyJWK(t *testing.T) {
+	k := testSigningKey(t, 0)
+	jwk := k.jwk()
+	if jwk.KeyType != "RSA" || jwk.Use != "sig" || jwk.Algorithm != "RS256" || jwk.KeyID != k.ID {
+		t.Errorf("jwk %+v", jwk)
+	}
+	if jwk.E != "AQAB" {
+		t.Errorf("exponent %s, want AQAB", jwk.E)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil || new(big.Int).SetBytes(n).Cmp(k.key.N) != 0 {
+		t.Errorf("modulus does not match the key: %v", err)
+	}
+	if strings.Contains(jwk.N+jwk.E, k.key.D.String()) {
+		t.Error("private exponent published")
+	}
+}
+
+func TestSigningKeyParse(t *testing.T) {
+	k := testSigningKey(t, 0)
+	stored := signingKey{ID: k.ID, PrivateKey: k.PrivateKey}
+	if err := stored.parse(); err != nil {
+		t.Fatal(err)
+	}
+	if !stored.key.Equal(k.key) {
+		t.Error("parsed key differs")
+	}
+
+	if err := (&signingKey{ID: "x", PrivateKey: "not pem"}).parse(); err == nil {
+		t.Error("non PEM key accepted")
+	}
+	ec, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(ec)
+	ecKey := signingKey{ID: "x", PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))}
+	if err := ecKey.parse(); err == nil {
+		t.Error("EC key accepted")
+	}
+}
+
+func TestKeyringSigning(t *testing.T) {
+	old, current := testSigningKey(t, 0), testSigningKey(t, 1)
+	next := old
+	next.ID = "next"
+	next.ActivatesAt = time.Now().Add(time.Hour)
+	useTestKeyring(t, old, current, next)
+	ctx := context.Background()
+
+	k, err := keys.signing(ctx)
+	if err != nil || k.ID != current.ID {
+		t.Errorf("signing key %s, %v; want the latest activated %s", k.ID, err, current.ID)
+	}
+	if _, ok, _ := keys.lookup(ctx, "next"); !ok {
+		t.Error("prepublished key not found")
+	}
+	if _, ok, _ := keys.lookup(ctx, "unknown"); ok {
+		t.Error("unknown key found")
+	}
+
+	useTestKeyring(t, next)
+	if _, err := keys.signing(ctx); err != ErrNoSigningKey {
+		t.Errorf("signing before activation = %v, want ErrNoSigningKey", err)
+	}
+}
+
+func TestKeyringPublished(t *testing.T) {
+	k := testSigningKey(t, 0)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("loads once a minute", func(mt *mtest.T) {
+		useMockCollections(t, mt, &signingKeyCollection)
+		r := &keyring{}
+		mt.AddMockResponses(found(bson.D{
+			{Key: "_id", Value: k.ID}, {Key: "alg", Value: "RS256"}, {Key: "privateKey", Value: k.PrivateKey},
+			{Key: "activatesAt", Value: k.ActivatesAt},
+		}))
+
+		for i := 0; i < 2; i++ {
+			published, err := r.published(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(published) != 1 || published[0].ID != k.ID || !published[0].key.Equal(k.key) {
+				t.Fatalf("published %+v", published)
+			}
+		}
+		if got := commands(mt); len(got) != 1 {
+			t.Errorf("commands %v, want a single load", got)
+		}
+		// expired keys are not loaded
+		filter := mt.GetStartedEvent().Command.Lookup("filter", "$or").Array()
+		if _, err := filter.Index(1).Value().Document().LookupErr("expiresAt", "$gt"); err != nil {
+			t.Errorf("filter %s", filter)
+		}
+	})
+}
+
+func TestJWKSHandler(t *testing.T) {
+	useTestKeyring(t, testSigningKey(t, 0), testSigningKey(t, 1))
+	w := serve(JWKSHandler, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var body struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Keys) != 2 || body.Keys[0]["kid"] != testSigningKey(t, 0).ID || body.Keys[1]["kid"] != testSigningKey(t, 1).ID {
+		t.Errorf("keys %v", body.Keys)
+	}
+	for _, k := range body.Keys {
+		if _, ok := k["d"]; ok {
+			t.Error("private key published")
+		}
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=300" {
+		t.Errorf("Cache-Control %q", cc)
+	}
+}
+
+func TestRotateSigningKeys(t *testing.T) {
+	useTestProducer(t)
+	useTestKeyring(t)
+	t.Setenv("OIDC_KEY_ROTATION_INTERVAL", "720h")
+	t.Setenv("OIDC_KEY_PREPUBLISH", "1h")
+	t.Setenv("OIDC_KEY_OVERLAP", "24h")
+	newest := func(age time.Duration) bson.D {
+		return bson.D{{Key: "_id", Value: "k0"}, {Key: "createdAt", Value: time.Now().Add(-age)}}
+	}
+	insertedActivation := func(t *testing.T, mt *mtest.T) time.Time {
+		t.Helper()
+		for _, ev := range mt.GetAllStartedEvents() {
+			if ev.CommandName == "insert" {
+				return ev.Command.Lookup("documents").Array().Index(0).Value().Document().Lookup("activatesAt").Time()
+			}
+		}
+		t.Fatal("no key inserted")
+		return time.Time{}
+	}
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("first key", func(mt *mtest.T) {
+		useMockCollections(t, mt, &signingKeyCollection)
+		mt.AddMockResponses(found(), mtest.CreateSuccessResponse())
+
+		created, err := RotateSigningKeys(context.Background(), false)
+		if err != nil || !created {
+			t.Fatalf("RotateSigningKeys = %v, %v", created, err)
+		}
+		if got := strings.Join(commands(mt), ","); got != "find,insert" {
+			t.Errorf("commands %s", got)
+		}
+		if at := insertedActivation(t, mt); time.Since(at) > time.Minute {
+			t.Errorf("first key activates at %v, want right away", at)
+		}
+	})
+	mt.Run("not due", func(mt *mtest.T) {
+		useMockCollections(t, mt, &signingKeyCollection)
+		mt.AddMockResponses(found(newest(time.Hour)))
+
+		if created, err := RotateSigningKeys(context.Background(), false); err != nil || created {
+			t.Errorf("RotateSigningKeys = %v, %v; want nothing done", created, err)
+		}
+	})
+	mt.Run("due", func(mt *mtest.T) {
+		useMockCollections(t, mt, &signingKeyCollection)
+		mt.AddMockResponses(found(newest(800*time.Hour)), updated(1), mtest.CreateSuccessResponse(), updated(1))
+
+		created, err := RotateSigningKeys(context.Background(), false)
+		if err != nil || !created {
+			t.Fatalf("RotateSigningKeys = %v, %v", created, err)
+		}
+		if got := strings.Join(commands(mt), ","); got != "find,update,insert,update" {
+			t.Errorf("commands %s", got)
+		}
+		activatesAt := insertedActivation(t, mt)
+		if d := time.Until(activatesAt); d < 59*time.Minute || d > time.Hour {
+			t.Errorf("new key activates in %v, want after OIDC_KEY_PREPUBLISH", d)
+		}
+		retire := lastUpdate(t, mt).Lookup("u", "$set", "expiresAt").Time()
+		if !retire.Equal(activatesAt.Add(24 * time.Hour)) {
+			t.Errorf("old keys retire at %v, want OIDC_KEY_OVERLAP after %v", retire, activatesAt)
+		}
+	})
+	mt.Run("forced", func(mt *mtest.T) {
+		useMockCollections(t, mt, &signingKeyCollection)
+		mt.AddMockResponses(found(newest(time.Hour)), updated(1), mtest.CreateSuccessResponse(), updated(1))
+
+		if created, err := RotateSigningKeys(context.Background(), true); err != nil || !created {
+			t.Errorf("RotateSigningKeys = %v, %v", created, err)
+		}
+	})
+	mt.Run("rotated by another instance", func(mt *mtest.T) {
+		useMockCollections(t, mt, &signingKeyCollection)
+		mt.AddMockResponses(found(newest(800*time.Hour)), updated(0))
+
+		if created, err := RotateSigningKeys(context.Background(), false); err != nil || created {
+			t.Errorf("RotateSigningKeys = %v, %v; want nothing done", created, err)
+		}
+		if got := strings.Join(commands(mt), ","); got != "find,update" {
+			t.Errorf("commands %s", got)
+		}
+	})
+}
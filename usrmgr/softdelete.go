@@ -0,0 +1,136 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+)
+
+// DeleteUser soft deletes the user if it is still at version, a version of
+// 0 skips the check. Deleted users are hidden from reads and updates until
+// restored, and purged for good once the retention has passed.
+func DeleteUser(ctx context.Context, id string, version int64) (User, error) {
+
+	tracer := otel.Tracer("DeleteUserServiceTrace")
+	ctx, span := tracer.Start(ctx, "DeleteUserService")
+	defer span.End()
+	SendLogs(ctx, fmt.Sprintf("received request to delete user %s", id))
+
+	before, user, err := modifyUser(ctx, id, version, false, bson.M{
+		"deletedAt": time.Now().UTC(),
+		"deletedBy": ActorFromContext(ctx),
+	}, nil)
+	if err != nil {
+		return User{}, err
+	}
+
+	SendLogs(ctx, fmt.Sprintf("user %s successfully deleted", id))
+	recordAudit(ctx, auditEvent{Action: AuditUserDelete, TargetType: AuditTargetUser, TargetID: id, Before: before, After: user})
+	publishUserEvent(ctx, EventUserDeleted, user)
+	return user, nil
+}
+
+// RestoreUser undoes the soft delete of a user that has not been purged yet.
+// It returns ErrUserNotDeleted when the user is not deleted.
+func RestoreUser(ctx context.Context, id string, version int64) (User, error) {
+
+	tracer := otel.Tracer("RestoreUserServiceTrace")
+	ctx, span := tracer.Start(ctx, "RestoreUserService")
+	defer span.End()
+	SendLogs(ctx, fmt.Sprintf("received request to restore user %s", id))
+
+	before, user, err := modifyUser(ctx, id, version, true, nil, bson.M{"deletedAt": "", "deletedBy": ""})
+	if errors.Is(err, ErrUserNotFound) {
+		if _, err := GetUserByID(ctx, id); err == nil {
+			return User{}, ErrUserNotDeleted
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	SendLogs(ctx, fmt.Sprintf("user %s successfully restored", id))
+	recordAudit(ctx, auditEvent{Action: AuditUserRestore, TargetType: AuditTargetUser, TargetID: id, Before: before, After: user})
+	publishUserEvent(ctx, EventUserRestored, user)
+	return user, nil
+}
+
+// PurgeDeletedUsers hard deletes the users soft deleted before cutoff and
+// publishes a UserPurged event for each of them. Replicas may purge
+// concurrently, a user is only reported by the one that removed it.
+func PurgeDeletedUsers(ctx context.Context, cutoff time.Time) (int, error) {
+	cursor, err := userCollection.Find(ctx, bson.M{"deletedAt": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, err
+	}
+	var users []User
+	if err := cursor.All(ctx, &users); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, user := range users {
+		res, err := userCollection.DeleteOne(ctx, bson.M{"id": user.ID, "deletedAt": bson.M{"$lt": cutoff}})
+		if err != nil {
+			return purged, err
+		}
+		if res.DeletedCount == 0 {
+			continue
+		}
+		purged++
+		recordAudit(ctx, auditEvent{
+			Action: AuditUserPurge, TargetType: AuditTargetUser, TargetID: user.ID,
+			Details: auditDetails("deletedBy", user.DeletedBy),
+		})
+
+		err = PublishEvent(ctx, Event{
+			Type:   EventUserPurged,
+			UserID: user.ID,
+			Actor:  user.DeletedBy,
+			Data:   map[string]interface{}{"deletedAt": user.DeletedAt},
+		})
+		if err != nil {
+			logs.FromContext(ctx).Errorf("unable to publish purge of user %s: %v", user.ID, err)
+		}
+	}
+	return purged, nil
+}
+
+// StartPurgeJob purges users deleted longer than retention ago every
+// interval until the returned function is called.
+func StartPurgeJob(interval, retention time.Duration) func() {
+	ctx, cancel := context.WithCancel(WithActor(context.Background(), SystemActor))
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			purged, err := PurgeDeletedUsers(ctx, time.Now().UTC().Add(-retention))
+			if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, mongo.ErrClientDisconnected) {
+				logs.FromContext(ctx).Errorf("purge of deleted users failed: %v", err)
+			} else if purged > 0 {
+				logs.FromContext(ctx).Infof("purged %d deleted users", purged)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,162 @@
+package usrmgr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Token purposes.
+const (
+	TokenEmailVerification = "email_verification"
+	TokenPasswordReset     = "password_reset"
+	TokenMFAChallenge      = "mfa_challenge"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+
+	tokenCollection *mongo.Collection
+	tokenSecret     []byte
+)
+
+// tokenClaims is the signed content of a token. The nonce is the id of the
+// token record, which makes the token single use.
+type tokenClaims struct {
+	Purpose   string `json:"p"`
+	UserID    string `json:"u"`
+	Email     string `json:"e,omitempty"`
+	Nonce     string `json:"n"`
+	ExpiresAt int64  `json:"x"`
+}
+
+// tokenRecord tracks an issued token until it is used or expires.
+type tokenRecord struct {
+	Nonce     string     `bson:"_id"`
+	Purpose   string     `bson:"purpose"`
+	UserID    string     `bson:"userId"`
+	Email     string     `bson:"email,omitempty"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	UsedAt    *time.Time `bson:"usedAt,omitempty"`
+}
+
+// issueToken records and returns a new single use token.
+func issueToken(ctx context.Context, purpose, userID, email string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	rec := tokenRecord{
+		Nonce:     hex.EncodeToString(b),
+		Purpose:   purpose,
+		UserID:    userID,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if _, err := tokenCollection.InsertOne(ctx, rec); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(tokenClaims{
+		Purpose:   purpose,
+		UserID:    userID,
+		Email:     email,
+		Nonce:     rec.Nonce,
+		ExpiresAt: rec.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(signToken(payload)), nil
+}
+
+// redeemToken checks token and marks it used. Every failure is reported as
+// ErrInvalidToken so callers can not probe why a token was refused.
+func redeemToken(ctx context.Context, purpose, token string) (tokenClaims, error) {
+	claims, err := parseToken(purpose, token)
+	if err != nil {
+		return claims, err
+	}
+	return claims, useToken(ctx, claims)
+}
+
+// parseToken checks the signature, purpose and expiry of token without
+// using it up.
+func parseToken(purpose, token string) (tokenClaims, error) {
+	var claims tokenClaims
+
+	enc := base64.RawURLEncoding
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, ErrInvalidToken
+	}
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil || !hmac.Equal(sig, signToken(payload)) {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if claims.Purpose != purpose || time.Now().Unix() >= claims.ExpiresAt {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// useToken marks the token of claims used, it fails with ErrInvalidToken
+// when it already was.
+func useToken(ctx context.Context, claims tokenClaims) error {
+	res := tokenCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": claims.Nonce, "purpose": claims.Purpose, "usedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"usedAt": time.Now().UTC()}})
+	if errors.Is(res.Err(), mongo.ErrNoDocuments) {
+		return ErrInvalidToken
+	}
+	return res.Err()
+}
+
+// recentTokens returns how many tokens of purpose were issued to the user
+// since the given time, and when the first and the last of them were issued.
+func recentTokens(ctx context.Context, purpose, userID string, since time.Time) (int64, time.Time, time.Time, error) {
+	filter := bson.M{"purpose": purpose, "userId": userID, "createdAt": bson.M{"$gte": since}}
+	n, err := tokenCollection.CountDocuments(ctx, filter)
+	if err != nil || n == 0 {
+		return n, time.Time{}, time.Time{}, err
+	}
+
+	var first, last tokenRecord
+	opts := options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	if err := tokenCollection.FindOne(ctx, filter, opts).Decode(&first); err != nil {
+		return n, time.Time{}, time.Time{}, err
+	}
+	opts = options.FindOne().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	if err := tokenCollection.FindOne(ctx, filter, opts).Decode(&last); err != nil {
+		return n, time.Time{}, time.Time{}, err
+	}
+	return n, first.CreatedAt, last.CreatedAt, nil
+}
+
+func signToken(payload []byte) []byte {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,135 @@
+package usrmgr
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// useTestTokens signs tokens with a fixed secret and stores them in the
+// mocked collection of mt.
+func useTestTokens(t *testing.T, mt *mtest.T) {
+	t.Helper()
+	prevSecret, prevColl := tokenSecret, tokenCollection
+	tokenSecret = []byte("test-secret")
+	tokenCollection = mt.Coll
+	t.Cleanup(func() { tokenSecret, tokenCollection = prevSecret, prevColl })
+}
+
+// signedToken returns a token for claims as issueToken encodes it.
+func signedToken(claims tokenClaims) string {
+	payload, _ := json.Marshal(claims)
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(signToken(payload))
+}
+
+// tokenUsed is the reply to the findAndModify of useToken, found tells
+// whether the token was still unused.
+func tokenUsed(found bool) bson.D {
+	if !found {
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+	}
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{{Key: "_id", Value: "nonce"}}})
+}
+
+func TestIssueAndRedeemToken(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("redeem once", func(mt *mtest.T) {
+		useTestTokens(t, mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		token, err := issueToken(context.Background(), TokenEmailVerification, "u1", "jane@example.com", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inserted := mt.GetStartedEvent().Command.Lookup("documents").Array().Index(0).Value().Document()
+		nonce := inserted.Lookup("_id").StringValue()
+		if inserted.Lookup("userId").StringValue() != "u1" || len(nonce) != 32 {
+			t.Errorf("recorded %v", inserted)
+		}
+
+		mt.AddMockResponses(tokenUsed(true))
+		claims, err := redeemToken(context.Background(), TokenEmailVerification, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.UserID != "u1" || claims.Email != "jane@example.com" || claims.Nonce != nonce {
+			t.Errorf("claims = %+v", claims)
+		}
+
+		// the record is already marked used
+		mt.AddMockResponses(tokenUsed(false))
+		if _, err := redeemToken(context.Background(), TokenEmailVerification, token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("reused token: %v, want %v", err, ErrInvalidToken)
+		}
+	})
+	mt.Run("store error", func(mt *mtest.T) {
+		useTestTokens(t, mt)
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutting down"}))
+		if _, err := issueToken(context.Background(), TokenPasswordReset, "u1", "", time.Hour); err == nil {
+			t.Error("want the insert error")
+		}
+	})
+}
+
+func TestParseToken(t *testing.T) {
+	defer func(prev []byte) { tokenSecret = prev }(tokenSecret)
+	tokenSecret = []byte("test-secret")
+
+	valid := tokenClaims{Purpose: TokenPasswordReset, UserID: "u1", Nonce: "n", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	token := signedToken(valid)
+	if claims, err := parseToken(TokenPasswordReset, token); err != nil || claims != valid {
+		t.Fatalf("parseToken = %+v, %v", claims, err)
+	}
+
+	expired := valid
+	expired.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	payload, sig, _ := strings.Cut(token, ".")
+	forged, _ := json.Marshal(tokenClaims{Purpose: TokenPasswordReset, UserID: "admin", Nonce: "n", ExpiresAt: valid.ExpiresAt})
+
+	tests := map[string]struct {
+		purpose, token string
+	}{
+		"other purpose":    {TokenEmailVerification, token},
+		"expired":          {TokenPasswordReset, signedToken(expired)},
+		"forged payload":   {TokenPasswordReset, base64.RawURLEncoding.EncodeToString(forged) + "." + sig},
+		"truncated sig":    {TokenPasswordReset, payload + "." + sig[:10]},
+		"no signature":     {TokenPasswordReset, payload},
+		"invalid encoding": {TokenPasswordReset, "!!." + sig},
+		"empty":            {TokenPasswordReset, ""},
+	}
+	for name, tt := range tests {
+		if _, err := parseToken(tt.purpose, tt.token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: %v, want %v", name, err, ErrInvalidToken)
+		}
+	}
+
+	tokenSecret = []byte("rotated-secret")
+	if _, err := parseToken(TokenPasswordReset, token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token signed with another secret: %v", err)
+	}
+}
+
+func TestUseTokenReportsStoreErrors(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("error", func(mt *mtest.T) {
+		useTestTokens(t, mt)
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 91, Message: "shutting down"}))
+		err := useToken(context.Background(), tokenClaims{Purpose: TokenPasswordReset, Nonce: "n"})
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) {
+			t.Errorf("err = %v, want the store error rather than an invalid token", err)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package usrmgr
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors, base32 encoded.
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, truncated to the last six of the eight digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(rfcSecret, totpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTOTPCodeLowercaseSecret(t *testing.T) {
+	upper, _ := totpCode("JBSWY3DPEHPK3PXP", 1)
+	lower, err := totpCode("jbswy3dpehpk3pxp", 1)
+	if err != nil || lower != upper {
+		t.Errorf("lowercase secret = %q, %v; want %q", lower, err, upper)
+	}
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestMatchTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, _ := totpCode(rfcSecret, current+offset)
+		step, ok := matchTOTP(rfcSecret, code, now, 0)
+		want := offset >= -totpSkew && offset <= totpSkew
+		if ok != want {
+			t.Errorf("code of step %+d accepted = %v, want %v", offset, ok, want)
+		}
+		if ok && step != current+offset {
+			t.Errorf("code of step %+d matched step %d", offset, step-current)
+		}
+	}
+}
+
+func TestMatchTOTPReplay(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := totpStep(now)
+	code, _ := totpCode(rfcSecret, current)
+
+	if _, ok := matchTOTP(rfcSecret, code, now, current); ok {
+		t.Error("code of a used step accepted again")
+	}
+	if _, ok := matchTOTP(rfcSecret, code, now, current+1); ok {
+		t.Error("code older than the last used step accepted")
+	}
+	if step, ok := matchTOTP(rfcSecret, code, now, current-1); !ok || step != current {
+		t.Errorf("match after an older step = %d, %v", step, ok)
+	}
+	// an earlier code is refused once a later one was used
+	previous, _ := totpCode(rfcSecret, current-1)
+	if _, ok := matchTOTP(rfcSecret, previous, now, current); ok {
+		t.Error("code of an earlier step accepted after a later one was used")
+	}
+}
+
+func TestMatchTOTPMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "abcdef"} {
+		if _, ok := matchTOTP(rfcSecret, code, now, 0); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+	if _, ok := matchTOTP(rfcSecret, " 287082 ", now, 0); !ok {
+		t.Error("code with surrounding spaces refused")
+	}
+	if _, ok := matchTOTP("not base32!", "287082", now, 0); ok {
+		t.Error("code accepted with an invalid secret")
+	}
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+	a, err := newTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newTOTPSecret()
+	key, err := totpEncoding.DecodeString(a)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v", a, len(key), err)
+	}
+	if a == b {
+		t.Error("secrets repeat")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(totpURI("user service", "jane@example.com", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/user service:jane@example.com" {
+		t.Errorf("uri %s", u)
+	}
+	q := u.Query()
+	for k, want := range map[string]string{
+		"secret": "JBSWY3DPEHPK3PXP", "issuer": "user service",
+		"algorithm": "SHA1", "digits": "6", "period": "30",
+	} {
+		if q.Get(k) != want {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), want)
+		}
+	}
+}
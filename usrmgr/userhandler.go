@@ -1,10 +1,16 @@
 package usrmgr
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/subhamproject/user-service/buildinfo"
 	"github.com/subhamproject/user-service/logs"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -14,15 +20,20 @@ import (
 func CreateUserHandler(c *gin.Context) {
 
 	tracer := otel.Tracer("CreateUserHandlerTrace")
-	_, span := tracer.Start(c.Request.Context(), "CreateUserHandler")
+	ctx, span := tracer.Start(c.Request.Context(), "CreateUserHandler")
 
 	defer span.End()
+	ctx = WithActor(ctx, requestActor(c))
 
-	logs.DebugTrace(c.Request.Context(), span, "received request to create new user")
-	var user User
-	err := c.BindJSON(&user)
+	logs.FromContext(ctx).Debug("received request to create new user")
+	var req struct {
+		User
+		Password string `json:"password"`
+	}
+	err := c.BindJSON(&req)
+	user := req.User
 	if err != nil {
-		logs.ErrorTrace(c.Request.Context(), span, fmt.Sprintf("unable parse create user request, error - %v", err))
+		logs.FromContext(ctx).Errorf("unable parse create user request, error - %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -34,62 +45,291 @@ func CreateUserHandler(c *gin.Context) {
 	currentSpan.AddEvent("CreateUserHandler-Event")
 	currentSpan.SetAttributes(attribute.String("UserName", user.Name))
 
-	usrId, err := CreateUser(c.Request.Context(), user)
+	usrId, err := CreateUser(ctx, user, req.Password)
 	if err != nil {
-		logs.ErrorTrace(c.Request.Context(), span, fmt.Sprintf("failed create user request, error - %v", err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		logs.FromContext(ctx).Errorf("failed create user request, error - %v", err)
+		var validationErr *ValidationError
+		switch {
+		case errors.As(err, &validationErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrEmailTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
 		return
 	}
+	c.Header("ETag", userETag(1))
 	c.JSON(http.StatusOK, usrId)
 }
 
 func GetAllUsersHandler(c *gin.Context) {
 	tracer := otel.Tracer("GetAllUsersHandlerTrace")
-	_, span := tracer.Start(c.Request.Context(), "GetAllUsersHandler")
+	ctx, span := tracer.Start(c.Request.Context(), "GetAllUsersHandler")
 	defer span.End()
 
-	logs.DebugTrace(c.Request.Context(), span, "received request to get all users")
-	users, err := GetAllUsers(c.Request.Context())
+	logs.FromContext(ctx).Debug("received request to get all users")
+	var filter UserFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	users, err := ListUsers(ctx, filter)
 	if err != nil {
-		logs.ErrorTrace(c.Request.Context(), span, fmt.Sprintf("failed to get users from db, error - %v", err))
-		logs.Error(fmt.Sprintf("failed to get users from db, error - %v", err))
+		logs.FromContext(ctx).Errorf("failed to get users from db, error - %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable retrieve users, error: " + err.Error()})
 		return
 	}
+	auditRead(c, ctx, auditEvent{Action: AuditUserList, TargetType: AuditTargetUser, Details: filter.auditDetails(len(users))})
 	c.JSON(http.StatusOK, users)
 }
 
 func GetUserHandler(c *gin.Context) {
 	tracer := otel.Tracer("GetUserHandlerTrace")
-	_, span := tracer.Start(c.Request.Context(), "GetUserHandler")
+	ctx, span := tracer.Start(c.Request.Context(), "GetUserHandler")
+	defer span.End()
+	id := c.Query("id")
+	logs.FromContext(ctx).Debugf("received request to get user by id %s", id)
+	user, err := GetUserByID(ctx, id)
+	if err != nil {
+		// deleted users are not found either
+		writeUserError(c, ctx, "retrieve", id, err)
+		return
+	}
+	auditRead(c, ctx, auditEvent{Action: AuditUserRead, TargetType: AuditTargetUser, TargetID: id})
+	c.Header("ETag", userETag(user.Version))
+	c.JSON(http.StatusOK, user)
+}
+
+// UpdateUserHandler updates the user given by the id query parameter. The
+// request must carry the ETag of the version it was based on in If-Match;
+// * is refused, an update can not overwrite changes it has not seen.
+func UpdateUserHandler(c *gin.Context) {
+	tracer := otel.Tracer("UpdateUserHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "UpdateUserHandler")
+	defer span.End()
+	ctx = WithActor(ctx, requestActor(c))
+
+	id := c.Query("id")
+	logs.FromContext(ctx).Debugf("received request to update user %s", id)
+
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header with the ETag of the user is required"})
+		return
+	}
+	version, err := parseIfMatch(ifMatch)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var upd UserUpdate
+	if err := c.BindJSON(&upd); err != nil {
+		logs.FromContext(ctx).Errorf("unable parse update user request, error - %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := UpdateUser(ctx, id, version, upd)
+	if err != nil {
+		writeUserError(c, ctx, "update", id, err)
+		return
+	}
+	c.Header("ETag", userETag(user.Version))
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteUserHandler soft deletes the user given by the id query parameter.
+// If-Match is optional, when present the user must still be at that version;
+// * only requires the user to exist.
+func DeleteUserHandler(c *gin.Context) {
+	tracer := otel.Tracer("DeleteUserHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "DeleteUserHandler")
 	defer span.End()
+	ctx = WithActor(ctx, requestActor(c))
+
 	id := c.Query("id")
-	fmt.Printf("received request to get user by id %s\n", id)
-	user, err := GetUserByID(c.Request.Context(), id)
+	logs.FromContext(ctx).Debugf("received request to delete user %s", id)
+
+	version, err := optionalIfMatch(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := DeleteUser(ctx, id, version)
 	if err != nil {
-		fmt.Printf("unable to get user by id %s , error - %v\n", id, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable retrieve user"})
+		writeUserError(c, ctx, "delete", id, err)
 		return
 	}
+	c.Header("ETag", userETag(user.Version))
 	c.JSON(http.StatusOK, user)
 }
 
+// VerifyEmailHandler redeems the verification token sent by email, either
+// from the link (GET ?token=) or posted as {"token": "..."}.
+func VerifyEmailHandler(c *gin.Context) {
+	tracer := otel.Tracer("VerifyEmailHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "VerifyEmailHandler")
+	defer span.End()
+
+	token := c.Query("token")
+	if c.Request.Method == http.MethodPost {
+		var body struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.BindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		token = body.Token
+	}
+
+	user, err := VerifyEmail(ctx, token)
+	if err != nil {
+		writeUserError(c, ctx, "verify", "", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": user.ID, "emailVerified": user.EmailVerified, "status": user.Status})
+}
+
+// ResendVerificationHandler sends a new verification email to the user
+// with the given email. Like /password/forgot it always answers 202, so
+// it tells nothing about which emails are registered.
+func ResendVerificationHandler(c *gin.Context) {
+	tracer := otel.Tracer("ResendVerificationHandlerTrace")
+	ctx, span := tracer.Start(c.Request.Context(), "ResendVerificationHandler")
+	defer span.End()
+
+	var req struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// keep the trace but not the cancellation of the request
+	bgCtx := trace.ContextWithSpanContext(context.Background(), span.SpanContext())
+	go func() {
+		bgCtx, cancel := context.WithTimeout(bgCtx, 30*time.Second)
+		defer cancel()
+		err := ResendVerification(bgCtx, req.Email)
+		var rateLimitErr *RateLimitError
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrEmailAlreadyVerified), errors.As(err, &rateLimitErr):
+			logs.FromContext(bgCtx).Debugf("verification resend refused: %v", err)
+		default:
+			logs.FromContext(bgCtx).Errorf("verification resend failed, error - %v", err)
+		}
+	}()
+
+	logs.FromContext(ctx).Debug("verification resend requested")
+	c.JSON(http.StatusAccepted, gin.H{"status": "if the email is registered and unverified a verification link has been sent"})
+}
+
+// writeUserError maps the errors of user modifications to responses.
+func writeUserError(c *gin.Context, ctx context.Context, action, id string, err error) {
+	var validationErr *ValidationError
+	var rateLimitErr *RateLimitError
+	switch {
+	case errors.As(err, &validationErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrEmailTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrNoErasure):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrUserErased):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrOrderServiceUnavailable):
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrVersionMismatch):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrUserNotDeleted), errors.Is(err, ErrEmailAlreadyVerified),
+		errors.Is(err, ErrMFAAlreadyEnabled), errors.Is(err, ErrMFANotEnrolling):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNoEmail), errors.Is(err, ErrInvalidToken), errors.Is(err, ErrInvalidMFACode),
+		errors.Is(err, ErrMFACodeRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.As(err, &rateLimitErr):
+		c.Header("Retry-After", strconv.Itoa(int(rateLimitErr.RetryAfter.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		logs.FromContext(ctx).Errorf("unable to %s user %s, error - %v", action, id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable " + action + " user"})
+	}
+}
+
+func userETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// optionalIfMatch returns the version of the If-Match header, 0 when the
+// header is missing.
+func optionalIfMatch(c *gin.Context) (int64, error) {
+	if h := c.GetHeader("If-Match"); h != "" {
+		return parseIfMatch(h)
+	}
+	return 0, nil
+}
+
+// parseIfMatch returns the version of an If-Match header, 0 for *.
+func parseIfMatch(h string) (int64, error) {
+	h = strings.TrimSpace(h)
+	if h == "*" {
+		return 0, nil
+	}
+	tag := strings.Trim(strings.TrimPrefix(h, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid If-Match header %q", h)
+	}
+	return version, nil
+}
+
 func GetUserOrderHandler(c *gin.Context) {
 	tracer := otel.Tracer("GetUserOrderHandlerTrace")
-	_, span := tracer.Start(c.Request.Context(), "GetUserOrderHandler")
+	ctx, span := tracer.Start(c.Request.Context(), "GetUserOrderHandler")
 	defer span.End()
 
 	id := c.Query("id")
-	fmt.Printf("received request to get user %s, orders \n", id)
-	userOrder, err := GetUserOrder(c.Request.Context(), id)
+	logs.FromContext(ctx).Debugf("received request to get user %s, orders", id)
+	userOrder, err := GetUserOrder(ctx, id)
 	if err != nil {
-		fmt.Printf("unable to get user %s, orders. error - %v \n", id, err)
+		logs.FromContext(ctx).Errorf("unable to get user %s, orders. error - %v", id, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable retrieve user's order data, %v", err)})
 		return
 	}
+	auditRead(c, ctx, auditEvent{Action: AuditUserRead, TargetType: AuditTargetUser, TargetID: id, Details: auditDetails("orders", true)})
 	c.JSON(http.StatusOK, userOrder)
 }
 
 func GetServiceHealthHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, "I'm Healthly")
 }
+
+// GetServiceReadinessHandler reports whether the dependencies needed to serve
+// traffic are reachable. Unlike GetServiceHealthHandler it fails while Kafka
+// or MongoDB are down so the instance is taken out of rotation.
+func GetServiceReadinessHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	status := http.StatusOK
+	checks := gin.H{"kafka": "ok", "mongodb": "ok"}
+	if err := CheckKafka(ctx); err != nil {
+		status = http.StatusServiceUnavailable
+		checks["kafka"] = err.Error()
+	}
+	if err := CheckMongoDB(ctx); err != nil {
+		status = http.StatusServiceUnavailable
+		checks["mongodb"] = err.Error()
+	}
+	c.JSON(status, checks)
+}
+
+func GetVersionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, buildinfo.Get())
+}
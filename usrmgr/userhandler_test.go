@@ -0,0 +1,138 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func serve(handler gin.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Handle(req.Method, req.URL.Path, handler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUpdateUserHandlerPreconditions(t *testing.T) {
+	tests := []struct {
+		ifMatch string
+		want    int
+	}{
+		{"", http.StatusPreconditionRequired},
+		{"*", http.StatusPreconditionRequired},
+		{" * ", http.StatusPreconditionRequired},
+		{`"abc"`, http.StatusBadRequest},
+		{`"0"`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/user?id=1", strings.NewReader(`{"name":"x"}`))
+		if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+		if w := serve(UpdateUserHandler, req); w.Code != tt.want {
+			t.Errorf("If-Match %q: status %d, want %d", tt.ifMatch, w.Code, tt.want)
+		}
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int64
+		wantErr bool
+	}{
+		{`"3"`, 3, false},
+		{`W/"3"`, 3, false},
+		{"*", 0, false},
+		{`"-1"`, 0, true},
+		{"three", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIfMatch(tt.header)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseIfMatch(%q) = %d, %v", tt.header, got, err)
+		}
+	}
+	if v, err := parseIfMatch(userETag(7)); v != 7 || err != nil {
+		t.Errorf("ETag does not round trip: %d, %v", v, err)
+	}
+}
+
+func TestWriteUserError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("update: %w", ErrVersionMismatch), http.StatusPreconditionFailed},
+		{ErrUserNotFound, http.StatusNotFound},
+		{ErrUserErased, http.StatusGone},
+		{ErrEmailTaken, http.StatusConflict},
+		{invalid("email", "is invalid"), http.StatusBadRequest},
+		{&RateLimitError{RetryAfter: 2 * time.Second}, http.StatusTooManyRequests},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeUserError(c, context.Background(), "update", "1", tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
+
+func TestGetUserHandler(t *testing.T) {
+	useTestProducer(t)
+	defer func(prev *mongo.Collection) { userCollection = prev }(userCollection)
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("found", func(mt *mtest.T) {
+		userCollection = mt.Coll
+		mt.AddMockResponses(mtest.CreateCursorResponse(1, "demo.users", mtest.FirstBatch,
+			bson.D{{Key: "id", Value: "1"}, {Key: "name", Value: "jane"}, {Key: "version", Value: int64(3)}}))
+
+		w := serve(GetUserHandler, httptest.NewRequest(http.MethodGet, "/user?id=1", nil))
+		if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` {
+			t.Errorf("status %d, ETag %s", w.Code, w.Header().Get("ETag"))
+		}
+	})
+	// deleted users are excluded by the query, the server finds nothing
+	mt.Run("missing or deleted", func(mt *mtest.T) {
+		userCollection = mt.Coll
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, "demo.users", mtest.FirstBatch))
+
+		w := serve(GetUserHandler, httptest.NewRequest(http.MethodGet, "/user?id=1", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+		}
+		filter, _ := mt.GetStartedEvent().Command.Lookup("filter").Document().LookupErr("deletedAt")
+		if filter.Type == 0 {
+			t.Error("query does not exclude deleted users")
+		}
+	})
+	mt.Run("server error", func(mt *mtest.T) {
+		userCollection = mt.Coll
+		mt.AddMockResponses(mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 11600, Message: "interrupted"}))
+
+		w := serve(GetUserHandler, httptest.NewRequest(http.MethodGet, "/user?id=1", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("status %d, want %d", w.Code, http.StatusInternalServerError)
+		}
+	})
+}
@@ -4,53 +4,163 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/subhamproject/user-service/logs"
 	"github.com/subhamproject/user-service/utils"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrVersionMismatch = errors.New("user has been modified")
+	ErrUserNotDeleted  = errors.New("user is not deleted")
+)
+
 type User struct {
 	ID    string      `json:"id"`
 	Name  string      `json:"name"`
-	Order interface{} `json:"order,omitempty"`
+	Order interface{} `bson:"order,omitempty" json:"order,omitempty"`
+
+	// Profile, validated and normalized by the service, see profile.go.
+	Email       string            `bson:"email,omitempty" json:"email,omitempty"`
+	Phone       string            `bson:"phone,omitempty" json:"phone,omitempty"`
+	DisplayName string            `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	Locale      string            `bson:"locale,omitempty" json:"locale,omitempty"`
+	Timezone    string            `bson:"timezone,omitempty" json:"timezone,omitempty"`
+	Status      string            `bson:"status" json:"status"`
+	Labels      []string          `bson:"labels,omitempty" json:"labels,omitempty"`
+	Metadata    map[string]string `bson:"metadata,omitempty" json:"metadata,omitempty"`
+
+	// Set once the user proved ownership of Email, see VerifyEmail.
+	EmailVerified   bool       `bson:"emailVerified" json:"emailVerified"`
+	EmailVerifiedAt *time.Time `bson:"emailVerifiedAt,omitempty" json:"emailVerifiedAt,omitempty"`
+
+	// Argon2id hash of the password, never serialized to clients or events.
+	PasswordHash      string     `bson:"passwordHash,omitempty" json:"-"`
+	PasswordChangedAt *time.Time `bson:"passwordChangedAt,omitempty" json:"passwordChangedAt,omitempty"`
+	MFA               *MFAState  `bson:"mfa,omitempty" json:"mfa,omitempty"`
+
+	// Audit fields, maintained by the service. Version starts at 1 and is
+	// incremented by every update.
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt" json:"updatedAt"`
+	CreatedBy string    `bson:"createdBy" json:"createdBy"`
+	UpdatedBy string    `bson:"updatedBy" json:"updatedBy"`
+	Version   int64     `bson:"version" json:"version"`
+
+	// Set while the user is soft deleted, see DeleteUser.
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	DeletedBy string     `bson:"deletedBy,omitempty" json:"deletedBy,omitempty"`
+}
+
+// UserUpdate holds the fields a client may change. Fields left out are
+// kept, empty strings clear optional fields.
+type UserUpdate struct {
+	Name        *string            `json:"name"`
+	Email       *string            `json:"email"`
+	Phone       *string            `json:"phone"`
+	DisplayName *string            `json:"displayName"`
+	Locale      *string            `json:"locale"`
+	Timezone    *string            `json:"timezone"`
+	Status      *string            `json:"status"`
+	Labels      *[]string          `json:"labels"`
+	Metadata    *map[string]string `json:"metadata"`
+}
+
+// UserFilter selects the users to list. Zero values are ignored.
+type UserFilter struct {
+	Status         string `form:"status"`
+	Label          string `form:"label"`
+	Email          string `form:"email"`
+	IncludeDeleted bool   `form:"-"`
+}
+
+// auditDetails describes a listing with the filter for the audit log. The
+// email is only kept as its hash, see emailHash.
+func (f UserFilter) auditDetails(count int) map[string]string {
+	return auditDetails("status", f.Status, "label", f.Label, "emailHash", emailHash(f.Email),
+		"includeDeleted", f.IncludeDeleted, "count", count)
+}
+
+// emailHash returns the hex SHA-256 of the normalized email, empty for no
+// email. It lets the audit log name an email without storing it.
+func emailHash(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
 }
 
 func GetUserByID(ctx context.Context, id string) (User, error) {
 
 	tracer := otel.Tracer("GetUserByIDServiceTrace")
-	_, span := tracer.Start(ctx, "GetUserByIDService")
+	ctx, span := tracer.Start(ctx, "GetUserByIDService")
 	defer span.End()
-	SendLogs(fmt.Sprintf("received request to get user by Id %s", id))
+	SendLogs(ctx, fmt.Sprintf("received request to get user by Id %s", id))
 
 	var user User
-	filter := bson.D{{"id", id}}
+	filter := bson.D{{Key: "id", Value: id}, deletedFilter(false)}
 	err := userCollection.FindOne(ctx, filter).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return user, ErrUserNotFound
+	}
 	if err != nil {
 		return user, err
 	}
-	SendLogs(fmt.Sprintf("successfully get user %s details from database", id))
+	SendLogs(ctx, fmt.Sprintf("successfully get user %s details from database", id))
 	return user, nil
 }
 
 func GetAllUsers(ctx context.Context) ([]User, error) {
+	return ListUsers(ctx, UserFilter{})
+}
+
+// ListUsers returns the users matching filter, soft deleted ones only when
+// the filter includes them.
+func ListUsers(ctx context.Context, f UserFilter) ([]User, error) {
 
 	tracer := otel.Tracer("GetAllUsersServiceTrace")
-	_, span := tracer.Start(ctx, "GetAllUsersService")
+	ctx, span := tracer.Start(ctx, "GetAllUsersService")
 	defer span.End()
 
-	SendLogs("received request to get all users")
+	SendLogs(ctx, "received request to get all users")
+	filter := bson.D{}
+	if !f.IncludeDeleted {
+		filter = append(filter, deletedFilter(false))
+	}
+	if f.Status != "" {
+		filter = append(filter, bson.E{Key: "status", Value: strings.ToLower(f.Status)})
+	}
+	if f.Label != "" {
+		filter = append(filter, bson.E{Key: "labels", Value: strings.ToLower(f.Label)})
+	}
+	if f.Email != "" {
+		email, err := userFieldQuery(ctx, "email", strings.ToLower(strings.TrimSpace(f.Email)))
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{Key: "email", Value: email})
+	}
 	var users []User
-	cursor, err := userCollection.Find(ctx, bson.D{{}})
+	cursor, err := userCollection.Find(ctx, filter)
 	if err != nil {
 		return users, err
 	}
@@ -59,75 +169,236 @@ func GetAllUsers(ctx context.Context) ([]User, error) {
 		return users, err
 	}
 
-	SendLogs(fmt.Sprintf("successfully get all the users from the database, total is %d", len(users)))
+	SendLogs(ctx, fmt.Sprintf("successfully get all the users from the database, total is %d", len(users)))
 	return users, nil
 }
 
-func CreateUser(ctx context.Context, usr User) (string, error) {
+// CreateUser stores a new user. password is optional, when given it must
+// satisfy the password policy.
+func CreateUser(ctx context.Context, usr User, password string) (string, error) {
 
-	SendLogs(fmt.Sprintf("received request to create new user %s", usr.Name))
+	SendLogs(ctx, "received request to create new user")
 
 	tracer := otel.Tracer("CreateUserServiceTrace")
-	_, span := tracer.Start(ctx, "CreateUserService")
+	ctx, span := tracer.Start(ctx, "CreateUserService")
 	defer span.End()
 
-	logs.DebugTrace(ctx, span, fmt.Sprintf("CreateUserService %v", usr))
+	logs.FromContext(ctx).Debugf("CreateUserService %v", usr)
 
 	// get the current span by the request context
 	currentSpan := trace.SpanFromContext(ctx)
 	currentSpan.AddEvent("CreateUserService-Event")
 	currentSpan.SetAttributes(attribute.String("UserName", usr.Name))
 
-	id := genUserId()
+	// fields maintained by the service can not be set by clients
+	usr.EmailVerified, usr.EmailVerifiedAt = false, nil
+	usr.DeletedAt, usr.DeletedBy = nil, ""
+	// a user with an email stays pending until it is verified
+	if usr.Email != "" {
+		usr.Status = UserStatusPending
+	}
+	if err := usr.normalizeProfile(); err != nil {
+		return "", err
+	}
+	usr.PasswordHash, usr.PasswordChangedAt, usr.MFA = "", nil, nil
+	if password != "" {
+		if err := validatePassword(usr, password); err != nil {
+			return "", err
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return "", err
+		}
+		now := time.Now().UTC()
+		usr.PasswordHash, usr.PasswordChangedAt = hash, &now
+	}
+
+	if err := checkEmailAvailable(ctx, usr.Email, ""); err != nil {
+		return "", err
+	}
+
+	id, err := newUserID(ctx)
+	if err != nil {
+		return "", err
+	}
 	usr.ID = id
 
+	now := time.Now().UTC()
+	actor := ActorFromContext(ctx)
+	usr.CreatedAt, usr.UpdatedAt = now, now
+	usr.CreatedBy, usr.UpdatedBy = actor, actor
+	usr.Version = 1
+
 	result, err := userCollection.InsertOne(ctx, usr)
+	if isDuplicateEmail(err) {
+		return "", ErrEmailTaken
+	}
 	if err != nil {
-		logs.Error(err.Error())
+		logs.FromContext(ctx).Error(err.Error())
 		return "", err
 	}
-	fmt.Println("user inserted with InsertedID: ", result.InsertedID)
+	logs.FromContext(ctx).Debugf("user inserted with InsertedID: %v", result.InsertedID)
 
 	CreateUserOrder(ctx, usr.ID)
 
-	SendLogs(fmt.Sprintf("user %s successfully created and user id is %s", usr.Name, id))
+	SendLogs(ctx, fmt.Sprintf("user %s successfully created", id))
+	recordAudit(ctx, auditEvent{Action: AuditUserCreate, TargetType: AuditTargetUser, TargetID: id, After: usr})
+	publishUserEvent(ctx, EventUserCreated, usr)
+	if usr.Email != "" {
+		sendVerificationOrLog(ctx, usr)
+	}
 	return id, nil
 }
 
-func GetUserOrder(ctx context.Context, id string) (User, error) {
-	host := utils.GetEnvParam("ORDER_SVC_HOST", "localhost")
-	port := utils.GetEnvParam("ORDER_SVC_PORT", "8081")
+// UpdateUser applies upd to the user if it is still at version, a version
+// of 0 skips the check. It returns the updated user, ErrUserNotFound or
+// ErrVersionMismatch.
+func UpdateUser(ctx context.Context, id string, version int64, upd UserUpdate) (User, error) {
 
-	tracer := otel.Tracer("GetUserOrderTrace")
-	_, span := tracer.Start(ctx, "GetUserOrder")
+	tracer := otel.Tracer("UpdateUserServiceTrace")
+	ctx, span := tracer.Start(ctx, "UpdateUserService")
 	defer span.End()
+	SendLogs(ctx, fmt.Sprintf("received request to update user %s", id))
 
-	orderSvcUrl := fmt.Sprintf("http://%s:%s/order?userId=%s", host, port, id)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderSvcUrl, bytes.NewBuffer(nil))
+	set, unset, err := upd.fields()
 	if err != nil {
-		fmt.Println("failed to creare request for user orders ", err)
 		return User{}, err
 	}
-	httpClient := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
-	resp, err := httpClient.Do(req)
+
+	emailChanged := false
+	if upd.Email != nil || upd.Status != nil {
+		current, err := GetUserByID(ctx, id)
+		if err != nil {
+			return User{}, err
+		}
+		email, verified := current.Email, current.EmailVerified
+		if upd.Email != nil {
+			newEmail, _ := set["email"].(string)
+			if newEmail != current.Email {
+				// a new email has to be verified again
+				if err := checkEmailAvailable(ctx, newEmail, id); err != nil {
+					return User{}, err
+				}
+				emailChanged = true
+				email, verified = newEmail, false
+				set["emailVerified"] = false
+				unset["emailVerifiedAt"] = ""
+			}
+		}
+		if set["status"] == UserStatusActive && email != "" && !verified {
+			return User{}, invalid("status", "the email has to be verified before the user can be active")
+		}
+	}
+
+	before, user, err := modifyUser(ctx, id, version, false, set, unset)
+	if isDuplicateEmail(err) {
+		return User{}, ErrEmailTaken
+	}
 	if err != nil {
-		fmt.Println("error while loading user orders ", err)
 		return User{}, err
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	recordAudit(ctx, auditEvent{Action: AuditUserUpdate, TargetType: AuditTargetUser, TargetID: id, Before: before, After: user})
+	publishUserEvent(ctx, EventUserUpdated, user)
+	if emailChanged && user.Email != "" {
+		sendVerificationOrLog(ctx, user)
+	}
+
+	SendLogs(ctx, fmt.Sprintf("user %s successfully updated to version %d", id, user.Version))
+	return user, nil
+}
+
+// modifyUser sets and unsets fields of the user if it is still at version
+// (0 skips the check) and is deleted or not, recording the actor and bumping
+// the version. It returns the user before and after the update,
+// ErrUserNotFound or ErrVersionMismatch.
+func modifyUser(ctx context.Context, id string, version int64, deleted bool, set, unset bson.M) (User, User, error) {
+	filter := bson.D{{Key: "id", Value: id}, deletedFilter(deleted)}
+	if version > 0 {
+		filter = append(filter, bson.E{Key: "version", Value: version})
+	}
+
+	fields := bson.M{
+		"updatedAt": time.Now().UTC(),
+		"updatedBy": ActorFromContext(ctx),
+	}
+	for k, v := range set {
+		fields[k] = v
+	}
+	if err := encryptUserFields(ctx, fields); err != nil {
+		return User{}, User{}, err
+	}
+	update := bson.M{"$set": fields, "$inc": bson.M{"version": 1}}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	// the previous document is needed for the audit log, the update is
+	// replayed on it rather than reading the user again
+	var before User
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := userCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// tell a missing user from a stale version
+		n, err := userCollection.CountDocuments(ctx, bson.D{{Key: "id", Value: id}, deletedFilter(deleted)})
+		if err != nil {
+			return User{}, User{}, err
+		}
+		if n == 0 {
+			return User{}, User{}, ErrUserNotFound
+		}
+		return User{}, User{}, ErrVersionMismatch
+	}
 	if err != nil {
-		return User{}, fmt.Errorf("error while reading user order response- %v", err)
+		return User{}, User{}, err
 	}
-	var order interface{}
-	err = json.Unmarshal(body, &order)
+	after, err := applyUserUpdate(before, fields, unset)
+	return before, after, err
+}
+
+// applyUserUpdate returns user with the top level fields set and unset and
+// the version bumped, as modifyUser stores it.
+func applyUserUpdate(user User, set, unset bson.M) (User, error) {
+	raw, err := bson.Marshal(user)
 	if err != nil {
-		fmt.Println("error while parsing user orders ", err)
-		return User{}, fmt.Errorf("error while parsing user orders- %v", err)
+		return User{}, err
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return User{}, err
+	}
+	for k, v := range set {
+		doc[k] = v
+	}
+	for k := range unset {
+		delete(doc, k)
+	}
+	doc["version"] = user.Version + 1
+
+	if raw, err = bson.Marshal(doc); err != nil {
+		return User{}, err
+	}
+	var updated User
+	err = bson.Unmarshal(raw, &updated)
+	return updated, err
+}
+
+// deletedFilter matches soft deleted users, or the others.
+func deletedFilter(deleted bool) bson.E {
+	return bson.E{Key: "deletedAt", Value: bson.M{"$exists": deleted}}
+}
+
+func GetUserOrder(ctx context.Context, id string) (User, error) {
+	tracer := otel.Tracer("GetUserOrderTrace")
+	ctx, span := tracer.Start(ctx, "GetUserOrder")
+	defer span.End()
+
+	order, err := fetchUserOrders(ctx, id)
+	if err != nil {
+		return User{}, err
 	}
 	usr, err := GetUserByID(ctx, id)
 	if err != nil {
-		fmt.Println("error while finding user by Id", err)
+		logs.FromContext(ctx).Error("error while finding user by Id ", err)
 		return User{}, err
 	}
 
@@ -135,6 +406,37 @@ func GetUserOrder(ctx context.Context, id string) (User, error) {
 	return usr, nil
 }
 
+// fetchUserOrders returns the orders of the user from the order service.
+func fetchUserOrders(ctx context.Context, id string) (interface{}, error) {
+	host := utils.GetEnvParam("ORDER_SVC_HOST", "localhost")
+	port := utils.GetEnvParam("ORDER_SVC_PORT", "8081")
+
+	orderSvcUrl := fmt.Sprintf("http://%s:%s/order?userId=%s", host, port, id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, orderSvcUrl, bytes.NewBuffer(nil))
+	if err != nil {
+		logs.FromContext(ctx).Error("failed to creare request for user orders ", err)
+		return nil, err
+	}
+	httpClient := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logs.FromContext(ctx).Error("error while loading user orders ", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading user order response- %v", err)
+	}
+	var order interface{}
+	err = json.Unmarshal(body, &order)
+	if err != nil {
+		logs.FromContext(ctx).Error("error while parsing user orders ", err)
+		return nil, fmt.Errorf("error while parsing user orders- %v", err)
+	}
+	return order, nil
+}
+
 func CreateUserOrder(ctx context.Context, userId string) error {
 
 	// get the current span by the request context
@@ -143,11 +445,11 @@ func CreateUserOrder(ctx context.Context, userId string) error {
 	currentSpan.SetAttributes(attribute.String("UserId", userId))
 
 	tracer := otel.Tracer("CreateUserOrderTrace")
-	_, span := tracer.Start(ctx, "CreateUserOrder")
+	ctx, span := tracer.Start(ctx, "CreateUserOrder")
 
 	defer span.End()
 
-	fmt.Printf("invoke order-service to create order for user %v\n", userId)
+	logs.FromContext(ctx).Debugf("invoke order-service to create order for user %v", userId)
 
 	host := utils.GetEnvParam("ORDER_SVC_HOST", "localhost")
 	port := utils.GetEnvParam("ORDER_SVC_PORT", "8081")
@@ -155,25 +457,26 @@ func CreateUserOrder(ctx context.Context, userId string) error {
 	orderSvcUrl := fmt.Sprintf("http://%s:%s/order?userId=%s", host, port, userId)
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, orderSvcUrl, bytes.NewBuffer(nil))
 	if err != nil {
-		fmt.Println("failed to creare request for user orders ", err)
+		logs.FromContext(ctx).Error("failed to creare request for user orders ", err)
 		return err
 	}
 	httpClient := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		fmt.Println("failed to creare user orders ", err)
+		logs.FromContext(ctx).Error("failed to creare user orders ", err)
 		return err
 	}
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("failed to creare user orders received response ", resp)
+		logs.FromContext(ctx).Errorf("failed to creare user orders received response %v", resp)
 		return err
 	}
 	return nil
 }
 
 func genUserId() string {
-	// Create a big.Int with the maximum value for the desired range
-	max := big.NewInt(10000)
+	// Create a big.Int with the maximum value for the desired range,
+	// ids are unique so the range has to make collisions unlikely
+	max := big.NewInt(1000000000000)
 
 	// Generate a random big.Int
 	// The first argument is a reader that returns random numbers
@@ -181,7 +484,7 @@ func genUserId() string {
 	randInt, err := rand.Int(rand.Reader, max)
 
 	if err != nil {
-		fmt.Println("Error generating random number:", err)
+		logs.FromContext(context.Background()).Error("Error generating random number: ", err)
 		return "100"
 	}
 	return randInt.String()
@@ -0,0 +1,163 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/subhamproject/user-service/logs"
+	"github.com/subhamproject/user-service/mailer"
+	"github.com/subhamproject/user-service/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel"
+)
+
+const EventUserEmailVerified = "UserEmailVerified"
+
+var (
+	ErrNoEmail              = errors.New("user has no email")
+	ErrEmailAlreadyVerified = errors.New("email is already verified")
+
+	verification verificationConfig
+)
+
+// RateLimitError is returned when an operation is attempted too often.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many requests, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+type verificationConfig struct {
+	TokenTTL       time.Duration
+	ResendInterval time.Duration
+	ResendMax      int
+}
+
+func loadVerificationConfig() verificationConfig {
+	return verificationConfig{
+		TokenTTL:       utils.GetEnvDurationParam("VERIFICATION_TOKEN_TTL", 24*time.Hour),
+		ResendInterval: utils.GetEnvDurationParam("VERIFICATION_RESEND_INTERVAL", time.Minute),
+		ResendMax:      utils.GetEnvIntParam("VERIFICATION_RESEND_MAX", 5),
+	}
+}
+
+// SendVerification mails the user a link proving ownership of its email.
+func SendVerification(ctx context.Context, user User) error {
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	token, err := issueToken(ctx, TokenEmailVerification, user.ID, user.Email, verification.TokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL + "/verify?token=" + url.QueryEscape(token)
+	return mailSender.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nplease confirm your email address by opening\n\n%s\n\nThe link expires in %s.\n",
+			user.Name, link, verification.TokenTTL),
+	})
+}
+
+// sendVerificationOrLog sends the verification of a user that has just
+// been stored, failures are logged as the user can ask for a resend.
+func sendVerificationOrLog(ctx context.Context, user User) {
+	if err := SendVerification(ctx, user); err != nil {
+		logs.FromContext(ctx).Errorf("unable to send verification email to user %s: %v", user.ID, err)
+	}
+}
+
+// VerifyEmail redeems a verification token, marks the email verified and
+// activates the user if it was pending. Tokens issued for an email the user
+// no longer has are refused.
+func VerifyEmail(ctx context.Context, token string) (User, error) {
+
+	tracer := otel.Tracer("VerifyEmailServiceTrace")
+	ctx, span := tracer.Start(ctx, "VerifyEmailService")
+	defer span.End()
+
+	claims, err := redeemToken(ctx, TokenEmailVerification, token)
+	if err != nil {
+		return User{}, err
+	}
+	ctx = WithActor(ctx, claims.UserID)
+
+	email, err := userFieldQuery(ctx, "email", claims.Email)
+	if err != nil {
+		return User{}, err
+	}
+	now := time.Now().UTC()
+	filter := bson.D{{Key: "id", Value: claims.UserID}, {Key: "email", Value: email}, deletedFilter(false)}
+	update := bson.A{bson.M{"$set": bson.M{
+		"emailVerified":   true,
+		"emailVerifiedAt": now,
+		"status": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$status", UserStatusPending}}, UserStatusActive, "$status",
+		}},
+		"updatedAt": now,
+		"updatedBy": claims.UserID,
+		"version":   bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+	}}}
+
+	var user User
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = userCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return User{}, ErrInvalidToken
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	SendLogs(ctx, fmt.Sprintf("user %s verified email", user.ID))
+	recordAudit(ctx, auditEvent{Action: AuditEmailVerify, TargetType: AuditTargetUser, TargetID: user.ID})
+	publishUserEvent(ctx, EventUserEmailVerified, user)
+	return user, nil
+}
+
+// ResendVerification sends a new verification email to the user with the
+// email, at most once per resend interval and VERIFICATION_RESEND_MAX
+// times a day. Unknown emails are ignored so callers can not tell which
+// emails are registered.
+func ResendVerification(ctx context.Context, email string) error {
+
+	tracer := otel.Tracer("ResendVerificationServiceTrace")
+	ctx, span := tracer.Start(ctx, "ResendVerificationService")
+	defer span.End()
+
+	user, err := findUserByEmail(ctx, email)
+	if errors.Is(err, ErrUserNotFound) {
+		logs.FromContext(ctx).Debug("verification resend requested for an unknown email")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+
+	now := time.Now().UTC()
+	dayAgo := now.Add(-24 * time.Hour)
+	n, first, last, err := recentTokens(ctx, TokenEmailVerification, user.ID, dayAgo)
+	if err != nil {
+		return err
+	}
+	if wait := last.Add(verification.ResendInterval).Sub(now); n > 0 && wait > 0 {
+		return &RateLimitError{RetryAfter: wait}
+	}
+	if verification.ResendMax > 0 && n >= int64(verification.ResendMax) {
+		// the oldest of the day has to age out first
+		return &RateLimitError{RetryAfter: first.Sub(dayAgo)}
+	}
+
+	return SendVerification(ctx, user)
+}
@@ -0,0 +1,72 @@
+package usrmgr
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestResendVerification(t *testing.T) {
+	prev := verification
+	verification = verificationConfig{TokenTTL: time.Hour, ResendInterval: time.Minute, ResendMax: 5}
+	t.Cleanup(func() { verification = prev })
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("unverified email", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found(resetUser(false)), found(), mtest.CreateSuccessResponse())
+
+		if err := ResendVerification(context.Background(), "Jane@Example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if len(sent.sent) != 1 || sent.sent[0].To != "jane@example.com" || !strings.Contains(sent.sent[0].Body, "/verify?token=") {
+			t.Errorf("sent %+v", sent.sent)
+		}
+	})
+	mt.Run("unknown email", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found())
+
+		if err := ResendVerification(context.Background(), "nobody@example.com"); err != nil || len(sent.sent) != 0 {
+			t.Errorf("ResendVerification = %v, sent %d", err, len(sent.sent))
+		}
+	})
+	mt.Run("verified email", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		mt.AddMockResponses(found(resetUser(true)))
+
+		if err := ResendVerification(context.Background(), "jane@example.com"); !errors.Is(err, ErrEmailAlreadyVerified) || len(sent.sent) != 0 {
+			t.Errorf("ResendVerification = %v, sent %d", err, len(sent.sent))
+		}
+	})
+	mt.Run("rate limited", func(mt *mtest.T) {
+		useMockCollections(t, mt, &userCollection, &tokenCollection)
+		sent := useRecordingMailer(t)
+		recent := bson.D{{Key: "_id", Value: "n1"}, {Key: "createdAt", Value: time.Now().Add(-10 * time.Second)}}
+		mt.AddMockResponses(found(resetUser(false)), sessionCount(1), found(recent), found(recent))
+
+		var rateLimitErr *RateLimitError
+		if err := ResendVerification(context.Background(), "jane@example.com"); !errors.As(err, &rateLimitErr) || len(sent.sent) != 0 {
+			t.Errorf("ResendVerification = %v, sent %d", err, len(sent.sent))
+		}
+	})
+}
+
+func TestResendVerificationHandlerRequiresEmail(t *testing.T) {
+	// the user id is no longer accepted, it would reveal which ids exist
+	req := httptest.NewRequest(http.MethodPost, "/verify/resend?id=u1", nil)
+	if w := serve(ResendVerificationHandler, req); w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", w.Code)
+	}
+}
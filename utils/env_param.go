@@ -3,24 +3,91 @@ package utils
 import (
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	lookedUp   = map[string]string{}
+	lookedUpMu sync.Mutex
+)
+
+// record remembers the effective value of every parameter the service reads
+// so it can be inspected at runtime.
+func record(param, value string) {
+	lookedUpMu.Lock()
+	lookedUp[param] = value
+	lookedUpMu.Unlock()
+}
+
+// EffectiveConfig : return the effective value of every environmental param read so far
+func EffectiveConfig() map[string]string {
+	lookedUpMu.Lock()
+	defer lookedUpMu.Unlock()
+	cfg := make(map[string]string, len(lookedUp))
+	for k, v := range lookedUp {
+		cfg[k] = v
+	}
+	return cfg
+}
+
 // GetEnvParam : return string environmental param if exists, otherwise return default
 func GetEnvParam(param string, dflt string) string {
 	if v, exists := os.LookupEnv(param); exists {
+		record(param, v)
 		return v
 	}
+	record(param, dflt)
 	return dflt
 }
 
+// GetEnvSecretParam : return the content of the file named by <param>_FILE if set,
+// otherwise the string environmental param if exists, otherwise return default
+func GetEnvSecretParam(param string, dflt string) (string, error) {
+	if file, exists := os.LookupEnv(param + "_FILE"); exists && file != "" {
+		record(param+"_FILE", file)
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return GetEnvParam(param, dflt), nil
+}
+
 // GetEnvBoolParam : return bool environmental param if exists, otherwise return default
 func GetEnvBoolParam(param string, dflt bool) bool {
+	b := dflt
 	if v, exists := os.LookupEnv(param); exists {
-		b, err := strconv.ParseBool(v)
-		if err != nil {
-			return dflt
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			b = parsed
 		}
-		return b
 	}
-	return dflt
+	record(param, strconv.FormatBool(b))
+	return b
+}
+
+// GetEnvIntParam : return int environmental param if exists, otherwise return default
+func GetEnvIntParam(param string, dflt int) int {
+	i := dflt
+	if v, exists := os.LookupEnv(param); exists {
+		if parsed, err := strconv.Atoi(v); err == nil {
+			i = parsed
+		}
+	}
+	record(param, strconv.Itoa(i))
+	return i
+}
+
+// GetEnvDurationParam : return time.Duration environmental param if exists, otherwise return default
+func GetEnvDurationParam(param string, dflt time.Duration) time.Duration {
+	d := dflt
+	if v, exists := os.LookupEnv(param); exists {
+		if parsed, err := time.ParseDuration(v); err == nil {
+			d = parsed
+		}
+	}
+	record(param, d.String())
+	return d
 }
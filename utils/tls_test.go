@@ -0,0 +1,352 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for cn signed by the CA and its key to
+// certFile and keyFile.
+func (ca testCA) issue(t *testing.T, cn string, serial int64, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func writeFile(t *testing.T, name string, b []byte) {
+	t.Helper()
+	if err := os.WriteFile(name, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch moves the modification time of files forward, as file systems
+// with a coarse clock may not tell a quick rewrite apart.
+func touch(t *testing.T, d time.Duration, files ...string) {
+	t.Helper()
+	at := time.Now().Add(d)
+	for _, f := range files {
+		if err := os.Chtimes(f, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveTLS accepts connections with config until the test ends and
+// returns the listener address.
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// peerSerial connects to addr and returns the serial of the server
+// certificate.
+func peerSerial(addr string, config *tls.Config) (int64, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestCertReloaderReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca := newTestCA(t, "test ca")
+	ca.issue(t, "localhost", 100, certFile, keyFile)
+
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reloadErrs []error
+	reloader.OnReloadError = func(err error) { reloadErrs = append(reloadErrs, err) }
+	addr := serveTLS(t, &tls.Config{GetCertificate: reloader.GetCertificate})
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+
+	if serial, err := peerSerial(addr, client); err != nil || serial != 100 {
+		t.Fatalf("before rotation got serial %d, %v, want 100", serial, err)
+	}
+
+	ca.issue(t, "localhost", 200, certFile, keyFile)
+	touch(t, time.Second, certFile, keyFile)
+	if serial, err := peerSerial(addr, client); err != nil || serial != 200 {
+		t.Fatalf("after rotation got serial %d, %v, want 200", serial, err)
+	}
+
+	// a broken replacement keeps the previous pair in service
+	writeFile(t, certFile, []byte("not a certificate"))
+	touch(t, 2*time.Second, certFile)
+	if serial, err := peerSerial(addr, client); err != nil || serial != 200 {
+		t.Fatalf("after broken rotation got serial %d, %v, want 200", serial, err)
+	}
+	if len(reloadErrs) != 1 {
+		t.Errorf("got %d reload errors, want 1", len(reloadErrs))
+	}
+}
+
+func TestCertReloaderChecksAtMostOncePerInterval(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	ca := newTestCA(t, "test ca")
+	ca.issue(t, "localhost", 1, certFile, keyFile)
+
+	reloader, err := NewCertReloader(certFile, keyFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.issue(t, "localhost", 2, certFile, keyFile)
+	touch(t, time.Second, certFile, keyFile)
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.SerialNumber.Int64() != 1 {
+		t.Errorf("serial = %d, want 1 until the interval has passed", leaf.SerialNumber.Int64())
+	}
+}
+
+func TestCertReloaderClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test ca")
+	serverCert, serverKey := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	clientCert, clientKey := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ca.issue(t, "localhost", 1, serverCert, serverKey)
+	ca.issue(t, "orders", 2, clientCert, clientKey)
+
+	server, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	addr := serveTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	reloader, err := NewCertReloader(clientCert, clientKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:              pool,
+		ServerName:           "localhost",
+		GetClientCertificate: reloader.GetClientCertificate,
+	})
+	if err != nil {
+		t.Fatalf("mutual tls handshake failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestUntrustedCAIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	newTestCA(t, "rogue ca").issue(t, "localhost", 1, certFile, keyFile)
+	trusted := newTestCA(t, "trusted ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, trusted.pem)
+
+	reloader, err := NewCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, &tls.Config{GetCertificate: reloader.GetCertificate})
+
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = peerSerial(addr, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	var unknownAuthority x509.UnknownAuthorityError
+	if !errors.As(err, &unknownAuthority) {
+		t.Fatalf("got %v, want an unknown authority error", err)
+	}
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if _, err := NewCertReloader(certFile, keyFile, 0); err == nil {
+		t.Error("missing files: want an error")
+	}
+
+	writeFile(t, certFile, []byte("garbage"))
+	writeFile(t, keyFile, []byte("garbage"))
+	if _, err := NewCertReloader(certFile, keyFile, 0); err == nil {
+		t.Error("invalid pem: want an error")
+	}
+
+	// a certificate with the key of another one
+	ca := newTestCA(t, "test ca")
+	ca.issue(t, "a", 1, certFile, keyFile)
+	ca.issue(t, "b", 2, filepath.Join(dir, "other.crt"), keyFile)
+	if _, err := NewCertReloader(certFile, keyFile, 0); err == nil {
+		t.Error("mismatched key: want an error")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, append(newTestCA(t, "a").pem, newTestCA(t, "b").pem...))
+	if _, err := LoadCertPool(caFile); err != nil {
+		t.Errorf("valid bundle: %v", err)
+	}
+
+	if _, err := LoadCertPool(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("missing file: want an error")
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	writeFile(t, empty, []byte("no pem here"))
+	if _, err := LoadCertPool(empty); err == nil {
+		t.Error("file without certificates: want an error")
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"1.1", tls.VersionTLS11, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"TLS1.3", tls.VersionTLS13, false},
+		{" tls12 ", tls.VersionTLS12, false},
+		{"13", tls.VersionTLS13, false},
+		{"1.4", 0, true},
+		{"ssl3", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTLSVersion(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTLSVersion(%q) = %v, %v, want %v, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := ParseCipherSuites("")
+	if err != nil || ids != nil {
+		t.Errorf("empty list = %v, %v, want nil", ids, err)
+	}
+
+	ids, err = ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}
+	if len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+
+	for _, names := range []string{
+		"TLS_NOT_A_SUITE",
+		"TLS_RSA_WITH_RC4_128_SHA",
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,",
+	} {
+		if _, err := ParseCipherSuites(names); err == nil {
+			t.Errorf("ParseCipherSuites(%q): want an error", names)
+		}
+	}
+}